@@ -0,0 +1,306 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstrap
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// backupContentDir is the top level directory of a juju
+	// create-backup archive. It holds the files bundle, the
+	// mongodump output and the backup metadata.
+	backupContentDir = "juju-backup"
+	backupFilesName  = "root.tar"
+	backupDumpDir    = "dump"
+
+	// controllerNodesC holds a document per controller machine,
+	// with its vote, from Juju 2.7. Before that the vote is on the
+	// machine document.
+	controllerNodesC = "controllerNodes"
+)
+
+// Backup holds what's needed from a juju create-backup archive to
+// rebootstrap without MongoDB: the machine agents' agent.conf files
+// and the dumped Juju collections that record the controllers.
+type Backup struct {
+	// AgentConfs holds the agent.conf of each machine agent in the
+	// backup, by machine id.
+	AgentConfs map[string][]byte
+
+	// collections holds the dumped documents of the collections we
+	// read, by collection name.
+	collections map[string][][]byte
+}
+
+// backupCollections are the collections read from the dump.
+var backupCollections = []string{controllersC, machinesC, spacesC, controllerNodesC}
+
+// ReadBackup reads a juju create-backup archive (a gzipped tarball).
+// It fails if the archive doesn't have a dump of the controllers and
+// machines collections.
+func ReadBackup(archive string) (*Backup, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, errors.Annotatef(err, "reading %q", archive)
+	}
+	backup := &Backup{
+		AgentConfs:  make(map[string][]byte),
+		collections: make(map[string][][]byte),
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Annotatef(err, "reading %q", archive)
+		}
+		name := strings.TrimPrefix(path.Clean(hdr.Name), "./")
+		switch {
+		case name == path.Join(backupContentDir, backupFilesName):
+			if err := backup.readFiles(tr); err != nil {
+				return nil, errors.Annotatef(err, "reading %s", name)
+			}
+		case path.Dir(name) == path.Join(backupContentDir, backupDumpDir, JujuDB):
+			if !isBackupCollection(path.Base(name)) {
+				continue
+			}
+			collection := strings.TrimSuffix(path.Base(name), ".bson")
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, errors.Annotatef(err, "reading %s", name)
+			}
+			if backup.collections[collection], err = splitBSON(data); err != nil {
+				return nil, errors.Annotatef(err, "reading %s", name)
+			}
+		}
+	}
+	for _, collection := range []string{controllersC, machinesC} {
+		if _, ok := backup.collections[collection]; !ok {
+			return nil, errors.NotFoundf("%s collection in %q", collection, archive)
+		}
+	}
+	return backup, nil
+}
+
+func isBackupCollection(base string) bool {
+	for _, collection := range backupCollections {
+		if base == collection+".bson" {
+			return true
+		}
+	}
+	return false
+}
+
+// readFiles picks the agent.conf files out of the backup's files
+// bundle.
+func (b *Backup) readFiles(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Trace(err)
+		}
+		name := path.Clean("/" + hdr.Name)
+		dir, file := path.Split(name)
+		agent := path.Base(dir)
+		if file != "agent.conf" || path.Base(path.Dir(path.Clean(dir))) != "agents" || !strings.HasPrefix(agent, "machine-") {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return errors.Annotatef(err, "reading %s", name)
+		}
+		b.AgentConfs[strings.TrimPrefix(agent, "machine-")] = data
+	}
+}
+
+// splitBSON splits mongodump output into its documents.
+func splitBSON(data []byte) ([][]byte, error) {
+	var docs [][]byte
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, errors.New("truncated document")
+		}
+		size := int(binary.LittleEndian.Uint32(data))
+		if size < 5 || size > len(data) {
+			return nil, errors.Errorf("bad document length %d", size)
+		}
+		docs = append(docs, data[:size])
+		data = data[size:]
+	}
+	return docs, nil
+}
+
+// findID unmarshals the document with the given _id from a dumped
+// collection into out, returning a NotFound error if there isn't one.
+func (b *Backup) findID(collection, id string, out interface{}) error {
+	for _, doc := range b.collections[collection] {
+		var key struct {
+			ID string `bson:"_id"`
+		}
+		if err := bson.Unmarshal(doc, &key); err != nil {
+			return errors.Annotatef(err, "reading %s", collection)
+		}
+		if key.ID == id {
+			return errors.Annotatef(bson.Unmarshal(doc, out), "reading %s %q", collection, id)
+		}
+	}
+	return errors.NotFoundf("%s %q", collection, id)
+}
+
+// BackupSource takes the servers from the controller records in a
+// backup: the controller machines, with raft addresses chosen from
+// their machine addresses as jujud would (in juju-ha-space if that's
+// set). Machines that don't both have and want a vote, decided as
+// ControllerVotes does, become nonvoters.
+type BackupSource struct {
+	Backup  *Backup
+	APIPort int
+}
+
+// Servers is part of MemberSource.
+func (s BackupSource) Servers(context.Context) (raft.Configuration, error) {
+	b := s.Backup
+	var info controllerInfoDoc
+	if err := b.findID(controllersC, controllerInfoKey, &info); err != nil {
+		return raft.Configuration{}, errors.Annotate(err, "reading controller info")
+	}
+	if len(info.MachineIds) == 0 {
+		return raft.Configuration{}, errors.NotFoundf("controller machines in the backup")
+	}
+	var settings settingsDoc
+	if err := b.findID(controllersC, controllerSettingsKey, &settings); err != nil {
+		return raft.Configuration{}, errors.Annotate(err, "reading controller config")
+	}
+	space, _ := settings.Settings[haSpaceKey].(string)
+	spaceNames := make(map[string]string)
+	for _, data := range b.collections[spacesC] {
+		var model struct {
+			ModelUUID string `bson:"model-uuid"`
+		}
+		var doc spaceDoc
+		if err := bson.Unmarshal(data, &model); err != nil {
+			return raft.Configuration{}, errors.Annotate(err, "reading spaces")
+		}
+		if err := bson.Unmarshal(data, &doc); err != nil {
+			return raft.Configuration{}, errors.Annotate(err, "reading spaces")
+		}
+		if model.ModelUUID == info.ModelUUID {
+			spaceNames[doc.SpaceID] = doc.Name
+		}
+	}
+
+	ids := append([]string(nil), info.MachineIds...)
+	sort.Slice(ids, func(i, j int) bool { return machineIDLess(ids[i], ids[j]) })
+	var config raft.Configuration
+	for _, id := range ids {
+		var machine machineDoc
+		if err := b.findID(machinesC, info.ModelUUID+":"+id, &machine); err != nil {
+			return raft.Configuration{}, errors.Annotatef(err, "reading machine %s", id)
+		}
+		if machine.Life == lifeDead {
+			logger.Warningf("controller machine %s is dead in the backup, leaving it out", id)
+			continue
+		}
+		addrs := append(machine.Addresses, machine.MachineAddresses...)
+		address, ok := backupAddress(addrs, space, spaceNames)
+		if !ok {
+			return raft.Configuration{}, errors.NotFoundf("address for machine %s", id)
+		}
+		vote, err := b.controllerVote(info.ModelUUID, id)
+		if err != nil {
+			return raft.Configuration{}, errors.Trace(err)
+		}
+		suffrage := raft.Voter
+		if vote != nil && !vote.Voter() {
+			logger.Infof("the backup records has-vote=%t, wants-vote=%t for machine %s, making it a nonvoter", vote.HasVote, vote.WantsVote, id)
+			suffrage = raft.Nonvoter
+		}
+		config.Servers = append(config.Servers, raft.Server{
+			ID:       raft.ServerID(id),
+			Address:  raft.ServerAddress(net.JoinHostPort(address, strconv.Itoa(s.APIPort))),
+			Suffrage: suffrage,
+		})
+	}
+	return config, nil
+}
+
+// controllerVote reads a machine's vote from the backup as
+// ControllerVotes does from MongoDB, or returns nil if the backup
+// doesn't record it.
+func (b *Backup) controllerVote(modelUUID, id string) (*ControllerVote, error) {
+	var node *controllerNodeVoteDoc
+	for _, nodeID := range controllerNodeIDs(modelUUID, id) {
+		var doc controllerNodeVoteDoc
+		err := b.findID(controllerNodesC, nodeID, &doc)
+		if err == nil {
+			node = &doc
+			break
+		}
+		if !errors.IsNotFound(err) {
+			return nil, errors.Trace(err)
+		}
+	}
+	var machine *machineVoteDoc
+	var doc machineVoteDoc
+	err := b.findID(machinesC, modelUUID+":"+id, &doc)
+	if err == nil {
+		machine = &doc
+	} else if !errors.IsNotFound(err) {
+		return nil, errors.Trace(err)
+	}
+	vote, ok := controllerVote(node, machine)
+	if !ok {
+		return nil, nil
+	}
+	return &vote, nil
+}
+
+// backupAddress picks a machine's raft address: the best one in space
+// if that's set, or otherwise the best by scopePreference.
+func backupAddress(addrs []addressDoc, space string, spaceNames map[string]string) (string, bool) {
+	if space != "" {
+		return selectSpaceAddress(addrs, space, spaceNames)
+	}
+	for _, scope := range scopePreference {
+		if address, ok := selectScopeAddress(addrs, scope, "", spaceNames); ok {
+			return address, true
+		}
+	}
+	return "", false
+}
+
+// machineIDLess orders machine ids numerically where they're numbers.
+func machineIDLess(a, b string) bool {
+	x, errA := strconv.Atoi(a)
+	y, errB := strconv.Atoi(b)
+	if errA == nil && errB == nil {
+		return x < y
+	}
+	return a < b
+}
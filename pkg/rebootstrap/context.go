@@ -0,0 +1,34 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstrap
+
+import (
+	"context"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+)
+
+// WithSession runs f with a copy of session, returning early with the
+// context's error if ctx is done before f finishes. mgo has no way to
+// abandon a query, so f carries on in the background against its own
+// copy of the session (closed when it returns), but the caller is free
+// to give up on a hung server.
+func WithSession(ctx context.Context, session *mgo.Session, f func(*mgo.Session) error) error {
+	if err := ctx.Err(); err != nil {
+		return errors.Trace(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		s := session.Copy()
+		defer s.Close()
+		done <- f(s)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return errors.Trace(ctx.Err())
+	}
+}
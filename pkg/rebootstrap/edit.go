@@ -0,0 +1,144 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstrap
+
+import (
+	"io"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/errors"
+)
+
+// LatestConfiguration finds the newest configuration entry in the
+// log store, returning the entry and its decoded configuration. Once
+// a store has been compacted the configuration may only be recorded
+// in a snapshot, which gives a NotFound error.
+func LatestConfiguration(logs raft.LogStore) (*raft.Log, raft.Configuration, error) {
+	first, err := logs.FirstIndex()
+	if err != nil {
+		return nil, raft.Configuration{}, errors.Annotate(err, "reading first index")
+	}
+	last, err := logs.LastIndex()
+	if err != nil {
+		return nil, raft.Configuration{}, errors.Annotate(err, "reading last index")
+	}
+	for index := last; index >= first && index > 0; index-- {
+		var entry raft.Log
+		if err := logs.GetLog(index, &entry); err != nil {
+			return nil, raft.Configuration{}, errors.Annotatef(err, "reading log entry %d", index)
+		}
+		switch entry.Type {
+		case raft.LogConfiguration:
+			return &entry, raft.DecodeConfiguration(entry.Data), nil
+		case raft.LogAddPeerDeprecated, raft.LogRemovePeerDeprecated:
+			return nil, raft.Configuration{}, errors.NotSupportedf("editing a protocol version 2 configuration (entry %d)", index)
+		}
+	}
+	return nil, raft.Configuration{}, errors.NotFoundf("configuration entry in the log")
+}
+
+// ReplaceConfiguration overwrites the configuration held by entry,
+// which must be a configuration entry read from logs, keeping its
+// index and term. Rewriting the entry in place rather than appending
+// a new one means every controller given the same edit still has
+// matching logs. The agent must not be running. Append-only log
+// stores such as raft-wal refuse the rewrite.
+func ReplaceConfiguration(logs raft.LogStore, entry *raft.Log, config raft.Configuration) error {
+	if entry.Type != raft.LogConfiguration {
+		return errors.NotValidf("log entry %d of type %v", entry.Index, entry.Type)
+	}
+	replaced := *entry
+	replaced.Data = raft.EncodeConfiguration(config)
+	return errors.Annotatef(logs.StoreLog(&replaced), "rewriting log entry %d", entry.Index)
+}
+
+// StoredConfiguration is the configuration raft starts with from a
+// store, and where it's held.
+type StoredConfiguration struct {
+	Configuration raft.Configuration
+
+	// Entry is the configuration entry in the log holding it, or
+	// nil if it comes from Snapshot.
+	Entry *raft.Log
+
+	// Snapshot is the newest snapshot, set when it's at or after
+	// the last configuration entry in the log. Raft restores the
+	// configuration from it and only looks at the log after it, so
+	// that's where the configuration has to be changed.
+	Snapshot *raft.SnapshotMeta
+}
+
+// CurrentConfiguration finds the configuration raft would start with
+// from a store: the newest configuration entry in logs, unless newest
+// (the newest snapshot's metadata, or nil if there's none) is at or
+// past it.
+func CurrentConfiguration(logs raft.LogStore, newest *raft.SnapshotMeta) (*StoredConfiguration, error) {
+	entry, config, err := LatestConfiguration(logs)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, errors.Trace(err)
+	}
+	if newest != nil && (entry == nil || newest.Index >= entry.Index) {
+		if len(newest.Configuration.Servers) == 0 {
+			return nil, errors.NotSupportedf("editing snapshot %s, which records no configuration (written with raft protocol version 2?)", newest.ID)
+		}
+		return &StoredConfiguration{Configuration: newest.Configuration, Snapshot: newest}, nil
+	}
+	if entry == nil {
+		return nil, errors.NotFoundf("configuration in the log or a snapshot")
+	}
+	return &StoredConfiguration{Configuration: config, Entry: entry}, nil
+}
+
+// ReplaceStoredConfiguration changes the configuration where stored
+// says it's held: the log entry is rewritten with
+// ReplaceConfiguration, or the snapshot replaced with
+// ReplaceSnapshotConfiguration. snapshots is only needed for the
+// latter.
+func ReplaceStoredConfiguration(logs raft.LogStore, snapshots raft.SnapshotStore, stored *StoredConfiguration, config raft.Configuration) error {
+	if stored.Entry != nil {
+		return errors.Trace(ReplaceConfiguration(logs, stored.Entry, config))
+	}
+	return errors.Trace(ReplaceSnapshotConfiguration(snapshots, stored.Snapshot.ID, config))
+}
+
+// ReplaceSnapshotConfiguration writes a copy of the snapshot with the
+// given id, with the same index, term and state but config as its
+// configuration. Raft prefers the copy since its id sorts after the
+// original's. The agent must not be running.
+func ReplaceSnapshotConfiguration(snapshots raft.SnapshotStore, id string, config raft.Configuration) error {
+	meta, state, err := snapshots.Open(id)
+	if err != nil {
+		return errors.Annotatef(err, "opening snapshot %s", id)
+	}
+	defer state.Close()
+	_, transport := raft.NewInmemTransport(raft.ServerAddress("notused"))
+	defer transport.Close()
+	sink, err := snapshots.Create(meta.Version, meta.Index, meta.Term, config, meta.ConfigurationIndex, transport)
+	if err != nil {
+		return errors.Annotatef(err, "creating copy of snapshot %s", id)
+	}
+	if _, err := io.Copy(sink, state); err != nil {
+		sink.Cancel()
+		return errors.Annotatef(err, "copying snapshot %s", id)
+	}
+	return errors.Annotatef(sink.Close(), "closing copy of snapshot %s", id)
+}
+
+// TruncateLog removes the entries before index below from logs,
+// returning how many were removed. The caller must make sure a
+// snapshot covers them, since raft can't otherwise rebuild the state
+// they held. The agent must not be running.
+func TruncateLog(logs raft.LogStore, below uint64) (uint64, error) {
+	first, err := logs.FirstIndex()
+	if err != nil {
+		return 0, errors.Annotate(err, "reading first index")
+	}
+	if first == 0 || below <= first {
+		return 0, nil
+	}
+	if err := logs.DeleteRange(first, below-1); err != nil {
+		return 0, errors.Annotatef(err, "removing entries %d to %d", first, below-1)
+	}
+	return below - first, nil
+}
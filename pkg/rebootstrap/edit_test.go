@@ -0,0 +1,222 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstrap_test
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/raft"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap/rebootstraptest"
+)
+
+func configurationEntry(index, term uint64, config raft.Configuration) *raft.Log {
+	return &raft.Log{Index: index, Term: term, Type: raft.LogConfiguration, Data: raft.EncodeConfiguration(config)}
+}
+
+func TestCurrentConfiguration(t *testing.T) {
+	inLog := rebootstraptest.Servers(3)
+	inSnapshot := rebootstraptest.Servers(5)
+	for _, test := range []struct {
+		about        string
+		entries      []*raft.Log
+		snapshot     *raft.SnapshotMeta
+		fromSnapshot bool
+		err          string
+	}{{
+		about:   "only in the log",
+		entries: []*raft.Log{configurationEntry(1, 1, inLog), logEntries(1, 2)[0]},
+	}, {
+		about:    "log entry after the snapshot",
+		entries:  []*raft.Log{configurationEntry(11, 2, inLog)},
+		snapshot: &raft.SnapshotMeta{ID: "1-10", Index: 10, Term: 1, Configuration: inSnapshot},
+	}, {
+		about:        "snapshot after the log entry",
+		entries:      []*raft.Log{configurationEntry(5, 1, inLog), logEntries(1, 6)[0]},
+		snapshot:     &raft.SnapshotMeta{ID: "1-10", Index: 10, Term: 1, Configuration: inSnapshot},
+		fromSnapshot: true,
+	}, {
+		about:        "snapshot at the log entry",
+		entries:      []*raft.Log{configurationEntry(10, 1, inLog)},
+		snapshot:     &raft.SnapshotMeta{ID: "1-10", Index: 10, Term: 1, Configuration: inSnapshot},
+		fromSnapshot: true,
+	}, {
+		about:        "compacted log",
+		entries:      logEntries(1, 11, 12),
+		snapshot:     &raft.SnapshotMeta{ID: "1-10", Index: 10, Term: 1, Configuration: inSnapshot},
+		fromSnapshot: true,
+	}, {
+		about:    "snapshot without a configuration",
+		entries:  logEntries(1, 11),
+		snapshot: &raft.SnapshotMeta{ID: "1-10", Index: 10, Term: 1},
+		err:      "editing snapshot 1-10, which records no configuration (written with raft protocol version 2?) not supported",
+	}, {
+		about:   "no configuration anywhere",
+		entries: logEntries(1, 1, 2),
+		err:     "configuration in the log or a snapshot not found",
+	}} {
+		t.Run(test.about, func(t *testing.T) {
+			logs := raft.NewInmemStore()
+			if err := logs.StoreLogs(test.entries); err != nil {
+				t.Fatal(err)
+			}
+			stored, err := rebootstrap.CurrentConfiguration(logs, test.snapshot)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CurrentConfiguration: %v", err)
+			}
+			want := inLog
+			if test.fromSnapshot {
+				want = inSnapshot
+				if stored.Snapshot != test.snapshot || stored.Entry != nil {
+					t.Errorf("configuration held in %+v, %+v, want the snapshot", stored.Entry, stored.Snapshot)
+				}
+			} else if stored.Entry == nil || stored.Snapshot != nil {
+				t.Errorf("configuration held in %+v, %+v, want the log", stored.Entry, stored.Snapshot)
+			}
+			if !reflect.DeepEqual(stored.Configuration, want) {
+				t.Errorf("got configuration %v, want %v", stored.Configuration, want)
+			}
+		})
+	}
+}
+
+func TestReplaceSnapshotConfiguration(t *testing.T) {
+	snapshots := raft.NewInmemSnapshotStore()
+	_, transport := raft.NewInmemTransport("notused")
+	defer transport.Close()
+	sink, err := snapshots.Create(raft.SnapshotVersionMax, 10, 2, rebootstraptest.Servers(3), 7, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sink.Write([]byte("state")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	replacement := rebootstraptest.Servers(1)
+	if err := rebootstrap.ReplaceSnapshotConfiguration(snapshots, sink.ID(), replacement); err != nil {
+		t.Fatalf("ReplaceSnapshotConfiguration: %v", err)
+	}
+	list, err := snapshots.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("got %d snapshots, want 1", len(list))
+	}
+	meta, reader, err := snapshots.Open(list[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Index != 10 || meta.Term != 2 || meta.ConfigurationIndex != 7 {
+		t.Errorf("replacement at index %d, term %d, configuration index %d, want 10, 2, 7", meta.Index, meta.Term, meta.ConfigurationIndex)
+	}
+	if !reflect.DeepEqual(meta.Configuration, replacement) {
+		t.Errorf("replacement has configuration %v, want %v", meta.Configuration, replacement)
+	}
+	if string(data) != "state" {
+		t.Errorf("replacement has state %q, want %q", data, "state")
+	}
+}
+
+func TestReplaceConfiguration(t *testing.T) {
+	logs := raft.NewInmemStore()
+	entries := append([]*raft.Log{configurationEntry(1, 1, rebootstraptest.Servers(3))}, logEntries(1, 2, 3)...)
+	if err := logs.StoreLogs(entries); err != nil {
+		t.Fatal(err)
+	}
+	entry, config, err := rebootstrap.LatestConfiguration(logs)
+	if err != nil {
+		t.Fatalf("LatestConfiguration: %v", err)
+	}
+	if entry.Index != 1 || !reflect.DeepEqual(config, rebootstraptest.Servers(3)) {
+		t.Fatalf("got entry %d with %v, want entry 1", entry.Index, config)
+	}
+
+	replacement := rebootstraptest.Servers(1)
+	if err := rebootstrap.ReplaceConfiguration(logs, entry, replacement); err != nil {
+		t.Fatalf("ReplaceConfiguration: %v", err)
+	}
+	entry, config, err = rebootstrap.LatestConfiguration(logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Index != 1 || entry.Term != 1 || !reflect.DeepEqual(config, replacement) {
+		t.Errorf("got entry %d term %d with %v, want entry 1 term 1 with %v", entry.Index, entry.Term, config, replacement)
+	}
+	if last, _ := logs.LastIndex(); last != 3 {
+		t.Errorf("last index %d after replacing, want 3", last)
+	}
+
+	var command raft.Log
+	if err := logs.GetLog(2, &command); err != nil {
+		t.Fatal(err)
+	}
+	err = rebootstrap.ReplaceConfiguration(logs, &command, replacement)
+	if err == nil || err.Error() != "log entry 2 of type LogCommand not valid" {
+		t.Errorf("replacing a command entry gave %v", err)
+	}
+}
+
+func TestTruncateLog(t *testing.T) {
+	for _, test := range []struct {
+		about   string
+		indexes []uint64
+		below   uint64
+		removed uint64
+		first   uint64
+	}{{
+		about:   "some entries",
+		indexes: []uint64{1, 2, 3, 4, 5},
+		below:   4,
+		removed: 3,
+		first:   4,
+	}, {
+		about:   "already truncated",
+		indexes: []uint64{6, 7},
+		below:   4,
+		first:   6,
+	}, {
+		about:   "at the first entry",
+		indexes: []uint64{4, 5},
+		below:   4,
+		first:   4,
+	}, {
+		about: "empty log",
+		below: 4,
+	}} {
+		t.Run(test.about, func(t *testing.T) {
+			logs := raft.NewInmemStore()
+			if err := logs.StoreLogs(logEntries(1, test.indexes...)); err != nil {
+				t.Fatal(err)
+			}
+			removed, err := rebootstrap.TruncateLog(logs, test.below)
+			if err != nil {
+				t.Fatalf("TruncateLog: %v", err)
+			}
+			if removed != test.removed {
+				t.Errorf("removed %d entries, want %d", removed, test.removed)
+			}
+			if first, _ := logs.FirstIndex(); first != test.first {
+				t.Errorf("first index %d, want %d", first, test.first)
+			}
+		})
+	}
+}
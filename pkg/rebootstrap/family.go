@@ -0,0 +1,122 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstrap
+
+import (
+	"context"
+	"net"
+
+	"github.com/juju/errors"
+	"github.com/juju/replicaset"
+	"gopkg.in/mgo.v2"
+)
+
+// Address families that can be asked for with FamilyAddresses.
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+	FamilyAny  = "any"
+)
+
+// InFamily reports whether host is an IP address of the given family.
+// Hostnames are in neither IPv4 nor IPv6, since what they resolve to
+// is up to each peer, but every host is in FamilyAny.
+func InFamily(host, family string) bool {
+	if family == FamilyAny {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.To4() != nil {
+		return family == FamilyIPv4
+	}
+	return family == FamilyIPv6
+}
+
+// FamilyAddresses returns addresses (a map from machine id to host,
+// as MakeServers takes) with the host of any member not in family,
+// whether it came from addresses or the replicaset, replaced by the
+// machine's best address in that family in Juju, chosen as jujud
+// would (in juju-ha-space, if that's set). A machine without such an
+// address gives a NotFound error.
+func FamilyAddresses(ctx context.Context, session *mgo.Session, members []replicaset.Member, addresses map[string]string, family string) (map[string]string, error) {
+	if family != FamilyIPv4 && family != FamilyIPv6 {
+		return nil, errors.NotValidf("address family %q", family)
+	}
+	var result map[string]string
+	err := WithSession(ctx, session, func(s *mgo.Session) error {
+		var err error
+		result, err = familyAddresses(s, members, addresses, family)
+		return err
+	})
+	return result, err
+}
+
+func familyAddresses(session *mgo.Session, members []replicaset.Member, addresses map[string]string, family string) (map[string]string, error) {
+	result := make(map[string]string)
+	for id, address := range addresses {
+		result[id] = address
+	}
+	var wrong []replicaset.Member
+	for _, member := range members {
+		id, ok := member.Tags[MachineIDTag]
+		if !ok {
+			// MakeServers will report this.
+			continue
+		}
+		host, ok := result[id]
+		if !ok {
+			var err error
+			if host, _, err = net.SplitHostPort(member.Address); err != nil {
+				return nil, errors.Annotatef(err, "getting base address for replset member %d", member.Id)
+			}
+		}
+		if !InFamily(host, family) {
+			wrong = append(wrong, member)
+		}
+	}
+	if len(wrong) == 0 {
+		return result, nil
+	}
+
+	db := session.DB(JujuDB)
+	space, err := getHASpace(db)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	info, err := getControllerInfo(db)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	spaceNames, err := getSpaceNames(db, info.ModelUUID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, member := range wrong {
+		id := member.Tags[MachineIDTag]
+		var machine machineDoc
+		err := db.C(machinesC).FindId(info.ModelUUID + ":" + id).One(&machine)
+		if err != nil {
+			return nil, errors.Annotatef(err, "reading addresses for machine %s", id)
+		}
+		var addrs []addressDoc
+		for _, addr := range append(machine.Addresses, machine.MachineAddresses...) {
+			if InFamily(addr.Value, family) {
+				addrs = append(addrs, addr)
+			}
+		}
+		address, ok := selectInternalAddress(addrs, space, spaceNames)
+		if !ok {
+			if space != "" {
+				return nil, errors.NotFoundf("%s address in space %q for machine %s", family, space, id)
+			}
+			return nil, errors.NotFoundf("%s address for machine %s", family, id)
+		}
+		logger.Infof("machine %s: using %s address %s", id, family, address)
+		result[id] = address
+	}
+	return result, nil
+}
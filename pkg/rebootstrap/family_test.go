@@ -0,0 +1,32 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstrap_test
+
+import (
+	"testing"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+func TestInFamily(t *testing.T) {
+	for _, test := range []struct {
+		host   string
+		family string
+		expect bool
+	}{
+		{"10.0.0.1", rebootstrap.FamilyIPv4, true},
+		{"10.0.0.1", rebootstrap.FamilyIPv6, false},
+		{"fd00::1", rebootstrap.FamilyIPv6, true},
+		{"fd00::1", rebootstrap.FamilyIPv4, false},
+		{"::ffff:10.0.0.1", rebootstrap.FamilyIPv4, true},
+		{"controller-0.example.com", rebootstrap.FamilyIPv4, false},
+		{"controller-0.example.com", rebootstrap.FamilyIPv6, false},
+		{"controller-0.example.com", rebootstrap.FamilyAny, true},
+		{"fd00::1", rebootstrap.FamilyAny, true},
+	} {
+		if got := rebootstrap.InFamily(test.host, test.family); got != test.expect {
+			t.Errorf("InFamily(%q, %q) = %t, want %t", test.host, test.family, got, test.expect)
+		}
+	}
+}
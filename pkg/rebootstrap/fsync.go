@@ -0,0 +1,51 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstrap
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/juju/errors"
+)
+
+// SyncTree fsyncs every file and directory under dir, including dir
+// itself. Directories are synced after their contents so the entries
+// pointing at the synced files are durable too.
+func SyncTree(dir string) error {
+	var dirs []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			dirs = append(dirs, path)
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return SyncPath(path)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// Walk visits parents before children, so go backwards.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := SyncPath(dirs[i]); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// SyncPath opens path and fsyncs it.
+func SyncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+	return errors.Annotatef(f.Sync(), "syncing %q", path)
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstrap
+
+import (
+	"strings"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/errors"
+)
+
+// Server id schemes: how the servers in a controller's raft
+// configuration are named.
+const (
+	// IDSchemeMachineID names servers by bare machine id ("0").
+	// It's what jujud has always used.
+	IDSchemeMachineID = "machine-id"
+
+	// IDSchemeTag names servers by machine tag ("machine-0").
+	IDSchemeTag = "tag"
+)
+
+const machineTagPrefix = "machine-"
+
+// ServerID returns the raft server id for a machine under the given
+// scheme. An empty scheme means IDSchemeMachineID.
+func ServerID(machineID, scheme string) raft.ServerID {
+	if scheme == IDSchemeTag {
+		return raft.ServerID(machineTagPrefix + machineID)
+	}
+	return raft.ServerID(machineID)
+}
+
+// ServerMachineID returns the machine id a server id names, whichever
+// scheme it's in.
+func ServerMachineID(id raft.ServerID) string {
+	return strings.TrimPrefix(string(id), machineTagPrefix)
+}
+
+// ApplyIDScheme returns a copy of config with its server ids in the
+// given scheme.
+func ApplyIDScheme(config raft.Configuration, scheme string) raft.Configuration {
+	result := config.Clone()
+	for i, server := range result.Servers {
+		result.Servers[i].ID = ServerID(ServerMachineID(server.ID), scheme)
+	}
+	return result
+}
+
+// DetectIDScheme works out which scheme the server ids in config are
+// in. It returns a NotFound error for an empty configuration and a
+// NotValid one if the ids are a mixture.
+func DetectIDScheme(config raft.Configuration) (string, error) {
+	var scheme string
+	for _, server := range config.Servers {
+		s := IDSchemeMachineID
+		if strings.HasPrefix(string(server.ID), machineTagPrefix) {
+			s = IDSchemeTag
+		}
+		if scheme != "" && s != scheme {
+			return "", errors.NotValidf("configuration with both %s and %s server ids", scheme, s)
+		}
+		scheme = s
+	}
+	if scheme == "" {
+		return "", errors.NotFoundf("servers in configuration")
+	}
+	return scheme, nil
+}
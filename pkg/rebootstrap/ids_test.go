@@ -0,0 +1,102 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstrap_test
+
+import (
+	"testing"
+
+	"github.com/hashicorp/raft"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap/rebootstraptest"
+)
+
+func TestApplyIDScheme(t *testing.T) {
+	tagged := rebootstraptest.Servers(2)
+	tagged.Servers[0].ID = "machine-0"
+	tagged.Servers[1].ID = "machine-1"
+	for _, test := range []struct {
+		about  string
+		config raft.Configuration
+		scheme string
+		expect []raft.ServerID
+	}{{
+		about:  "machine ids to tags",
+		config: rebootstraptest.Servers(2),
+		scheme: rebootstrap.IDSchemeTag,
+		expect: []raft.ServerID{"machine-0", "machine-1"},
+	}, {
+		about:  "tags to machine ids",
+		config: tagged,
+		scheme: rebootstrap.IDSchemeMachineID,
+		expect: []raft.ServerID{"0", "1"},
+	}, {
+		about:  "tags kept",
+		config: tagged,
+		scheme: rebootstrap.IDSchemeTag,
+		expect: []raft.ServerID{"machine-0", "machine-1"},
+	}, {
+		about:  "no scheme is machine ids",
+		config: tagged,
+		expect: []raft.ServerID{"0", "1"},
+	}} {
+		t.Run(test.about, func(t *testing.T) {
+			before := test.config.Clone()
+			result := rebootstrap.ApplyIDScheme(test.config, test.scheme)
+			for i, server := range result.Servers {
+				if server.ID != test.expect[i] {
+					t.Errorf("server %d has id %q, want %q", i, server.ID, test.expect[i])
+				}
+				if server.Address != test.config.Servers[i].Address {
+					t.Errorf("server %d address changed to %q", i, server.Address)
+				}
+			}
+			if test.config.Servers[0].ID != before.Servers[0].ID {
+				t.Errorf("ApplyIDScheme changed its argument")
+			}
+		})
+	}
+}
+
+func TestDetectIDScheme(t *testing.T) {
+	tagged := rebootstraptest.Servers(2)
+	tagged.Servers[0].ID = "machine-0"
+	tagged.Servers[1].ID = "machine-1"
+	mixed := rebootstraptest.Servers(2)
+	mixed.Servers[1].ID = "machine-1"
+	for _, test := range []struct {
+		about  string
+		config raft.Configuration
+		scheme string
+		err    string
+	}{{
+		about:  "machine ids",
+		config: rebootstraptest.Servers(3),
+		scheme: rebootstrap.IDSchemeMachineID,
+	}, {
+		about:  "tags",
+		config: tagged,
+		scheme: rebootstrap.IDSchemeTag,
+	}, {
+		about:  "mixed",
+		config: mixed,
+		err:    "configuration with both machine-id and tag server ids not valid",
+	}, {
+		about: "empty",
+		err:   "servers in configuration not found",
+	}} {
+		t.Run(test.about, func(t *testing.T) {
+			scheme, err := rebootstrap.DetectIDScheme(test.config)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil || scheme != test.scheme {
+				t.Errorf("got %q, %v, want %q", scheme, err, test.scheme)
+			}
+		})
+	}
+}
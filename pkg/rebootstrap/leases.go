@@ -0,0 +1,124 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstrap
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	leaseHoldersC = "leaseholders"
+
+	// leaseSnapshotVersion is the version of the raft lease FSM
+	// snapshot format that jujud reads.
+	leaseSnapshotVersion = 1
+
+	// seededLeaseDuration is how long leases written into a seeded
+	// snapshot are held for. It matches the duration jujud uses
+	// when claiming application leadership.
+	seededLeaseDuration = time.Minute
+)
+
+// LeaseSnapshot mirrors the snapshot format written by the raft lease
+// FSM in jujud.
+type LeaseSnapshot struct {
+	Version    int                     `yaml:"version"`
+	Entries    map[LeaseKey]LeaseEntry `yaml:"entries"`
+	Pinned     map[LeaseKey][]string   `yaml:"pinned"`
+	GlobalTime time.Time               `yaml:"global-time"`
+}
+
+// LeaseKey identifies a lease in a LeaseSnapshot.
+type LeaseKey struct {
+	Namespace string `yaml:"namespace"`
+	ModelUUID string `yaml:"model-uuid"`
+	Lease     string `yaml:"lease"`
+}
+
+// LeaseEntry records the holder of a lease and when it expires.
+type LeaseEntry struct {
+	Holder   string        `yaml:"holder"`
+	Start    time.Time     `yaml:"start"`
+	Duration time.Duration `yaml:"duration"`
+}
+
+// Expiry returns when the lease runs out, in the snapshot's global
+// time.
+func (e LeaseEntry) Expiry() time.Time {
+	return e.Start.Add(e.Duration)
+}
+
+type leaseHolderDoc struct {
+	Namespace string `bson:"namespace"`
+	ModelUUID string `bson:"model-uuid"`
+	Lease     string `bson:"lease"`
+	Holder    string `bson:"holder"`
+}
+
+// ReadLeaseSnapshot reads the lease holders that jujud mirrors into
+// Mongo and builds a lease FSM snapshot from them. Mongo doesn't
+// record lease expiry times, so each lease is given a fresh
+// seededLeaseDuration starting at the snapshot's global time.
+func ReadLeaseSnapshot(ctx context.Context, session *mgo.Session) (*LeaseSnapshot, error) {
+	var docs []leaseHolderDoc
+	err := WithSession(ctx, session, func(s *mgo.Session) error {
+		return s.DB(JujuDB).C(leaseHoldersC).Find(nil).All(&docs)
+	})
+	if err != nil {
+		return nil, errors.Annotate(err, "reading lease holders")
+	}
+	snapshot := EmptyLeaseSnapshot()
+	for _, doc := range docs {
+		key := LeaseKey{
+			Namespace: doc.Namespace,
+			ModelUUID: doc.ModelUUID,
+			Lease:     doc.Lease,
+		}
+		snapshot.Entries[key] = LeaseEntry{
+			Holder:   doc.Holder,
+			Start:    snapshot.GlobalTime,
+			Duration: seededLeaseDuration,
+		}
+	}
+	return snapshot, nil
+}
+
+// EmptyLeaseSnapshot returns a lease FSM snapshot with no leases.
+func EmptyLeaseSnapshot() *LeaseSnapshot {
+	return &LeaseSnapshot{
+		Version: leaseSnapshotVersion,
+		Entries: make(map[LeaseKey]LeaseEntry),
+		Pinned:  make(map[LeaseKey][]string),
+	}
+}
+
+// ResetExpiries makes every lease in the snapshot run for d from the
+// snapshot's global time. A zero d expires them all, so leadership is
+// claimed afresh as soon as the controllers are back; a longer one
+// keeps the current holders in place while the agents reconnect.
+func (s *LeaseSnapshot) ResetExpiries(d time.Duration) {
+	for key, entry := range s.Entries {
+		entry.Start = s.GlobalTime
+		entry.Duration = d
+		s.Entries[key] = entry
+	}
+}
+
+// DecodeLeaseSnapshot parses the data of a snapshot written by the
+// raft lease FSM.
+func DecodeLeaseSnapshot(data []byte) (*LeaseSnapshot, error) {
+	var snapshot LeaseSnapshot
+	if err := yaml.Unmarshal(data, &snapshot); err != nil {
+		return nil, errors.Annotate(err, "decoding lease snapshot")
+	}
+	if snapshot.Version != leaseSnapshotVersion {
+		return nil, errors.NotSupportedf("lease snapshot version %d", snapshot.Version)
+	}
+	return &snapshot, nil
+}
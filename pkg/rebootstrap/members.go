@@ -0,0 +1,610 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstrap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/errors"
+	"github.com/juju/replicaset"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// JujuDB is the name of the database Juju keeps its state in.
+	JujuDB = "juju"
+
+	// ReplicaSetName is the name Juju gives the controller
+	// replicaset.
+	ReplicaSetName = "juju"
+
+	// MachineIDTag is the key for the replset member tag where Juju
+	// stores the member's corresponding machine id.
+	MachineIDTag = "juju-machine-id"
+
+	controllersC = "controllers"
+	machinesC    = "machines"
+	spacesC      = "spaces"
+
+	// controllerInfoKey and controllerSettingsKey are the ids of the
+	// documents in the controllers collection holding the controller
+	// model details and controller config respectively.
+	controllerInfoKey     = "e"
+	controllerSettingsKey = "controllerSettings"
+
+	// haSpaceKey is the controller config key naming the space that
+	// controller machines should use to talk to each other.
+	haSpaceKey = "juju-ha-space"
+
+	// controllerUUIDKey is the controller config key holding the
+	// controller's UUID.
+	controllerUUIDKey = "controller-uuid"
+
+	// lifeDead is the value of the life field for a dead entity.
+	lifeDead = 2
+)
+
+// scopePreference orders the network scopes we'll accept for a raft
+// address, most preferred first. This matches the order jujud uses
+// when choosing an internal address to advertise to its peers.
+var scopePreference = []string{"local-cloud", "public", "", "unknown"}
+
+type controllerInfoDoc struct {
+	ModelUUID  string   `bson:"model-uuid"`
+	MachineIds []string `bson:"machineids"`
+}
+
+type settingsDoc struct {
+	Settings map[string]interface{} `bson:"settings"`
+}
+
+type machineDoc struct {
+	MachineID        string       `bson:"machineid"`
+	Life             int          `bson:"life"`
+	Addresses        []addressDoc `bson:"addresses"`
+	MachineAddresses []addressDoc `bson:"machineaddresses"`
+}
+
+type addressDoc struct {
+	Value     string `bson:"value"`
+	Scope     string `bson:"networkscope"`
+	SpaceName string `bson:"spacename"`
+	SpaceID   string `bson:"spaceid"`
+}
+
+type spaceDoc struct {
+	SpaceID string `bson:"spaceid"`
+	Name    string `bson:"name"`
+}
+
+// getControllerInfo reads the controller model details, including
+// the ids of the controller machines.
+func getControllerInfo(db *mgo.Database) (*controllerInfoDoc, error) {
+	var info controllerInfoDoc
+	if err := db.C(controllersC).FindId(controllerInfoKey).One(&info); err != nil {
+		return nil, errors.Annotate(err, "reading controller info")
+	}
+	return &info, nil
+}
+
+// getControllerSettings reads the controller config.
+func getControllerSettings(db *mgo.Database) (map[string]interface{}, error) {
+	var doc settingsDoc
+	if err := db.C(controllersC).FindId(controllerSettingsKey).One(&doc); err != nil {
+		return nil, errors.Annotate(err, "reading controller config")
+	}
+	return doc.Settings, nil
+}
+
+// Members returns the current replicaset members. If they can't be
+// fetched from the primary (because there isn't one) they're read
+// from the local.system.replset document of the server session is
+// connected to, which every member keeps a copy of.
+func Members(ctx context.Context, session *mgo.Session) ([]replicaset.Member, error) {
+	var members []replicaset.Member
+	err := WithSession(ctx, session, func(s *mgo.Session) error {
+		var err error
+		members, err = replicaset.CurrentMembers(s)
+		if err != nil {
+			logger.Debugf("getting replica set members from the primary: %v", err)
+			members, err = localMembers(s)
+		}
+		return err
+	})
+	return members, errors.Annotate(err, "getting replica set members")
+}
+
+// localMembers reads the members from local.system.replset.
+func localMembers(session *mgo.Session) ([]replicaset.Member, error) {
+	session.SetMode(mgo.Monotonic, true)
+	var config struct {
+		Members []replicaset.Member `bson:"members"`
+	}
+	err := session.DB("local").C("system.replset").Find(nil).One(&config)
+	if err != nil {
+		return nil, errors.Annotate(err, "reading local.system.replset")
+	}
+	logger.Warningf("read replica set members from local.system.replset")
+	return config.Members, nil
+}
+
+// CurrentReplicaSetName returns the name of the replicaset the server
+// session is connected to belongs to, from its local.system.replset
+// document, so it works on any member.
+func CurrentReplicaSetName(ctx context.Context, session *mgo.Session) (string, error) {
+	var config struct {
+		Name string `bson:"_id"`
+	}
+	err := WithSession(ctx, session, func(s *mgo.Session) error {
+		s.SetMode(mgo.Monotonic, true)
+		return s.DB("local").C("system.replset").Find(nil).One(&config)
+	})
+	if err == mgo.ErrNotFound {
+		return "", errors.New("MongoDB isn't running as a replicaset member")
+	}
+	return config.Name, errors.Annotate(err, "reading local.system.replset")
+}
+
+// DataMembers returns the members that hold data, dropping arbiters
+// with a warning. Juju never creates arbiters, but hand-modified
+// controllers sometimes have them, and they'll never run jujud.
+func DataMembers(members []replicaset.Member) []replicaset.Member {
+	var kept []replicaset.Member
+	for _, member := range members {
+		if member.Arbiter != nil && *member.Arbiter {
+			logger.Warningf("skipping arbiter member %d (%s)", member.Id, member.Address)
+			continue
+		}
+		kept = append(kept, member)
+	}
+	return kept
+}
+
+// ControllerUUID returns the UUID of the controller the database
+// belongs to.
+func ControllerUUID(ctx context.Context, session *mgo.Session) (string, error) {
+	var settings map[string]interface{}
+	err := WithSession(ctx, session, func(s *mgo.Session) error {
+		var err error
+		settings, err = getControllerSettings(s.DB(JujuDB))
+		return err
+	})
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	uuid, _ := settings[controllerUUIDKey].(string)
+	return uuid, nil
+}
+
+// CheckControllerMembers makes sure every replicaset member is a live
+// controller machine. Failed enable-ha operations can leave members
+// behind for machines that are no longer (or never became)
+// controllers, and those mustn't be made raft servers.
+func CheckControllerMembers(ctx context.Context, session *mgo.Session, members []replicaset.Member) error {
+	return WithSession(ctx, session, func(s *mgo.Session) error {
+		return checkControllerMembers(s, members)
+	})
+}
+
+func checkControllerMembers(session *mgo.Session, members []replicaset.Member) error {
+	db := session.DB(JujuDB)
+	info, err := getControllerInfo(db)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	controllers := make(map[string]bool)
+	for _, id := range info.MachineIds {
+		controllers[id] = true
+	}
+
+	var problems []string
+	for _, member := range members {
+		id, ok := member.Tags[MachineIDTag]
+		if !ok {
+			// MakeServers will report this.
+			continue
+		}
+		if !controllers[id] {
+			problems = append(problems, fmt.Sprintf("member %d (%s): machine %s is not a controller", member.Id, member.Address, id))
+			continue
+		}
+		var machine machineDoc
+		err := db.C(machinesC).FindId(info.ModelUUID + ":" + id).One(&machine)
+		if err == mgo.ErrNotFound {
+			problems = append(problems, fmt.Sprintf("member %d (%s): machine %s doesn't exist", member.Id, member.Address, id))
+			continue
+		} else if err != nil {
+			return errors.Annotatef(err, "reading machine %s", id)
+		}
+		if machine.Life == lifeDead {
+			problems = append(problems, fmt.Sprintf("member %d (%s): machine %s is dead", member.Id, member.Address, id))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("replicaset has members that aren't live controllers:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// getHASpace returns the value of juju-ha-space from the controller
+// config, or "" if it isn't set.
+func getHASpace(db *mgo.Database) (string, error) {
+	settings, err := getControllerSettings(db)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	space, _ := settings[haSpaceKey].(string)
+	return space, nil
+}
+
+// HASpaceAddresses returns a map from machine id to the address
+// each replicaset member should use for raft, chosen from the
+// controller's juju-ha-space. If no HA space is configured the map
+// is empty and the replicaset addresses should be used as they are.
+func HASpaceAddresses(ctx context.Context, session *mgo.Session, members []replicaset.Member) (map[string]string, error) {
+	var addresses map[string]string
+	err := WithSession(ctx, session, func(s *mgo.Session) error {
+		var err error
+		addresses, err = haSpaceAddresses(s, members)
+		return err
+	})
+	return addresses, err
+}
+
+func haSpaceAddresses(session *mgo.Session, members []replicaset.Member) (map[string]string, error) {
+	db := session.DB(JujuDB)
+	space, err := getHASpace(db)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if space == "" {
+		logger.Debugf("%s not set, using replicaset addresses", haSpaceKey)
+		return map[string]string{}, nil
+	}
+	logger.Infof("selecting addresses in %s %q", haSpaceKey, space)
+
+	info, err := getControllerInfo(db)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	spaceNames, err := getSpaceNames(db, info.ModelUUID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	result := make(map[string]string)
+	for _, member := range members {
+		id, ok := member.Tags[MachineIDTag]
+		if !ok {
+			// MakeServers will report this.
+			continue
+		}
+		var machine machineDoc
+		err := db.C(machinesC).FindId(info.ModelUUID + ":" + id).One(&machine)
+		if err != nil {
+			return nil, errors.Annotatef(err, "reading addresses for machine %s", id)
+		}
+		addrs := append(machine.Addresses, machine.MachineAddresses...)
+		address, ok := selectSpaceAddress(addrs, space, spaceNames)
+		if !ok {
+			return nil, errors.NotFoundf("address in space %q for machine %s", space, id)
+		}
+		logger.Debugf("machine %s: using %s address %s", id, haSpaceKey, address)
+		result[id] = address
+	}
+	return result, nil
+}
+
+// Address scopes that can be asked for with ScopeAddresses.
+const (
+	// ScopePublic selects addresses reachable from outside the
+	// cloud.
+	ScopePublic = "public"
+
+	// ScopeInternal selects cloud-local addresses.
+	ScopeInternal = "internal"
+)
+
+// addressScopes maps the scopes accepted by ScopeAddresses to the
+// network scopes Juju records on machine addresses.
+var addressScopes = map[string]string{
+	ScopePublic:   "public",
+	ScopeInternal: "local-cloud",
+}
+
+// ScopeAddresses returns a map from machine id to the address each
+// replicaset member should use for raft, chosen from the machine's
+// addresses in Juju with the given scope (ScopePublic or
+// ScopeInternal) rather than taken from the replicaset. If the
+// controller has juju-ha-space set the address must be in that space
+// too. A machine without such an address gives a NotFound error.
+func ScopeAddresses(ctx context.Context, session *mgo.Session, members []replicaset.Member, scope string) (map[string]string, error) {
+	networkScope, ok := addressScopes[scope]
+	if !ok {
+		return nil, errors.NotValidf("address scope %q", scope)
+	}
+	var addresses map[string]string
+	err := WithSession(ctx, session, func(s *mgo.Session) error {
+		var err error
+		addresses, err = scopeAddresses(s, members, networkScope)
+		return err
+	})
+	return addresses, err
+}
+
+func scopeAddresses(session *mgo.Session, members []replicaset.Member, networkScope string) (map[string]string, error) {
+	db := session.DB(JujuDB)
+	space, err := getHASpace(db)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	info, err := getControllerInfo(db)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	spaceNames, err := getSpaceNames(db, info.ModelUUID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	result := make(map[string]string)
+	for _, member := range members {
+		id, ok := member.Tags[MachineIDTag]
+		if !ok {
+			// MakeServers will report this.
+			continue
+		}
+		var machine machineDoc
+		err := db.C(machinesC).FindId(info.ModelUUID + ":" + id).One(&machine)
+		if err != nil {
+			return nil, errors.Annotatef(err, "reading addresses for machine %s", id)
+		}
+		address, ok := selectScopeAddress(append(machine.Addresses, machine.MachineAddresses...), networkScope, space, spaceNames)
+		if !ok {
+			if space != "" {
+				return nil, errors.NotFoundf("%s address in space %q for machine %s", networkScope, space, id)
+			}
+			return nil, errors.NotFoundf("%s address for machine %s", networkScope, id)
+		}
+		logger.Debugf("machine %s: using %s address %s", id, networkScope, address)
+		result[id] = address
+	}
+	return result, nil
+}
+
+// SelectedAddresses returns a map from machine id to the address
+// each replicaset member should use for raft, chosen from all of its
+// machine's addresses in Juju the way jujud chooses the address its
+// peers reach it on (in juju-ha-space, if that's set), rather than
+// reusing the replicaset's host. This matters for controllers with
+// several NICs, where the replicaset address may not be the one raft
+// should use. A machine without a usable address gives a NotFound
+// error.
+func SelectedAddresses(ctx context.Context, session *mgo.Session, members []replicaset.Member) (map[string]string, error) {
+	var addresses map[string]string
+	err := WithSession(ctx, session, func(s *mgo.Session) error {
+		var err error
+		addresses, err = selectedAddresses(s, members)
+		return err
+	})
+	return addresses, err
+}
+
+func selectedAddresses(session *mgo.Session, members []replicaset.Member) (map[string]string, error) {
+	db := session.DB(JujuDB)
+	space, err := getHASpace(db)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	info, err := getControllerInfo(db)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	spaceNames, err := getSpaceNames(db, info.ModelUUID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	result := make(map[string]string)
+	for _, member := range members {
+		id, ok := member.Tags[MachineIDTag]
+		if !ok {
+			// MakeServers will report this.
+			continue
+		}
+		var machine machineDoc
+		err := db.C(machinesC).FindId(info.ModelUUID + ":" + id).One(&machine)
+		if err != nil {
+			return nil, errors.Annotatef(err, "reading addresses for machine %s", id)
+		}
+		address, ok := selectInternalAddress(append(machine.Addresses, machine.MachineAddresses...), space, spaceNames)
+		if !ok {
+			if space != "" {
+				return nil, errors.NotFoundf("usable address in space %q for machine %s", space, id)
+			}
+			return nil, errors.NotFoundf("usable address for machine %s", id)
+		}
+		if host, _, err := net.SplitHostPort(member.Address); err == nil && host != address {
+			logger.Infof("machine %s: using %s rather than the replicaset's %s", id, address, host)
+		}
+		result[id] = address
+	}
+	return result, nil
+}
+
+// internalScopeRanks orders the network scopes an internal address
+// can have, best first, as Juju's internal address selection does.
+// Machine-local and link-local addresses are never chosen.
+var internalScopeRanks = map[string]int{
+	"local-cloud": 0,
+	"local-fan":   1,
+	"public":      2,
+	"":            3,
+	"unknown":     3,
+}
+
+// selectInternalAddress picks the address a controller's peers should
+// reach it on: in space if that isn't empty, with the best scope by
+// internalScopeRanks, and IPv4 ahead of IPv6 and hostnames within a
+// scope, as Juju sorts machine addresses.
+func selectInternalAddress(addrs []addressDoc, space string, spaceNames map[string]string) (string, bool) {
+	best, bestRank := "", -1
+	for _, addr := range addrs {
+		if space != "" {
+			name := addr.SpaceName
+			if name == "" {
+				name = spaceNames[addr.SpaceID]
+			}
+			if name != space {
+				continue
+			}
+		}
+		scopeRank, ok := internalScopeRanks[strings.ToLower(addr.Scope)]
+		if !ok {
+			continue
+		}
+		rank := scopeRank * 3
+		if ip := net.ParseIP(addr.Value); ip == nil {
+			rank += 2
+		} else if ip.To4() == nil {
+			rank++
+		}
+		if bestRank < 0 || rank < bestRank {
+			best, bestRank = addr.Value, rank
+		}
+	}
+	return best, bestRank >= 0
+}
+
+// selectScopeAddress picks the first address with the given network
+// scope, in space if that isn't empty.
+func selectScopeAddress(addrs []addressDoc, networkScope, space string, spaceNames map[string]string) (string, bool) {
+	for _, addr := range addrs {
+		if !strings.EqualFold(addr.Scope, networkScope) {
+			continue
+		}
+		if space != "" {
+			name := addr.SpaceName
+			if name == "" {
+				name = spaceNames[addr.SpaceID]
+			}
+			if name != space {
+				continue
+			}
+		}
+		return addr.Value, true
+	}
+	return "", false
+}
+
+// getSpaceNames returns a map from space id to space name for the
+// given model. Older controllers record space names directly on
+// addresses, in which case this will be empty.
+func getSpaceNames(db *mgo.Database, modelUUID string) (map[string]string, error) {
+	var docs []spaceDoc
+	err := db.C(spacesC).Find(bson.M{"model-uuid": modelUUID}).All(&docs)
+	if err != nil {
+		return nil, errors.Annotate(err, "reading spaces")
+	}
+	result := make(map[string]string)
+	for _, doc := range docs {
+		result[doc.SpaceID] = doc.Name
+	}
+	return result, nil
+}
+
+// selectSpaceAddress picks the best address in the named space,
+// preferring scopes in the order given by scopePreference.
+func selectSpaceAddress(addrs []addressDoc, space string, spaceNames map[string]string) (string, bool) {
+	for _, scope := range scopePreference {
+		for _, addr := range addrs {
+			name := addr.SpaceName
+			if name == "" {
+				name = spaceNames[addr.SpaceID]
+			}
+			if name != space || !strings.EqualFold(addr.Scope, scope) {
+				continue
+			}
+			return addr.Value, true
+		}
+	}
+	return "", false
+}
+
+// Why a replicaset member is made a raft nonvoter, as returned by
+// NonvoterReason.
+const (
+	reasonNoVote    = "has no vote"
+	reasonHidden    = "is hidden"
+	reasonPriority0 = "has priority 0"
+)
+
+// NonvoterReason says why a replicaset member will be made a raft
+// nonvoter, or returns "" if it will be a voter. Besides members
+// without a vote, hidden and priority 0 members are made nonvoters:
+// they can never become primary, which is how backup or standby
+// controllers are set up by hand.
+func NonvoterReason(member replicaset.Member) string {
+	switch {
+	case member.Votes != nil && *member.Votes < 1:
+		return reasonNoVote
+	case member.Hidden != nil && *member.Hidden:
+		return reasonHidden
+	case member.Priority != nil && *member.Priority == 0:
+		return reasonPriority0
+	}
+	return ""
+}
+
+// memberVotes reports whether a replicaset member should be a raft
+// voter, logging why not if it's anything other than having no vote.
+func memberVotes(member replicaset.Member) bool {
+	reason := NonvoterReason(member)
+	if reason != "" && reason != reasonNoVote {
+		logger.Infof("member %d (%s) %s, making it a nonvoter", member.Id, member.Address, reason)
+	}
+	return reason == ""
+}
+
+// MakeServers builds the raft configuration from the replicaset
+// members. If addresses has an entry for a member's machine id that
+// host is used instead of the one from the replicaset. A member
+// without a machine id tag gives a NotFound error. Members without a
+// vote, hidden members and priority 0 members become nonvoters.
+func MakeServers(members []replicaset.Member, addresses map[string]string, apiPort int) (raft.Configuration, error) {
+	var empty raft.Configuration
+	var servers []raft.Server
+	for _, member := range members {
+		id, ok := member.Tags[MachineIDTag]
+		if !ok {
+			return empty, errors.NotFoundf("juju machine id for replset member %d", member.Id)
+		}
+		baseAddress, ok := addresses[id]
+		if !ok {
+			host, _, err := net.SplitHostPort(member.Address)
+			if err != nil {
+				return empty, errors.Annotatef(err, "getting base address for replset member %d", member.Id)
+			}
+			baseAddress = host
+		}
+		apiAddress := net.JoinHostPort(baseAddress, strconv.Itoa(apiPort))
+		suffrage := raft.Voter
+		if !memberVotes(member) {
+			suffrage = raft.Nonvoter
+		}
+		server := raft.Server{
+			ID:       raft.ServerID(id),
+			Address:  raft.ServerAddress(apiAddress),
+			Suffrage: suffrage,
+		}
+		servers = append(servers, server)
+	}
+	return raft.Configuration{Servers: servers}, nil
+}
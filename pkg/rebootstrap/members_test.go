@@ -0,0 +1,94 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstrap_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/replicaset"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+func member(id int, address, machineID string) replicaset.Member {
+	m := replicaset.Member{Id: id, Address: address}
+	if machineID != "" {
+		m.Tags = map[string]string{rebootstrap.MachineIDTag: machineID}
+	}
+	return m
+}
+
+func TestMakeServers(t *testing.T) {
+	noVotes, hidden, priority0 := 0, true, 0.0
+	withVotes := member(1, "10.0.0.2:37017", "1")
+	withVotes.Votes = &noVotes
+	withHidden := member(1, "10.0.0.2:37017", "1")
+	withHidden.Hidden = &hidden
+	withPriority0 := member(1, "10.0.0.2:37017", "1")
+	withPriority0.Priority = &priority0
+
+	server := func(id, address string, suffrage raft.ServerSuffrage) raft.Server {
+		return raft.Server{ID: raft.ServerID(id), Address: raft.ServerAddress(address), Suffrage: suffrage}
+	}
+	for _, test := range []struct {
+		about     string
+		members   []replicaset.Member
+		addresses map[string]string
+		expect    []raft.Server
+		err       string
+	}{{
+		about:   "replicaset addresses",
+		members: []replicaset.Member{member(0, "10.0.0.1:37017", "0"), member(1, "[fd00::2]:37017", "1")},
+		expect: []raft.Server{
+			server("0", "10.0.0.1:17070", raft.Voter),
+			server("1", "[fd00::2]:17070", raft.Voter),
+		},
+	}, {
+		about:     "chosen addresses",
+		members:   []replicaset.Member{member(0, "10.0.0.1:37017", "0"), member(1, "10.0.0.2:37017", "1")},
+		addresses: map[string]string{"1": "192.168.0.2"},
+		expect: []raft.Server{
+			server("0", "10.0.0.1:17070", raft.Voter),
+			server("1", "192.168.0.2:17070", raft.Voter),
+		},
+	}, {
+		about:   "no votes",
+		members: []replicaset.Member{withVotes},
+		expect:  []raft.Server{server("1", "10.0.0.2:17070", raft.Nonvoter)},
+	}, {
+		about:   "hidden",
+		members: []replicaset.Member{withHidden},
+		expect:  []raft.Server{server("1", "10.0.0.2:17070", raft.Nonvoter)},
+	}, {
+		about:   "priority 0",
+		members: []replicaset.Member{withPriority0},
+		expect:  []raft.Server{server("1", "10.0.0.2:17070", raft.Nonvoter)},
+	}, {
+		about:   "missing machine id",
+		members: []replicaset.Member{member(0, "10.0.0.1:37017", "0"), member(3, "10.0.0.4:37017", "")},
+		err:     "juju machine id for replset member 3 not found",
+	}, {
+		about:   "bad address",
+		members: []replicaset.Member{member(0, "10.0.0.1", "0")},
+		err:     "getting base address for replset member 0: address 10.0.0.1: missing port in address",
+	}} {
+		t.Run(test.about, func(t *testing.T) {
+			config, err := rebootstrap.MakeServers(test.members, test.addresses, 17070)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MakeServers: %v", err)
+			}
+			if !reflect.DeepEqual(config.Servers, test.expect) {
+				t.Errorf("got %v, want %v", config.Servers, test.expect)
+			}
+		})
+	}
+}
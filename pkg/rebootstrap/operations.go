@@ -0,0 +1,62 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstrap
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// OperationsC is the collection in the juju database that
+// RecordOperation writes to. Juju itself never reads it.
+const OperationsC = "rebootstrapRaftOperations"
+
+// Operation records a rebootstrap of a controller's raft store.
+type Operation struct {
+	// MachineID is the controller machine whose store was written.
+	MachineID string `bson:"machine-id"`
+
+	// Time is when the store was written.
+	Time time.Time `bson:"time"`
+
+	// User and Host say who ran the tool and where.
+	User string `bson:"user"`
+	Host string `bson:"host"`
+
+	// ToolVersion is the version of rebootstrap-raft that was run.
+	ToolVersion string `bson:"tool-version"`
+
+	// Servers is the configuration written.
+	Servers []OperationServer `bson:"servers"`
+
+	// StartIndex and StartTerm are where the configuration entry
+	// was written.
+	StartIndex uint64 `bson:"start-index"`
+	StartTerm  uint64 `bson:"start-term"`
+}
+
+// OperationServer is a server in an Operation's configuration.
+type OperationServer struct {
+	ID       string `bson:"id"`
+	Address  string `bson:"address"`
+	Suffrage string `bson:"suffrage"`
+}
+
+// RecordOperation inserts op into the OperationsC collection, so
+// that the controller carries a trace of the change to its raft
+// store. It needs a session that can write to the primary.
+func RecordOperation(ctx context.Context, session *mgo.Session, op Operation) error {
+	err := WithSession(ctx, session, func(s *mgo.Session) error {
+		doc := struct {
+			ID        bson.ObjectId `bson:"_id"`
+			Operation `bson:",inline"`
+		}{bson.NewObjectId(), op}
+		return s.DB(JujuDB).C(OperationsC).Insert(doc)
+	})
+	return errors.Annotatef(err, "recording operation in %s", OperationsC)
+}
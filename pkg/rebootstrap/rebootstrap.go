@@ -0,0 +1,241 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package rebootstrap recreates the raft store of a Juju controller
+// from the controller's replicaset members. It's the core of the
+// rebootstrap-raft tool, for embedding in other recovery tooling.
+package rebootstrap
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/errors"
+	"github.com/juju/loggo"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/yaml.v2"
+)
+
+var logger = loggo.GetLogger("rebootstrap-raft.rebootstrap")
+
+// Options holds what Run needs to rebootstrap a controller's raft
+// store.
+type Options struct {
+	// Session is connected to the controller's MongoDB. It's
+	// needed unless Members is set and SeedLeases isn't.
+	Session *mgo.Session
+
+	// Members provides the servers for the configuration. Nil
+	// means a MongoSource using Session and APIPort.
+	Members MemberSource
+
+	// RaftDir is where the store is written. It mustn't exist.
+	RaftDir string
+
+	// APIPort is the controller API port, used in raft addresses
+	// taken from the replicaset.
+	APIPort int
+
+	// MinVoters and AllowEvenVoters say which voter counts are
+	// acceptable; see ValidateVoters.
+	MinVoters       int
+	AllowEvenVoters bool
+
+	// SeedLeases writes the lease holders recorded in MongoDB into
+	// the store as its initial snapshot.
+	SeedLeases bool
+
+	// LeaseDuration, if non-zero, is how long seeded leases are held
+	// for rather than a minute.
+	LeaseDuration time.Duration
+
+	// Snapshot, if SeedLeases isn't set, is written as the store's
+	// initial snapshot.
+	Snapshot []byte
+
+	// Copy, if set, is written with CopyStore in place of a new
+	// configuration. The servers from Members are still validated.
+	Copy *StoreCopy
+
+	// Store says how to write the store, including the log store
+	// builder. Store.MachineID must be set.
+	Store StoreOptions
+
+	// NoSync skips syncing the store and its parent directory to
+	// disk before and after it's moved into place.
+	NoSync bool
+
+	// Prepare, if set, is called with the staging directory once the
+	// store has been written there and before it's synced, to check
+	// it or change its ownership.
+	Prepare func(stagingDir string) error
+
+	// BeforeMove, if set, is called just before the store is moved
+	// into place. It's where an existing RaftDir is moved aside:
+	// Run doesn't insist that RaftDir doesn't exist when it's set.
+	BeforeMove func() error
+}
+
+// Result describes a rebootstrapped store.
+type Result struct {
+	// Servers is the configuration written.
+	Servers raft.Configuration
+
+	// Leases is how many leases were seeded.
+	Leases int
+}
+
+// PlanServers works out the raft configuration from the replicaset
+// members, with suffrage from Juju's record of each controller's
+// vote where it has one, and checks that it's sensible.
+func PlanServers(ctx context.Context, session *mgo.Session, apiPort, minVoters int, allowEvenVoters bool) (raft.Configuration, error) {
+	members, err := Members(ctx, session)
+	if err != nil {
+		return raft.Configuration{}, errors.Trace(err)
+	}
+	members = DataMembers(members)
+	if err := CheckControllerMembers(ctx, session, members); err != nil {
+		return raft.Configuration{}, errors.Trace(err)
+	}
+	addresses, err := HASpaceAddresses(ctx, session, members)
+	if err != nil {
+		return raft.Configuration{}, errors.Annotate(err, "selecting addresses")
+	}
+	servers, err := MakeServers(members, addresses, apiPort)
+	if err != nil {
+		return raft.Configuration{}, errors.Annotate(err, "constructing raft server configuration")
+	}
+	votes, err := ControllerVotes(ctx, session, members)
+	if err != nil {
+		return raft.Configuration{}, errors.Trace(err)
+	}
+	ApplyControllerVotes(&servers, votes)
+	if err := ValidateUnique(servers); err != nil {
+		return raft.Configuration{}, errors.Trace(err)
+	}
+	if err := ValidateVoters(servers, minVoters, allowEvenVoters); err != nil {
+		return raft.Configuration{}, errors.Trace(err)
+	}
+	return servers, nil
+}
+
+// Run rebootstraps the raft store for a controller machine: it gets
+// the configuration from the member source and writes a new store at
+// opts.RaftDir with the store builder. The store is written to a
+// staging directory, synced to disk and moved into place once
+// complete, so a crash leaves either no store or a whole one. The
+// machine agent must not be running. If ctx is cancelled the run
+// stops and nothing is left behind, unless a store step timed out;
+// see ErrStepTimeout.
+func Run(ctx context.Context, opts Options) (*Result, error) {
+	members := opts.Members
+	if members == nil {
+		members = MongoSource{Session: opts.Session, APIPort: opts.APIPort}
+	}
+	if opts.Session == nil && (opts.Members == nil || opts.SeedLeases) {
+		return nil, errors.NotValidf("missing Session")
+	}
+	if opts.Store.MachineID == "" {
+		return nil, errors.NotValidf("missing Store.MachineID")
+	}
+	if opts.BeforeMove == nil {
+		if _, err := os.Stat(opts.RaftDir); err == nil {
+			return nil, errors.AlreadyExistsf("raft directory %q", opts.RaftDir)
+		} else if !os.IsNotExist(err) {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	servers, err := members.Servers(ctx)
+	if err != nil {
+		return nil, errors.Annotate(err, "getting servers")
+	}
+	if err := ValidateUnique(servers); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := ValidateVoters(servers, opts.MinVoters, opts.AllowEvenVoters); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := ValidateLocal(servers, opts.Store.MachineID); err != nil {
+		return nil, errors.Trace(err)
+	}
+	result := &Result{Servers: servers}
+
+	snapshot := opts.Snapshot
+	if opts.SeedLeases {
+		leases, err := ReadLeaseSnapshot(ctx, opts.Session)
+		if err != nil {
+			return nil, errors.Annotate(err, "getting leases")
+		}
+		result.Leases = len(leases.Entries)
+		if opts.LeaseDuration > 0 {
+			leases.ResetExpiries(opts.LeaseDuration)
+		}
+		if snapshot, err = yaml.Marshal(leases); err != nil {
+			return nil, errors.Annotate(err, "marshalling lease snapshot")
+		}
+	}
+
+	move := os.Rename
+	virtual, isVirtual := opts.Store.builder().(VirtualStoreBuilder)
+	if isVirtual {
+		move = virtual.MoveStore
+	} else if err := os.MkdirAll(filepath.Dir(opts.RaftDir), 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+	// Nothing else can be synced for a store that isn't on disk.
+	syncToDisk := !opts.NoSync && !isVirtual
+	stagingDir := fmt.Sprintf("%s.tmp-%d", opts.RaftDir, os.Getpid())
+	if opts.Copy != nil {
+		err = CopyStore(ctx, stagingDir, *opts.Copy, opts.Store)
+	} else {
+		err = WriteStore(ctx, stagingDir, servers, snapshot, opts.Store)
+	}
+	if errors.Cause(err) == ErrStepTimeout {
+		// The step is still writing there.
+		logger.Warningf("leaving staging directory %q, which a timed out store step may still be writing to", stagingDir)
+		return nil, errors.Trace(err)
+	}
+	if err != nil {
+		os.RemoveAll(stagingDir)
+		return nil, errors.Trace(err)
+	}
+	install := func() error {
+		if opts.Prepare != nil {
+			if err := opts.Prepare(stagingDir); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		if syncToDisk {
+			if err := SyncTree(stagingDir); err != nil {
+				return errors.Annotate(err, "syncing new store")
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return errors.Trace(err)
+		}
+		if opts.BeforeMove != nil {
+			if err := opts.BeforeMove(); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		return errors.Annotate(move(stagingDir, opts.RaftDir), "moving new store into place")
+	}
+	if err := install(); err != nil {
+		os.RemoveAll(stagingDir)
+		return nil, errors.Trace(err)
+	}
+	if syncToDisk {
+		// The rename is only durable once the directory holding
+		// it has been synced.
+		if err := SyncPath(filepath.Dir(opts.RaftDir)); err != nil {
+			return nil, errors.Annotate(err, "syncing raft directory parent")
+		}
+	}
+	logger.Infof("Raft cluster store bootstrapped in %q.", opts.RaftDir)
+	return result, nil
+}
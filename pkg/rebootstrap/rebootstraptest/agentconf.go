@@ -0,0 +1,75 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstraptest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/juju/errors"
+)
+
+const (
+	// ControllerUUID is the controller the agent.conf fixtures
+	// belong to.
+	ControllerUUID = "deadbeef-1bad-500d-9000-4b1d0d06f00d"
+
+	// StatePassword is the MongoDB password in the agent.conf
+	// fixtures.
+	StatePassword = "not-a-real-password"
+)
+
+// agentConfTemplate is a controller machine's agent.conf, trimmed to
+// the fields rebootstrap-raft reads. It takes the machine id (twice)
+// and the agent version.
+const agentConfTemplate = `# format 2.0
+tag: machine-%s
+datadir: /var/lib/juju
+logdir: /var/log/juju
+nonce: user-admin:bootstrap
+jobs:
+- JobManageModel
+- JobHostUnits
+upgradedToVersion: %s
+cacert: |
+  -----BEGIN CERTIFICATE-----
+  not a real certificate
+  -----END CERTIFICATE-----
+controller: controller-` + ControllerUUID + `
+model: model-` + ControllerUUID + `
+apiaddresses:
+- 10.0.0.1:17070
+- 10.0.0.2:17070
+- 10.0.0.3:17070
+apipassword: not-a-real-api-password
+oldpassword: not-a-real-old-password
+statepassword: ` + StatePassword + `
+stateaddresses:
+- localhost:37017
+mongoversion: "4.4"
+values:
+  AGENT_SERVICE_NAME: jujud-machine-%s
+`
+
+// AgentConf returns the agent.conf for a controller machine running
+// the given juju version, such as "2.9.42".
+func AgentConf(machineID, version string) string {
+	return fmt.Sprintf(agentConfTemplate, machineID, version, machineID)
+}
+
+// WriteAgentConf writes AgentConf for the machine under dataDir, where
+// rebootstrap-raft expects to find it, and returns its path.
+func WriteAgentConf(dataDir, machineID, version string) (string, error) {
+	dir := filepath.Join(dataDir, "agents", "machine-"+machineID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", errors.Trace(err)
+	}
+	path := filepath.Join(dir, "agent.conf")
+	if err := ioutil.WriteFile(path, []byte(AgentConf(machineID, version)), 0600); err != nil {
+		return "", errors.Trace(err)
+	}
+	return path, nil
+}
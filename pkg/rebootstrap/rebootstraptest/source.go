@@ -0,0 +1,60 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package rebootstraptest provides fakes for exercising the
+// rebootstrap package without a MongoDB or a real raft directory: a
+// member source, an in-memory store builder and agent.conf fixtures.
+package rebootstraptest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/hashicorp/raft"
+)
+
+// Servers returns a configuration of n voters with machine ids 0 to
+// n-1 and addresses 10.0.0.1:17070 upwards.
+func Servers(n int) raft.Configuration {
+	var config raft.Configuration
+	for i := 0; i < n; i++ {
+		config.Servers = append(config.Servers, raft.Server{
+			ID:       raft.ServerID(fmt.Sprint(i)),
+			Address:  raft.ServerAddress(fmt.Sprintf("10.0.0.%d:17070", i+1)),
+			Suffrage: raft.Voter,
+		})
+	}
+	return config
+}
+
+// FakeSource is a rebootstrap.MemberSource that returns Config, or
+// Err if it's set, and records how often it was asked.
+type FakeSource struct {
+	Config raft.Configuration
+	Err    error
+
+	mu    sync.Mutex
+	calls int
+}
+
+// Servers is part of rebootstrap.MemberSource.
+func (s *FakeSource) Servers(ctx context.Context) (raft.Configuration, error) {
+	s.mu.Lock()
+	s.calls++
+	s.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return raft.Configuration{}, err
+	}
+	if s.Err != nil {
+		return raft.Configuration{}, s.Err
+	}
+	return s.Config, nil
+}
+
+// Calls returns the number of times Servers has been called.
+func (s *FakeSource) Calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
@@ -0,0 +1,115 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstraptest
+
+import (
+	"sync"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/errors"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+// MemStore is a raft store held in memory.
+type MemStore struct {
+	Logs      *raft.InmemStore
+	Snapshots *raft.InmemSnapshotStore
+}
+
+// Configuration returns the last configuration entry in the log.
+func (s *MemStore) Configuration() (raft.Configuration, error) {
+	first, err := s.Logs.FirstIndex()
+	if err != nil {
+		return raft.Configuration{}, errors.Trace(err)
+	}
+	last, err := s.Logs.LastIndex()
+	if err != nil {
+		return raft.Configuration{}, errors.Trace(err)
+	}
+	for index := last; index >= first && index > 0; index-- {
+		var entry raft.Log
+		if err := s.Logs.GetLog(index, &entry); err != nil {
+			return raft.Configuration{}, errors.Annotatef(err, "reading log entry %d", index)
+		}
+		if entry.Type == raft.LogConfiguration {
+			return raft.DecodeConfiguration(entry.Data), nil
+		}
+	}
+	return raft.Configuration{}, errors.NotFoundf("configuration entry")
+}
+
+// MemStoreBuilder is a rebootstrap.VirtualStoreBuilder that keeps
+// stores in memory, keyed by the directory they were written for, so
+// Run can be used without touching the disk. The zero value is ready
+// to use.
+type MemStoreBuilder struct {
+	mu     sync.Mutex
+	stores map[string]*MemStore
+}
+
+var _ rebootstrap.VirtualStoreBuilder = (*MemStoreBuilder)(nil)
+
+// memLogStore adds the Close that rebootstrap.LogStore needs.
+type memLogStore struct {
+	*raft.InmemStore
+}
+
+// Close is part of io.Closer.
+func (memLogStore) Close() error {
+	return nil
+}
+
+func (b *MemStoreBuilder) open(dir string) *MemStore {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stores == nil {
+		b.stores = make(map[string]*MemStore)
+	}
+	store, ok := b.stores[dir]
+	if !ok {
+		store = &MemStore{
+			Logs:      raft.NewInmemStore(),
+			Snapshots: raft.NewInmemSnapshotStore(),
+		}
+		b.stores[dir] = store
+	}
+	return store
+}
+
+// OpenLogStore is part of rebootstrap.StoreBuilder.
+func (b *MemStoreBuilder) OpenLogStore(dir string) (rebootstrap.LogStore, error) {
+	return memLogStore{b.open(dir).Logs}, nil
+}
+
+// OpenSnapshotStore is part of rebootstrap.VirtualStoreBuilder. The
+// in-memory snapshot store only ever keeps the latest snapshot, so
+// retain is ignored.
+func (b *MemStoreBuilder) OpenSnapshotStore(dir string, retain int) (raft.SnapshotStore, error) {
+	return b.open(dir).Snapshots, nil
+}
+
+// MoveStore is part of rebootstrap.VirtualStoreBuilder.
+func (b *MemStoreBuilder) MoveStore(from, to string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	store, ok := b.stores[from]
+	if !ok {
+		return errors.NotFoundf("store %q", from)
+	}
+	if _, ok := b.stores[to]; ok {
+		return errors.AlreadyExistsf("store %q", to)
+	}
+	b.stores[to] = store
+	delete(b.stores, from)
+	return nil
+}
+
+// Store returns the store written for dir, if there is one.
+func (b *MemStoreBuilder) Store(dir string) (*MemStore, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	store, ok := b.stores[dir]
+	return store, ok
+}
@@ -0,0 +1,176 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstrap
+
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// leaseCommandVersion is the version of the lease FSM command format
+// that jujud writes.
+const leaseCommandVersion = 1
+
+// The lease FSM operations.
+const (
+	opClaim   = "claim"
+	opExtend  = "extend"
+	opRevoke  = "revoke"
+	opSetTime = "setTime"
+	opPin     = "pin"
+	opUnpin   = "unpin"
+)
+
+// LeaseCommand mirrors the commands the raft lease FSM in jujud
+// applies from the log.
+type LeaseCommand struct {
+	Version   int           `yaml:"version"`
+	Operation string        `yaml:"operation"`
+	Namespace string        `yaml:"namespace,omitempty"`
+	ModelUUID string        `yaml:"model-uuid,omitempty"`
+	Lease     string        `yaml:"lease,omitempty"`
+	Holder    string        `yaml:"holder,omitempty"`
+	Duration  time.Duration `yaml:"duration,omitempty"`
+	OldTime   time.Time     `yaml:"old-time,omitempty"`
+	NewTime   time.Time     `yaml:"new-time,omitempty"`
+	PinEntity string        `yaml:"pin-entity,omitempty"`
+}
+
+func (c *LeaseCommand) key() LeaseKey {
+	return LeaseKey{Namespace: c.Namespace, ModelUUID: c.ModelUUID, Lease: c.Lease}
+}
+
+// Apply applies a command to the snapshot as jujud's lease FSM does.
+// Commands the FSM would refuse, such as a claim of a lease that's
+// already held, leave the snapshot unchanged, since they're in the
+// log all the same.
+func (s *LeaseSnapshot) Apply(command *LeaseCommand) error {
+	if command.Version != leaseCommandVersion {
+		return errors.NotSupportedf("lease command version %d", command.Version)
+	}
+	key := command.key()
+	switch command.Operation {
+	case opClaim:
+		if _, found := s.Entries[key]; !found {
+			s.Entries[key] = LeaseEntry{
+				Holder:   command.Holder,
+				Start:    s.GlobalTime,
+				Duration: command.Duration,
+			}
+		}
+	case opExtend:
+		entry, found := s.Entries[key]
+		if !found || entry.Holder != command.Holder {
+			break
+		}
+		if s.GlobalTime.Add(command.Duration).After(entry.Expiry()) {
+			entry.Start = s.GlobalTime
+			entry.Duration = command.Duration
+			s.Entries[key] = entry
+		}
+	case opRevoke:
+		if entry, found := s.Entries[key]; found && entry.Holder == command.Holder {
+			delete(s.Entries, key)
+		}
+	case opSetTime:
+		if !s.GlobalTime.Equal(command.OldTime) {
+			break
+		}
+		s.GlobalTime = command.NewTime
+		for key, entry := range s.Entries {
+			if _, pinned := s.Pinned[key]; !pinned && entry.Expiry().Before(s.GlobalTime) {
+				delete(s.Entries, key)
+			}
+		}
+	case opPin:
+		for _, entity := range s.Pinned[key] {
+			if entity == command.PinEntity {
+				return nil
+			}
+		}
+		s.Pinned[key] = append(s.Pinned[key], command.PinEntity)
+	case opUnpin:
+		var entities []string
+		for _, entity := range s.Pinned[key] {
+			if entity != command.PinEntity {
+				entities = append(entities, entity)
+			}
+		}
+		if len(entities) == 0 {
+			delete(s.Pinned, key)
+		} else {
+			s.Pinned[key] = entities
+		}
+	default:
+		return errors.NotSupportedf("lease operation %q", command.Operation)
+	}
+	return nil
+}
+
+// LeaseReplay is the state reached by replaying log entries over a
+// lease snapshot: the leases and the configuration as they stood
+// after the entry at Index.
+type LeaseReplay struct {
+	Leases             *LeaseSnapshot
+	Configuration      raft.Configuration
+	ConfigurationIndex uint64
+	Index              uint64
+	Term               uint64
+
+	// Commands counts the lease commands applied.
+	Commands int
+}
+
+// Replay applies the log entries after r.Index up to and including
+// to, which must all be in logs.
+func (r *LeaseReplay) Replay(logs raft.LogStore, to uint64) error {
+	for index := r.Index + 1; index <= to; index++ {
+		var entry raft.Log
+		if err := logs.GetLog(index, &entry); err != nil {
+			return errors.Annotatef(err, "reading log entry %d", index)
+		}
+		switch entry.Type {
+		case raft.LogCommand:
+			var command LeaseCommand
+			if err := yaml.Unmarshal(entry.Data, &command); err != nil {
+				return errors.Annotatef(err, "decoding log entry %d", index)
+			}
+			if err := r.Leases.Apply(&command); err != nil {
+				return errors.Annotatef(err, "applying log entry %d", index)
+			}
+			r.Commands++
+		case raft.LogConfiguration:
+			r.Configuration = raft.DecodeConfiguration(entry.Data)
+			r.ConfigurationIndex = index
+		case raft.LogAddPeerDeprecated, raft.LogRemovePeerDeprecated:
+			return errors.NotSupportedf("replaying a protocol version 2 configuration (entry %d)", index)
+		}
+		r.Index, r.Term = entry.Index, entry.Term
+	}
+	return nil
+}
+
+// WriteSnapshot writes the replayed leases to store as a snapshot
+// covering the log up to r.Index, returning its id.
+func (r *LeaseReplay) WriteSnapshot(store raft.SnapshotStore) (string, error) {
+	if len(r.Configuration.Servers) == 0 {
+		return "", errors.NotFoundf("configuration in the replayed log")
+	}
+	data, err := yaml.Marshal(r.Leases)
+	if err != nil {
+		return "", errors.Annotate(err, "marshalling lease snapshot")
+	}
+	sink, err := store.Create(raft.SnapshotVersionMax, r.Index, r.Term, r.Configuration, r.ConfigurationIndex, nil)
+	if err != nil {
+		return "", errors.Annotate(err, "creating snapshot")
+	}
+	if _, err := sink.Write(data); err != nil {
+		sink.Cancel()
+		return "", errors.Annotate(err, "writing snapshot")
+	}
+	return sink.ID(), errors.Annotate(sink.Close(), "closing snapshot")
+}
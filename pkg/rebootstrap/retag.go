@@ -0,0 +1,149 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstrap
+
+import (
+	"context"
+	"net"
+	"sort"
+
+	"github.com/juju/errors"
+	"github.com/juju/replicaset"
+	"gopkg.in/mgo.v2"
+)
+
+// ProposeMachineTags works out which controller machine each
+// replicaset member without a MachineIDTag belongs to, by matching
+// the member's host against the addresses Juju has for the controller
+// machines not already tagged on another member. The result maps
+// member id to machine id. Members that match no machine, or more
+// than one, or the same machine as another member, are left out with
+// a warning.
+func ProposeMachineTags(ctx context.Context, session *mgo.Session, members []replicaset.Member) (map[int]string, error) {
+	var tags map[int]string
+	err := WithSession(ctx, session, func(s *mgo.Session) error {
+		var err error
+		tags, err = proposeMachineTags(s, members)
+		return err
+	})
+	return tags, errors.Trace(err)
+}
+
+func proposeMachineTags(session *mgo.Session, members []replicaset.Member) (map[int]string, error) {
+	db := session.DB(JujuDB)
+	info, err := getControllerInfo(db)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	tagged := make(map[string]bool)
+	for _, member := range members {
+		if id, ok := member.Tags[MachineIDTag]; ok {
+			tagged[id] = true
+		}
+	}
+
+	// hostMachines maps each address to the untagged controller
+	// machines that have it.
+	hostMachines := make(map[string][]string)
+	for _, id := range info.MachineIds {
+		if tagged[id] {
+			continue
+		}
+		var machine machineDoc
+		err := db.C(machinesC).FindId(info.ModelUUID + ":" + id).One(&machine)
+		if err == mgo.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, errors.Annotatef(err, "reading addresses for machine %s", id)
+		}
+		seen := make(map[string]bool)
+		for _, addr := range append(machine.Addresses, machine.MachineAddresses...) {
+			if !seen[addr.Value] {
+				seen[addr.Value] = true
+				hostMachines[addr.Value] = append(hostMachines[addr.Value], id)
+			}
+		}
+	}
+
+	result := make(map[int]string)
+	claimed := make(map[string][]int)
+	for _, member := range members {
+		if _, ok := member.Tags[MachineIDTag]; ok {
+			continue
+		}
+		host, _, err := net.SplitHostPort(member.Address)
+		if err != nil {
+			return nil, errors.Annotatef(err, "getting host for replset member %d", member.Id)
+		}
+		candidates := hostMachines[host]
+		switch len(candidates) {
+		case 0:
+			logger.Warningf("member %d (%s): no untagged controller machine has address %s", member.Id, member.Address, host)
+		case 1:
+			result[member.Id] = candidates[0]
+			claimed[candidates[0]] = append(claimed[candidates[0]], member.Id)
+		default:
+			sort.Strings(candidates)
+			logger.Warningf("member %d (%s): machines %v all have address %s", member.Id, member.Address, candidates, host)
+		}
+	}
+	for id, memberIDs := range claimed {
+		if len(memberIDs) > 1 {
+			logger.Warningf("members %v all match machine %s", memberIDs, id)
+			for _, memberID := range memberIDs {
+				delete(result, memberID)
+			}
+		}
+	}
+	return result, nil
+}
+
+// SetMachineTags sets the MachineIDTag of the replicaset members
+// given by member id in tags to the machine ids there, keeping their
+// other tags, and reconfigures the replicaset. It needs a session to
+// the primary. A member id that isn't in the replicaset gives a
+// NotFound error before anything is changed.
+func SetMachineTags(ctx context.Context, session *mgo.Session, tags map[int]string) error {
+	err := WithSession(ctx, session, func(s *mgo.Session) error {
+		members, err := replicaset.CurrentMembers(s)
+		if err != nil {
+			return errors.Annotate(err, "getting replica set members from the primary")
+		}
+		found := 0
+		for i, member := range members {
+			id, ok := tags[member.Id]
+			if !ok {
+				continue
+			}
+			found++
+			newTags := map[string]string{MachineIDTag: id}
+			for key, value := range member.Tags {
+				if key != MachineIDTag {
+					newTags[key] = value
+				}
+			}
+			members[i].Tags = newTags
+		}
+		if found != len(tags) {
+			for memberID := range tags {
+				if !HasMember(members, memberID) {
+					return errors.NotFoundf("replset member %d", memberID)
+				}
+			}
+		}
+		return errors.Annotate(replicaset.Set(s, members), "reconfiguring replica set")
+	})
+	return errors.Trace(err)
+}
+
+// HasMember reports whether members includes the one with the given
+// replicaset member id.
+func HasMember(members []replicaset.Member, id int) bool {
+	for _, member := range members {
+		if member.Id == id {
+			return true
+		}
+	}
+	return false
+}
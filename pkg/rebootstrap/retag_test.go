@@ -0,0 +1,27 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstrap_test
+
+import (
+	"testing"
+
+	"github.com/juju/replicaset"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+func TestHasMember(t *testing.T) {
+	members := []replicaset.Member{{Id: 1}, {Id: 3}}
+	for _, test := range []struct {
+		id     int
+		expect bool
+	}{{1, true}, {3, true}, {2, false}, {0, false}} {
+		if got := rebootstrap.HasMember(members, test.id); got != test.expect {
+			t.Errorf("HasMember(%d) = %t, want %t", test.id, got, test.expect)
+		}
+	}
+	if rebootstrap.HasMember(nil, 0) {
+		t.Errorf("HasMember found a member in an empty list")
+	}
+}
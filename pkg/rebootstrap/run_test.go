@@ -0,0 +1,132 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstrap_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap/rebootstraptest"
+)
+
+func runOptions(t *testing.T, source rebootstrap.MemberSource, builder *rebootstraptest.MemStoreBuilder) rebootstrap.Options {
+	dir, err := ioutil.TempDir("", "rebootstrap-run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return rebootstrap.Options{
+		Members:   source,
+		RaftDir:   filepath.Join(dir, "raft"),
+		MinVoters: 1,
+		Store: rebootstrap.StoreOptions{
+			MachineID: "0",
+			Builder:   builder,
+		},
+	}
+}
+
+func TestRunWritesConfiguration(t *testing.T) {
+	source := &rebootstraptest.FakeSource{Config: rebootstraptest.Servers(3)}
+	builder := &rebootstraptest.MemStoreBuilder{}
+	opts := runOptions(t, source, builder)
+
+	result, err := rebootstrap.Run(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if !reflect.DeepEqual(result.Servers, source.Config) {
+		t.Errorf("Run returned servers %v, want %v", result.Servers, source.Config)
+	}
+	if calls := source.Calls(); calls != 1 {
+		t.Errorf("source asked %d times, want 1", calls)
+	}
+
+	store, ok := builder.Store(opts.RaftDir)
+	if !ok {
+		t.Fatalf("no store moved to %s", opts.RaftDir)
+	}
+	config, err := store.Configuration()
+	if err != nil {
+		t.Fatalf("reading configuration: %v", err)
+	}
+	if !reflect.DeepEqual(config, source.Config) {
+		t.Errorf("store has configuration %v, want %v", config, source.Config)
+	}
+	if _, err := os.Stat(opts.RaftDir); !os.IsNotExist(err) {
+		t.Errorf("in-memory run touched %s: %v", opts.RaftDir, err)
+	}
+}
+
+func TestRunSourceError(t *testing.T) {
+	source := &rebootstraptest.FakeSource{Err: errors.New("no members")}
+	builder := &rebootstraptest.MemStoreBuilder{}
+	opts := runOptions(t, source, builder)
+
+	if _, err := rebootstrap.Run(context.Background(), opts); err == nil {
+		t.Fatal("Run succeeded with a failing source")
+	}
+	if _, ok := builder.Store(opts.RaftDir); ok {
+		t.Errorf("store written to %s despite the source failing", opts.RaftDir)
+	}
+}
+
+func TestRunHooks(t *testing.T) {
+	for _, test := range []struct {
+		about      string
+		prepareErr error
+		moveErr    error
+		written    bool
+	}{
+		{about: "both hooks pass", written: true},
+		{about: "prepare fails", prepareErr: errors.New("bad store")},
+		{about: "before move fails", moveErr: errors.New("agent running")},
+	} {
+		t.Run(test.about, func(t *testing.T) {
+			source := &rebootstraptest.FakeSource{Config: rebootstraptest.Servers(3)}
+			builder := &rebootstraptest.MemStoreBuilder{}
+			opts := runOptions(t, source, builder)
+			var calls []string
+			opts.Prepare = func(stagingDir string) error {
+				if _, ok := builder.Store(stagingDir); !ok {
+					t.Errorf("nothing written to %s before Prepare", stagingDir)
+				}
+				calls = append(calls, "prepare")
+				return test.prepareErr
+			}
+			opts.BeforeMove = func() error {
+				calls = append(calls, "before move")
+				return test.moveErr
+			}
+
+			_, err := rebootstrap.Run(context.Background(), opts)
+			want := []string{"prepare", "before move"}
+			switch {
+			case test.prepareErr != nil:
+				want = want[:1]
+				if err == nil || err.Error() != test.prepareErr.Error() {
+					t.Errorf("got error %v, want %v", err, test.prepareErr)
+				}
+			case test.moveErr != nil:
+				if err == nil || err.Error() != test.moveErr.Error() {
+					t.Errorf("got error %v, want %v", err, test.moveErr)
+				}
+			case err != nil:
+				t.Fatalf("Run: %v", err)
+			}
+			if !reflect.DeepEqual(calls, want) {
+				t.Errorf("called %v, want %v", calls, want)
+			}
+			if _, ok := builder.Store(opts.RaftDir); ok != test.written {
+				t.Errorf("store at %s: %v, want %v", opts.RaftDir, ok, test.written)
+			}
+		})
+	}
+}
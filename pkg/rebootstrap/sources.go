@@ -0,0 +1,143 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstrap
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/yaml.v2"
+)
+
+// MemberSource provides the servers to put in the new configuration.
+// There's deliberately no source reading agent.conf: it lists the
+// controllers' API addresses but not which machine has each, so it
+// can't give server ids. It's only used to cross-check the addresses
+// another source gives.
+type MemberSource interface {
+	// Servers returns the configuration. Run validates it, so a
+	// source needn't.
+	Servers(ctx context.Context) (raft.Configuration, error)
+}
+
+// MongoSource takes the servers from the controller's replicaset
+// members, as PlanServers does.
+type MongoSource struct {
+	Session *mgo.Session
+	APIPort int
+}
+
+// Servers is part of MemberSource.
+func (s MongoSource) Servers(ctx context.Context) (raft.Configuration, error) {
+	// Validation is left to the caller; allowing even voters here
+	// and requiring none means nothing is rejected twice.
+	return PlanServers(ctx, s.Session, s.APIPort, 0, true)
+}
+
+// StaticSource is a configuration that's already known.
+type StaticSource raft.Configuration
+
+// Servers is part of MemberSource.
+func (s StaticSource) Servers(context.Context) (raft.Configuration, error) {
+	return raft.Configuration(s), nil
+}
+
+// FileSource reads the servers from a YAML (or JSON) file with a
+// servers list, each entry having an id, address and suffrage - the
+// form rebootstrap-raft prints them in with --format yaml or json.
+type FileSource struct {
+	Path string
+}
+
+// fileServer is a server as written in a FileSource file.
+type fileServer struct {
+	ID       string `yaml:"id"`
+	Address  string `yaml:"address"`
+	Suffrage string `yaml:"suffrage"`
+}
+
+// Servers is part of MemberSource.
+func (s FileSource) Servers(context.Context) (raft.Configuration, error) {
+	data, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return raft.Configuration{}, errors.Trace(err)
+	}
+	return parseServerList(data, fmt.Sprintf("%q", s.Path))
+}
+
+// SSHSource takes the servers from another controller by running
+// Command there over ssh, such as a dry run of rebootstrap-raft
+// bootstrap with --format yaml. What it prints must be in the form a
+// FileSource file has.
+type SSHSource struct {
+	// Target is the [user@]host to ssh to.
+	Target string
+
+	// Options are extra ssh options, such as -i <key>.
+	Options []string
+
+	// Command is the remote shell command to run.
+	Command string
+}
+
+// Servers is part of MemberSource.
+func (s SSHSource) Servers(ctx context.Context) (raft.Configuration, error) {
+	args := append([]string{"-o", "BatchMode=yes"}, s.Options...)
+	args = append(args, "--", s.Target, s.Command)
+	command := exec.CommandContext(ctx, "ssh", args...)
+	var stderr bytes.Buffer
+	command.Stderr = &stderr
+	out, err := command.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = errors.Errorf("%v: %s", err, msg)
+		}
+		return raft.Configuration{}, errors.Annotatef(err, "running %q on %s", s.Command, s.Target)
+	}
+	return parseServerList(out, s.Target)
+}
+
+// parseServerList parses a servers list in the form FileSource reads
+// from data, which came from origin.
+func parseServerList(data []byte, origin string) (raft.Configuration, error) {
+	var file struct {
+		Servers []fileServer `yaml:"servers"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return raft.Configuration{}, errors.Annotatef(err, "parsing servers from %s", origin)
+	}
+	if len(file.Servers) == 0 {
+		return raft.Configuration{}, errors.NotFoundf("servers from %s", origin)
+	}
+	var config raft.Configuration
+	for _, server := range file.Servers {
+		if server.ID == "" || server.Address == "" {
+			return raft.Configuration{}, errors.NotValidf("server %+v from %s", server, origin)
+		}
+		var suffrage raft.ServerSuffrage
+		switch server.Suffrage {
+		case "", raft.Voter.String():
+			suffrage = raft.Voter
+		case raft.Nonvoter.String():
+			suffrage = raft.Nonvoter
+		case raft.Staging.String():
+			suffrage = raft.Staging
+		default:
+			return raft.Configuration{}, errors.NotValidf("suffrage %q for server %s", server.Suffrage, server.ID)
+		}
+		config.Servers = append(config.Servers, raft.Server{
+			ID:       raft.ServerID(server.ID),
+			Address:  raft.ServerAddress(server.Address),
+			Suffrage: suffrage,
+		})
+	}
+	return config, nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstrap_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/raft"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+func TestFileSource(t *testing.T) {
+	for _, test := range []struct {
+		about   string
+		content string
+		servers []raft.Server
+		err     string
+	}{{
+		about: "voters and a nonvoter",
+		content: `
+servers:
+- {id: "0", address: "10.0.0.1:17070", suffrage: Voter}
+- {id: "1", address: "10.0.0.2:17070"}
+- {id: "2", address: "10.0.0.3:17070", suffrage: Nonvoter}
+`,
+		servers: []raft.Server{
+			{ID: "0", Address: "10.0.0.1:17070", Suffrage: raft.Voter},
+			{ID: "1", Address: "10.0.0.2:17070", Suffrage: raft.Voter},
+			{ID: "2", Address: "10.0.0.3:17070", Suffrage: raft.Nonvoter},
+		},
+	}, {
+		about:   "no servers",
+		content: "servers: []\n",
+		err:     "not found",
+	}, {
+		about:   "missing address",
+		content: "servers:\n- {id: \"0\"}\n",
+		err:     "server {ID:0 Address: Suffrage:} from",
+	}, {
+		about:   "unknown suffrage",
+		content: "servers:\n- {id: \"0\", address: \"10.0.0.1:17070\", suffrage: Observer}\n",
+		err:     "suffrage \"Observer\" for server 0 not valid",
+	}} {
+		t.Run(test.about, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "servers.yaml")
+			if err := ioutil.WriteFile(path, []byte(test.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			config, err := rebootstrap.FileSource{Path: path}.Servers(context.Background())
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want one containing %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Servers: %v", err)
+			}
+			if !reflect.DeepEqual(config.Servers, test.servers) {
+				t.Errorf("got servers %v, want %v", config.Servers, test.servers)
+			}
+		})
+	}
+}
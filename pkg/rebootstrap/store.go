@@ -0,0 +1,681 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstrap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/raft-boltdb/v2"
+	"github.com/hashicorp/raft-wal"
+	"github.com/juju/errors"
+	"github.com/juju/loggo"
+	"go.etcd.io/bbolt"
+	"gopkg.in/yaml.v2"
+)
+
+// KeyCurrentTerm is the stable store key raft uses to record the
+// current term.
+var KeyCurrentTerm = []byte("CurrentTerm")
+
+// StoreOptions says how to write a raft store.
+type StoreOptions struct {
+	// MachineID is the id of the controller machine the store is
+	// for.
+	MachineID string
+
+	// IDScheme is how server ids are written: IDSchemeMachineID
+	// (the default) or IDSchemeTag. The servers passed to
+	// WriteStore are converted to it.
+	IDScheme string
+
+	// ProtocolVersion is the raft protocol version to write the
+	// configuration with.
+	ProtocolVersion raft.ProtocolVersion
+
+	// Builder opens the log store. Nil means a bolt store with the
+	// default options.
+	Builder StoreBuilder
+
+	// SnapshotRetain is how many snapshots the snapshot store keeps.
+	SnapshotRetain int
+
+	// StartIndex and StartTerm are where the configuration entry is
+	// written. Zero means 1.
+	StartIndex uint64
+	StartTerm  uint64
+
+	// Entries are log entries carried over from an old store,
+	// written before the configuration entry. They must be
+	// contiguous and end just before the start index, and unless
+	// they begin at index 1 there must be a snapshot covering what
+	// comes before them.
+	Entries []*raft.Log
+
+	// SnapshotIndex and SnapshotTerm are the index and term the
+	// initial snapshot covers. Zero means the start index and term.
+	SnapshotIndex uint64
+	SnapshotTerm  uint64
+
+	// StepTimeout limits how long each step of writing the store
+	// (opening the log and snapshot stores, bootstrapping and
+	// writing the snapshot) may take, so that a dying disk or hung
+	// mount gives an error rather than hanging. Zero means no
+	// limit.
+	StepTimeout time.Duration
+}
+
+func (o StoreOptions) builder() StoreBuilder {
+	if o.Builder == nil {
+		return BoltStoreBuilder{}
+	}
+	return o.Builder
+}
+
+func (o StoreOptions) startIndex() uint64 {
+	if o.StartIndex == 0 {
+		return 1
+	}
+	return o.StartIndex
+}
+
+func (o StoreOptions) startTerm() uint64 {
+	if o.StartTerm == 0 {
+		return 1
+	}
+	return o.StartTerm
+}
+
+func (o StoreOptions) snapshotPosition() (uint64, uint64) {
+	if o.SnapshotIndex == 0 {
+		return o.startIndex(), o.startTerm()
+	}
+	return o.SnapshotIndex, o.SnapshotTerm
+}
+
+// checkEntries makes sure the carried over entries fit before the
+// configuration entry.
+func (o StoreOptions) checkEntries(haveSnapshot bool) error {
+	if len(o.Entries) == 0 {
+		return nil
+	}
+	for i, entry := range o.Entries[1:] {
+		if entry.Index != o.Entries[i].Index+1 {
+			return errors.Errorf("entries aren't contiguous: %d follows %d", entry.Index, o.Entries[i].Index)
+		}
+	}
+	if last := o.Entries[len(o.Entries)-1]; last.Index+1 != o.startIndex() {
+		return errors.Errorf("entries end at %d, not just before start index %d", last.Index, o.startIndex())
+	}
+	if first := o.Entries[0].Index; first > 1 {
+		if !haveSnapshot {
+			return errors.Errorf("entries from index %d need a snapshot covering those before", first)
+		}
+		if index, _ := o.snapshotPosition(); index+1 < first {
+			return errors.Errorf("snapshot at index %d leaves a gap before entries from %d", index, first)
+		}
+	}
+	return nil
+}
+
+// ErrStepTimeout is the cause of the error WriteStore and CopyStore
+// return when a step takes longer than StoreOptions.StepTimeout. The
+// step is still running, and may hold the store's lock and go on
+// writing to it, so a caller getting this should exit rather than
+// touch the directory again.
+var ErrStepTimeout = errors.New("timed out")
+
+// runStep runs f, giving up with ErrStepTimeout if it takes longer
+// than timeout (when that's non-zero). Blocked I/O can't be
+// interrupted, so f is left to finish in the background; what it
+// produces after the timeout is discarded.
+func runStep(timeout time.Duration, name string, f func() error) error {
+	if timeout <= 0 {
+		return f()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return errors.Annotatef(ErrStepTimeout, "%s after %v - is the disk or mount under the raft directory healthy?", name, timeout)
+	}
+}
+
+// closeStore closes logStore once the caller's steps are over. After
+// a timeout the step that was abandoned may still be using it, and
+// closing would wait for that, so logStore is left open instead.
+func closeStore(logStore LogStore, err *error) {
+	if errors.Cause(*err) == ErrStepTimeout {
+		return
+	}
+	logStore.Close()
+}
+
+// WriteStore creates the log and snapshot stores in dir and
+// bootstraps the cluster configuration into them. If snapshot is
+// non-nil it's written as the initial snapshot. Cancelling ctx stops
+// it between steps, leaving dir for the caller to remove.
+func WriteStore(ctx context.Context, dir string, servers raft.Configuration, snapshot []byte, opts StoreOptions) (err error) {
+	_, transport := raft.NewInmemTransport(raft.ServerAddress("notused"))
+	defer transport.Close()
+
+	logStore, snapshotStore, err := openStores(dir, opts)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer closeStore(logStore, &err)
+
+	servers = ApplyIDScheme(servers, opts.IDScheme)
+	config, err := makeRaftConfig(string(ServerID(opts.MachineID, opts.IDScheme)), opts.ProtocolVersion)
+	if err != nil {
+		return errors.Annotate(err, "making raft config")
+	}
+	if err := ctx.Err(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := opts.checkEntries(snapshot != nil); err != nil {
+		return errors.Trace(err)
+	}
+
+	index, term := opts.startIndex(), opts.startTerm()
+	err = runStep(opts.StepTimeout, "bootstrapping", func() error {
+		if index == 1 && term == 1 {
+			return raft.BootstrapCluster(config, logStore, logStore, snapshotStore, transport, servers)
+		}
+		return bootstrapAt(logStore, logStore, snapshotStore, servers, opts.Entries, index, term)
+	})
+	if err != nil {
+		return errors.Annotate(err, "bootstrapping raft cluster")
+	}
+	if snapshot == nil && index > 1 && len(opts.Entries) == 0 {
+		// Peers that are behind need a snapshot to catch up to
+		// the first log entry.
+		snapshot, err = yaml.Marshal(EmptyLeaseSnapshot())
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return errors.Trace(err)
+	}
+	if snapshot != nil {
+		snapshotIndex, snapshotTerm := opts.snapshotPosition()
+		err := runStep(opts.StepTimeout, "writing snapshot", func() error {
+			return writeSnapshot(snapshot, snapshotStore, servers, snapshotIndex, snapshotTerm, transport)
+		})
+		if err != nil {
+			return errors.Annotate(err, "writing initial snapshot")
+		}
+	}
+	return nil
+}
+
+// openStores opens the log and snapshot stores in dir, each within
+// opts.StepTimeout.
+func openStores(dir string, opts StoreOptions) (LogStore, raft.SnapshotStore, error) {
+	// The stores are passed back over a channel so that one opened
+	// after a timeout is closed rather than used.
+	logStores := make(chan LogStore, 1)
+	err := runStep(opts.StepTimeout, "making log store", func() error {
+		logStore, err := opts.builder().OpenLogStore(dir)
+		if err != nil {
+			return errors.Annotate(err, "making log store")
+		}
+		logStores <- logStore
+		return nil
+	})
+	if err != nil {
+		go closeLate(logStores)
+		return nil, nil, errors.Trace(err)
+	}
+	logStore := <-logStores
+
+	snapshotStores := make(chan raft.SnapshotStore, 1)
+	err = runStep(opts.StepTimeout, "making snapshot store", func() error {
+		var store raft.SnapshotStore
+		var err error
+		if virtual, ok := opts.builder().(VirtualStoreBuilder); ok {
+			store, err = virtual.OpenSnapshotStore(dir, opts.SnapshotRetain)
+		} else {
+			store, err = NewSnapshotStore(dir, opts.SnapshotRetain)
+		}
+		if err != nil {
+			return errors.Annotate(err, "making snapshot store")
+		}
+		snapshotStores <- store
+		return nil
+	})
+	if err != nil {
+		logStore.Close()
+		return nil, nil, errors.Trace(err)
+	}
+	return logStore, <-snapshotStores, nil
+}
+
+// StoreCopy is what CopyStore writes: another controller's log
+// entries, current term and newest snapshot.
+type StoreCopy struct {
+	// Entries are the log entries, which must be contiguous.
+	// Unless they begin at index 1 the snapshot must cover what
+	// comes before them.
+	Entries []*raft.Log
+
+	// CurrentTerm is the source's current term.
+	CurrentTerm uint64
+
+	// Snapshot is the state of the newest snapshot and SnapshotMeta
+	// its metadata, or nil if there isn't one.
+	Snapshot     []byte
+	SnapshotMeta *raft.SnapshotMeta
+}
+
+// LastIndex returns the index of the last entry copied, or of the
+// snapshot if there are no entries after it.
+func (c StoreCopy) LastIndex() uint64 {
+	if len(c.Entries) > 0 {
+		return c.Entries[len(c.Entries)-1].Index
+	}
+	if c.SnapshotMeta != nil {
+		return c.SnapshotMeta.Index
+	}
+	return 0
+}
+
+// check makes sure the copy is a store raft could have written.
+func (c StoreCopy) check() error {
+	if len(c.Entries) == 0 && c.SnapshotMeta == nil {
+		return errors.NotValidf("copy with no log entries or snapshot")
+	}
+	for i, entry := range c.Entries {
+		if i > 0 && entry.Index != c.Entries[i-1].Index+1 {
+			return errors.Errorf("entries aren't contiguous: %d follows %d", entry.Index, c.Entries[i-1].Index)
+		}
+		if entry.Term > c.CurrentTerm {
+			return errors.Errorf("entry %d has term %d, after the current term %d", entry.Index, entry.Term, c.CurrentTerm)
+		}
+	}
+	if c.SnapshotMeta != nil && c.SnapshotMeta.Term > c.CurrentTerm {
+		return errors.Errorf("snapshot has term %d, after the current term %d", c.SnapshotMeta.Term, c.CurrentTerm)
+	}
+	if len(c.Entries) > 0 && c.Entries[0].Index > 1 {
+		if c.SnapshotMeta == nil {
+			return errors.Errorf("entries from index %d need a snapshot covering those before", c.Entries[0].Index)
+		}
+		if c.SnapshotMeta.Index+1 < c.Entries[0].Index {
+			return errors.Errorf("snapshot at index %d leaves a gap before entries from %d", c.SnapshotMeta.Index, c.Entries[0].Index)
+		}
+	}
+	return nil
+}
+
+// CopyStore creates the log and snapshot stores in dir holding src
+// exactly as it is. Unlike WriteStore nothing is added: a store that
+// went on from the source's last index or term could win an election
+// over peers that have committed more, so a controller rejoining a
+// healthy cluster has to take the log as its peers have it. The local
+// server id isn't recorded in the log or snapshots, so nothing needs
+// re-homing. Only opts' Builder, SnapshotRetain and StepTimeout are
+// used.
+func CopyStore(ctx context.Context, dir string, src StoreCopy, opts StoreOptions) (err error) {
+	if err := src.check(); err != nil {
+		return errors.Trace(err)
+	}
+	_, transport := raft.NewInmemTransport(raft.ServerAddress("notused"))
+	defer transport.Close()
+
+	logStore, snapshotStore, err := openStores(dir, opts)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer closeStore(logStore, &err)
+	if err := ctx.Err(); err != nil {
+		return errors.Trace(err)
+	}
+
+	err = runStep(opts.StepTimeout, "copying log", func() error {
+		if err := logStore.SetUint64(KeyCurrentTerm, src.CurrentTerm); err != nil {
+			return errors.Annotate(err, "saving current term")
+		}
+		if len(src.Entries) == 0 {
+			return nil
+		}
+		return errors.Annotate(logStore.StoreLogs(src.Entries), "copying log entries")
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if src.SnapshotMeta == nil {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return errors.Trace(err)
+	}
+	err = runStep(opts.StepTimeout, "copying snapshot", func() error {
+		return storeSnapshot(src.Snapshot, snapshotStore, *src.SnapshotMeta, transport)
+	})
+	return errors.Annotate(err, "copying snapshot")
+}
+
+// closeLate closes a log store that was opened after its step timed
+// out, if it ever is.
+func closeLate(logStores <-chan LogStore) {
+	logStore := <-logStores
+	logStore.Close()
+}
+
+// LogStore is the combined log and stable store that raft uses to
+// keep its log entries and current term.
+type LogStore interface {
+	raft.LogStore
+	raft.StableStore
+	io.Closer
+}
+
+// StoreBuilder opens the log store a raft store is written with.
+type StoreBuilder interface {
+	// OpenLogStore opens (creating if needed) the log store in
+	// the raft directory dir.
+	OpenLogStore(dir string) (LogStore, error)
+}
+
+// VirtualStoreBuilder is implemented by store builders that keep the
+// whole store somewhere other than the raft directory, such as the
+// in-memory one in rebootstraptest. WriteStore takes the snapshot
+// store from it too, and Run moves the finished store with MoveStore
+// rather than renaming directories.
+type VirtualStoreBuilder interface {
+	StoreBuilder
+
+	// OpenSnapshotStore opens the snapshot store for dir.
+	OpenSnapshotStore(dir string, retain int) (raft.SnapshotStore, error)
+
+	// MoveStore moves the store written to from so that it's at to.
+	MoveStore(from, to string) error
+}
+
+// BoltStoreBuilder builds bolt log stores, as jujud uses.
+type BoltStoreBuilder struct {
+	// Options are used to open the bolt file. Nil means the
+	// defaults.
+	Options *bbolt.Options
+}
+
+// OpenLogStore is part of StoreBuilder.
+func (b BoltStoreBuilder) OpenLogStore(dir string) (LogStore, error) {
+	return NewLogStore(dir, b.Options)
+}
+
+// WALStoreBuilder builds raft-wal log stores.
+type WALStoreBuilder struct{}
+
+// OpenLogStore is part of StoreBuilder.
+func (WALStoreBuilder) OpenLogStore(dir string) (LogStore, error) {
+	return NewWALStore(dir)
+}
+
+// NewLogStore opens a boltDB logstore in the specified directory. If
+// the directory doesn't already exist it'll be created. The bolt
+// options may be nil to use the defaults.
+func NewLogStore(dir string, options *bbolt.Options) (*raftboltdb.BoltStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Trace(err)
+	}
+	logs, err := raftboltdb.New(raftboltdb.Options{
+		Path:        filepath.Join(dir, "logs"),
+		BoltOptions: options,
+	})
+	if err != nil {
+		return nil, errors.Annotate(err, "failed to create bolt store for raft logs")
+	}
+	return logs, nil
+}
+
+// NewWALStore opens a raft-wal logstore in the wal subdirectory of
+// the specified directory, creating it if needed.
+func NewWALStore(dir string) (*wal.WAL, error) {
+	walDir := filepath.Join(dir, "wal")
+	if err := os.MkdirAll(walDir, 0700); err != nil {
+		return nil, errors.Trace(err)
+	}
+	logs, err := wal.Open(walDir, wal.WithLogger(newHCLogger("wal")))
+	if err != nil {
+		return nil, errors.Annotate(err, "failed to create wal store for raft logs")
+	}
+	return logs, nil
+}
+
+// NewSnapshotStore opens a file-based snapshot store in the specified
+// directory. If the directory doesn't exist it'll be created.
+func NewSnapshotStore(
+	dir string,
+	retain int,
+) (raft.SnapshotStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Trace(err)
+	}
+	snaps, err := raft.NewFileSnapshotStoreWithLogger(dir, retain, newHCLogger("snapshot"))
+	if err != nil {
+		return nil, errors.Annotate(err, "failed to create file snapshot store")
+	}
+	return snaps, nil
+}
+
+func makeRaftConfig(machineID string, protocolVersion raft.ProtocolVersion) (*raft.Config, error) {
+	raftConfig := raft.DefaultConfig()
+	raftConfig.LocalID = raft.ServerID(machineID)
+	raftConfig.ProtocolVersion = protocolVersion
+	if protocolVersion < 3 {
+		// Older protocol versions store the configuration as a
+		// list of peer addresses, so server IDs and suffrage
+		// aren't recorded.
+		logger.Warningf("raft protocol version %d doesn't record server IDs or suffrage", protocolVersion)
+	}
+	// Having ShutdownOnRemove true means that the raft node also
+	// stops when it's demoted if it's the leader.
+	raftConfig.ShutdownOnRemove = false
+
+	raftConfig.Logger = newHCLogger("raft")
+
+	if err := raft.ValidateConfig(raftConfig); err != nil {
+		return nil, errors.Annotate(err, "validating raft config")
+	}
+	return raftConfig, nil
+}
+
+// bootstrapAt does the same job as raft.BootstrapCluster, but writes
+// the configuration entry at the given index and term rather than
+// always using 1, after any entries carried over from an old store.
+// This lets a rebootstrapped node supersede peers that still hold
+// state from the old cluster.
+func bootstrapAt(
+	logs raft.LogStore,
+	stable raft.StableStore,
+	snaps raft.SnapshotStore,
+	configuration raft.Configuration,
+	entries []*raft.Log,
+	index, term uint64,
+) error {
+	hasState, err := raft.HasExistingState(logs, stable, snaps)
+	if err != nil {
+		return errors.Annotate(err, "checking for existing state")
+	}
+	if hasState {
+		return raft.ErrCantBootstrap
+	}
+	if err := stable.SetUint64(KeyCurrentTerm, term); err != nil {
+		return errors.Annotate(err, "saving current term")
+	}
+	if len(entries) > 0 {
+		if err := logs.StoreLogs(entries); err != nil {
+			return errors.Annotate(err, "appending retained entries to log")
+		}
+	}
+	entry := &raft.Log{
+		Index: index,
+		Term:  term,
+		Type:  raft.LogConfiguration,
+		Data:  raft.EncodeConfiguration(configuration),
+	}
+	if err := logs.StoreLog(entry); err != nil {
+		return errors.Annotate(err, "appending configuration entry to log")
+	}
+	return nil
+}
+
+// writeSnapshot stores data as a snapshot in the snapshot store. The
+// snapshot covers the log up to index and term (normally the
+// bootstrap configuration entry) and records the new configuration,
+// so it's consistent with the bootstrapped log regardless of where
+// the data came from.
+func writeSnapshot(
+	data []byte,
+	store raft.SnapshotStore,
+	servers raft.Configuration,
+	index, term uint64,
+	transport raft.Transport,
+) error {
+	meta := raft.SnapshotMeta{
+		Version:            raft.SnapshotVersionMax,
+		Index:              index,
+		Term:               term,
+		Configuration:      servers,
+		ConfigurationIndex: index,
+	}
+	return errors.Trace(storeSnapshot(data, store, meta, transport))
+}
+
+// storeSnapshot stores data as a snapshot with the given metadata.
+func storeSnapshot(data []byte, store raft.SnapshotStore, meta raft.SnapshotMeta, transport raft.Transport) error {
+	sink, err := store.Create(meta.Version, meta.Index, meta.Term, meta.Configuration, meta.ConfigurationIndex, transport)
+	if err != nil {
+		return errors.Annotate(err, "creating snapshot")
+	}
+	if _, err := sink.Write(data); err != nil {
+		sink.Cancel()
+		return errors.Annotate(err, "writing snapshot")
+	}
+	return errors.Annotate(sink.Close(), "closing snapshot")
+}
+
+// hclogWriter is the io.Writer raft's hclog loggers write to. They
+// write JSON, so each line is unpacked and logged through loggo at
+// its own level, in a module under raftLogger named for the hclog
+// logger, with the fields after the message as key=value pairs. That
+// way raft's output is formatted like the rest and goes wherever the
+// rest goes. Until SetRaftLogLevel is called, anything below a
+// warning is logged at debug level.
+type hclogWriter struct{}
+
+// hclogLevelNames maps the levels hclog writes in JSON to loggo's.
+var hclogLevelNames = map[string]loggo.Level{
+	"trace": loggo.TRACE,
+	"debug": loggo.DEBUG,
+	"info":  loggo.INFO,
+	"warn":  loggo.WARNING,
+	"error": loggo.ERROR,
+}
+
+// Write is part of the io.Writer interface.
+func (hclogWriter) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(bytes.TrimSpace(p), []byte("\n")) {
+		if len(line) > 0 {
+			logHCLogLine(line)
+		}
+	}
+	return len(p), nil
+}
+
+func logHCLogLine(line []byte) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(line, &fields); err != nil {
+		raftLogger.Debugf("%s", line)
+		return
+	}
+	levelName, _ := fields["@level"].(string)
+	message, _ := fields["@message"].(string)
+	module, _ := fields["@module"].(string)
+	level, ok := hclogLevelNames[levelName]
+	if !ok {
+		level = loggo.INFO
+	}
+	if raftLogLevel == loggo.UNSPECIFIED && level < loggo.WARNING {
+		level = loggo.DEBUG
+	}
+	var keys []string
+	for key := range fields {
+		if !strings.HasPrefix(key, "@") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		message += fmt.Sprintf(" %s=%v", key, fields[key])
+	}
+	// raft's own logger is just "raft"; the stores' get their own
+	// modules under it.
+	target := raftLogger
+	if module != "" && module != "raft" {
+		target = loggo.GetLogger(raftLogger.Name() + "." + module)
+	}
+	target.Logf(level, "%s", message)
+}
+
+// raftLogger receives the output of raft's hclog loggers. Unless
+// SetRaftLogLevel is called its warnings and errors are shown along
+// with the rest of the package's logging, and the rest only at debug
+// level.
+var raftLogger = loggo.GetLogger("rebootstrap-raft.rebootstrap.raft")
+
+// raftLogLevel is the level set with SetRaftLogLevel.
+var raftLogLevel = loggo.UNSPECIFIED
+
+// SetRaftLogLevel sets how much of hashicorp raft's and the stores'
+// logging is shown, independently of the level of the rest of the
+// logging. It affects loggers made after it's called.
+func SetRaftLogLevel(level loggo.Level) {
+	raftLogLevel = level
+	raftLogger.SetLogLevel(level)
+}
+
+// hclogLevels maps loggo levels to hclog's.
+var hclogLevels = map[loggo.Level]hclog.Level{
+	loggo.TRACE:    hclog.Trace,
+	loggo.DEBUG:    hclog.Debug,
+	loggo.INFO:     hclog.Info,
+	loggo.WARNING:  hclog.Warn,
+	loggo.ERROR:    hclog.Error,
+	loggo.CRITICAL: hclog.Error,
+}
+
+// newHCLogger returns an hclog.Logger with the given name that
+// writes to our loggo loggers through hclogWriter. hclog drops what's
+// below the raft log level if one has been set, or below debug.
+func newHCLogger(name string) hclog.Logger {
+	level := hclog.Debug
+	if raftLogLevel != loggo.UNSPECIFIED {
+		level = hclogLevels[raftLogLevel]
+	}
+	return hclog.New(&hclog.LoggerOptions{
+		Name:        name,
+		Output:      hclogWriter{},
+		Level:       level,
+		JSONFormat:  true,
+		DisableTime: true,
+	})
+}
@@ -0,0 +1,210 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstrap_test
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/errors"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap/rebootstraptest"
+)
+
+func logEntries(term uint64, indexes ...uint64) []*raft.Log {
+	entries := make([]*raft.Log, len(indexes))
+	for i, index := range indexes {
+		entries[i] = &raft.Log{Index: index, Term: term, Type: raft.LogCommand, Data: []byte{byte(index)}}
+	}
+	return entries
+}
+
+func TestCopyStore(t *testing.T) {
+	servers := rebootstraptest.Servers(3)
+	snapshotAt := func(index, term uint64) *raft.SnapshotMeta {
+		return &raft.SnapshotMeta{
+			Version:            raft.SnapshotVersionMax,
+			Index:              index,
+			Term:               term,
+			Configuration:      servers,
+			ConfigurationIndex: 1,
+		}
+	}
+	for _, test := range []struct {
+		about string
+		src   rebootstrap.StoreCopy
+		err   string
+	}{{
+		about: "log from the start",
+		src:   rebootstrap.StoreCopy{Entries: logEntries(2, 1, 2, 3), CurrentTerm: 3},
+	}, {
+		about: "snapshot and the entries after it",
+		src: rebootstrap.StoreCopy{
+			Entries:      logEntries(4, 11, 12),
+			CurrentTerm:  4,
+			Snapshot:     []byte("state"),
+			SnapshotMeta: snapshotAt(10, 4),
+		},
+	}, {
+		about: "snapshot overlapping the log",
+		src: rebootstrap.StoreCopy{
+			Entries:      logEntries(4, 8, 9, 10, 11),
+			CurrentTerm:  5,
+			Snapshot:     []byte("state"),
+			SnapshotMeta: snapshotAt(10, 4),
+		},
+	}, {
+		about: "snapshot only",
+		src: rebootstrap.StoreCopy{
+			CurrentTerm:  4,
+			Snapshot:     []byte("state"),
+			SnapshotMeta: snapshotAt(10, 4),
+		},
+	}, {
+		about: "nothing to copy",
+		src:   rebootstrap.StoreCopy{CurrentTerm: 1},
+		err:   "copy with no log entries or snapshot not valid",
+	}, {
+		about: "gap in the log",
+		src:   rebootstrap.StoreCopy{Entries: append(logEntries(1, 1, 2), logEntries(1, 4)...), CurrentTerm: 1},
+		err:   "entries aren't contiguous: 4 follows 2",
+	}, {
+		about: "entry after the current term",
+		src:   rebootstrap.StoreCopy{Entries: logEntries(3, 1), CurrentTerm: 2},
+		err:   "entry 1 has term 3, after the current term 2",
+	}, {
+		about: "log starting later without a snapshot",
+		src:   rebootstrap.StoreCopy{Entries: logEntries(1, 5, 6), CurrentTerm: 1},
+		err:   "entries from index 5 need a snapshot covering those before",
+	}, {
+		about: "gap after the snapshot",
+		src: rebootstrap.StoreCopy{
+			Entries:      logEntries(4, 12),
+			CurrentTerm:  4,
+			Snapshot:     []byte("state"),
+			SnapshotMeta: snapshotAt(10, 4),
+		},
+		err: "snapshot at index 10 leaves a gap before entries from 12",
+	}} {
+		t.Run(test.about, func(t *testing.T) {
+			builder := &rebootstraptest.MemStoreBuilder{}
+			err := rebootstrap.CopyStore(context.Background(), "raft", test.src, rebootstrap.StoreOptions{Builder: builder})
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CopyStore: %v", err)
+			}
+			store, ok := builder.Store("raft")
+			if !ok {
+				t.Fatal("no store written")
+			}
+			term, err := store.Logs.GetUint64(rebootstrap.KeyCurrentTerm)
+			if err != nil || term != test.src.CurrentTerm {
+				t.Errorf("current term %d (%v), want %d", term, err, test.src.CurrentTerm)
+			}
+			var wantLast uint64
+			if len(test.src.Entries) > 0 {
+				wantLast = test.src.LastIndex()
+			}
+			last, err := store.Logs.LastIndex()
+			if err != nil || last != wantLast {
+				t.Errorf("last index %d (%v), want %d", last, err, wantLast)
+			}
+			for _, expected := range test.src.Entries {
+				var entry raft.Log
+				if err := store.Logs.GetLog(expected.Index, &entry); err != nil {
+					t.Fatalf("reading entry %d: %v", expected.Index, err)
+				}
+				if entry.Term != expected.Term || entry.Type != expected.Type || !reflect.DeepEqual(entry.Data, expected.Data) {
+					t.Errorf("entry %d is %+v, want %+v", expected.Index, entry, *expected)
+				}
+			}
+			snapshots, err := store.Snapshots.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.src.SnapshotMeta == nil {
+				if len(snapshots) != 0 {
+					t.Errorf("got %d snapshots, want none", len(snapshots))
+				}
+				return
+			}
+			if len(snapshots) != 1 {
+				t.Fatalf("got %d snapshots, want 1", len(snapshots))
+			}
+			meta, reader, err := store.Snapshots.Open(snapshots[0].ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			data, err := ioutil.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := test.src.SnapshotMeta
+			if meta.Index != want.Index || meta.Term != want.Term || meta.ConfigurationIndex != want.ConfigurationIndex ||
+				!reflect.DeepEqual(meta.Configuration, want.Configuration) {
+				t.Errorf("snapshot meta %+v, want %+v", *meta, *want)
+			}
+			if string(data) != string(test.src.Snapshot) {
+				t.Errorf("snapshot state %q, want %q", data, test.src.Snapshot)
+			}
+		})
+	}
+}
+
+// stuckBuilder gives out log stores whose writes block until release
+// is closed, like one on a hung mount.
+type stuckBuilder struct {
+	rebootstraptest.MemStoreBuilder
+	release chan struct{}
+	closed  chan struct{}
+}
+
+func (b *stuckBuilder) OpenLogStore(dir string) (rebootstrap.LogStore, error) {
+	store, err := b.MemStoreBuilder.OpenLogStore(dir)
+	return stuckStore{store, b}, err
+}
+
+type stuckStore struct {
+	rebootstrap.LogStore
+	builder *stuckBuilder
+}
+
+func (s stuckStore) StoreLogs(logs []*raft.Log) error {
+	<-s.builder.release
+	return s.LogStore.StoreLogs(logs)
+}
+
+func (s stuckStore) Close() error {
+	close(s.builder.closed)
+	return s.LogStore.Close()
+}
+
+func TestCopyStoreTimeout(t *testing.T) {
+	builder := &stuckBuilder{release: make(chan struct{}), closed: make(chan struct{})}
+	src := rebootstrap.StoreCopy{Entries: logEntries(1, 1, 2), CurrentTerm: 1}
+	opts := rebootstrap.StoreOptions{Builder: builder, StepTimeout: 10 * time.Millisecond}
+	err := rebootstrap.CopyStore(context.Background(), "raft", src, opts)
+	if errors.Cause(err) != rebootstrap.ErrStepTimeout {
+		t.Fatalf("got error %v, want a timeout", err)
+	}
+	// The step is still running, so the store mustn't have been
+	// closed under it.
+	close(builder.release)
+	select {
+	case <-builder.closed:
+		t.Fatal("store closed after the timeout")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
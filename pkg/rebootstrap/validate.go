@@ -0,0 +1,83 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstrap
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/errors"
+)
+
+// ValidateVoters checks that the configuration has at least minVoters
+// voters and, unless allowEven is set, that the number of voters is
+// odd. A raft cluster with an even number of voters can't tolerate
+// any more failures than one with a voter fewer, and a 2-voter
+// cluster loses quorum as soon as either node goes away.
+func ValidateVoters(config raft.Configuration, minVoters int, allowEven bool) error {
+	var voters []raft.ServerID
+	for _, server := range config.Servers {
+		if server.Suffrage == raft.Voter {
+			voters = append(voters, server.ID)
+		}
+	}
+	if len(voters) < minVoters {
+		return errors.Errorf("configuration has %d voter(s) %v, need at least %d (see --min-voters)",
+			len(voters), voters, minVoters)
+	}
+	if len(voters)%2 == 0 && !allowEven {
+		return errors.Errorf("configuration has an even number of voters %v - pass --allow-even-voters to bootstrap anyway",
+			voters)
+	}
+	return nil
+}
+
+// ValidateUnique checks that no two servers in the configuration share
+// an ID or an address. This can happen when replicaset members sit
+// behind the same NAT address, or when the juju-machine-id tags have
+// been copied between members by hand.
+func ValidateUnique(config raft.Configuration) error {
+	ids := make(map[raft.ServerID][]raft.ServerAddress)
+	addresses := make(map[raft.ServerAddress][]raft.ServerID)
+	for _, server := range config.Servers {
+		ids[server.ID] = append(ids[server.ID], server.Address)
+		addresses[server.Address] = append(addresses[server.Address], server.ID)
+	}
+	var problems []string
+	for _, server := range config.Servers {
+		if found := ids[server.ID]; len(found) > 1 {
+			problems = append(problems, fmt.Sprintf("machine %s is used by members with addresses %v", server.ID, found))
+			delete(ids, server.ID)
+		}
+		if found := addresses[server.Address]; len(found) > 1 {
+			problems = append(problems, fmt.Sprintf("address %s is used by machines %v", server.Address, found))
+			delete(addresses, server.Address)
+		}
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("duplicate servers in configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// ValidateLocal checks that the machine the store is being written
+// for is one of the voters in the configuration. A raft node whose
+// own ID isn't in its configuration never starts, and a lone
+// nonvoter can't elect a leader, so either way the machine agent
+// would be stuck.
+func ValidateLocal(config raft.Configuration, machineID string) error {
+	for _, server := range config.Servers {
+		if string(server.ID) != machineID {
+			continue
+		}
+		if server.Suffrage != raft.Voter {
+			return errors.Errorf("machine %s is a %s in the configuration, so it couldn't take part in electing a leader - "+
+				"check its replicaset member has votes, isn't hidden and has a non-zero priority", machineID, server.Suffrage)
+		}
+		return nil
+	}
+	return errors.Errorf("machine %s isn't in the configuration - check --machine-id is this machine's id "+
+		"(the tag in its agent.conf) and that its replicaset member has a %s tag", machineID, MachineIDTag)
+}
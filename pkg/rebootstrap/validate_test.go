@@ -0,0 +1,89 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstrap_test
+
+import (
+	"testing"
+
+	"github.com/hashicorp/raft"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap/rebootstraptest"
+)
+
+func TestValidateVoters(t *testing.T) {
+	withNonvoter := rebootstraptest.Servers(4)
+	withNonvoter.Servers[3].Suffrage = raft.Nonvoter
+	for _, test := range []struct {
+		about     string
+		config    raft.Configuration
+		minVoters int
+		allowEven bool
+		err       string
+	}{{
+		about:     "three voters",
+		config:    rebootstraptest.Servers(3),
+		minVoters: 1,
+	}, {
+		about:     "nonvoters don't count",
+		config:    withNonvoter,
+		minVoters: 3,
+	}, {
+		about:     "too few voters",
+		config:    rebootstraptest.Servers(1),
+		minVoters: 3,
+		err:       "configuration has 1 voter(s) [0], need at least 3 (see --min-voters)",
+	}, {
+		about:     "even voters",
+		config:    rebootstraptest.Servers(2),
+		minVoters: 1,
+		err:       "configuration has an even number of voters [0 1] - pass --allow-even-voters to bootstrap anyway",
+	}, {
+		about:     "even voters allowed",
+		config:    rebootstraptest.Servers(2),
+		minVoters: 1,
+		allowEven: true,
+	}} {
+		t.Run(test.about, func(t *testing.T) {
+			err := rebootstrap.ValidateVoters(test.config, test.minVoters, test.allowEven)
+			if test.err == "" && err != nil {
+				t.Errorf("unexpected error %v", err)
+			} else if test.err != "" && (err == nil || err.Error() != test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestValidateUnique(t *testing.T) {
+	sameID := rebootstraptest.Servers(3)
+	sameID.Servers[2].ID = "1"
+	sameAddress := rebootstraptest.Servers(3)
+	sameAddress.Servers[2].Address = sameAddress.Servers[0].Address
+	for _, test := range []struct {
+		about  string
+		config raft.Configuration
+		err    string
+	}{{
+		about:  "unique",
+		config: rebootstraptest.Servers(3),
+	}, {
+		about:  "shared id",
+		config: sameID,
+		err:    "duplicate servers in configuration:\n  machine 1 is used by members with addresses [10.0.0.2:17070 10.0.0.3:17070]",
+	}, {
+		about:  "shared address",
+		config: sameAddress,
+		err:    "duplicate servers in configuration:\n  address 10.0.0.1:17070 is used by machines [0 2]",
+	}} {
+		t.Run(test.about, func(t *testing.T) {
+			err := rebootstrap.ValidateUnique(test.config)
+			if test.err == "" && err != nil {
+				t.Errorf("unexpected error %v", err)
+			} else if test.err != "" && (err == nil || err.Error() != test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
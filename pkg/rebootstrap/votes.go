@@ -0,0 +1,137 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstrap
+
+import (
+	"context"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/errors"
+	"github.com/juju/replicaset"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ControllerVote is what Juju records about a controller machine's
+// vote: whether the peergrouper has given it one, and whether it's
+// meant to have one (false while the machine is being removed from
+// the controllers, or if it's never been promoted).
+type ControllerVote struct {
+	HasVote   bool
+	WantsVote bool
+}
+
+// Voter says whether the machine should be a raft voter: only if Juju
+// both wants it to vote and has given it the vote.
+func (v ControllerVote) Voter() bool {
+	return v.HasVote && v.WantsVote
+}
+
+type controllerNodeVoteDoc struct {
+	HasVote   *bool `bson:"has-vote"`
+	WantsVote *bool `bson:"wants-vote"`
+}
+
+type machineVoteDoc struct {
+	HasVote *bool `bson:"hasvote"`
+	NoVote  *bool `bson:"novote"`
+}
+
+// controllerVote decides a machine's vote from its controllerNodes
+// document, which Juju 2.7 and later keep it in, or else from its
+// machine document, either of which may be nil if it wasn't found.
+// It reports false if neither records the vote.
+func controllerVote(node *controllerNodeVoteDoc, machine *machineVoteDoc) (ControllerVote, bool) {
+	if node != nil && node.HasVote != nil && node.WantsVote != nil {
+		return ControllerVote{HasVote: *node.HasVote, WantsVote: *node.WantsVote}, true
+	}
+	if machine != nil && machine.HasVote != nil {
+		wants := machine.NoVote == nil || !*machine.NoVote
+		return ControllerVote{HasVote: *machine.HasVote, WantsVote: wants}, true
+	}
+	return ControllerVote{}, false
+}
+
+// controllerNodeIDs are the ids a machine's controllerNodes document
+// may have: it's prefixed with the model UUID in some versions and
+// not others.
+func controllerNodeIDs(modelUUID, id string) []string {
+	return []string{id, modelUUID + ":" + id}
+}
+
+// ControllerVotes returns, by machine id, Juju's record of the vote
+// of each member's controller machine, from the controllerNodes
+// collection or, for older controllers, the machine document.
+// Machines where neither says are left out, so their suffrage comes
+// from the replicaset.
+func ControllerVotes(ctx context.Context, session *mgo.Session, members []replicaset.Member) (map[string]ControllerVote, error) {
+	var votes map[string]ControllerVote
+	err := WithSession(ctx, session, func(s *mgo.Session) error {
+		var err error
+		votes, err = controllerVotes(s, members)
+		return err
+	})
+	return votes, errors.Annotate(err, "reading controller votes")
+}
+
+func controllerVotes(session *mgo.Session, members []replicaset.Member) (map[string]ControllerVote, error) {
+	db := session.DB(JujuDB)
+	info, err := getControllerInfo(db)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	votes := make(map[string]ControllerVote)
+	for _, member := range members {
+		id, ok := member.Tags[MachineIDTag]
+		if !ok {
+			// MakeServers will report this.
+			continue
+		}
+		var node *controllerNodeVoteDoc
+		var nodeDoc controllerNodeVoteDoc
+		err := db.C(controllerNodesC).Find(bson.M{
+			"_id": bson.M{"$in": controllerNodeIDs(info.ModelUUID, id)},
+		}).One(&nodeDoc)
+		if err == nil {
+			node = &nodeDoc
+		} else if err != mgo.ErrNotFound {
+			return nil, errors.Annotatef(err, "reading controller node %s", id)
+		}
+		var machine *machineVoteDoc
+		var machineDoc machineVoteDoc
+		err = db.C(machinesC).FindId(info.ModelUUID + ":" + id).One(&machineDoc)
+		if err == nil {
+			machine = &machineDoc
+		} else if err != mgo.ErrNotFound {
+			return nil, errors.Annotatef(err, "reading machine %s", id)
+		}
+		if vote, ok := controllerVote(node, machine); ok {
+			votes[id] = vote
+			continue
+		}
+		logger.Debugf("machine %s: Juju doesn't record its vote, using the replicaset's", id)
+	}
+	return votes, nil
+}
+
+// ApplyControllerVotes sets the suffrage of the servers in config
+// that have an entry in votes from it, logging where that differs
+// from what the replicaset gave.
+func ApplyControllerVotes(config *raft.Configuration, votes map[string]ControllerVote) {
+	for i, server := range config.Servers {
+		vote, ok := votes[string(server.ID)]
+		if !ok {
+			continue
+		}
+		suffrage := raft.Nonvoter
+		if vote.Voter() {
+			suffrage = raft.Voter
+		}
+		if suffrage != server.Suffrage {
+			logger.Infof("machine %s: making it a %s as Juju has it (has-vote %t, wants-vote %t), not a %s as in the replicaset",
+				server.ID, suffrage, vote.HasVote, vote.WantsVote, server.Suffrage)
+		}
+		config.Servers[i].Suffrage = suffrage
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package rebootstrap_test
+
+import (
+	"testing"
+
+	"github.com/hashicorp/raft"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap/rebootstraptest"
+)
+
+func TestApplyControllerVotes(t *testing.T) {
+	for _, test := range []struct {
+		about    string
+		replset  raft.ServerSuffrage
+		vote     *rebootstrap.ControllerVote
+		suffrage raft.ServerSuffrage
+	}{{
+		about:    "no record keeps the replicaset's voter",
+		replset:  raft.Voter,
+		suffrage: raft.Voter,
+	}, {
+		about:    "no record keeps the replicaset's nonvoter",
+		replset:  raft.Nonvoter,
+		suffrage: raft.Nonvoter,
+	}, {
+		about:    "has and wants the vote",
+		replset:  raft.Nonvoter,
+		vote:     &rebootstrap.ControllerVote{HasVote: true, WantsVote: true},
+		suffrage: raft.Voter,
+	}, {
+		about:    "being removed",
+		replset:  raft.Voter,
+		vote:     &rebootstrap.ControllerVote{HasVote: true, WantsVote: false},
+		suffrage: raft.Nonvoter,
+	}, {
+		about:    "not yet given the vote",
+		replset:  raft.Voter,
+		vote:     &rebootstrap.ControllerVote{HasVote: false, WantsVote: true},
+		suffrage: raft.Nonvoter,
+	}} {
+		t.Run(test.about, func(t *testing.T) {
+			config := rebootstraptest.Servers(2)
+			config.Servers[1].Suffrage = test.replset
+			votes := make(map[string]rebootstrap.ControllerVote)
+			if test.vote != nil {
+				votes["1"] = *test.vote
+			}
+			rebootstrap.ApplyControllerVotes(&config, votes)
+			if got := config.Servers[1].Suffrage; got != test.suffrage {
+				t.Errorf("got %v, want %v", got, test.suffrage)
+			}
+			if got := config.Servers[0].Suffrage; got != raft.Voter {
+				t.Errorf("machine without a vote record changed to %v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+)
+
+const addMemberDoc = `
+
+Add servers to the configuration in an existing raft store, for
+re-enlisting a replacement controller into a cluster that's recovering
+from losing some of its members. Each server is given as
+<id>=<address>, optionally followed by :nonvoter to add it without a
+vote. If the address has no port, the port the other servers use is
+taken:
+
+    rebootstrap-raft add-member --machine-id 0 3=10.0.0.13 4=10.0.0.14:17070:nonvoter
+
+Run it with the same servers on every controller already in the
+cluster, with their agents stopped. The raft directory is backed up
+next to itself first.
+
+`
+
+type addMemberCommand struct {
+	storeEditCommand
+	servers []raft.Server
+}
+
+// Info is part of cmd.Command.
+func (c *addMemberCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "add-member",
+		Args:    "--machine-id <id> <member-id>=<address>[:nonvoter] [...]",
+		Purpose: "Add servers to an existing raft store's configuration.",
+		Doc:     strings.TrimSpace(addMemberDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *addMemberCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.storeEditCommand.setFlags(f)
+}
+
+// Init is part of cmd.Command.
+func (c *addMemberCommand) Init(args []string) error {
+	if err := c.storeEditCommand.init(); err != nil {
+		return errors.Trace(err)
+	}
+	if len(args) == 0 {
+		return errors.Errorf("at least one member is required")
+	}
+	for _, arg := range args {
+		server, err := parseMember(arg)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		c.servers = append(c.servers, server)
+	}
+	return nil
+}
+
+// parseMember parses <id>=<address>[:voter|:nonvoter]. The address
+// may leave out the port, which is filled in later.
+func parseMember(arg string) (raft.Server, error) {
+	parts := strings.SplitN(arg, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return raft.Server{}, errors.Errorf("expected <id>=<address>[:nonvoter], got %q", arg)
+	}
+	server := raft.Server{ID: raft.ServerID(parts[0]), Suffrage: raft.Voter}
+	address := parts[1]
+	if i := strings.LastIndex(address, ":"); i >= 0 {
+		switch address[i+1:] {
+		case "nonvoter":
+			server.Suffrage = raft.Nonvoter
+			address = address[:i]
+		case "voter":
+			address = address[:i]
+		}
+	}
+	server.Address = raft.ServerAddress(address)
+	return server, nil
+}
+
+// Run is part of cmd.Command.
+func (c *addMemberCommand) Run(ctx *cmd.Context) error {
+	return reportExitCode(ctx, c.apply(ctx, c.add))
+}
+
+// add appends the new servers to config.
+func (c *addMemberCommand) add(config *raft.Configuration) error {
+	for _, server := range c.servers {
+		if serverIndex(*config, server.ID) >= 0 {
+			return errors.AlreadyExistsf("server %s", server.ID)
+		}
+		if _, _, err := net.SplitHostPort(string(server.Address)); err != nil {
+			port, err := commonPort(*config)
+			if err != nil {
+				return errors.Annotatef(err, "choosing a port for server %s (give one in its address)", server.ID)
+			}
+			server.Address = raft.ServerAddress(net.JoinHostPort(string(server.Address), port))
+		}
+		logger.Infof("adding server %s (%s) as a %s", server.ID, server.Address, server.Suffrage)
+		config.Servers = append(config.Servers, server)
+	}
+	return nil
+}
+
+// commonPort returns the port every server in config uses.
+func commonPort(config raft.Configuration) (string, error) {
+	var common string
+	for _, server := range config.Servers {
+		_, port, err := net.SplitHostPort(string(server.Address))
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		if common != "" && port != common {
+			return "", errors.Errorf("servers use different ports")
+		}
+		common = port
+	}
+	if common == "" {
+		return "", errors.NotFoundf("servers to take the port from")
+	}
+	return common, nil
+}
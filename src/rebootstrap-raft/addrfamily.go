@@ -0,0 +1,86 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// familyDialTimeout is how long each address gets when a preferred
+// family is being tried before the other one. A firewall that drops
+// rather than refuses would otherwise use up the whole dial timeout
+// on the first address.
+const familyDialTimeout = 5 * time.Second
+
+// preferredFamily returns "tcp4" or "tcp6" for --prefer-ipv4 or
+// --prefer-ipv6, or "" if neither was given.
+func (m *mongoFlags) preferredFamily() string {
+	switch {
+	case m.preferIPv4:
+		return "tcp4"
+	case m.preferIPv6:
+		return "tcp6"
+	}
+	return ""
+}
+
+// dialTCP connects to address. Without a preferred family it's left
+// to Go's dialer, which races the families (RFC 6555) with the first
+// one the resolver returned given a head start. With one, the host's
+// addresses in that family are tried first, one at a time, and then
+// the others, so a dual-stack host where one family is firewalled is
+// still reached.
+func (m *mongoFlags) dialTCP(ctx context.Context, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	preferred := m.preferredFamily()
+	if preferred == "" {
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	ordered := orderByFamily(ips, preferred == "tcp4")
+	var lastErr error
+	for i, ip := range ordered {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if i < len(ordered)-1 {
+			attemptCtx, cancel = context.WithTimeout(ctx, familyDialTimeout)
+		}
+		conn, err := dialer.DialContext(attemptCtx, "tcp", net.JoinHostPort(ip.String(), port))
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		logger.Debugf("dialling %s at %s: %v", address, ip, err)
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// orderByFamily returns the addresses with those in the preferred
+// family (IPv4 if ipv4, otherwise IPv6) first, keeping the resolver's
+// order within each family.
+func orderByFamily(ips []net.IPAddr, ipv4 bool) []net.IPAddr {
+	var preferred, others []net.IPAddr
+	for _, ip := range ips {
+		if (ip.IP.To4() != nil) == ipv4 {
+			preferred = append(preferred, ip)
+		} else {
+			others = append(others, ip)
+		}
+	}
+	return append(preferred, others...)
+}
@@ -0,0 +1,61 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestOrderByFamily(t *testing.T) {
+	addrs := func(ips ...string) []net.IPAddr {
+		var result []net.IPAddr
+		for _, ip := range ips {
+			result = append(result, net.IPAddr{IP: net.ParseIP(ip)})
+		}
+		return result
+	}
+	for _, test := range []struct {
+		about  string
+		ips    []net.IPAddr
+		ipv4   bool
+		expect []net.IPAddr
+	}{{
+		about:  "ipv4 first",
+		ips:    addrs("fd00::1", "10.0.0.1", "fd00::2", "10.0.0.2"),
+		ipv4:   true,
+		expect: addrs("10.0.0.1", "10.0.0.2", "fd00::1", "fd00::2"),
+	}, {
+		about:  "ipv6 first",
+		ips:    addrs("10.0.0.1", "fd00::1", "10.0.0.2"),
+		expect: addrs("fd00::1", "10.0.0.1", "10.0.0.2"),
+	}, {
+		about:  "only the other family",
+		ips:    addrs("10.0.0.1"),
+		expect: addrs("10.0.0.1"),
+	}} {
+		t.Run(test.about, func(t *testing.T) {
+			got := orderByFamily(test.ips, test.ipv4)
+			if !reflect.DeepEqual(got, test.expect) {
+				t.Errorf("got %v, want %v", got, test.expect)
+			}
+		})
+	}
+}
+
+func TestPreferredFamily(t *testing.T) {
+	for _, test := range []struct {
+		flags  mongoFlags
+		expect string
+	}{
+		{mongoFlags{}, ""},
+		{mongoFlags{preferIPv4: true}, "tcp4"},
+		{mongoFlags{preferIPv6: true}, "tcp6"},
+	} {
+		if got := test.flags.preferredFamily(); got != test.expect {
+			t.Errorf("%+v: got %q, want %q", test.flags, got, test.expect)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// noAgentService is given as the agent service when the machine agent
+// isn't run by systemd, as in a Kubernetes controller pod. Whatever
+// runs the agent has to make sure it isn't running.
+const noAgentService = "none"
+
+// agentServiceName returns the name of the systemd service for the
+// machine agent as Juju installs it outside a snap.
+func agentServiceName(machineID string) string {
+	return fmt.Sprintf("jujud-machine-%s.service", machineID)
+}
+
+// agentUnitArgs are the systemctl arguments listing the installed
+// units that could be machineID's agent, with or without a snap.
+func agentUnitArgs(machineID string) []string {
+	return []string{"list-unit-files", "--no-legend", "--plain", "*" + agentServiceName(machineID)}
+}
+
+// pickAgentService returns the machine agent's service among the
+// units systemctl listed: the one Juju installs itself if it's there,
+// otherwise a snap's snap.<name>.jujud-machine-<id>.service. It
+// returns agentServiceName's if neither is listed.
+func pickAgentService(listed, machineID string) string {
+	service := agentServiceName(machineID)
+	var snap string
+	for _, line := range strings.Split(listed, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		match := agentServicePattern.FindStringSubmatch(fields[0])
+		switch {
+		case match == nil || match[1] != machineID:
+		case fields[0] == service:
+			return service
+		case snap == "":
+			snap = fields[0]
+		}
+	}
+	if snap != "" {
+		return snap
+	}
+	return service
+}
+
+// localAgentService returns the name of this machine's agent service.
+func localAgentService(machineID string) string {
+	_, out, err := systemctl(agentUnitArgs(machineID)...)
+	if err != nil {
+		logger.Debugf("can't list the agent's units, assuming %s: %v", agentServiceName(machineID), err)
+	}
+	return pickAgentService(out, machineID)
+}
+
+// remoteAgentService returns the name of the agent service for
+// machineID on r.
+func remoteAgentService(r remote, machineID string) string {
+	out, err := r.Run(append([]string{"systemctl"}, agentUnitArgs(machineID)...)...)
+	if err != nil {
+		logger.Debugf("can't list the agent's units on %s, assuming %s: %v", r, agentServiceName(machineID), err)
+	}
+	return pickAgentService(string(out), machineID)
+}
+
+// systemctl runs systemctl with the given arguments, returning the
+// exit code and combined output.
+func systemctl(args ...string) (int, string, error) {
+	out, err := exec.Command("systemctl", args...).CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), strings.TrimSpace(string(out)), nil
+	}
+	if err != nil {
+		return 0, "", errors.Trace(err)
+	}
+	return 0, strings.TrimSpace(string(out)), nil
+}
+
+// serviceActive reports whether the named service is running (or
+// starting or stopping, which is just as bad for us).
+func serviceActive(service string) (bool, error) {
+	code, out, err := systemctl("is-active", service)
+	if err != nil {
+		return false, errors.Annotatef(err, "checking %s", service)
+	}
+	switch out {
+	case "active", "activating", "deactivating", "reloading":
+		return true, nil
+	case "inactive", "failed", "unknown":
+		return false, nil
+	}
+	return false, errors.Errorf("unexpected state %q (exit code %d) for %s", out, code, service)
+}
+
+// stopService stops the named service and waits for it to finish.
+func stopService(service string) error {
+	code, out, err := systemctl("stop", service)
+	if err == nil && code != 0 {
+		err = errors.Errorf("systemctl stop %s failed: %s", service, out)
+	}
+	return errors.Trace(err)
+}
+
+// startService starts the named service.
+func startService(service string) error {
+	code, out, err := systemctl("start", service)
+	if err == nil && code != 0 {
+		err = errors.Errorf("systemctl start %s failed: %s", service, out)
+	}
+	return errors.Trace(err)
+}
+
+// ensureAgentStopped refuses to continue while the machine agent is
+// running, unless stop is set in which case it's stopped. It reports
+// whether the agent was stopped.
+func ensureAgentStopped(service string, stop bool) (bool, error) {
+	if service == noAgentService {
+		logger.Infof("Not checking the machine agent.")
+		return false, nil
+	}
+	active, err := serviceActive(service)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if !active {
+		logger.Infof("%s is not running.", service)
+		return false, nil
+	}
+	if !stop {
+		return false, withRemedy(errors.Errorf("%s is running - stop it first (or use --stop-agent)", service), remedyAgentRunning)
+	}
+	logger.Infof("Stopping %s.", service)
+	if err := stopService(service); err != nil {
+		return false, errors.Trace(err)
+	}
+	if active, err := serviceActive(service); err != nil {
+		return true, errors.Trace(err)
+	} else if active {
+		return true, errors.Errorf("%s is still running after being stopped", service)
+	}
+	return true, nil
+}
@@ -0,0 +1,39 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import "testing"
+
+func TestPickAgentService(t *testing.T) {
+	for _, test := range []struct {
+		about  string
+		listed string
+		expect string
+	}{{
+		about:  "nothing listed",
+		expect: "jujud-machine-1.service",
+	}, {
+		about:  "installed by juju",
+		listed: "jujud-machine-1.service enabled enabled\n",
+		expect: "jujud-machine-1.service",
+	}, {
+		about:  "installed by a snap",
+		listed: "snap.juju-db.daemon.service enabled enabled\nsnap.jujud.jujud-machine-1.service enabled enabled\n",
+		expect: "snap.jujud.jujud-machine-1.service",
+	}, {
+		about:  "both installed",
+		listed: "jujud-machine-1.service linked enabled\nsnap.jujud.jujud-machine-1.service enabled enabled\n",
+		expect: "jujud-machine-1.service",
+	}, {
+		about:  "another machine's",
+		listed: "snap.jujud.jujud-machine-11.service enabled enabled\n",
+		expect: "jujud-machine-1.service",
+	}} {
+		t.Run(test.about, func(t *testing.T) {
+			if got := pickAgentService(test.listed, "1"); got != test.expect {
+				t.Errorf("got %q, want %q", got, test.expect)
+			}
+		})
+	}
+}
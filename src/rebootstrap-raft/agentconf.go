@@ -0,0 +1,223 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// agentConfFormats are the agent.conf formats we know how to read.
+// Both are flat YAML with the same credential keys; 1.18 predates the
+// controller tag and the mongo version.
+var agentConfFormats = []string{"1.18", "2.0"}
+
+// agentConfig holds the fields we use from a machine agent's
+// agent.conf.
+type agentConfig struct {
+	// Format is the format from the "# format" header line, or ""
+	// if there isn't one.
+	Format string `yaml:"-"`
+
+	Tag               string   `yaml:"tag"`
+	Controller        string   `yaml:"controller"`
+	UpgradedToVersion string   `yaml:"upgradedToVersion"`
+	APIAddresses      []string `yaml:"apiaddresses"`
+	APIPort           int      `yaml:"apiport"`
+	StatePort         int      `yaml:"stateport"`
+	MongoVersion      string   `yaml:"mongoversion"`
+	JujuDBSnapChannel string   `yaml:"juju-db-snap-channel"`
+}
+
+// agentConfPath returns the path of the agent.conf for the given
+// machine.
+func agentConfPath(dataDir, machineID string) string {
+	return filepath.Join(dataDir, "agents", fmt.Sprintf("machine-%s", machineID), "agent.conf")
+}
+
+// agentSecrets are the credentials in agent.conf. They're kept out of
+// agentConfig so that they can't end up in a dump of it.
+type agentSecrets struct {
+	StatePassword string `yaml:"statepassword"`
+	APIPassword   string `yaml:"apipassword"`
+	OldPassword   string `yaml:"oldpassword"`
+	SharedSecret  string `yaml:"sharedsecret"`
+	CAPrivateKey  string `yaml:"caprivatekey"`
+	PrivateKey    string `yaml:"privatekey"`
+}
+
+// readAgentConfig reads and parses the agent.conf at path. Any
+// credentials it holds are registered as secrets so that they're
+// redacted from all output.
+func readAgentConfig(path string) (*agentConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return parseAgentConfig(data, path)
+}
+
+// parseAgentConfig parses agent.conf contents read from path (which
+// is only used in messages), registering its credentials as secrets.
+func parseAgentConfig(data []byte, path string) (*agentConfig, error) {
+	var creds agentSecrets
+	if err := yaml.Unmarshal(data, &creds); err != nil {
+		return nil, errors.Annotatef(err, "parsing %q", path)
+	}
+	for _, secret := range []string{
+		creds.StatePassword, creds.APIPassword, creds.OldPassword,
+		creds.SharedSecret, creds.CAPrivateKey, creds.PrivateKey,
+	} {
+		secrets.add(secret)
+	}
+	var config agentConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, errors.Annotatef(err, "parsing %q", path)
+	}
+	config.Format = agentConfFormat(data)
+	if !knownAgentConfFormat(config.Format) {
+		logger.Warningf("%q has unrecognised format %q - reading it as format 2.0", path, config.Format)
+	}
+	return &config, nil
+}
+
+// agentConfFormat returns the format named in the "# format" line at
+// the top of an agent.conf.
+func agentConfFormat(data []byte) string {
+	line := strings.SplitN(string(data), "\n", 2)[0]
+	const prefix = "# format "
+	if !strings.HasPrefix(line, prefix) {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(line, prefix))
+}
+
+func knownAgentConfFormat(format string) bool {
+	for _, known := range agentConfFormats {
+		if format == known {
+			return true
+		}
+	}
+	return false
+}
+
+// controllerUUID returns the UUID from the agent's controller tag.
+// Agents configured before controllers had their own tag have none,
+// which gives a NotFound error.
+func (c *agentConfig) controllerUUID() (string, error) {
+	const prefix = "controller-"
+	if c.Controller == "" {
+		return "", errors.NotFoundf("controller tag")
+	}
+	if !strings.HasPrefix(c.Controller, prefix) {
+		return "", errors.NotValidf("controller tag %q", c.Controller)
+	}
+	return strings.TrimPrefix(c.Controller, prefix), nil
+}
+
+// readAgentTag returns the tag in the agent.conf at path, which is
+// the MongoDB user its statepassword belongs to.
+func readAgentTag(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	var conf struct {
+		Tag string `yaml:"tag"`
+	}
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		return "", errors.Annotatef(err, "parsing %q", path)
+	}
+	if conf.Tag == "" {
+		return "", errors.NotFoundf("tag in %q", path)
+	}
+	return conf.Tag, nil
+}
+
+// readCACert returns the controller CA certificate from the agent.conf
+// at path, which signs the MongoDB server certificate.
+func readCACert(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var conf struct {
+		CACert string `yaml:"cacert"`
+	}
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		return nil, errors.Annotatef(err, "parsing %q", path)
+	}
+	if conf.CACert == "" {
+		return nil, errors.NotFoundf("cacert in %q", path)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(conf.CACert)) {
+		return nil, errors.NotValidf("cacert in %q", path)
+	}
+	return pool, nil
+}
+
+// readMongoPasswords returns the MongoDB password from the agent.conf
+// at path, along with the oldpassword to fall back to if it's
+// rejected. Like jujud, an agent that hasn't yet been given a
+// statepassword uses its oldpassword, in which case there's nothing
+// to fall back to.
+func readMongoPasswords(path string) (password, oldPassword string, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", "", errors.Trace(err)
+	}
+	var creds agentSecrets
+	if err := yaml.Unmarshal(data, &creds); err != nil {
+		return "", "", errors.Annotatef(err, "parsing %q", path)
+	}
+	switch {
+	case creds.StatePassword != "" && creds.OldPassword != creds.StatePassword:
+		return creds.StatePassword, creds.OldPassword, nil
+	case creds.StatePassword != "":
+		return creds.StatePassword, "", nil
+	case creds.OldPassword != "":
+		logger.Warningf("no statepassword in %q, using oldpassword", path)
+		return creds.OldPassword, "", nil
+	}
+	return "", "", errors.NotFoundf("statepassword or oldpassword in %q", path)
+}
+
+// readSharedSecret reads the MongoDB shared secret from keyfile if
+// that's set, or else from the sharedsecret in the agent.conf at
+// agentConfPath. Like mongod, whitespace in a keyfile is ignored.
+func readSharedSecret(agentConfPath, keyfile string) (string, error) {
+	if keyfile != "" {
+		data, err := ioutil.ReadFile(keyfile)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		secret := strings.Join(strings.Fields(string(data)), "")
+		if secret == "" {
+			return "", errors.Errorf("%q is empty", keyfile)
+		}
+		return secret, nil
+	}
+	if agentConfPath == "" {
+		return "", errors.NotFoundf("agent.conf (use --keyfile)")
+	}
+	data, err := ioutil.ReadFile(agentConfPath)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	var creds agentSecrets
+	if err := yaml.Unmarshal(data, &creds); err != nil {
+		return "", errors.Annotatef(err, "parsing %q", agentConfPath)
+	}
+	if creds.SharedSecret == "" {
+		return "", errors.NotFoundf("sharedsecret in %q", agentConfPath)
+	}
+	return creds.SharedSecret, nil
+}
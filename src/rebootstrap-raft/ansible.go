@@ -0,0 +1,58 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/juju/errors"
+)
+
+// ansibleResult is what --ansible writes to stdout: the JSON object
+// Ansible expects from a module, with changed and failed, a message,
+// and the run's result (as --format json would give it) if it got
+// that far.
+type ansibleResult struct {
+	Changed bool             `json:"changed"`
+	Failed  bool             `json:"failed"`
+	Msg     string           `json:"msg"`
+	RC      int              `json:"rc"`
+	Result  *bootstrapResult `json:"result,omitempty"`
+
+	// Remediation says what to do about a failure.
+	Remediation *remediation `json:"remediation,omitempty"`
+}
+
+// writeAnsibleResult writes the outcome of a run for Ansible. The
+// raft store is changed if it was written, whether or not the run
+// went on to fail after that.
+func writeAnsibleResult(w io.Writer, result *bootstrapResult, runErr error, vars map[string]string) error {
+	out := ansibleResult{Result: result}
+	if result != nil {
+		out.Changed = result.Written
+	}
+	switch {
+	case runErr != nil:
+		out.Failed = true
+		out.RC = exitCode(runErr)
+		out.Msg = runErr.Error()
+		out.Remediation = remediationFor(runErr, vars)
+	case result == nil:
+		out.Msg = "nothing done"
+	case result.DryRun:
+		out.Msg = fmt.Sprintf("dry run - would write %s with %d servers", result.RaftDir, len(result.Servers))
+	case result.Written:
+		out.Msg = fmt.Sprintf("wrote %s with %d servers", result.RaftDir, len(result.Servers))
+	default:
+		out.Msg = fmt.Sprintf("nothing written to %s", result.RaftDir)
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return errors.Trace(err)
+}
@@ -0,0 +1,363 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"gopkg.in/yaml.v2"
+)
+
+const batchDoc = `
+
+Verify and rebootstrap many Juju controllers, listed in a YAML
+inventory:
+
+  controllers:
+  - name: prod-1
+    ssh: ubuntu@10.0.0.5
+    ssh-identity: ~/.ssh/prod-1
+    machine-id: "0"
+    password: agent-conf
+    args: [--all-controllers, --stop-agent, --restart-agents]
+
+For each controller this tool is copied over ssh to the machine named
+by ssh and a dry run of bootstrap is done there with args, checking
+that it can reach MongoDB and would write a valid configuration. The
+dry runs are summarised and, once confirmed, every controller that
+passed is bootstrapped in turn. One controller failing doesn't stop
+the others; the report at the end gives the outcome for each, and the
+exit code is non-zero if any failed.
+
+password says where the MongoDB password comes from: agent-conf (the
+default) has the remote run read it from the machine's agent.conf,
+env:<VAR> takes it from an environment variable here and file:<path>
+from a file here.
+
+`
+
+// The credential sources an inventory entry can give.
+const (
+	passwordAgentConf = "agent-conf"
+	passwordEnvPrefix = "env:"
+	passwordFile      = "file:"
+)
+
+// inventory is the file read by batch.
+type inventory struct {
+	Controllers []inventoryController `yaml:"controllers"`
+}
+
+// inventoryController is one controller in the inventory.
+type inventoryController struct {
+	Name        string   `yaml:"name"`
+	SSH         string   `yaml:"ssh"`
+	SSHIdentity string   `yaml:"ssh-identity"`
+	MachineID   string   `yaml:"machine-id"`
+	Password    string   `yaml:"password"`
+	Args        []string `yaml:"args"`
+}
+
+// readInventory reads and checks the inventory at path.
+func readInventory(path string) (*inventory, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var inv inventory
+	if err := yaml.UnmarshalStrict(data, &inv); err != nil {
+		return nil, errors.Annotatef(err, "parsing %q", path)
+	}
+	if len(inv.Controllers) == 0 {
+		return nil, errors.Errorf("%q lists no controllers", path)
+	}
+	names := make(map[string]bool)
+	for i, controller := range inv.Controllers {
+		if controller.Name == "" || controller.SSH == "" || controller.MachineID == "" {
+			return nil, errors.Errorf("controller %d in %q needs a name, ssh and machine-id", i+1, path)
+		}
+		if names[controller.Name] {
+			return nil, errors.Errorf("controller %q appears twice in %q", controller.Name, path)
+		}
+		names[controller.Name] = true
+		switch {
+		case controller.Password == "", controller.Password == passwordAgentConf:
+		case strings.HasPrefix(controller.Password, passwordEnvPrefix):
+		case strings.HasPrefix(controller.Password, passwordFile):
+		default:
+			return nil, errors.Errorf("controller %q: password must be %s, %s<VAR> or %s<path>",
+				controller.Name, passwordAgentConf, passwordEnvPrefix, passwordFile)
+		}
+	}
+	return &inv, nil
+}
+
+// password returns the MongoDB password for the controller, or "" if
+// the remote run should read it from agent.conf.
+func (c inventoryController) password() (string, error) {
+	switch {
+	case strings.HasPrefix(c.Password, passwordEnvPrefix):
+		name := strings.TrimPrefix(c.Password, passwordEnvPrefix)
+		value := os.Getenv(name)
+		if value == "" {
+			return "", errors.Errorf("$%s isn't set", name)
+		}
+		return value, nil
+	case strings.HasPrefix(c.Password, passwordFile):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(c.Password, passwordFile))
+		if err != nil {
+			return "", errors.Annotate(err, "reading password")
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return "", nil
+}
+
+// remote returns the remote for the controller's ssh endpoint.
+func (c inventoryController) remote(defaultUser string) *sshRemote {
+	user, host := defaultUser, c.SSH
+	if i := strings.LastIndex(c.SSH, "@"); i >= 0 {
+		user, host = c.SSH[:i], c.SSH[i+1:]
+	}
+	identity := c.SSHIdentity
+	if strings.HasPrefix(identity, "~/") {
+		identity = os.Getenv("HOME") + identity[1:]
+	}
+	return &sshRemote{host: host, user: user, identity: identity}
+}
+
+// batchReport is the outcome of a batch run.
+type batchReport struct {
+	SchemaVersion int           `json:"schema-version" yaml:"schema-version"`
+	DryRun        bool          `json:"dry-run" yaml:"dry-run"`
+	Controllers   []batchResult `json:"controllers" yaml:"controllers"`
+}
+
+// batchResult is the outcome for one controller in the inventory.
+type batchResult struct {
+	Name        string             `json:"name" yaml:"name"`
+	Host        string             `json:"host" yaml:"host"`
+	Verified    bool               `json:"verified" yaml:"verified"`
+	Servers     []serverResult     `json:"servers,omitempty" yaml:"servers,omitempty"`
+	Written     bool               `json:"written" yaml:"written"`
+	Backup      string             `json:"backup,omitempty" yaml:"backup,omitempty"`
+	Controllers []controllerResult `json:"controllers,omitempty" yaml:"controllers,omitempty"`
+	Error       string             `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+type batchCommand struct {
+	cmd.CommandBase
+	out cmd.Output
+	logFlags
+	inventoryPath string
+	sshUser       string
+	dryRun        bool
+	yes           bool
+}
+
+// Info is part of cmd.Command.
+func (c *batchCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "batch",
+		Args:    "<inventory.yaml>",
+		Purpose: "Verify and rebootstrap the controllers in an inventory.",
+		Doc:     strings.TrimSpace(batchDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *batchCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	c.logFlags.setFlags(f)
+	c.out.AddFlags(f, "text", map[string]cmd.Formatter{
+		"text": formatBatchReport,
+		"json": cmd.FormatJson,
+		"yaml": cmd.FormatYaml,
+	})
+	f.StringVar(&c.sshUser, "ssh-user", "ubuntu", "user to ssh as when an inventory entry doesn't give one")
+	f.BoolVar(&c.dryRun, "dry-run", false, "only verify each controller")
+	f.BoolVar(&c.yes, "yes", false, "don't ask for confirmation before writing")
+}
+
+// Init is part of cmd.Command.
+func (c *batchCommand) Init(args []string) error {
+	if err := c.setupLogging(c.dryRun); err != nil {
+		return errors.Trace(err)
+	}
+	if len(args) == 0 {
+		return errors.Errorf("an inventory file is required")
+	}
+	c.inventoryPath, args = args[0], args[1:]
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *batchCommand) Run(ctx *cmd.Context) error {
+	c.setupOutput(ctx)
+	return reportExitCode(ctx, c.run(ctx))
+}
+
+func (c *batchCommand) run(ctx *cmd.Context) error {
+	inv, err := readInventory(c.inventoryPath)
+	if err != nil {
+		return withExitCode(err, exitValidation)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return errors.Annotate(err, "finding this executable")
+	}
+	progress := newProgress(ctx.Stderr, c.quiet)
+	report := &batchReport{SchemaVersion: outputSchemaVersion, DryRun: c.dryRun}
+
+	// Each controller keeps its copy of the tool until the end, so
+	// it's only copied once.
+	remotes := make([]*sshRemote, len(inv.Controllers))
+	paths := make([]string, len(inv.Controllers))
+	var removes []func()
+	defer func() {
+		for _, remove := range removes {
+			remove()
+		}
+	}()
+	verified := 0
+	for i, controller := range inv.Controllers {
+		r := controller.remote(c.sshUser)
+		result := batchResult{Name: controller.Name, Host: r.String()}
+		done := progress.start("Verifying " + controller.Name)
+		path, remove, err := pushFile(r, self, "rebootstrap-raft")
+		if err == nil {
+			remotes[i], paths[i] = r, path
+			removes = append(removes, remove)
+			var plan *bootstrapResult
+			plan, err = c.runBootstrap(r, path, controller, "--dry-run")
+			if err == nil {
+				result.Verified = true
+				result.Servers = plan.Servers
+				verified++
+			}
+		}
+		done(err)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		report.Controllers = append(report.Controllers, result)
+	}
+	if c.dryRun || verified == 0 {
+		return c.writeReport(ctx, report)
+	}
+
+	if !c.yes {
+		fmt.Fprintf(ctx.Stderr, "Dry runs:\n")
+		plans := &batchReport{DryRun: true, Controllers: report.Controllers}
+		if err := formatBatchReport(ctx.Stderr, plans); err != nil {
+			return errors.Trace(err)
+		}
+		ok, err := confirm(ctx, fmt.Sprintf("Rebootstrap the %d controllers that passed?", verified))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !ok {
+			return errors.New("aborted")
+		}
+	}
+	for i, controller := range inv.Controllers {
+		result := &report.Controllers[i]
+		if !result.Verified {
+			continue
+		}
+		done := progress.start("Rebootstrapping " + controller.Name)
+		written, err := c.runBootstrap(remotes[i], paths[i], controller, "--yes")
+		done(err)
+		if written != nil {
+			result.Written = written.Written
+			result.Backup = written.Backup
+			result.Controllers = written.Controllers
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+	}
+	return c.writeReport(ctx, report)
+}
+
+// runBootstrap runs bootstrap for the controller on r with its
+// inventory args and the given extra flags.
+func (c *batchCommand) runBootstrap(r *sshRemote, path string, controller inventoryController, flags ...string) (*bootstrapResult, error) {
+	args := []string{path, "bootstrap", "--machine-id", controller.MachineID}
+	password, err := controller.password()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var stdin []byte
+	if password != "" {
+		secrets.add(password)
+		// The password goes on standard input rather than the
+		// command line, where ps would show it on both machines.
+		args = append(args, "--password-cmd", "cat")
+		stdin = []byte(password + "\n")
+	}
+	args = append(args, controller.Args...)
+	args = append(args, flags...)
+	args = append(args, "--quiet", "--format", "json")
+	return parseRemoteBootstrap(r.RunInput(stdin, args...))
+}
+
+// writeReport writes the report, failing if any controller did.
+func (c *batchCommand) writeReport(ctx *cmd.Context, report *batchReport) error {
+	if err := c.out.Write(ctx, report); err != nil {
+		return errors.Trace(err)
+	}
+	failed, unverified := 0, 0
+	for _, result := range report.Controllers {
+		if !result.Verified {
+			unverified++
+		} else if result.Error != "" {
+			failed++
+		}
+	}
+	switch {
+	case failed > 0 && unverified > 0:
+		return withExitCode(errors.Errorf("%d of %d controllers failed, and %d more failed verification",
+			failed, len(report.Controllers), unverified), exitWriteFailed)
+	case failed > 0:
+		return withExitCode(errors.Errorf("%d of %d controllers failed", failed, len(report.Controllers)), exitWriteFailed)
+	case unverified > 0:
+		return withExitCode(errors.Errorf("%d of %d controllers failed verification", unverified, len(report.Controllers)), exitValidation)
+	}
+	return nil
+}
+
+func formatBatchReport(writer io.Writer, value interface{}) error {
+	report, ok := value.(*batchReport)
+	if !ok {
+		return errors.Errorf("expected *batchReport, got %T", value)
+	}
+	tw := tabwriter.NewWriter(writer, 0, 1, 2, ' ', 0)
+	fmt.Fprintf(tw, "NAME\tHOST\tSERVERS\tVERIFIED\tWRITTEN\tERROR\n")
+	for _, result := range report.Controllers {
+		written := "-"
+		if !report.DryRun && result.Verified {
+			written = fmt.Sprint(result.Written)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%v\t%s\t%s\n", result.Name, result.Host, len(result.Servers),
+			result.Verified, written, dashIfEmpty(firstLine(result.Error)))
+	}
+	return errors.Trace(tw.Flush())
+}
+
+// firstLine returns s up to its first newline.
+func firstLine(s string) string {
+	if i := strings.Index(s, "\n"); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
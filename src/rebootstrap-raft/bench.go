@@ -0,0 +1,241 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"go.etcd.io/bbolt"
+)
+
+const benchDoc = `
+
+Measure how fast the filesystem that holds (or will hold) the raft
+directory can commit to a bolt file, as raft's log store does for
+every entry. A scratch bolt file is written next to the raft directory
+with one fsynced transaction per entry, then removed, and the commit
+latencies and rate are compared with what jujud's raft needs. Slow
+disks make the leader miss heartbeats, which causes elections and
+often the store damage that led here, so it's worth checking before
+rebootstrapping onto the same disk.
+
+The exit code is non-zero if the disk is too slow for raft. The live
+store isn't touched, so this is safe on a running controller, though
+it adds a little I/O.
+
+`
+
+const (
+	// benchWarnLatency is the 99th percentile commit latency above
+	// which raft starts to struggle under load.
+	benchWarnLatency = 50 * time.Millisecond
+
+	// benchFailLatency is the 99th percentile commit latency above
+	// which a leader can't reliably commit within half of raft's
+	// one second heartbeat timeout.
+	benchFailLatency = 500 * time.Millisecond
+
+	// benchMinRate is the fewest commits a second that keeps up
+	// with the lease and other writes of a busy controller.
+	benchMinRate = 50
+)
+
+// benchBucket is the bucket the scratch entries are written to.
+var benchBucket = []byte("bench")
+
+type benchCommand struct {
+	cmd.CommandBase
+	out cmd.Output
+	logFlags
+	dataDirFlags
+	dir        string
+	writes     int
+	entryBytes int
+}
+
+// benchReport is the outcome of a benchmark.
+type benchReport struct {
+	SchemaVersion    int      `json:"schema-version" yaml:"schema-version"`
+	Path             string   `json:"path" yaml:"path"`
+	Writes           int      `json:"writes" yaml:"writes"`
+	EntryBytes       int      `json:"entry-bytes" yaml:"entry-bytes"`
+	Seconds          float64  `json:"seconds" yaml:"seconds"`
+	CommitsPerSecond float64  `json:"commits-per-second" yaml:"commits-per-second"`
+	BytesPerSecond   float64  `json:"bytes-per-second" yaml:"bytes-per-second"`
+	P50Millis        float64  `json:"p50-ms" yaml:"p50-ms"`
+	P99Millis        float64  `json:"p99-ms" yaml:"p99-ms"`
+	MaxMillis        float64  `json:"max-ms" yaml:"max-ms"`
+	Status           string   `json:"status" yaml:"status"`
+	Problems         []string `json:"problems,omitempty" yaml:"problems,omitempty"`
+}
+
+// Info is part of cmd.Command.
+func (c *benchCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "bench",
+		Args:    "[<dir>]",
+		Purpose: "Check the raft directory's disk is fast enough for raft.",
+		Doc:     strings.TrimSpace(benchDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *benchCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	c.logFlags.setFlags(f)
+	c.dataDirFlags.setFlags(f)
+	c.out.AddFlags(f, "text", map[string]cmd.Formatter{
+		"text": formatBenchReport,
+		"json": cmd.FormatJson,
+		"yaml": cmd.FormatYaml,
+	})
+	f.IntVar(&c.writes, "writes", 200, "how many entries to commit")
+	f.IntVar(&c.entryBytes, "entry-size", 1024, "size of each entry in bytes")
+}
+
+// Init is part of cmd.Command.
+func (c *benchCommand) Init(args []string) error {
+	if err := c.setupLogging(false); err != nil {
+		return errors.Trace(err)
+	}
+	if c.writes < 1 || c.entryBytes < 1 {
+		return errors.Errorf("--writes and --entry-size must be positive")
+	}
+	if len(args) > 0 {
+		c.dir, args = existingAncestor(args[0]), args[1:]
+	} else {
+		if err := c.dataDirFlags.resolve(); err != nil {
+			return errors.Trace(err)
+		}
+		// The raft directory itself may not exist yet, or may
+		// be about to be replaced.
+		c.dir = existingAncestor(filepath.Dir(c.getJujuPath("raft")))
+	}
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *benchCommand) Run(ctx *cmd.Context) error {
+	c.setupOutput(ctx)
+	report, err := runBench(c.dir, c.writes, c.entryBytes)
+	if err != nil {
+		return reportExitCode(ctx, errors.Trace(err))
+	}
+	if err := c.out.Write(ctx, report); err != nil {
+		return reportExitCode(ctx, errors.Trace(err))
+	}
+	if report.Status == preflightFail {
+		return reportExitCode(ctx, withExitCode(errors.Errorf("%q is too slow for raft", c.dir), exitValidation))
+	}
+	return nil
+}
+
+// runBench commits writes entries of entryBytes each, one per
+// transaction, to a scratch bolt file in dir and reports how long the
+// commits took.
+func runBench(dir string, writes, entryBytes int) (*benchReport, error) {
+	scratch, err := ioutil.TempDir(dir, ".rebootstrap-raft-bench-")
+	if err != nil {
+		return nil, errors.Annotatef(err, "creating scratch directory in %q", dir)
+	}
+	defer os.RemoveAll(scratch)
+	db, err := bbolt.Open(filepath.Join(scratch, "bench"), 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer db.Close()
+
+	value := make([]byte, entryBytes)
+	latencies := make([]time.Duration, writes)
+	start := time.Now()
+	for i := range latencies {
+		commitStart := time.Now()
+		err := db.Update(func(tx *bbolt.Tx) error {
+			bucket, err := tx.CreateBucketIfNotExists(benchBucket)
+			if err != nil {
+				return err
+			}
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, uint64(i+1))
+			return bucket.Put(key, value)
+		})
+		if err != nil {
+			return nil, errors.Annotate(err, "writing to the scratch store")
+		}
+		latencies[i] = time.Since(commitStart)
+	}
+	elapsed := time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p int) time.Duration {
+		return latencies[(len(latencies)-1)*p/100]
+	}
+	millis := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+	report := &benchReport{
+		SchemaVersion:    outputSchemaVersion,
+		Path:             dir,
+		Writes:           writes,
+		EntryBytes:       entryBytes,
+		Seconds:          elapsed.Seconds(),
+		CommitsPerSecond: float64(writes) / elapsed.Seconds(),
+		BytesPerSecond:   float64(writes*entryBytes) / elapsed.Seconds(),
+		P50Millis:        millis(percentile(50)),
+		P99Millis:        millis(percentile(99)),
+		MaxMillis:        millis(latencies[len(latencies)-1]),
+		Status:           preflightOK,
+	}
+	p99 := percentile(99)
+	switch {
+	case p99 > benchFailLatency:
+		report.Status = preflightFail
+		report.Problems = append(report.Problems, fmt.Sprintf("99%% of commits took up to %v; raft needs well under %v", p99.Round(time.Millisecond), benchFailLatency))
+	case p99 > benchWarnLatency:
+		report.Status = preflightWarn
+		report.Problems = append(report.Problems, fmt.Sprintf("99%% of commits took up to %v; over %v makes raft struggle under load", p99.Round(time.Millisecond), benchWarnLatency))
+	}
+	if report.CommitsPerSecond < benchMinRate {
+		if report.Status == preflightOK {
+			report.Status = preflightWarn
+		}
+		report.Problems = append(report.Problems, fmt.Sprintf("only %.0f commits a second; a busy controller needs at least %d", report.CommitsPerSecond, benchMinRate))
+	}
+	return report, nil
+}
+
+func formatBenchReport(writer io.Writer, value interface{}) error {
+	report, ok := value.(*benchReport)
+	if !ok {
+		return errors.Errorf("expected *benchReport, got %T", value)
+	}
+	fmt.Fprintf(writer, "Path:     %s\n", report.Path)
+	fmt.Fprintf(writer, "Commits:  %d of %s in %.2fs\n", report.Writes, humanize.IBytes(uint64(report.EntryBytes)), report.Seconds)
+	fmt.Fprintf(writer, "Rate:     %.0f commits/s, %s/s\n", report.CommitsPerSecond, humanize.IBytes(uint64(report.BytesPerSecond)))
+	fmt.Fprintf(writer, "Latency:  p50 %.1fms, p99 %.1fms, max %.1fms\n", report.P50Millis, report.P99Millis, report.MaxMillis)
+	for _, problem := range report.Problems {
+		fmt.Fprintf(writer, "  %s\n", problem)
+	}
+	switch report.Status {
+	case preflightOK:
+		fmt.Fprintln(writer, "The disk is fast enough for raft.")
+	case preflightWarn:
+		fmt.Fprintln(writer, "The disk is slow for raft; expect elections under load.")
+	default:
+		fmt.Fprintln(writer, "The disk is too slow for raft.")
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/raft-boltdb/v2"
+	"github.com/juju/errors"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+// readOldStoreState returns the highest index and term recorded in
+// an old raft directory, looking at both its bolt log store and its
+// snapshots. The log store is opened read-only.
+func readOldStoreState(dir string) (index, term uint64, _ error) {
+	if _, err := os.Stat(filepath.Join(dir, "logs")); err == nil {
+		store, err := openStoreReadOnly(dir)
+		if err != nil {
+			return 0, 0, errors.Trace(err)
+		}
+		defer store.Close()
+		index, err = store.LastIndex()
+		if err != nil {
+			return 0, 0, errors.Annotate(err, "reading last index")
+		}
+		term, err = store.GetUint64(rebootstrap.KeyCurrentTerm)
+		if err != nil && err != raftboltdb.ErrKeyNotFound {
+			return 0, 0, errors.Annotate(err, "reading current term")
+		}
+	}
+	_, meta, err := findNewestSnapshot(filepath.Join(dir, "snapshots"))
+	if err != nil && !errors.IsNotFound(err) {
+		return 0, 0, errors.Trace(err)
+	}
+	if meta != nil {
+		if meta.Index > index {
+			index = meta.Index
+		}
+		if meta.Term > term {
+			term = meta.Term
+		}
+	}
+	if index == 0 && term == 0 {
+		return 0, 0, errors.NotFoundf("raft state in %q", dir)
+	}
+	return index, term, nil
+}
+
+// readOldStoreTail reads what --retain-old-logs carries over from an
+// old raft directory: its newest snapshot (nil if there isn't one)
+// and the log entries after it. Without a snapshot the log must
+// start at index 1, since nothing else covers the entries before it.
+func readOldStoreTail(dir string) (*sourceSnapshot, []*raft.Log, error) {
+	snapshot, err := readSourceSnapshot(filepath.Join(dir, "snapshots"))
+	if errors.IsNotFound(err) || os.IsNotExist(errors.Cause(err)) {
+		snapshot = nil
+	} else if err != nil {
+		return nil, nil, errors.Annotate(err, "reading snapshot")
+	}
+	store, err := openStoreReadOnly(dir)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	defer store.Close()
+	first, err := store.FirstIndex()
+	if err != nil {
+		return nil, nil, errors.Annotate(err, "reading first index")
+	}
+	last, err := store.LastIndex()
+	if err != nil {
+		return nil, nil, errors.Annotate(err, "reading last index")
+	}
+	from := first
+	switch {
+	case snapshot != nil && snapshot.Meta.Index+1 >= first:
+		from = snapshot.Meta.Index + 1
+	case snapshot != nil:
+		return nil, nil, errors.Errorf("log starts at %d, leaving a gap after snapshot at index %d", first, snapshot.Meta.Index)
+	case first > 1:
+		return nil, nil, errors.Errorf("log starts at %d and there's no snapshot", first)
+	}
+	var entries []*raft.Log
+	for index := from; last > 0 && index <= last; index++ {
+		var entry raft.Log
+		if err := store.GetLog(index, &entry); err != nil {
+			return nil, nil, errors.Annotatef(err, "reading entry %d", index)
+		}
+		entries = append(entries, &entry)
+	}
+	return snapshot, entries, nil
+}
+
+// readSourceStore reads what --source-raft-dir copies: the newest
+// snapshot, the log entries after it and the current term.
+func readSourceStore(dir string) (*rebootstrap.StoreCopy, error) {
+	snapshot, entries, err := readOldStoreTail(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	_, term, err := readOldStoreState(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	copied := &rebootstrap.StoreCopy{Entries: entries, CurrentTerm: term}
+	if snapshot != nil {
+		meta := snapshot.Meta
+		copied.Snapshot, copied.SnapshotMeta = snapshot.Data, &meta
+	}
+	return copied, nil
+}
@@ -0,0 +1,212 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"go.etcd.io/bbolt"
+	"gopkg.in/yaml.v2"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+const bundleDoc = `
+
+Build the raft store for every controller in one run and pack each
+into its own tarball, raft-machine-<id>.tar.gz in --out-dir, for
+controllers that can't run the tool themselves (air-gapped machines or
+minimal images). The configuration is generated from MongoDB as
+bootstrap does, and each store is written with that machine as its
+local server. A SHA256SUMS file lists the tarballs' digests.
+
+Nothing on this machine's raft directory is touched. On each
+controller, with its machine agent stopped and the old raft directory
+removed, unpack the tarball as root into an empty raft directory.
+
+`
+
+// bundleSums is the checksum file written beside the tarballs.
+const bundleSums = "SHA256SUMS"
+
+type bundleCommand struct {
+	cmd.CommandBase
+	logFlags
+	mongoFlags
+	dataDirFlags
+	machineID    string
+	outDir       string
+	apiPort      int
+	minVoters    int
+	allowEven    bool
+	logStoreType string
+	idScheme     string
+	seedLeases   bool
+}
+
+// Info is part of cmd.Command.
+func (c *bundleCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "bundle",
+		Args:    "--machine-id <id> --out-dir <dir>",
+		Purpose: "Write a raft store tarball for every controller.",
+		Doc:     strings.TrimSpace(bundleDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *bundleCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	c.logFlags.setFlags(f)
+	c.dataDirFlags.setFlags(f)
+	c.mongoFlags.setFlags(f)
+	f.StringVar(&c.machineID, "machine-id", "", "ID of this Juju controller machine, whose credentials are used for MongoDB")
+	f.StringVar(&c.outDir, "out-dir", "", "directory to write the tarballs into")
+	f.IntVar(&c.apiPort, "api-port", 17070, "the API port of the Juju controller")
+	f.IntVar(&c.minVoters, "min-voters", 1, "fail if the generated configuration has fewer voters than this")
+	f.BoolVar(&c.allowEven, "allow-even-voters", false, "allow a configuration with an even number of voters")
+	f.StringVar(&c.logStoreType, "log-store", boltLogStore, "log store backend to create (bolt or wal)")
+	f.StringVar(&c.idScheme, "server-id-scheme", rebootstrap.IDSchemeMachineID, "how to write server ids: machine-id (\"0\") or tag (\"machine-0\")")
+	f.BoolVar(&c.seedLeases, "seed-leases", false, "write an initial snapshot holding the lease holders recorded in MongoDB into every store")
+}
+
+// Init is part of cmd.Command.
+func (c *bundleCommand) Init(args []string) error {
+	if err := c.setupLogging(false); err != nil {
+		return errors.Trace(err)
+	}
+	if c.machineID == "" {
+		return errors.Errorf("--machine-id is required")
+	}
+	if c.outDir == "" {
+		return errors.Errorf("--out-dir is required")
+	}
+	if err := c.dataDirFlags.resolve(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := c.mongoFlags.validate(c.agentConfFile(c.machineID), c.hostfsPrefix); err != nil {
+		return errors.Trace(err)
+	}
+	if c.minVoters < 1 {
+		return errors.Errorf("--min-voters must be at least 1")
+	}
+	if c.logStoreType != boltLogStore && c.logStoreType != walLogStore {
+		return errors.Errorf("--log-store must be %q or %q", boltLogStore, walLogStore)
+	}
+	switch c.idScheme {
+	case rebootstrap.IDSchemeMachineID, rebootstrap.IDSchemeTag:
+	default:
+		return errors.Errorf("--server-id-scheme must be %q or %q", rebootstrap.IDSchemeMachineID, rebootstrap.IDSchemeTag)
+	}
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *bundleCommand) Run(ctx *cmd.Context) error {
+	c.setupOutput(ctx)
+	stdCtx, cancel := interruptContext()
+	defer cancel()
+	return reportExitCode(ctx, c.run(ctx, stdCtx))
+}
+
+func (c *bundleCommand) run(ctx *cmd.Context, stdCtx context.Context) error {
+	session, err := c.connect(stdCtx, c.machineID, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer session.Close()
+	servers, err := rebootstrap.PlanServers(stdCtx, session, c.apiPort, c.minVoters, c.allowEven)
+	if err != nil {
+		return withExitCode(err, exitValidation)
+	}
+	// Every store gets the same snapshot, so the controllers agree
+	// on the leases however long the run takes.
+	var snapshot []byte
+	if c.seedLeases {
+		leases, err := rebootstrap.ReadLeaseSnapshot(stdCtx, session)
+		if err != nil {
+			return errors.Annotate(err, "getting leases")
+		}
+		logger.Infof("Got %d lease holders.", len(leases.Entries))
+		if snapshot, err = yaml.Marshal(leases); err != nil {
+			return errors.Annotate(err, "marshalling lease snapshot")
+		}
+	}
+
+	if err := os.MkdirAll(c.outDir, 0700); err != nil {
+		return errors.Trace(err)
+	}
+	workDir, err := ioutil.TempDir("", "rebootstrap-raft")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	fmt.Fprintln(ctx.Stdout, "Configuration:")
+	writeServers(ctx.Stdout, "  ", servers)
+	var sums strings.Builder
+	for _, server := range servers.Servers {
+		machineID := string(server.ID)
+		name := "raft-machine-" + machineID + ".tar.gz"
+		path := filepath.Join(c.outDir, name)
+		if err := c.writeBundle(stdCtx, filepath.Join(workDir, machineID), path, machineID, servers, snapshot); err != nil {
+			return withExitCode(errors.Annotatef(err, "machine %s", machineID), exitWriteFailed)
+		}
+		digest, err := fileDigest(path)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		fmt.Fprintf(&sums, "%s  %s\n", digest, name)
+		fmt.Fprintf(ctx.Stdout, "Wrote %s.\n", path)
+	}
+	err = ioutil.WriteFile(filepath.Join(c.outDir, bundleSums), []byte(sums.String()), 0600)
+	return errors.Annotate(err, "writing checksums")
+}
+
+// writeBundle writes the store for machineID in dir and packs it
+// into a tarball at path.
+func (c *bundleCommand) writeBundle(ctx context.Context, dir, path, machineID string, servers raft.Configuration, snapshot []byte) error {
+	if _, err := os.Stat(path); err == nil {
+		return errors.Errorf("%q already exists", path)
+	} else if !os.IsNotExist(err) {
+		return errors.Trace(err)
+	}
+	opts := rebootstrap.StoreOptions{
+		MachineID:       machineID,
+		IDScheme:        c.idScheme,
+		ProtocolVersion: raft.ProtocolVersionMax,
+		Builder:         c.storeBuilder(),
+		SnapshotRetain:  jujudSnapshotRetention,
+	}
+	if err := rebootstrap.WriteStore(ctx, dir, servers, snapshot, opts); err != nil {
+		return errors.Trace(err)
+	}
+	if err := writeManifest(dir); err != nil {
+		return errors.Trace(err)
+	}
+	// The owner is set when the tarball is unpacked on the
+	// controller.
+	if err := applyModes(dir); err != nil {
+		return errors.Annotate(err, "setting modes")
+	}
+	return errors.Annotate(writeTarball(dir, path), "packing store")
+}
+
+// storeBuilder returns the builder for the --log-store chosen.
+func (c *bundleCommand) storeBuilder() rebootstrap.StoreBuilder {
+	if c.logStoreType == walLogStore {
+		return rebootstrap.WALStoreBuilder{}
+	}
+	return rebootstrap.BoltStoreBuilder{Options: &bbolt.Options{Timeout: time.Second}}
+}
@@ -0,0 +1,184 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+const checkDoc = `
+
+Compare the running raft configuration with the replicaset, for
+running periodically from Nagios, cron or similar. The configuration
+is taken from the local machine agent's raft worker (over its
+introspection socket) and compared with what bootstrap would generate
+from MongoDB. One line is printed and the exit code is the usual
+monitoring plugin one:
+
+  0 OK        the configuration matches the replicaset
+  1 WARNING   the same servers, but an address or suffrage differs
+  2 CRITICAL  servers are missing or extra, there's no leader, or the
+              agent's raft worker can't be read
+  3 UNKNOWN   MongoDB couldn't be read
+
+`
+
+// Monitoring plugin states, which are also the exit codes.
+const (
+	checkOK       = 0
+	checkWarning  = 1
+	checkCritical = 2
+	checkUnknown  = 3
+)
+
+var checkStateNames = map[int]string{
+	checkOK:       "OK",
+	checkWarning:  "WARNING",
+	checkCritical: "CRITICAL",
+	checkUnknown:  "UNKNOWN",
+}
+
+type checkCommand struct {
+	cmd.CommandBase
+	logFlags
+	mongoFlags
+	dataDirFlags
+	machineID string
+	apiPort   int
+}
+
+// Info is part of cmd.Command.
+func (c *checkCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "check",
+		Args:    "--machine-id <id>",
+		Purpose: "Check the live raft configuration against the replicaset.",
+		Doc:     strings.TrimSpace(checkDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *checkCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	c.logFlags.setFlags(f)
+	c.dataDirFlags.setFlags(f)
+	c.mongoFlags.setFlags(f)
+	f.StringVar(&c.machineID, "machine-id", "", "ID of this Juju controller machine")
+	f.IntVar(&c.apiPort, "api-port", 17070, "the API port of the Juju controller")
+}
+
+// Init is part of cmd.Command.
+func (c *checkCommand) Init(args []string) error {
+	if err := c.setupLogging(false); err != nil {
+		return errors.Trace(err)
+	}
+	if c.machineID == "" {
+		return errors.Errorf("--machine-id is required")
+	}
+	if err := c.dataDirFlags.resolve(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := c.mongoFlags.validate(c.agentConfFile(c.machineID), c.hostfsPrefix); err != nil {
+		return errors.Trace(err)
+	}
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *checkCommand) Run(ctx *cmd.Context) error {
+	c.setupOutput(ctx)
+	stdCtx, cancel := interruptContext()
+	defer cancel()
+	state, summary := c.check(stdCtx)
+	fmt.Fprintf(ctx.Stdout, "RAFT %s - %s\n", checkStateNames[state], summary)
+	if state == checkOK {
+		return nil
+	}
+	return cmd.NewRcPassthroughError(state)
+}
+
+// check returns the state and a one-line summary.
+func (c *checkCommand) check(ctx context.Context) (int, string) {
+	body, err := fetchDepengine(introspectionSocket(c.machineID))
+	if err != nil {
+		return checkCritical, fmt.Sprintf("can't read the machine agent's engine report: %v", err)
+	}
+	report, err := parseRaftReport(body)
+	if err != nil {
+		return checkCritical, err.Error()
+	}
+	if len(report.ClusterConfig.Servers) == 0 {
+		return checkCritical, "the raft worker reports no configuration"
+	}
+
+	session, err := c.connect(ctx, c.machineID, nil)
+	if err != nil {
+		return checkUnknown, err.Error()
+	}
+	defer session.Close()
+	expected, err := rebootstrap.PlanServers(ctx, session, c.apiPort, 1, true)
+	if err != nil {
+		return checkUnknown, fmt.Sprintf("generating configuration: %v", err)
+	}
+
+	state, problems := compareLiveConfig(report, expected)
+	if report.Leader == "" {
+		state = checkCritical
+		problems = append([]string{"no leader"}, problems...)
+	}
+	if state == checkOK {
+		return checkOK, fmt.Sprintf("%d servers match the replicaset, leader %s", len(expected.Servers), report.Leader)
+	}
+	return state, strings.Join(problems, "; ")
+}
+
+// compareLiveConfig compares the raft worker's configuration with the
+// expected one, returning the state and what differs.
+func compareLiveConfig(report *raftReport, expected raft.Configuration) (int, []string) {
+	state := checkOK
+	var problems []string
+	seen := make(map[string]bool)
+	for _, server := range expected.Servers {
+		id := string(server.ID)
+		seen[id] = true
+		live, ok := report.ClusterConfig.Servers[id]
+		switch {
+		case !ok:
+			state = checkCritical
+			problems = append(problems, "machine "+id+" is missing")
+			continue
+		case live.Address != string(server.Address):
+			problems = append(problems, fmt.Sprintf("machine %s has address %s, not %s", id, live.Address, server.Address))
+		case live.Suffrage != server.Suffrage.String():
+			problems = append(problems, fmt.Sprintf("machine %s is a %s, not a %s", id, live.Suffrage, server.Suffrage))
+		default:
+			continue
+		}
+		if state == checkOK {
+			state = checkWarning
+		}
+	}
+	var extra []string
+	for id := range report.ClusterConfig.Servers {
+		if !seen[id] {
+			extra = append(extra, id)
+		}
+	}
+	sort.Strings(extra)
+	for _, id := range extra {
+		state = checkCritical
+		problems = append(problems, "machine "+id+" isn't a replicaset member")
+	}
+	return state, problems
+}
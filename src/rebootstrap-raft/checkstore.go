@@ -0,0 +1,274 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/raft-boltdb/v2"
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"go.etcd.io/bbolt"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+const checkStoreDoc = `
+
+Check a raft store for damage, reporting each problem found. The bolt
+file is checked as "bbolt check" does (page references, freelist and
+so on), then the raft data in it: the log's keys must be contiguous
+indexes, every entry must decode with its index matching its key and
+terms never going backwards, configuration entries must decode to a
+usable configuration, the current term must be recorded and not be
+behind the log, and if the log doesn't start at index 1 a valid
+snapshot must cover the entries before it.
+
+The store is only read, so this is safe on a live controller. The
+exit code is 0 if the store is sound and 7 if anything is wrong.
+
+`
+
+// The buckets raft-boltdb keeps the log and the stable store in.
+var (
+	boltLogsBucket = []byte("logs")
+	boltConfBucket = []byte("conf")
+)
+
+// maxStoreProblems is how many problems of each kind check-store
+// reports before just counting them.
+const maxStoreProblems = 20
+
+type checkStoreCommand struct {
+	cmd.CommandBase
+	logFlags
+	dataDirFlags
+	raftDir string
+}
+
+// Info is part of cmd.Command.
+func (c *checkStoreCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "check-store",
+		Args:    "[<raft-dir>]",
+		Purpose: "Check a raft store for damage.",
+		Doc:     strings.TrimSpace(checkStoreDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *checkStoreCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	c.logFlags.setFlags(f)
+	c.dataDirFlags.setFlags(f)
+}
+
+// Init is part of cmd.Command.
+func (c *checkStoreCommand) Init(args []string) error {
+	if err := c.setupLogging(false); err != nil {
+		return errors.Trace(err)
+	}
+	if len(args) > 0 {
+		c.raftDir, args = args[0], args[1:]
+	} else {
+		if err := c.dataDirFlags.resolve(); err != nil {
+			return errors.Trace(err)
+		}
+		c.raftDir = c.getJujuPath("raft")
+	}
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *checkStoreCommand) Run(ctx *cmd.Context) error {
+	c.setupOutput(ctx)
+	return reportExitCode(ctx, c.run(ctx))
+}
+
+func (c *checkStoreCommand) run(ctx *cmd.Context) error {
+	path, copyDir, err := readableBoltFile(filepath.Join(c.raftDir, "logs"))
+	if err != nil {
+		return errors.Annotate(err, "finding the bolt log store")
+	}
+	if copyDir != "" {
+		defer os.RemoveAll(copyDir)
+	}
+	check := &storeCheck{}
+	check.checkBolt(path)
+	if len(check.problems) == 0 {
+		check.checkRaft(path)
+		check.checkSnapshotCoverage(filepath.Join(c.raftDir, "snapshots"))
+	}
+	for _, problem := range check.problems {
+		fmt.Fprintln(ctx.Stdout, problem)
+	}
+	if len(check.problems) > 0 {
+		return withExitCode(errors.Errorf("found %d problems in %q", len(check.problems), c.raftDir), exitValidation)
+	}
+	fmt.Fprintf(ctx.Stdout, "Store %s is sound: entries %d to %d, current term %d.\n", c.raftDir, check.first, check.last, check.currentTerm)
+	return nil
+}
+
+// storeCheck collects the problems found in a store.
+type storeCheck struct {
+	problems    []string
+	first       uint64
+	last        uint64
+	currentTerm uint64
+}
+
+func (s *storeCheck) addf(format string, args ...interface{}) {
+	s.problems = append(s.problems, fmt.Sprintf(format, args...))
+}
+
+// checkBolt checks the bolt file's structure and the layout of the
+// log bucket. It leaves the entries themselves to checkRaft.
+func (s *storeCheck) checkBolt(path string) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		s.addf("can't open bolt file: %v", err)
+		return
+	}
+	defer db.Close()
+	err = db.View(func(tx *bbolt.Tx) error {
+		count := 0
+		for err := range tx.Check() {
+			if count++; count <= maxStoreProblems {
+				s.addf("bolt: %v", err)
+			}
+		}
+		if count > maxStoreProblems {
+			s.addf("bolt: ... and %d more", count-maxStoreProblems)
+		}
+		if tx.Bucket(boltConfBucket) == nil {
+			s.addf("the stable store bucket %q is missing", boltConfBucket)
+		}
+		logs := tx.Bucket(boltLogsBucket)
+		if logs == nil {
+			s.addf("the log bucket %q is missing", boltLogsBucket)
+			return nil
+		}
+		var prev uint64
+		gaps := 0
+		return logs.ForEach(func(k, v []byte) error {
+			if len(k) != 8 {
+				s.addf("log key %x isn't an 8 byte index", k)
+				return nil
+			}
+			index := binary.BigEndian.Uint64(k)
+			if prev != 0 && index != prev+1 {
+				if gaps++; gaps <= maxStoreProblems {
+					s.addf("entries %d to %d are missing from the log", prev+1, index-1)
+				}
+			}
+			if s.first == 0 {
+				s.first = index
+			}
+			prev, s.last = index, index
+			return nil
+		})
+	})
+	if err != nil {
+		s.addf("reading bolt file: %v", err)
+	}
+}
+
+// checkRaft decodes every log entry and the stable store keys.
+func (s *storeCheck) checkRaft(path string) {
+	store, err := raftboltdb.New(raftboltdb.Options{
+		Path:        path,
+		BoltOptions: &bbolt.Options{ReadOnly: true, Timeout: time.Second},
+	})
+	if err != nil {
+		s.addf("can't open log store: %v", err)
+		return
+	}
+	defer store.Close()
+
+	var prevTerm uint64
+	bad := 0
+	for index := s.first; index <= s.last && index > 0; index++ {
+		var entry raft.Log
+		problem := ""
+		if err := store.GetLog(index, &entry); err != nil {
+			problem = fmt.Sprintf("entry %d can't be read: %v", index, err)
+		} else if entry.Index != index {
+			problem = fmt.Sprintf("entry %d records index %d", index, entry.Index)
+		} else if entry.Term < prevTerm {
+			problem = fmt.Sprintf("entry %d has term %d, behind the %d before it", index, entry.Term, prevTerm)
+		} else if entry.Type == raft.LogConfiguration {
+			config, err := decodeConfiguration(entry.Data)
+			if err == nil {
+				err = rebootstrap.ValidateUnique(config)
+			}
+			if err == nil && len(config.Servers) == 0 {
+				err = errors.New("no servers")
+			}
+			if err != nil {
+				problem = fmt.Sprintf("configuration entry %d is bad: %v", index, err)
+			}
+		}
+		if problem != "" {
+			if bad++; bad <= maxStoreProblems {
+				s.addf("%s", problem)
+			}
+			continue
+		}
+		prevTerm = entry.Term
+	}
+	if bad > maxStoreProblems {
+		s.addf("... and %d more bad entries", bad-maxStoreProblems)
+	}
+
+	s.currentTerm, err = store.GetUint64(rebootstrap.KeyCurrentTerm)
+	if err == raftboltdb.ErrKeyNotFound {
+		s.addf("the current term isn't recorded in the stable store")
+	} else if err != nil {
+		s.addf("the current term can't be read: %v", err)
+	} else if s.currentTerm < prevTerm {
+		s.addf("the current term %d is behind the log's last term %d", s.currentTerm, prevTerm)
+	}
+}
+
+// checkSnapshotCoverage makes sure that if the log has been compacted
+// a valid snapshot covers the entries that were removed.
+func (s *storeCheck) checkSnapshotCoverage(dir string) {
+	if s.first <= 1 {
+		return
+	}
+	snapshots, err := scanSnapshots(dir)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		s.addf("can't read snapshots: %v", err)
+		return
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.problem != "" {
+			s.addf("snapshot %s is broken: %s", snapshot.name, snapshot.problem)
+		}
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.meta != nil && snapshot.meta.Index+1 >= s.first {
+			return
+		}
+	}
+	s.addf("the log starts at %d but no valid snapshot covers the entries before it", s.first)
+}
+
+// decodeConfiguration decodes a configuration entry, which
+// raft.DecodeConfiguration would panic over if it's damaged.
+func decodeConfiguration(data []byte) (config raft.Configuration, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("%v", r)
+		}
+	}()
+	return raft.DecodeConfiguration(data), nil
+}
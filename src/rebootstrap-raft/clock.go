@@ -0,0 +1,116 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+// defaultMaxClockSkew is how far a peer's clock can be from ours
+// before we warn. Raft's own timeouts are measured locally, but lease
+// expiries are compared across controllers and skew of more than a
+// second or two shows up as leadership flapping.
+const defaultMaxClockSkew = 2 * time.Second
+
+// measureSkew works out how far ahead of the local clock a remote
+// clock is, given the remote time read between start and end. The
+// remote reading is assumed to have been taken half way through, so
+// the result is only good to within half the round trip.
+func measureSkew(remote, start, end time.Time) (skew, uncertainty time.Duration) {
+	rtt := end.Sub(start)
+	return remote.Sub(start.Add(rtt / 2)), rtt / 2
+}
+
+// mongoClockSkew compares the local clock with the MongoDB server's.
+func mongoClockSkew(ctx context.Context, session *mgo.Session) (time.Duration, time.Duration, error) {
+	var result struct {
+		LocalTime time.Time `bson:"localTime"`
+	}
+	var start, end time.Time
+	err := rebootstrap.WithSession(ctx, session, func(s *mgo.Session) error {
+		start = time.Now()
+		err := s.Run("isMaster", &result)
+		end = time.Now()
+		return err
+	})
+	if err != nil {
+		return 0, 0, errors.Annotate(err, "reading MongoDB server time")
+	}
+	if result.LocalTime.IsZero() {
+		return 0, 0, errors.NotFoundf("localTime in isMaster result")
+	}
+	skew, uncertainty := measureSkew(result.LocalTime, start, end)
+	return skew, uncertainty, nil
+}
+
+// remoteClockSkew compares the local clock with another controller's,
+// read with date over its remote.
+func remoteClockSkew(r remote) (time.Duration, time.Duration, error) {
+	start := time.Now()
+	out, err := r.Run("date", "+%s.%N")
+	if err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	end := time.Now()
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return 0, 0, errors.Annotatef(err, "parsing time %q", out)
+	}
+	remoteTime := time.Unix(0, int64(seconds*float64(time.Second)))
+	skew, uncertainty := measureSkew(remoteTime, start, end)
+	return skew, uncertainty, nil
+}
+
+// skewWarning returns a warning if skew is certainly beyond max, or
+// "" if it isn't.
+func skewWarning(what string, skew, uncertainty, max time.Duration) string {
+	magnitude := skew
+	if magnitude < 0 {
+		magnitude = -magnitude
+	}
+	logger.Debugf("%s clock is %v ahead (+/- %v)", what, skew, uncertainty)
+	if magnitude-uncertainty <= max {
+		return ""
+	}
+	return fmt.Sprintf("%s clock is %v ahead of this machine's (more than --max-clock-skew %v) - check NTP before restarting the agents",
+		what, skew.Round(time.Millisecond), max)
+}
+
+// warnRemoteClocks logs a warning for each of the other controllers
+// whose clock is too far from ours, unless the check is disabled.
+func (c *rebootstrapCommand) warnRemoteClocks(controllers []remoteController) {
+	if c.maxClockSkew <= 0 {
+		return
+	}
+	for _, warning := range checkRemoteClocks(controllers, c.maxClockSkew) {
+		logger.Warningf("%s", warning)
+	}
+}
+
+// checkRemoteClocks compares the clocks of the other controllers with
+// ours, returning warnings for any that are too far out.
+func checkRemoteClocks(controllers []remoteController, max time.Duration) []string {
+	var warnings []string
+	for _, controller := range controllers {
+		what := fmt.Sprintf("machine %s (%s)", controller.machineID, controller.remote)
+		skew, uncertainty, err := remoteClockSkew(controller.remote)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("can't read the clock on %s: %v", what, err))
+			continue
+		}
+		if warning := skewWarning(what, skew, uncertainty, max); warning != "" {
+			warnings = append(warnings, warning)
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,308 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"github.com/juju/replicaset"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/yaml.v2"
+)
+
+const collectDoc = `
+
+Gather what's needed to diagnose a broken raft store into a single
+gzipped tarball to attach to a support case:
+
+ - the machine agent's agent.conf, with every credential redacted
+ - the replicaset status and config (if MongoDB can be reached)
+ - a listing of the raft directory with sizes and SHA-256 checksums
+ - any tool log files named with --tool-log
+
+Anything that can't be collected is noted in errors.txt in the bundle
+rather than failing the run. Every file is passed through the same
+redaction as the tool's own output.
+
+`
+
+// secretAgentConfKeys are the agent.conf keys whose values are
+// replaced in a collected agent.conf. Some of these are multi-line
+// PEM blocks, which redacting by value wouldn't catch.
+var secretAgentConfKeys = map[string]bool{
+	"statepassword":  true,
+	"apipassword":    true,
+	"oldpassword":    true,
+	"sharedsecret":   true,
+	"caprivatekey":   true,
+	"privatekey":     true,
+	"controllerkey":  true,
+	"systemidentity": true,
+}
+
+type collectCommand struct {
+	cmd.CommandBase
+	logFlags
+	mongoFlags
+	dataDirFlags
+	machineID string
+	raftDir   string
+	output    string
+	toolLogs  string
+	noMongo   bool
+
+	mongoErr error
+}
+
+// Info is part of cmd.Command.
+func (c *collectCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "collect",
+		Args:    "--machine-id <id>",
+		Purpose: "Gather a redacted support bundle.",
+		Doc:     strings.TrimSpace(collectDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *collectCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	c.logFlags.setFlags(f)
+	c.dataDirFlags.setFlags(f)
+	c.mongoFlags.setFlags(f)
+	f.StringVar(&c.machineID, "machine-id", "", "ID of this Juju controller machine")
+	f.StringVar(&c.raftDir, "raft-dir", "", "raft directory location (default <data-dir>/raft)")
+	f.StringVar(&c.output, "output", "", "where to write the bundle (default rebootstrap-raft-collect-<time>.tar.gz)")
+	f.StringVar(&c.toolLogs, "tool-log", "", "comma-separated rebootstrap-raft log files (from --log-file) to include")
+	f.BoolVar(&c.noMongo, "no-mongo", false, "don't try to get the replicaset status")
+}
+
+// Init is part of cmd.Command.
+func (c *collectCommand) Init(args []string) error {
+	if err := c.setupLogging(false); err != nil {
+		return errors.Trace(err)
+	}
+	if c.machineID == "" {
+		return errors.Errorf("--machine-id is required")
+	}
+	if err := c.dataDirFlags.resolve(); err != nil {
+		return errors.Trace(err)
+	}
+	if c.raftDir == "" {
+		c.raftDir = c.getJujuPath("raft")
+	}
+	if c.output == "" {
+		c.output = fmt.Sprintf("rebootstrap-raft-collect-%s.tar.gz", time.Now().UTC().Format("20060102-150405"))
+	}
+	if !c.noMongo {
+		// A bundle is most wanted when things are broken, so a
+		// missing password only means the MongoDB part is skipped.
+		c.mongoErr = c.mongoFlags.validate(c.agentConfFile(c.machineID), c.hostfsPrefix)
+	}
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *collectCommand) Run(ctx *cmd.Context) error {
+	c.setupOutput(ctx)
+	stdCtx, cancel := interruptContext()
+	defer cancel()
+
+	bundle := newBundle()
+	confPath := c.agentConfFile(c.machineID)
+	agentConf, err := readAgentConfig(confPath)
+	if err == nil {
+		var data []byte
+		if data, err = ioutil.ReadFile(confPath); err == nil {
+			data, err = redactAgentConf(data)
+		}
+		if err == nil {
+			bundle.add("agent.conf", data)
+		}
+	}
+	bundle.noteError("agent.conf", err)
+
+	if !c.noMongo {
+		bundle.noteError("replicaset", c.collectReplicaset(stdCtx, bundle, agentConf))
+	}
+
+	listing, err := listRaftDir(c.raftDir)
+	if err == nil {
+		bundle.add("raft-listing.txt", listing)
+	}
+	bundle.noteError("raft directory", err)
+
+	for _, path := range strings.Split(c.toolLogs, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			bundle.add(filepath.Join("logs", filepath.Base(path)), data)
+		}
+		bundle.noteError(path, err)
+	}
+
+	if err := bundle.write(c.output); err != nil {
+		return errors.Annotate(err, "writing bundle")
+	}
+	fmt.Fprintf(ctx.Stdout, "%s\n", c.output)
+	return nil
+}
+
+// collectReplicaset adds the replicaset status and config to bundle.
+func (c *collectCommand) collectReplicaset(ctx context.Context, bundle *supportBundle, agentConf *agentConfig) error {
+	if c.mongoErr != nil {
+		return errors.Trace(c.mongoErr)
+	}
+	session, err := c.connect(ctx, c.machineID, agentConf)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer session.Close()
+	session.SetMode(mgo.Monotonic, true)
+
+	var errs []string
+	if status, err := replicaset.CurrentStatus(session); err != nil {
+		errs = append(errs, "status: "+err.Error())
+	} else if err := bundle.addYAML("replicaset-status.yaml", status); err != nil {
+		errs = append(errs, "status: "+err.Error())
+	}
+	if config, err := replicaset.CurrentConfig(session); err != nil {
+		errs = append(errs, "config: "+err.Error())
+	} else if err := bundle.addYAML("replicaset-config.yaml", config); err != nil {
+		errs = append(errs, "config: "+err.Error())
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// redactAgentConf replaces the values of the credential keys in an
+// agent.conf.
+func redactAgentConf(data []byte) ([]byte, error) {
+	var conf yaml.MapSlice
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		return nil, errors.Annotate(err, "parsing agent.conf")
+	}
+	for i, item := range conf {
+		if key, ok := item.Key.(string); ok && secretAgentConfKeys[strings.ToLower(key)] {
+			conf[i].Value = redactedText
+		}
+	}
+	return yaml.Marshal(conf)
+}
+
+// listRaftDir lists every file under dir with its size, mode and
+// SHA-256 digest.
+func listRaftDir(dir string) ([]byte, error) {
+	var buf bytes.Buffer
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		digest := "-"
+		if info.Mode().IsRegular() {
+			if digest, err = fileDigest(path); err != nil {
+				digest = "error: " + err.Error()
+			}
+		}
+		fmt.Fprintf(&buf, "%s %12d %s %s  %s\n", info.Mode(), info.Size(),
+			info.ModTime().UTC().Format(time.RFC3339), digest, rel)
+		return nil
+	})
+	return buf.Bytes(), errors.Trace(err)
+}
+
+// supportBundle accumulates the files for a collected bundle.
+type supportBundle struct {
+	names  []string
+	files  map[string][]byte
+	errors []string
+}
+
+func newBundle() *supportBundle {
+	return &supportBundle{files: make(map[string][]byte)}
+}
+
+// add adds a file, redacting any registered secrets from it.
+func (b *supportBundle) add(name string, data []byte) {
+	if _, ok := b.files[name]; !ok {
+		b.names = append(b.names, name)
+	}
+	b.files[name] = []byte(secrets.redact(string(data)))
+}
+
+// addYAML adds v as a YAML file.
+func (b *supportBundle) addYAML(name string, v interface{}) error {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	b.add(name, data)
+	return nil
+}
+
+// noteError records why what couldn't be collected, if err is set.
+func (b *supportBundle) noteError(what string, err error) {
+	if err == nil {
+		return
+	}
+	logger.Warningf("collecting %s: %v", what, err)
+	b.errors = append(b.errors, fmt.Sprintf("%s: %v", what, err))
+}
+
+// write writes the bundle as a gzipped tarball at path.
+func (b *supportBundle) write(path string) error {
+	if len(b.errors) > 0 {
+		b.add("errors.txt", []byte(strings.Join(b.errors, "\n")+"\n"))
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for _, name := range b.names {
+		data := b.files[name]
+		header := &tar.Header{
+			Name:    filepath.ToSlash(filepath.Join(strings.TrimSuffix(filepath.Base(path), ".tar.gz"), name)),
+			Mode:    0600,
+			Size:    int64(len(data)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return errors.Trace(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := gz.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(f.Close())
+}
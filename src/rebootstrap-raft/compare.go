@@ -0,0 +1,225 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+const compareDoc = `
+
+Check that every controller would bootstrap the same configuration,
+before any store is written. The controllers are found from the
+replicaset; this tool is copied to each of the others over ssh (or
+juju ssh with --juju-controller) and a dry run of bootstrap is done on
+every controller, including this one. The server lists they generate
+are compared and any differences shown.
+
+Controllers that disagree (because one sees a different replicaset,
+has a different juju-ha-space view or a stale agent.conf) would each
+write a different cluster, which is how split-brain recoveries happen.
+Arguments after -- are passed to every dry run.
+
+`
+
+type compareCommand struct {
+	cmd.CommandBase
+	logFlags
+	mongoFlags
+	dataDirFlags
+	sshFlags
+	machineID string
+	apiPort   int
+	extraArgs []string
+}
+
+// Info is part of cmd.Command.
+func (c *compareCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "compare",
+		Args:    "--machine-id <id> [-- <bootstrap flags>]",
+		Purpose: "Check every controller would generate the same configuration.",
+		Doc:     strings.TrimSpace(compareDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *compareCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	c.logFlags.setFlags(f)
+	c.dataDirFlags.setFlags(f)
+	c.mongoFlags.setFlags(f)
+	c.sshFlags.setFlags(f)
+	f.StringVar(&c.machineID, "machine-id", "", "ID of this Juju controller machine")
+	f.IntVar(&c.apiPort, "api-port", 17070, "the API port of the Juju controller")
+}
+
+// Init is part of cmd.Command.
+func (c *compareCommand) Init(args []string) error {
+	if err := c.setupLogging(false); err != nil {
+		return errors.Trace(err)
+	}
+	if c.machineID == "" {
+		return errors.Errorf("--machine-id is required")
+	}
+	if err := c.dataDirFlags.resolve(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := c.mongoFlags.validate(c.agentConfFile(c.machineID), c.hostfsPrefix); err != nil {
+		return errors.Trace(err)
+	}
+	c.extraArgs = args
+	return nil
+}
+
+// machinePlan is the configuration one controller generated.
+type machinePlan struct {
+	machineID string
+	host      string
+	servers   []serverResult
+	err       error
+}
+
+// Run is part of cmd.Command.
+func (c *compareCommand) Run(ctx *cmd.Context) error {
+	c.setupOutput(ctx)
+	stdCtx, cancel := interruptContext()
+	defer cancel()
+	return reportExitCode(ctx, c.run(ctx, stdCtx))
+}
+
+func (c *compareCommand) run(ctx *cmd.Context, stdCtx context.Context) error {
+	progress := newProgress(ctx.Stderr, c.quiet)
+
+	done := progress.start("Finding controllers")
+	session, err := c.connect(stdCtx, c.machineID, nil)
+	if err != nil {
+		done(err)
+		return errors.Trace(err)
+	}
+	servers, err := rebootstrap.PlanServers(stdCtx, session, c.apiPort, 1, true)
+	session.Close()
+	done(err)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	controllers, err := otherControllers(servers, c.machineID, &c.sshFlags)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return errors.Annotate(err, "finding this executable")
+	}
+
+	done = progress.start("Planning this machine")
+	plans := []machinePlan{c.plan(localRemote{}, self, c.machineID)}
+	done(plans[0].err)
+	for _, controller := range controllers {
+		done := progress.start("Planning machine " + controller.machineID + " on " + controller.remote.String())
+		path, remove, err := pushFile(controller.remote, self, "rebootstrap-raft")
+		plan := machinePlan{machineID: controller.machineID, err: err}
+		if plan.err == nil {
+			plan = c.plan(controller.remote, path, controller.machineID)
+			remove()
+		}
+		plan.host = controller.remote.String()
+		done(plan.err)
+		plans = append(plans, plan)
+	}
+
+	mismatched := writePlanComparison(ctx.Stdout, plans)
+	if mismatched > 0 {
+		return withExitCode(errors.Errorf("%d controllers don't agree with this one", mismatched), exitValidation)
+	}
+	fmt.Fprintf(ctx.Stdout, "All %d controllers agree.\n", len(plans))
+	return nil
+}
+
+// plan dry-runs bootstrap for machineID with the copy of this tool at
+// path on r.
+func (c *compareCommand) plan(r remote, path, machineID string) machinePlan {
+	args := []string{
+		"--machine-id", machineID,
+		"--dry-run",
+		"--quiet",
+		"--format", "json",
+		"--api-port", strconv.Itoa(c.apiPort),
+	}
+	result, err := runRemoteBootstrap(r, path, append(args, c.extraArgs...)...)
+	plan := machinePlan{machineID: machineID, host: r.String(), err: err}
+	if err == nil {
+		plan.servers = result.Servers
+	}
+	return plan
+}
+
+// writePlanComparison shows each controller's plan against the first
+// one (this machine's), returning how many don't match it.
+func writePlanComparison(w io.Writer, plans []machinePlan) int {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "MACHINE\tHOST\tRESULT")
+	mismatched := 0
+	reference := plans[0]
+	for _, plan := range plans {
+		var result string
+		switch {
+		case plan.err != nil:
+			result = "error: " + plan.err.Error()
+			mismatched++
+		case reference.err != nil:
+			result = "can't compare"
+		case reflect.DeepEqual(plan.servers, reference.servers):
+			result = "same"
+		default:
+			result = "differs: " + diffServers(reference.servers, plan.servers)
+			mismatched++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", plan.machineID, plan.host, result)
+	}
+	tw.Flush()
+	return mismatched
+}
+
+// diffServers describes how got differs from want.
+func diffServers(want, got []serverResult) string {
+	wanted := make(map[string]serverResult)
+	for _, server := range want {
+		wanted[server.ID] = server
+	}
+	var diffs []string
+	for _, server := range got {
+		expected, ok := wanted[server.ID]
+		delete(wanted, server.ID)
+		switch {
+		case !ok:
+			diffs = append(diffs, "+"+server.ID)
+		case expected.Address != server.Address || expected.Suffrage != server.Suffrage:
+			diffs = append(diffs, fmt.Sprintf("%s %s/%s (not %s/%s)", server.ID,
+				server.Address, server.Suffrage, expected.Address, expected.Suffrage))
+		}
+	}
+	for _, server := range want {
+		if _, ok := wanted[server.ID]; ok {
+			diffs = append(diffs, "-"+server.ID)
+		}
+	}
+	if len(diffs) == 0 {
+		return "different order"
+	}
+	return strings.Join(diffs, ", ")
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+)
+
+const completionDoc = `
+
+Print a shell completion script for rebootstrap-raft's subcommands and
+flags. The shell can be bash or zsh. To use it for the current shell:
+
+    source <(rebootstrap-raft completion bash)
+
+or write it to /etc/bash_completion.d/rebootstrap-raft to have it
+loaded in every new shell.
+
+`
+
+type completionCommand struct {
+	cmd.CommandBase
+	shell string
+}
+
+// Info is part of cmd.Command.
+func (c *completionCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "completion",
+		Args:    "bash|zsh",
+		Purpose: "Print a shell completion script.",
+		Doc:     strings.TrimSpace(completionDoc),
+	}
+}
+
+// Init is part of cmd.Command.
+func (c *completionCommand) Init(args []string) error {
+	if len(args) < 1 {
+		return errors.Errorf("shell is required")
+	}
+	c.shell = args[0]
+	if c.shell != "bash" && c.shell != "zsh" {
+		return errors.Errorf("unsupported shell %q", c.shell)
+	}
+	return c.CommandBase.Init(args[1:])
+}
+
+// Run is part of cmd.Command.
+func (c *completionCommand) Run(ctx *cmd.Context) error {
+	if c.shell == "zsh" {
+		fmt.Fprintln(ctx.Stdout, "autoload -U +X bashcompinit && bashcompinit")
+	}
+	return writeBashCompletion(ctx.Stdout, append(subcommands(), c))
+}
+
+// commandFlags returns the flags a command accepts, as they'd be
+// typed on the command line.
+func commandFlags(command cmd.Command) []string {
+	f := gnuflag.NewFlagSet(command.Info().Name, gnuflag.ContinueOnError)
+	f.SetOutput(ioutil.Discard)
+	command.SetFlags(f)
+	var flags []string
+	f.VisitAll(func(flag *gnuflag.Flag) {
+		if len(flag.Name) == 1 {
+			flags = append(flags, "-"+flag.Name)
+		} else {
+			flags = append(flags, "--"+flag.Name)
+		}
+	})
+	sort.Strings(flags)
+	return flags
+}
+
+// writeBashCompletion writes a bash completion function covering the
+// given commands. Flags given without a subcommand are completed as
+// the bootstrap command's, since that's what runCommand does with
+// them.
+func writeBashCompletion(w io.Writer, commands []cmd.Command) error {
+	var names []string
+	var bootstrapFlags []string
+	cases := new(strings.Builder)
+	for _, command := range commands {
+		name := command.Info().Name
+		flags := commandFlags(command)
+		names = append(names, name)
+		if name == "bootstrap" {
+			bootstrapFlags = flags
+		}
+		fmt.Fprintf(cases, "    %s) opts=%q ;;\n", name, strings.Join(flags, " "))
+	}
+	names = append(names, "help")
+	fmt.Fprintf(cases, "    -*) opts=%q ;;\n", strings.Join(bootstrapFlags, " "))
+	_, err := fmt.Fprintf(w, `_rebootstrap_raft() {
+  local cur="${COMP_WORDS[COMP_CWORD]}"
+  local opts
+  if [ "$COMP_CWORD" -eq 1 ]; then
+    opts=%q
+  else
+    case "${COMP_WORDS[1]}" in
+%s    help) opts=%q ;;
+    esac
+  fi
+  COMPREPLY=( $(compgen -W "$opts" -- "$cur") )
+}
+complete -o default -F _rebootstrap_raft rebootstrap-raft
+`, strings.Join(append(names, bootstrapFlags...), " "), cases.String(), strings.Join(names, " "))
+	return errors.Trace(err)
+}
@@ -0,0 +1,68 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+)
+
+// confirmPlan shows what's about to be written and asks the operator
+// to confirm it. The prompt goes to stderr so it doesn't get mixed up
+// with structured output.
+func confirmPlan(ctx *cmd.Context, raftDir string, servers []serverResult, localID string, color bool) error {
+	fmt.Fprintf(ctx.Stderr, "About to write a new raft store to %s with servers:\n", raftDir)
+	if err := writeServerTable(ctx.Stderr, "  ", servers, localID, color); err != nil {
+		return errors.Trace(err)
+	}
+	ok, err := confirm(ctx, "Continue?")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !ok {
+		return errors.New("aborted")
+	}
+	return nil
+}
+
+// confirm asks a yes/no question on stdin, defaulting to no.
+func confirm(ctx *cmd.Context, question string) (bool, error) {
+	fmt.Fprintf(ctx.Stderr, "%s [y/N]: ", question)
+	answer, err := readLine(ctx.Stdin)
+	if err == io.EOF && answer == "" {
+		fmt.Fprintln(ctx.Stderr)
+		return false, errors.New("no confirmation on stdin (use --yes to skip it)")
+	} else if err != nil && err != io.EOF {
+		return false, errors.Trace(err)
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
+
+// readLine reads a line from r a byte at a time, so that nothing
+// after it is consumed and lost to the next question when answers
+// are piped in. The newline isn't included.
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n > 0 {
+			if b[0] == '\n' {
+				return string(line), nil
+			}
+			line = append(line, b[0])
+		}
+		if err != nil {
+			return string(line), err
+		}
+	}
+}
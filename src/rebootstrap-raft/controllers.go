@@ -0,0 +1,62 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+// checkControllerUUID makes sure the database belongs to the
+// controller the local agent is part of. Pointing the tool at the
+// wrong database, such as a restored copy of another controller,
+// would otherwise produce a configuration full of strangers.
+func checkControllerUUID(ctx context.Context, session *mgo.Session, agentConf *agentConfig) error {
+	expected, err := agentConf.controllerUUID()
+	if errors.IsNotFound(err) {
+		logger.Warningf("agent.conf has no controller tag, can't check the database belongs to this controller")
+		return nil
+	}
+	if err != nil {
+		return errors.Annotate(err, "reading agent.conf")
+	}
+	actual, err := rebootstrap.ControllerUUID(ctx, session)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if actual != expected {
+		return errors.Errorf("database is for controller %q but agent.conf is for controller %q - is this the right MongoDB?", actual, expected)
+	}
+	logger.Debugf("controller UUID %s matches agent.conf", actual)
+	return nil
+}
+
+// crossCheckAPIAddresses warns about servers whose addresses aren't in
+// the agent's apiaddresses, and apiaddresses that don't correspond to
+// any server. Either usually means the replicaset membership is stale
+// or the wrong address has been picked for a member.
+func crossCheckAPIAddresses(config raft.Configuration, apiAddresses []string) {
+	known := make(map[string]bool)
+	for _, address := range apiAddresses {
+		known[address] = true
+	}
+	generated := make(map[string]bool)
+	for _, server := range config.Servers {
+		address := string(server.Address)
+		generated[address] = true
+		if !known[address] {
+			logger.Warningf("machine %s address %s is not in agent.conf apiaddresses", server.ID, address)
+		}
+	}
+	for _, address := range apiAddresses {
+		if !generated[address] {
+			logger.Warningf("agent.conf apiaddress %s doesn't match any replicaset member", address)
+		}
+	}
+}
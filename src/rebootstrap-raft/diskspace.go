@@ -0,0 +1,112 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/dustin/go-humanize"
+	"github.com/juju/errors"
+)
+
+const (
+	// storeOverhead is a generous allowance for the space taken by
+	// an empty bolt log store, snapshot metadata and the manifest,
+	// leaving room for bolt to grow its file once jujud starts.
+	storeOverhead = 64 << 20
+
+	// storeInodes allows for the files and directories in a new
+	// store, plus the staging directory.
+	storeInodes = 16
+)
+
+// checkDiskSpace makes sure the filesystem that will hold dir has room
+// for a new store containing a snapshot of snapshotSize bytes. The
+// store is written into a staging directory and renamed into place,
+// and any existing directory is renamed to a backup, so nothing else
+// needs to be allowed for.
+func checkDiskSpace(dir string, snapshotSize int) error {
+	path := existingAncestor(dir)
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return errors.Annotatef(err, "checking free space on %q", path)
+	}
+	available := stat.Bavail * uint64(stat.Bsize)
+	needed := uint64(storeOverhead + snapshotSize)
+	logger.Debugf("%q has %s free (%d inodes), need %s (%d inodes)",
+		path, humanize.IBytes(available), stat.Ffree, humanize.IBytes(needed), storeInodes)
+	if available < needed {
+		return errors.Errorf("not enough space on %q: %s available, need %s",
+			path, humanize.IBytes(available), humanize.IBytes(needed))
+	}
+	// Some filesystems don't have a fixed number of inodes and
+	// report zero.
+	if stat.Files > 0 && stat.Ffree < storeInodes {
+		return errors.Errorf("not enough free inodes on %q: %d available, need %d",
+			path, stat.Ffree, storeInodes)
+	}
+	return nil
+}
+
+// existingAncestor returns the closest existing directory to path
+// (including path itself).
+func existingAncestor(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
+
+// networkFilesystems are the statfs magic numbers of filesystems bolt
+// can't be trusted on: its locking and mmap'd writes aren't coherent
+// over a network, and stores on them corrupt under jujud's load.
+var networkFilesystems = map[uint32]string{
+	0x6969:     "NFS",
+	0xff534d42: "CIFS",
+	0xfe534d42: "SMB2",
+	0x517b:     "SMB",
+	0x65735546: "FUSE",
+	0x01021997: "9P",
+	0x00c36400: "Ceph",
+	0x5346414f: "AFS",
+}
+
+// tmpfsMagic is the statfs magic number of tmpfs.
+const tmpfsMagic = 0x01021994
+
+// checkFilesystem refuses to put a store in dir if the filesystem
+// there is a network one, unless allowNetwork is set. A store on tmpfs
+// only gets a warning, since it's sometimes done for testing, but it
+// won't survive a reboot.
+func checkFilesystem(dir string, allowNetwork bool) error {
+	path := existingAncestor(dir)
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return errors.Annotatef(err, "checking filesystem of %q", path)
+	}
+	fsType := uint32(stat.Type)
+	logger.Debugf("%q is on a filesystem of type %#x", path, fsType)
+	if fsType == tmpfsMagic {
+		logger.Warningf("%q is on tmpfs, so the new store will be lost when the machine restarts", path)
+		return nil
+	}
+	name, ok := networkFilesystems[fsType]
+	if !ok {
+		return nil
+	}
+	if allowNetwork {
+		logger.Warningf("%q is on %s - bolt stores on network filesystems can corrupt", path, name)
+		return nil
+	}
+	return errors.Errorf("%q is on %s, and bolt stores on network filesystems corrupt under jujud's load - "+
+		"put the raft directory on local disk, or use --allow-network-fs if you're sure", path, name)
+}
@@ -0,0 +1,324 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/yaml.v2"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+const dqliteDoc = `
+
+Recreate the dqlite node store of a Juju 3.x controller from the
+controller node records in MongoDB. Juju 3.x keeps leases in dqlite
+rather than raft; each controller's dqlite directory holds info.yaml,
+describing the local node, and cluster.yaml, listing every node in the
+cluster. This rewrites both files so that the local node can find its
+peers again. The database files themselves are left alone.
+
+This should be run as root on a controller machine with the machine
+agent stopped. Existing node store files are only replaced with
+--force, in which case they're kept as timestamped backups.
+
+`
+
+const (
+	controllerNodesC = "controllerNodes"
+
+	dqliteClusterFile = "cluster.yaml"
+	dqliteInfoFile    = "info.yaml"
+
+	// defaultDqlitePort is the port jujud binds dqlite to.
+	defaultDqlitePort = 17666
+)
+
+// These are node roles defined by go-dqlite's client.NodeRole.
+const (
+	dqliteVoter   = 0
+	dqliteStandBy = 1
+)
+
+// dqliteNodeInfo matches the YAML form of go-dqlite's client.NodeInfo,
+// which is what the node store files hold.
+type dqliteNodeInfo struct {
+	ID      uint64 `yaml:"ID"`
+	Address string `yaml:"Address"`
+	Role    int    `yaml:"Role"`
+}
+
+// controllerNodeDoc holds the fields we use from a document in the
+// controllerNodes collection.
+type controllerNodeDoc struct {
+	DocID             string `bson:"_id"`
+	HasVote           bool   `bson:"has-vote"`
+	DqliteNodeID      string `bson:"dqlite-node-id"`
+	DqliteBindAddress string `bson:"dqlite-bind-address"`
+}
+
+type dqliteCommand struct {
+	cmd.CommandBase
+	logFlags
+	mongoFlags
+	dataDirFlags
+	dryRun           bool
+	dqliteDir        string
+	dqlitePort       int
+	machineID        string
+	skipVersionCheck bool
+	force            bool
+	agentService     string
+	stopAgent        bool
+	yes              bool
+}
+
+// Info is part of cmd.Command.
+func (c *dqliteCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "dqlite",
+		Args:    "--machine-id <id> [--password <password>]",
+		Purpose: "Recreate a juju 3.x controller's dqlite node store.",
+		Doc:     strings.TrimSpace(dqliteDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *dqliteCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	c.logFlags.setFlags(f)
+	c.mongoFlags.setFlags(f)
+	c.dataDirFlags.setFlags(f)
+	f.BoolVar(&c.dryRun, "dry-run", false, "show the node store but don't write it")
+	f.StringVar(&c.dqliteDir, "dqlite-dir", "", "dqlite directory location (default <data-dir>/dqlite)")
+	f.IntVar(&c.dqlitePort, "dqlite-port", defaultDqlitePort, "port used for bind addresses recorded without one")
+	f.StringVar(&c.machineID, "machine-id", "", "ID of this Juju controller machine")
+	f.BoolVar(&c.skipVersionCheck, "skip-version-check", false, "only warn if the installed jujud doesn't use dqlite")
+	f.BoolVar(&c.force, "force", false, "back up and replace existing node store files")
+	f.StringVar(&c.agentService, "agent-service", "", "machine agent service name, or none if it isn't run by systemd (default jujud-machine-<id>.service, or the snap's if that's installed)")
+	f.BoolVar(&c.stopAgent, "stop-agent", false, "stop the machine agent if it's running")
+	f.BoolVar(&c.yes, "yes", false, "don't ask for confirmation before writing")
+}
+
+// Init is part of cmd.Command.
+func (c *dqliteCommand) Init(args []string) error {
+	if err := c.setupLogging(c.dryRun); err != nil {
+		return errors.Trace(err)
+	}
+	if c.machineID == "" {
+		return errors.Errorf("--machine-id is required")
+	}
+	if err := c.dataDirFlags.resolve(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := c.mongoFlags.validate(c.agentConfFile(c.machineID), c.hostfsPrefix); err != nil {
+		return errors.Trace(err)
+	}
+	if c.dqliteDir == "" {
+		c.dqliteDir = c.getJujuPath("dqlite")
+	}
+	if c.agentService == "" {
+		c.agentService = localAgentService(c.machineID)
+	}
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *dqliteCommand) Run(ctx *cmd.Context) error {
+	stdCtx, cancel := interruptContext()
+	defer cancel()
+	return reportExitCode(ctx, c.run(ctx, stdCtx))
+}
+
+func (c *dqliteCommand) run(ctx *cmd.Context, stdCtx context.Context) error {
+	c.setupOutput(ctx)
+	if !c.dryRun {
+		lock, err := acquireLock(c.dataDir)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer lock.Release()
+	}
+
+	if err := c.checkJujuVersion(); err != nil {
+		return errors.Trace(err)
+	}
+	if !c.force && !c.dryRun {
+		for _, name := range []string{dqliteClusterFile, dqliteInfoFile} {
+			path := filepath.Join(c.dqliteDir, name)
+			if _, err := os.Stat(path); err == nil {
+				return withExitCode(errors.Errorf("%q already exists - remove it first (or use --force to back it up)", path), exitRaftDirExists)
+			}
+		}
+	}
+
+	agentConf, err := readAgentConfig(c.agentConfFile(c.machineID))
+	if err != nil {
+		logger.Warningf("can't check MongoDB or controller against agent.conf: %v", err)
+	}
+
+	session, err := c.connect(stdCtx, c.machineID, agentConf)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer session.Close()
+
+	if agentConf != nil {
+		if err := checkControllerUUID(stdCtx, session, agentConf); err != nil {
+			return withExitCode(err, exitValidation)
+		}
+	}
+
+	nodes, local, err := getDqliteNodes(stdCtx, session, c.machineID, c.dqlitePort)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cluster, err := yaml.Marshal(nodes)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	info, err := yaml.Marshal(local)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	logger.Infof("dqlite cluster:\n%s", cluster)
+
+	if c.dryRun {
+		logger.Infof("dry-run specified - stopping")
+		return nil
+	}
+	if !c.yes {
+		fmt.Fprintf(ctx.Stderr, "About to write a dqlite node store to %s for node %d with cluster:\n%s", c.dqliteDir, local.ID, cluster)
+		ok, err := confirm(ctx, "Continue?")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !ok {
+			return errors.New("aborted")
+		}
+	}
+	if _, err := ensureAgentStopped(c.agentService, c.stopAgent); err != nil {
+		return errors.Trace(err)
+	}
+	if err := os.MkdirAll(c.dqliteDir, raftDirMode); err != nil {
+		return errors.Trace(err)
+	}
+	// info.yaml is written last so a node store is never left
+	// claiming to be complete without its cluster list.
+	if err := c.writeNodeStoreFile(dqliteClusterFile, cluster); err != nil {
+		return errors.Trace(err)
+	}
+	if err := c.writeNodeStoreFile(dqliteInfoFile, info); err != nil {
+		return errors.Trace(err)
+	}
+	logger.Infof("dqlite node store written in %q.", c.dqliteDir)
+	return nil
+}
+
+// checkJujuVersion makes sure the installed jujud keeps its leases in
+// dqlite.
+func (c *dqliteCommand) checkJujuVersion() error {
+	version, err := detectJujuVersion(c.dataDir, c.machineID, c.agentConfFile(c.machineID))
+	if err != nil {
+		logger.Warningf("can't determine installed juju version: %v", err)
+		return nil
+	}
+	logger.Infof("Installed juju version is %s.", version)
+	if version.Major >= 3 {
+		return nil
+	}
+	err = errors.Errorf("juju %s controllers use raft - use the bootstrap subcommand instead", version)
+	if c.skipVersionCheck {
+		logger.Warningf("%v", err)
+		return nil
+	}
+	return err
+}
+
+// writeNodeStoreFile atomically replaces name in the dqlite directory
+// with data, keeping any existing file as a timestamped backup.
+func (c *dqliteCommand) writeNodeStoreFile(name string, data []byte) error {
+	path := filepath.Join(c.dqliteDir, name)
+	tmpPath := fmt.Sprintf("%s.tmp-%d", path, os.Getpid())
+	if err := ioutil.WriteFile(tmpPath, data, raftFileMode); err != nil {
+		return errors.Trace(err)
+	}
+	if err := rebootstrap.SyncPath(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return errors.Trace(err)
+	}
+	if _, err := os.Stat(path); err == nil {
+		backup := fmt.Sprintf("%s.backup-%s", path, time.Now().UTC().Format("20060102-150405"))
+		if err := os.Rename(path, backup); err != nil {
+			os.Remove(tmpPath)
+			return errors.Trace(err)
+		}
+		logger.Warningf("Existing %s moved to %q.", name, backup)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return errors.Trace(err)
+	}
+	return rebootstrap.SyncPath(c.dqliteDir)
+}
+
+// getDqliteNodes builds the dqlite cluster from the controller node
+// records, returning every node ordered by ID along with the node for
+// localID. Controllers with a vote are made voters, the rest standbys.
+func getDqliteNodes(ctx context.Context, session *mgo.Session, localID string, defaultPort int) ([]dqliteNodeInfo, dqliteNodeInfo, error) {
+	var docs []controllerNodeDoc
+	err := rebootstrap.WithSession(ctx, session, func(s *mgo.Session) error {
+		return s.DB(rebootstrap.JujuDB).C(controllerNodesC).Find(nil).All(&docs)
+	})
+	if err != nil {
+		return nil, dqliteNodeInfo{}, errors.Annotate(err, "reading controller nodes")
+	}
+	var (
+		nodes []dqliteNodeInfo
+		local dqliteNodeInfo
+		found bool
+	)
+	for _, doc := range docs {
+		// Document ids may be prefixed with the controller model UUID.
+		machineID := doc.DocID[strings.LastIndex(doc.DocID, ":")+1:]
+		if doc.DqliteNodeID == "" || doc.DqliteBindAddress == "" {
+			return nil, dqliteNodeInfo{}, errors.Errorf("controller %s has no dqlite node recorded", machineID)
+		}
+		id, err := strconv.ParseUint(doc.DqliteNodeID, 10, 64)
+		if err != nil {
+			return nil, dqliteNodeInfo{}, errors.Annotatef(err, "controller %s dqlite node id", machineID)
+		}
+		address := doc.DqliteBindAddress
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, strconv.Itoa(defaultPort))
+		}
+		node := dqliteNodeInfo{ID: id, Address: address, Role: dqliteStandBy}
+		if doc.HasVote {
+			node.Role = dqliteVoter
+		}
+		logger.Debugf("controller %s: dqlite node %d at %s", machineID, id, address)
+		nodes = append(nodes, node)
+		if machineID == localID {
+			local, found = node, true
+		}
+	}
+	if !found {
+		return nil, dqliteNodeInfo{}, errors.NotFoundf("controller node for machine %s", localID)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes, local, nil
+}
@@ -0,0 +1,212 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"gopkg.in/yaml.v2"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+const dumpLogsDoc = `
+
+Print the entries in a raft store's bolt log, one per line, with lease
+commands and configurations decoded. The store is only read, so this
+is safe on a live controller.
+
+With --follow, entries appended after the current end of the log are
+printed as they arrive, until interrupted - useful for watching lease
+churn as it happens. While jujud holds the store each poll reads a
+copy of it, so keep --interval reasonable on a large store.
+
+`
+
+type dumpLogsCommand struct {
+	cmd.CommandBase
+	logFlags
+	dataDirFlags
+	raftDir  string
+	from     uint64
+	follow   bool
+	interval time.Duration
+}
+
+// Info is part of cmd.Command.
+func (c *dumpLogsCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "dump-logs",
+		Purpose: "Print the entries in a raft log store.",
+		Doc:     strings.TrimSpace(dumpLogsDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *dumpLogsCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	c.logFlags.setFlags(f)
+	c.dataDirFlags.setFlags(f)
+	f.StringVar(&c.raftDir, "raft-dir", "", "raft directory location (default <data-dir>/raft)")
+	f.Uint64Var(&c.from, "from", 0, "start at this index (default: the start of the log, or its end with --follow)")
+	f.BoolVar(&c.follow, "follow", false, "keep printing entries as they're appended")
+	f.DurationVar(&c.interval, "interval", 2*time.Second, "with --follow, how often to check for new entries")
+}
+
+// Init is part of cmd.Command.
+func (c *dumpLogsCommand) Init(args []string) error {
+	if err := c.setupLogging(false); err != nil {
+		return errors.Trace(err)
+	}
+	if err := c.dataDirFlags.resolve(); err != nil {
+		return errors.Trace(err)
+	}
+	if c.raftDir == "" {
+		c.raftDir = c.getJujuPath("raft")
+	}
+	if c.interval <= 0 {
+		return errors.Errorf("--interval must be positive")
+	}
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *dumpLogsCommand) Run(ctx *cmd.Context) error {
+	c.setupOutput(ctx)
+	stdCtx, cancel := interruptContext()
+	defer cancel()
+	return reportExitCode(ctx, c.run(ctx, stdCtx))
+}
+
+func (c *dumpLogsCommand) run(ctx *cmd.Context, stdCtx context.Context) error {
+	next := c.from
+	if next == 0 && c.follow {
+		_, last, err := readLogBounds(c.raftDir)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		next = last + 1
+		fmt.Fprintf(ctx.Stderr, "Following %s from index %d.\n", filepath.Join(c.raftDir, "logs"), next)
+	}
+	for {
+		var err error
+		next, err = dumpLogEntries(ctx.Stdout, c.raftDir, next)
+		if err != nil && !c.follow {
+			return errors.Trace(err)
+		} else if err != nil {
+			// jujud may have been writing the store as it was
+			// copied; the next poll will catch up.
+			logger.Warningf("reading log store: %v", err)
+		}
+		if !c.follow {
+			return nil
+		}
+		select {
+		case <-stdCtx.Done():
+			return nil
+		case <-time.After(c.interval):
+		}
+	}
+}
+
+// readLogBounds returns the first and last indexes in the store in
+// dir.
+func readLogBounds(dir string) (uint64, uint64, error) {
+	store, err := openStoreReadOnly(dir)
+	if err != nil {
+		return 0, 0, errors.Annotate(err, "opening log store")
+	}
+	defer store.Close()
+	first, err := store.FirstIndex()
+	if err != nil {
+		return 0, 0, errors.Annotate(err, "reading first index")
+	}
+	last, err := store.LastIndex()
+	if err != nil {
+		return 0, 0, errors.Annotate(err, "reading last index")
+	}
+	return first, last, nil
+}
+
+// dumpLogEntries writes the entries in the store in dir from index
+// from onwards, returning the index to continue from next time.
+func dumpLogEntries(w io.Writer, dir string, from uint64) (uint64, error) {
+	store, err := openStoreReadOnly(dir)
+	if err != nil {
+		return from, errors.Annotate(err, "opening log store")
+	}
+	defer store.Close()
+	first, err := store.FirstIndex()
+	if err != nil {
+		return from, errors.Annotate(err, "reading first index")
+	}
+	last, err := store.LastIndex()
+	if err != nil {
+		return from, errors.Annotate(err, "reading last index")
+	}
+	if from < first {
+		if from > 0 {
+			logger.Warningf("entries %d to %d have been compacted away", from, first-1)
+		}
+		from = first
+	}
+	for index := from; index <= last && index > 0; index++ {
+		var entry raft.Log
+		if err := store.GetLog(index, &entry); err != nil {
+			return index, errors.Annotatef(err, "reading log entry %d", index)
+		}
+		fmt.Fprintf(w, "%-8d %-6d %-14s %s\n", entry.Index, entry.Term, entry.Type, describeLogEntry(&entry))
+	}
+	if last+1 > from {
+		return last + 1, nil
+	}
+	return from, nil
+}
+
+// describeLogEntry summarises the data in a log entry: a lease
+// command or configuration decoded, or just the size of anything else.
+func describeLogEntry(entry *raft.Log) string {
+	switch entry.Type {
+	case raft.LogCommand:
+		var command rebootstrap.LeaseCommand
+		if err := yaml.Unmarshal(entry.Data, &command); err != nil || command.Operation == "" {
+			return fmt.Sprintf("%d bytes (not a lease command)", len(entry.Data))
+		}
+		return describeLeaseCommand(&command)
+	case raft.LogConfiguration:
+		var servers []string
+		for _, server := range raft.DecodeConfiguration(entry.Data).Servers {
+			servers = append(servers, fmt.Sprintf("%s=%s(%s)", server.ID, server.Address, server.Suffrage))
+		}
+		return strings.Join(servers, " ")
+	}
+	if len(entry.Data) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d bytes", len(entry.Data))
+}
+
+func describeLeaseCommand(command *rebootstrap.LeaseCommand) string {
+	lease := fmt.Sprintf("%s/%s/%s", command.ModelUUID, command.Namespace, command.Lease)
+	switch command.Operation {
+	case "claim", "extend":
+		return fmt.Sprintf("%s %s by %s for %v", command.Operation, lease, command.Holder, command.Duration)
+	case "revoke":
+		return fmt.Sprintf("revoke %s from %s", lease, command.Holder)
+	case "setTime":
+		return fmt.Sprintf("setTime %s (+%v)", command.NewTime.UTC().Format(time.RFC3339Nano), command.NewTime.Sub(command.OldTime))
+	case "pin", "unpin":
+		return fmt.Sprintf("%s %s for %s", command.Operation, lease, command.PinEntity)
+	}
+	return command.Operation
+}
@@ -0,0 +1,59 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// These are the events written with --events.
+const (
+	eventStarted         = "started"
+	eventMembersFetched  = "members-fetched"
+	eventConfigGenerated = "config-generated"
+	eventStoreWritten    = "store-written"
+	eventDone            = "done"
+	eventError           = "error"
+)
+
+// event is one line of the event stream.
+type event struct {
+	SchemaVersion int         `json:"schema-version"`
+	Time          string      `json:"time"`
+	Event         string      `json:"event"`
+	Data          interface{} `json:"data,omitempty"`
+}
+
+// eventStream writes events as JSON lines so that something driving
+// the tool can follow a run as it happens. A nil eventStream discards
+// everything.
+type eventStream struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func newEventStream(w io.Writer) *eventStream {
+	return &eventStream{encoder: json.NewEncoder(w)}
+}
+
+// emit writes an event with the given data, which may be nil.
+func (s *eventStream) emit(name string, data interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.encoder.Encode(event{
+		SchemaVersion: outputSchemaVersion,
+		Time:          time.Now().UTC().Format(time.RFC3339Nano),
+		Event:         name,
+		Data:          data,
+	})
+	if err != nil {
+		logger.Warningf("writing %s event: %v", name, err)
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/raft-boltdb/v2"
+	"github.com/juju/errors"
+	"go.etcd.io/bbolt"
+)
+
+// existingState describes what was found in a raft directory that
+// already exists.
+type existingState struct {
+	// hasState is set when the canonical stores hold raft state, as
+	// reported by raft.HasExistingState.
+	hasState bool
+
+	// stray lists log store or snapshot files found somewhere other
+	// than where jujud expects them, which usually means the
+	// directory was partially deleted or moved around by hand.
+	stray []string
+}
+
+// empty reports whether nothing of interest was found.
+func (s *existingState) empty() bool {
+	return !s.hasState && len(s.stray) == 0
+}
+
+func (s *existingState) String() string {
+	var parts []string
+	if s.hasState {
+		parts = append(parts, "existing raft state")
+	}
+	if len(s.stray) > 0 {
+		parts = append(parts, fmt.Sprintf("stray raft files %s", strings.Join(s.stray, ", ")))
+	}
+	if len(parts) == 0 {
+		return "no raft state"
+	}
+	return strings.Join(parts, " and ")
+}
+
+// inspectExistingState looks at the raft directory dir, returning nil
+// if it doesn't exist. Nothing in the directory is created or
+// modified.
+func inspectExistingState(dir string) (*existingState, error) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var state existingState
+
+	logsPath := filepath.Join(dir, "logs")
+	locked, err := boltFileLocked(logsPath)
+	if err != nil {
+		return nil, errors.Annotatef(err, "checking lock on %q", logsPath)
+	}
+	if locked {
+		// Someone has the store open, so it's certainly in use;
+		// checkTarget will refuse to replace it.
+		state.hasState = true
+	} else if info, err := os.Stat(logsPath); err == nil && info.Mode().IsRegular() {
+		store, err := raftboltdb.New(raftboltdb.Options{
+			Path: logsPath,
+			BoltOptions: &bbolt.Options{
+				ReadOnly: true,
+				Timeout:  time.Second,
+			},
+		})
+		if err != nil {
+			return nil, errors.Annotatef(err, "opening %q", logsPath)
+		}
+		defer store.Close()
+		state.hasState, err = raft.HasExistingState(store, store, snapshotLister{filepath.Join(dir, "snapshots")})
+		if err != nil {
+			return nil, errors.Annotatef(err, "checking state in %q", dir)
+		}
+	} else {
+		snapshots, err := snapshotLister{filepath.Join(dir, "snapshots")}.List()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		state.hasState = len(snapshots) > 0
+	}
+	if entries, err := ioutil.ReadDir(filepath.Join(dir, "wal")); err == nil && len(entries) > 0 {
+		// The WAL store can't be opened without risking changes to
+		// it, so any segment files count as state.
+		state.hasState = true
+	}
+
+	stray, err := findStrayFiles(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	state.stray = stray
+	return &state, nil
+}
+
+// findStrayFiles walks dir looking for log stores and snapshots that
+// aren't in their canonical places: dir/logs as a file and snapshot
+// directories directly under dir/snapshots.
+func findStrayFiles(dir string) ([]string, error) {
+	var stray []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		if rel == "." {
+			return nil
+		}
+		depth := strings.Count(rel, string(filepath.Separator)) + 1
+		name := info.Name()
+		switch {
+		case rel == "logs" && info.Mode().IsRegular():
+		case rel == "snapshots" && info.IsDir():
+		case rel == "wal" && info.IsDir():
+			return filepath.SkipDir
+		case depth == 2 && filepath.Dir(rel) == "snapshots" && info.IsDir():
+			return filepath.SkipDir
+		case strings.HasPrefix(name, "logs"), name == "snapshots", name == "wal", name == snapshotMetaFile:
+			stray = append(stray, rel)
+		}
+		if info.IsDir() && depth >= 3 {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "walking %q", dir)
+	}
+	return stray, nil
+}
+
+// snapshotLister is a read-only raft.SnapshotStore over an existing
+// snapshots directory. raft.NewFileSnapshotStore can't be used to
+// inspect one because it creates the directory and writes a test file
+// into it.
+type snapshotLister struct {
+	dir string
+}
+
+// List is part of raft.SnapshotStore.
+func (s snapshotLister) List() ([]*raft.SnapshotMeta, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var result []*raft.SnapshotMeta
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		meta, err := readSnapshotMeta(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			logger.Debugf("ignoring %q: %v", entry.Name(), err)
+			continue
+		}
+		result = append(result, &meta.SnapshotMeta)
+	}
+	return result, nil
+}
+
+// Create is part of raft.SnapshotStore.
+func (s snapshotLister) Create(
+	version raft.SnapshotVersion,
+	index, term uint64,
+	configuration raft.Configuration,
+	configurationIndex uint64,
+	trans raft.Transport,
+) (raft.SnapshotSink, error) {
+	return nil, errors.NotSupportedf("creating snapshots")
+}
+
+// Open is part of raft.SnapshotStore.
+func (s snapshotLister) Open(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	return nil, nil, errors.NotSupportedf("opening snapshots")
+}
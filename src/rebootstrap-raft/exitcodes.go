@@ -0,0 +1,95 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+)
+
+// These are the exit codes used for failures that wrappers might
+// want to handle differently. Anything else exits with 1, and bad
+// command lines exit with 2.
+const (
+	exitRaftDirExists    = 3
+	exitMongoUnreachable = 4
+	exitMongoAuth        = 5
+	exitMissingTags      = 6
+	exitValidation       = 7
+	exitWriteFailed      = 8
+	exitAgentUnhealthy   = 9
+	exitTimedOut         = 10
+)
+
+// exitCodeError marks an error with the exit code it should cause,
+// and optionally a remediation code more specific than the exit code.
+// It doesn't implement Cause, so errors.Cause stops at it however
+// much it's annotated afterwards.
+type exitCodeError struct {
+	error
+	code   int
+	remedy string
+}
+
+// withExitCode marks err, if it's not nil, as causing the given exit
+// code. An error that's already marked keeps its original code.
+func withExitCode(err error, code int) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := errors.Cause(err).(*exitCodeError); ok {
+		return err
+	}
+	return &exitCodeError{error: err, code: code}
+}
+
+// exitCode returns the exit code err should cause.
+func exitCode(err error) int {
+	if e, ok := errors.Cause(err).(*exitCodeError); ok {
+		return e.code
+	}
+	return 1
+}
+
+// mongoDialExitCode picks the exit code for a failure to dial MongoDB.
+func mongoDialExitCode(err error) int {
+	if qerr, ok := err.(*mgo.QueryError); ok && qerr.Code == 18 {
+		return exitMongoAuth
+	}
+	if strings.Contains(err.Error(), "auth fail") || strings.Contains(err.Error(), "Authentication failed") {
+		return exitMongoAuth
+	}
+	return exitMongoUnreachable
+}
+
+// reportExitCode is called with the error from a command's Run. If the
+// error has a specific exit code or a remediation it's reported here,
+// with what to do about it, and turned into an error that makes
+// cmd.Main exit with that code; otherwise it's left for cmd.Main to
+// report as usual.
+func reportExitCode(ctx *cmd.Context, err error) error {
+	return reportExitCodeWith(ctx, err, nil)
+}
+
+// reportExitCodeWith is reportExitCode, filling in the remediation's
+// command from vars.
+func reportExitCodeWith(ctx *cmd.Context, err error, vars map[string]string) error {
+	if err == nil {
+		return nil
+	}
+	code := exitCode(err)
+	remedy := remediationFor(err, vars)
+	if code == 1 && remedy == nil {
+		return err
+	}
+	cmd.WriteError(ctx.Stderr, err)
+	if remedy != nil {
+		writeRemediation(ctx.Stderr, remedy)
+	}
+	logger.Debugf("error stack: \n%v", errors.ErrorStack(err))
+	return cmd.NewRcPassthroughError(code)
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"crypto/tls"
+
+	"github.com/juju/errors"
+)
+
+// fipsBuild, set at build time with -ldflags "-X main.fipsBuild=true",
+// makes --fips the default and refuses to run without it, for builds
+// that must never use anything else.
+var fipsBuild = ""
+
+// fipsCipherSuites are the FIPS 140-2 approved cipher suites Go
+// offers: ECDHE key exchange with AES-GCM. TLS 1.3's suites can't be
+// restricted in Go, so FIPS mode stops at TLS 1.2.
+var fipsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// fipsCurves are the approved NIST curves.
+var fipsCurves = []tls.CurveID{tls.CurveP256, tls.CurveP384, tls.CurveP521}
+
+// applyFIPS restricts config to the approved protocol version, cipher
+// suites and curves.
+func applyFIPS(config *tls.Config) {
+	config.MinVersion = tls.VersionTLS12
+	config.MaxVersion = tls.VersionTLS12
+	config.CipherSuites = fipsCipherSuites
+	config.CurvePreferences = fipsCurves
+	config.PreferServerCipherSuites = false
+}
+
+// checkFIPSConnection makes sure what was negotiated is approved,
+// rather than trusting the configuration alone, so that the
+// connection fails closed. It can't see the signature algorithm the
+// server used in the handshake: Go's TLS 1.2 client still accepts
+// SHA-1 and Ed25519 signatures there and gives no way to restrict or
+// inspect them, so a FIPS validated toolchain is needed to rule those
+// out.
+func checkFIPSConnection(state tls.ConnectionState) error {
+	if state.Version != tls.VersionTLS12 {
+		return errors.Errorf("FIPS mode: negotiated TLS version %x, not 1.2", state.Version)
+	}
+	for _, suite := range fipsCipherSuites {
+		if state.CipherSuite == suite {
+			return nil
+		}
+	}
+	return errors.Errorf("FIPS mode: negotiated cipher suite %x isn't approved", state.CipherSuite)
+}
+
+// validateFIPS checks the FIPS settings once the MongoDB settings are
+// known: a FIPS build can't turn it off, and it needs TLS.
+func (m *mongoFlags) validateFIPS() error {
+	if fipsBuild == "true" && !m.fips {
+		return errors.Errorf("this build only runs with --fips")
+	}
+	if m.fips && !m.ssl {
+		return errors.Errorf("--fips needs TLS to MongoDB, but --ssl is off (or the local juju-db doesn't use TLS)")
+	}
+	return nil
+}
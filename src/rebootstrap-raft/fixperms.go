@@ -0,0 +1,120 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+)
+
+const fixPermissionsDoc = `
+
+Check the owner and mode of everything in an existing raft directory,
+snapshots included, against what the machine agent expects (owned by
+--owner, directories 0700 and files 0600), list what differs and put
+it right. A store copied from another machine, or written by hand
+under sudo, often ends up unreadable by the agent.
+
+`
+
+type fixPermissionsCommand struct {
+	cmd.CommandBase
+	logFlags
+	dataDirFlags
+	raftDir   string
+	ownerSpec string
+	owner     ownership
+	dryRun    bool
+	yes       bool
+}
+
+// Info is part of cmd.Command.
+func (c *fixPermissionsCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "fix-permissions",
+		Purpose: "Repair the ownership and modes in a raft directory.",
+		Doc:     strings.TrimSpace(fixPermissionsDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *fixPermissionsCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	c.logFlags.setFlags(f)
+	c.dataDirFlags.setFlags(f)
+	f.StringVar(&c.raftDir, "raft-dir", "", "raft directory location (default <data-dir>/raft)")
+	f.StringVar(&c.ownerSpec, "owner", "root:root", "user[:group] that should own the raft directory")
+	f.BoolVar(&c.dryRun, "dry-run", false, "list what's wrong without changing it")
+	f.BoolVar(&c.yes, "yes", false, "don't ask for confirmation")
+}
+
+// Init is part of cmd.Command.
+func (c *fixPermissionsCommand) Init(args []string) error {
+	if err := c.setupLogging(c.dryRun); err != nil {
+		return errors.Trace(err)
+	}
+	if err := c.dataDirFlags.resolve(); err != nil {
+		return errors.Trace(err)
+	}
+	if c.raftDir == "" {
+		c.raftDir = c.getJujuPath("raft")
+	}
+	var err error
+	if c.owner, err = parseOwnership(c.ownerSpec); err != nil {
+		return errors.Annotate(err, "parsing --owner")
+	}
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *fixPermissionsCommand) Run(ctx *cmd.Context) error {
+	c.setupOutput(ctx)
+	return reportExitCode(ctx, c.run(ctx))
+}
+
+func (c *fixPermissionsCommand) run(ctx *cmd.Context) error {
+	if _, err := os.Stat(c.raftDir); err != nil {
+		return errors.Trace(err)
+	}
+	checkParentOwnership(c.raftDir, c.owner)
+	problems, err := auditOwnership(c.raftDir, c.owner)
+	if err != nil {
+		return errors.Annotatef(err, "checking %q", c.raftDir)
+	}
+	if len(problems) == 0 {
+		fmt.Fprintf(ctx.Stdout, "Everything in %s has the expected owner and mode.\n", c.raftDir)
+		return nil
+	}
+	for _, problem := range problems {
+		fmt.Fprintf(ctx.Stdout, "%s: %s\n", problem.path, problem.problem)
+	}
+	if c.dryRun {
+		logger.Infof("dry-run specified - stopping")
+		return nil
+	}
+	lock, err := acquireLock(c.dataDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer lock.Release()
+	if !c.yes {
+		ok, err := confirm(ctx, fmt.Sprintf("Fix %d paths?", len(problems)))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !ok {
+			return errors.New("aborted")
+		}
+	}
+	if err := applyOwnership(c.raftDir, c.owner); err != nil {
+		return withExitCode(errors.Annotate(err, "setting ownership"), exitWriteFailed)
+	}
+	fmt.Fprintf(ctx.Stdout, "Fixed %d paths.\n", len(problems))
+	return nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+)
+
+const healDoc = `
+
+Change the address of one or more servers in an existing raft store,
+keeping the rest of its state. This is for when a controller has
+changed IP but the cluster is otherwise healthy, so there's no need to
+throw away the raft log.
+
+The newest configuration entry in the log is rewritten in place, so
+run the same command on every controller (with its agent stopped) to
+keep their logs in step. If no port is given the server's existing
+port is kept:
+
+    rebootstrap-raft heal --machine-id 0 --set-address 2=10.0.0.12
+
+The raft directory is backed up next to itself first.
+
+`
+
+type healCommand struct {
+	storeEditCommand
+	setAddress string
+	addresses  map[raft.ServerID]string
+}
+
+// Info is part of cmd.Command.
+func (c *healCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "heal",
+		Args:    "--machine-id <id> --set-address <id>=<address>[,...]",
+		Purpose: "Change server addresses in an existing raft store.",
+		Doc:     strings.TrimSpace(healDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *healCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.storeEditCommand.setFlags(f)
+	f.StringVar(&c.setAddress, "set-address", "", "comma-separated <id>=<address> pairs giving servers' new addresses")
+}
+
+// Init is part of cmd.Command.
+func (c *healCommand) Init(args []string) error {
+	if err := c.storeEditCommand.init(); err != nil {
+		return errors.Trace(err)
+	}
+	if c.setAddress == "" {
+		return errors.Errorf("--set-address is required")
+	}
+	addresses, err := parseAddressPairs("--set-address", c.setAddress)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	c.addresses = addresses
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *healCommand) Run(ctx *cmd.Context) error {
+	return reportExitCode(ctx, c.apply(ctx, c.heal))
+}
+
+// heal sets the new addresses in config.
+func (c *healCommand) heal(config *raft.Configuration) error {
+	return errors.Trace(setServerAddresses(config, c.addresses))
+}
+
+// parseAddressPairs parses comma-separated <id>=<address> pairs given
+// with the named flag.
+func parseAddressPairs(flag, value string) (map[raft.ServerID]string, error) {
+	addresses := make(map[raft.ServerID]string)
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("%s: expected <id>=<address>, got %q", flag, pair)
+		}
+		addresses[raft.ServerID(parts[0])] = parts[1]
+	}
+	return addresses, nil
+}
+
+// setServerAddresses gives the servers in config the addresses in
+// the map. An address without a port keeps the server's existing one.
+func setServerAddresses(config *raft.Configuration, addresses map[raft.ServerID]string) error {
+	for id, address := range addresses {
+		i := serverIndex(*config, id)
+		if i < 0 {
+			return errors.NotFoundf("server %s in the configuration", id)
+		}
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			_, port, err := net.SplitHostPort(string(config.Servers[i].Address))
+			if err != nil {
+				return errors.Annotatef(err, "server %s has address %q", id, config.Servers[i].Address)
+			}
+			address = net.JoinHostPort(address, port)
+		}
+		logger.Infof("server %s: %s -> %s", id, config.Servers[i].Address, address)
+		config.Servers[i].Address = raft.ServerAddress(address)
+	}
+	return nil
+}
+
+// serverIndex returns the position of the server with the given id in
+// config, or -1 if there isn't one.
+func serverIndex(config raft.Configuration, id raft.ServerID) int {
+	for i, server := range config.Servers {
+		if server.ID == id {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,61 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/juju/errors"
+)
+
+// The hooks that can be run around writing the store. The hook's
+// name is passed to it in $REBOOTSTRAP_RAFT_HOOK.
+const (
+	preHook  = "pre"
+	postHook = "post"
+)
+
+// hookPlan is what a hook script is given as JSON on stdin.
+type hookPlan struct {
+	Hook         string           `json:"hook"`
+	MachineID    string           `json:"machine-id"`
+	AgentService string           `json:"agent-service"`
+	Result       *bootstrapResult `json:"result"`
+}
+
+// checkHook makes sure the hook script at path can be run.
+func checkHook(flag, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return errors.Annotatef(err, "checking %s", flag)
+	}
+	if !info.Mode().IsRegular() || info.Mode()&0111 == 0 {
+		return errors.Errorf("%s %q isn't an executable file", flag, path)
+	}
+	return nil
+}
+
+// runHook runs the hook script at path with the plan on its stdin,
+// sending its output to w. The hook fails if the script exits
+// non-zero.
+func runHook(w io.Writer, path string, plan hookPlan) error {
+	data, err := json.Marshal(plan)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	logger.Infof("Running %s-hook %s.", plan.Hook, path)
+	command := exec.Command(path)
+	command.Stdin = bytes.NewReader(data)
+	command.Stdout = w
+	command.Stderr = w
+	command.Env = append(os.Environ(), "REBOOTSTRAP_RAFT_HOOK="+plan.Hook)
+	if err := command.Run(); err != nil {
+		return errors.Annotatef(err, "%s-hook %s", plan.Hook, path)
+	}
+	return nil
+}
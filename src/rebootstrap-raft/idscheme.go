@@ -0,0 +1,95 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/errors"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+// resolveIDScheme works out how server ids should be written, unless
+// --server-id-scheme said. A store from a surviving peer (the old raft
+// directory or a snapshot we were given) shows what the cluster
+// actually uses; failing that it's what the installed jujud expects.
+func (c *rebootstrapCommand) resolveIDScheme() error {
+	if c.idScheme != "" {
+		return nil
+	}
+	for _, source := range []struct {
+		name string
+		read func() (raft.Configuration, error)
+	}{
+		{c.oldRaftDir, func() (raft.Configuration, error) { return readStoreConfiguration(c.oldRaftDir) }},
+		{c.sourceRaftDir, func() (raft.Configuration, error) { return readStoreConfiguration(c.sourceRaftDir) }},
+		{c.configFrom, func() (raft.Configuration, error) { return readSnapshotConfiguration(c.configFrom) }},
+		{c.snapshotFrom, func() (raft.Configuration, error) { return readSnapshotConfiguration(c.snapshotFrom) }},
+	} {
+		if source.name == "" {
+			continue
+		}
+		config, err := source.read()
+		if err == nil {
+			c.idScheme, err = rebootstrap.DetectIDScheme(config)
+		}
+		if err == nil {
+			logger.Infof("%s uses %s server ids", source.name, c.idScheme)
+			return nil
+		}
+		logger.Debugf("can't tell server id scheme from %s: %v", source.name, err)
+	}
+	c.idScheme = rebootstrap.IDSchemeMachineID
+	version, err := detectJujuVersion(c.dataDir, c.agentMachineID, c.agentConfFile(c.agentMachineID))
+	if err != nil {
+		logger.Debugf("can't tell server id scheme from the juju version, using %s: %v", c.idScheme, err)
+		return nil
+	}
+	c.idScheme = settingsForVersion(version).serverIDScheme
+	logger.Debugf("juju %s uses %s server ids", version, c.idScheme)
+	return nil
+}
+
+// readStoreConfiguration reads the configuration raft would start
+// with from the store in an old raft directory: its newest
+// configuration entry, or its newest snapshot's if that's later or
+// the log is missing.
+func readStoreConfiguration(dir string) (raft.Configuration, error) {
+	if _, err := os.Stat(filepath.Join(dir, "logs")); err == nil {
+		logStore, err := openStoreReadOnly(dir)
+		if err != nil {
+			return raft.Configuration{}, errors.Trace(err)
+		}
+		defer logStore.Close()
+		stored, err := readCurrentConfiguration(dir, logStore)
+		if err != nil {
+			return raft.Configuration{}, errors.Trace(err)
+		}
+		return stored.Configuration, nil
+	}
+	return readSnapshotConfiguration(filepath.Join(dir, "snapshots"))
+}
+
+// readSnapshotConfiguration returns the configuration recorded with
+// the newest snapshot at path, which can be anything
+// readSourceSnapshot accepts. Only a tarball has to be read in full.
+func readSnapshotConfiguration(path string) (raft.Configuration, error) {
+	if info, err := os.Stat(path); err != nil {
+		return raft.Configuration{}, errors.Trace(err)
+	} else if !info.IsDir() {
+		snapshot, err := readSourceSnapshot(path)
+		if err != nil {
+			return raft.Configuration{}, errors.Trace(err)
+		}
+		return snapshot.Meta.Configuration, nil
+	}
+	_, meta, err := findNewestSnapshot(path)
+	if err != nil {
+		return raft.Configuration{}, errors.Trace(err)
+	}
+	return meta.Configuration, nil
+}
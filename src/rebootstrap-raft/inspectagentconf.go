@@ -0,0 +1,254 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"gopkg.in/yaml.v2"
+)
+
+const inspectAgentConfDoc = `
+
+Show what this tool reads from a machine agent's agent.conf - its tag,
+controller, ports, API addresses, juju and MongoDB versions, and which
+credentials are present (never their values) - along with anything
+wrong with them, for working out why discovery isn't finding what it
+should. The agent.conf is the one for --machine-id in the data
+directory, the one given with --agent-conf or as an argument, or the
+only machine agent's if there's just one. The exit code is non-zero
+if there are problems.
+
+`
+
+// agentConfReport is what inspect-agent-conf shows.
+type agentConfReport struct {
+	SchemaVersion     int      `json:"schema-version" yaml:"schema-version"`
+	Path              string   `json:"path" yaml:"path"`
+	Format            string   `json:"format" yaml:"format"`
+	Tag               string   `json:"tag" yaml:"tag"`
+	Controller        string   `json:"controller,omitempty" yaml:"controller,omitempty"`
+	UpgradedToVersion string   `json:"upgraded-to-version,omitempty" yaml:"upgraded-to-version,omitempty"`
+	APIPort           int      `json:"api-port,omitempty" yaml:"api-port,omitempty"`
+	StatePort         int      `json:"state-port,omitempty" yaml:"state-port,omitempty"`
+	APIAddresses      []string `json:"api-addresses" yaml:"api-addresses"`
+	MongoVersion      string   `json:"mongo-version,omitempty" yaml:"mongo-version,omitempty"`
+	StatePassword     bool     `json:"state-password" yaml:"state-password"`
+	OldPassword       bool     `json:"old-password" yaml:"old-password"`
+	SharedSecret      bool     `json:"shared-secret" yaml:"shared-secret"`
+	Problems          []string `json:"problems,omitempty" yaml:"problems,omitempty"`
+}
+
+type inspectAgentConfCommand struct {
+	cmd.CommandBase
+	out cmd.Output
+	logFlags
+	dataDirFlags
+	machineID string
+	path      string
+}
+
+// Info is part of cmd.Command.
+func (c *inspectAgentConfCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "inspect-agent-conf",
+		Args:    "[--machine-id <id> | <agent.conf>]",
+		Purpose: "Show and check the agent.conf fields this tool uses.",
+		Doc:     strings.TrimSpace(inspectAgentConfDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *inspectAgentConfCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	c.logFlags.setFlags(f)
+	c.dataDirFlags.setFlags(f)
+	c.out.AddFlags(f, "text", map[string]cmd.Formatter{
+		"text": formatAgentConfReport,
+		"json": cmd.FormatJson,
+		"yaml": cmd.FormatYaml,
+	})
+	f.StringVar(&c.machineID, "machine-id", "", "ID of the machine whose agent.conf to read")
+}
+
+// Init is part of cmd.Command.
+func (c *inspectAgentConfCommand) Init(args []string) error {
+	if err := c.setupLogging(false); err != nil {
+		return errors.Trace(err)
+	}
+	if len(args) > 0 {
+		if c.machineID != "" || c.agentConf != "" {
+			return errors.Errorf("give an agent.conf path or --machine-id or --agent-conf, not more than one")
+		}
+		c.path, args = args[0], args[1:]
+		return c.CommandBase.Init(args)
+	}
+	if err := c.dataDirFlags.resolve(); err != nil {
+		return errors.Trace(err)
+	}
+	if c.machineID == "" && c.agentConf == "" {
+		ids := localMachineIDs(c.dataDir)
+		if len(ids) != 1 {
+			return errors.Errorf("%d machine agents in %q (%s) - say which with --machine-id",
+				len(ids), c.dataDir, strings.Join(ids, ", "))
+		}
+		c.machineID = ids[0]
+	}
+	c.path = c.agentConfFile(c.machineID)
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *inspectAgentConfCommand) Run(ctx *cmd.Context) error {
+	c.setupOutput(ctx)
+	report, err := inspectAgentConf(c.path, c.machineID)
+	if err != nil {
+		return reportExitCode(ctx, errors.Trace(err))
+	}
+	if err := c.out.Write(ctx, report); err != nil {
+		return reportExitCode(ctx, errors.Trace(err))
+	}
+	if len(report.Problems) > 0 {
+		return reportExitCode(ctx, withExitCode(errors.Errorf("%d problems in %q", len(report.Problems), c.path), exitValidation))
+	}
+	return nil
+}
+
+// inspectAgentConf reads the agent.conf at path and checks the fields
+// this tool relies on. If machineID is set, the tag must be that
+// machine's.
+func inspectAgentConf(path, machineID string) (*agentConfReport, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	config, err := parseAgentConfig(data, path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var creds agentSecrets
+	if err := yaml.Unmarshal(data, &creds); err != nil {
+		return nil, errors.Annotatef(err, "parsing %q", path)
+	}
+	report := &agentConfReport{
+		SchemaVersion:     outputSchemaVersion,
+		Path:              path,
+		Format:            config.Format,
+		Tag:               config.Tag,
+		Controller:        config.Controller,
+		UpgradedToVersion: config.UpgradedToVersion,
+		APIPort:           config.APIPort,
+		StatePort:         config.StatePort,
+		APIAddresses:      config.APIAddresses,
+		MongoVersion:      firstNonEmpty(config.MongoVersion, config.JujuDBSnapChannel),
+		StatePassword:     creds.StatePassword != "",
+		OldPassword:       creds.OldPassword != "",
+		SharedSecret:      creds.SharedSecret != "",
+	}
+	problem := func(format string, args ...interface{}) {
+		report.Problems = append(report.Problems, fmt.Sprintf(format, args...))
+	}
+
+	if !knownAgentConfFormat(config.Format) {
+		problem("format %q isn't one of %s", config.Format, strings.Join(agentConfFormats, ", "))
+	}
+	switch {
+	case !strings.HasPrefix(config.Tag, "machine-"):
+		problem("tag %q isn't a machine tag", config.Tag)
+	case machineID != "" && config.Tag != "machine-"+machineID:
+		problem("tag %q isn't machine %s's", config.Tag, machineID)
+	}
+	if _, err := config.controllerUUID(); err != nil && !errors.IsNotFound(err) {
+		problem("%v", err)
+	}
+	if !report.StatePassword {
+		if report.OldPassword {
+			problem("no statepassword, so the oldpassword would be used")
+		} else {
+			problem("no statepassword or oldpassword, so --password is needed")
+		}
+	}
+	if config.APIPort == 0 {
+		problem("no apiport, so --api-port is needed if it isn't 17070")
+	}
+	if config.StatePort == 0 {
+		problem("no stateport - is this a controller machine?")
+	}
+	if len(config.APIAddresses) == 0 {
+		problem("no apiaddresses")
+	}
+	for _, address := range config.APIAddresses {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			problem("apiaddress %q: %v", address, err)
+		}
+	}
+	if config.UpgradedToVersion == "" {
+		problem("no upgradedToVersion, so the juju version can't be checked")
+	} else if _, err := parseJujuVersion(config.UpgradedToVersion); err != nil {
+		problem("upgradedToVersion: %v", err)
+	}
+	if report.MongoVersion != "" {
+		if _, ok := agentMongoVersion(config); !ok {
+			problem("mongo version %q can't be parsed", report.MongoVersion)
+		}
+	}
+	return report, nil
+}
+
+func formatAgentConfReport(writer io.Writer, value interface{}) error {
+	report, ok := value.(*agentConfReport)
+	if !ok {
+		return errors.Errorf("expected *agentConfReport, got %T", value)
+	}
+	present := func(ok bool) string {
+		if ok {
+			return "present"
+		}
+		return "missing"
+	}
+	tw := tabwriter.NewWriter(writer, 0, 1, 2, ' ', 0)
+	for _, field := range []struct{ name, value string }{
+		{"path", report.Path},
+		{"format", report.Format},
+		{"tag", report.Tag},
+		{"controller", report.Controller},
+		{"upgradedToVersion", report.UpgradedToVersion},
+		{"apiport", portString(report.APIPort)},
+		{"stateport", portString(report.StatePort)},
+		{"apiaddresses", strings.Join(report.APIAddresses, ", ")},
+		{"mongo version", report.MongoVersion},
+		{"statepassword", present(report.StatePassword)},
+		{"oldpassword", present(report.OldPassword)},
+		{"sharedsecret", present(report.SharedSecret)},
+	} {
+		fmt.Fprintf(tw, "%s:\t%s\n", field.name, dashIfEmpty(field.value))
+	}
+	if err := tw.Flush(); err != nil {
+		return errors.Trace(err)
+	}
+	if len(report.Problems) == 0 {
+		fmt.Fprintln(writer, "No problems found.")
+		return nil
+	}
+	fmt.Fprintln(writer, "Problems:")
+	for _, problem := range report.Problems {
+		fmt.Fprintf(writer, "  %s\n", problem)
+	}
+	return nil
+}
+
+func portString(port int) string {
+	if port == 0 {
+		return ""
+	}
+	return fmt.Sprint(port)
+}
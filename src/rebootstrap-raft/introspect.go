@@ -0,0 +1,187 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// raftManifolds are the workers that have to be running in the
+// restarted agent for the recovery to have worked.
+var raftManifolds = []string{"raft", "lease-manager"}
+
+// leaderManifold only runs while the agent is the raft leader.
+const leaderManifold = "raft-clusterer"
+
+// agentSettleTime is how long the raft workers must keep running
+// without restarting before the agent is considered healthy.
+const agentSettleTime = 30 * time.Second
+
+// introspectionSocket returns the abstract unix socket the machine
+// agent serves its introspection endpoints on, the one
+// juju_engine_report uses.
+func introspectionSocket(machineID string) string {
+	return "@jujud-machine-" + machineID
+}
+
+// manifoldState is the part of a dependency engine report we look at
+// for each manifold.
+type manifoldState struct {
+	State      string `yaml:"state"`
+	StartCount int    `yaml:"start-count"`
+	Error      string `yaml:"error"`
+
+	// Report is the worker's own report, of which only the raft
+	// worker's state is used.
+	Report struct {
+		State string `yaml:"state"`
+	} `yaml:"report"`
+}
+
+// engineReport is the report served at /depengine.
+type engineReport struct {
+	Manifolds map[string]manifoldState `yaml:"manifolds"`
+}
+
+// fetchEngineReport gets the dependency engine report from the agent
+// listening on socket.
+func fetchEngineReport(socket string) (*engineReport, error) {
+	body, err := fetchDepengine(socket)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return parseEngineReport(body)
+}
+
+// fetchDepengine gets the raw /depengine report from the agent
+// listening on socket.
+func fetchDepengine(socket string) ([]byte, error) {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	resp, err := client.Get("http://localhost/depengine")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+func parseEngineReport(body []byte) (*engineReport, error) {
+	var report engineReport
+	if err := yaml.Unmarshal(body, &report); err != nil {
+		return nil, errors.Annotate(err, "parsing engine report")
+	}
+	return &report, nil
+}
+
+// leading reports whether the agent's raft worker is the leader.
+func (r *engineReport) leading() bool {
+	return r.Manifolds["raft"].Report.State == "Leader"
+}
+
+// requiredManifolds returns the raft workers that should be running
+// given the agent's raft state in report.
+func requiredManifolds(report *engineReport) []string {
+	if report.leading() {
+		return append(raftManifolds[:len(raftManifolds):len(raftManifolds)], leaderManifold)
+	}
+	return raftManifolds
+}
+
+// raftWorkerProblems returns what's wrong with the raft workers in
+// report; if nothing is, it's empty.
+func raftWorkerProblems(report *engineReport) []string {
+	var problems []string
+	for _, name := range requiredManifolds(report) {
+		manifold, ok := report.Manifolds[name]
+		switch {
+		case !ok:
+			problems = append(problems, name+" is missing")
+		case manifold.State != "started":
+			problem := fmt.Sprintf("%s is %s", name, manifold.State)
+			if manifold.Error != "" {
+				problem += ": " + manifold.Error
+			}
+			problems = append(problems, problem)
+		}
+	}
+	return problems
+}
+
+// restartedManifolds returns the raft workers that have been started
+// again between the two reports. The leader's worker is only counted
+// if the agent led throughout, since it restarts whenever leadership
+// is won back.
+func restartedManifolds(before, after *engineReport) []string {
+	names := raftManifolds
+	if before.leading() && after.leading() {
+		names = requiredManifolds(after)
+	}
+	var restarted []string
+	for _, name := range names {
+		if after.Manifolds[name].StartCount > before.Manifolds[name].StartCount {
+			restarted = append(restarted, name)
+		}
+	}
+	sort.Strings(restarted)
+	return restarted
+}
+
+// verifyAgent waits up to timeout for the restarted machine agent to
+// have its raft workers running, then checks they stay up without
+// bouncing for agentSettleTime.
+func verifyAgent(machineID string, timeout time.Duration) error {
+	socket := introspectionSocket(machineID)
+	deadline := time.Now().Add(timeout)
+	var problems []string
+	for {
+		report, err := fetchEngineReport(socket)
+		if err != nil {
+			problems = []string{err.Error()}
+		} else if problems = raftWorkerProblems(report); len(problems) == 0 {
+			logger.Infof("Raft workers started; checking they stay up for %s.", agentSettleTime)
+			time.Sleep(agentSettleTime)
+			later, err := fetchEngineReport(socket)
+			if err != nil {
+				return errors.Annotate(err, "checking the agent again")
+			}
+			if problems := raftWorkerProblems(later); len(problems) > 0 {
+				return errors.Errorf("raft workers stopped: %s", strings.Join(problems, ", "))
+			}
+			if restarted := restartedManifolds(report, later); len(restarted) > 0 {
+				return errors.Errorf("raft workers are bouncing: %s restarted", strings.Join(restarted, ", "))
+			}
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.Errorf("raft workers not healthy after %s: %s", timeout, strings.Join(problems, ", "))
+		}
+		logger.Debugf("waiting for the agent: %s", strings.Join(problems, ", "))
+		time.Sleep(2 * time.Second)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRaftWorkerProblems(t *testing.T) {
+	for _, test := range []struct {
+		about    string
+		report   string
+		problems []string
+	}{{
+		about: "follower without the clusterer",
+		report: `
+manifolds:
+  raft: {state: started, report: {state: Follower}}
+  lease-manager: {state: started}
+  raft-clusterer: {state: stopped}
+`,
+	}, {
+		about: "leader with the clusterer",
+		report: `
+manifolds:
+  raft: {state: started, report: {state: Leader}}
+  lease-manager: {state: started}
+  raft-clusterer: {state: started}
+`,
+	}, {
+		about: "leader without the clusterer",
+		report: `
+manifolds:
+  raft: {state: started, report: {state: Leader}}
+  lease-manager: {state: started}
+  raft-clusterer: {state: stopped, error: "not leader"}
+`,
+		problems: []string{"raft-clusterer is stopped: not leader"},
+	}, {
+		about: "lease manager missing",
+		report: `
+manifolds:
+  raft: {state: started, report: {state: Candidate}}
+`,
+		problems: []string{"lease-manager is missing"},
+	}} {
+		t.Run(test.about, func(t *testing.T) {
+			report, err := parseEngineReport([]byte(test.report))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if problems := raftWorkerProblems(report); !reflect.DeepEqual(problems, test.problems) {
+				t.Errorf("got problems %q, want %q", problems, test.problems)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// jujuDB describes how the controller's MongoDB is packaged, and the
+// settings we found in its configuration.
+type jujuDB struct {
+	// Packaging is "juju-db snap" or "system mongod".
+	Packaging string
+
+	// ConfigPath is where the settings were read from.
+	ConfigPath string
+
+	// Port is the port mongod listens on, or "" if the
+	// configuration doesn't say.
+	Port string
+
+	// TLSMode is mongod's sslMode or tlsMode setting, or "" if the
+	// configuration doesn't say.
+	TLSMode string
+}
+
+// usesTLS reports whether clients must connect with TLS.
+func (db *jujuDB) usesTLS() bool {
+	return db.TLSMode != "disabled"
+}
+
+// Juju 2.9 and later run MongoDB from the juju-db snap with a
+// mongod config file; earlier controllers run a packaged mongod from
+// the juju-db systemd service, with its settings on the command line.
+var (
+	jujuDBSnapDir    = "/snap/juju-db"
+	jujuDBSnapConfig = "/var/snap/juju-db/common/juju-db.config"
+	jujuDBServices   = []string{
+		"/etc/systemd/system/juju-db.service",
+		"/lib/systemd/system/juju-db.service",
+	}
+)
+
+// detectJujuDB looks under hostfsPrefix for the juju-db snap or a
+// system juju-db service and reads its settings. It returns a
+// NotFound error if neither is there.
+func detectJujuDB(hostfsPrefix string) (*jujuDB, error) {
+	if _, err := os.Stat(filepath.Join(hostfsPrefix, jujuDBSnapDir)); err == nil {
+		db := &jujuDB{
+			Packaging:  "juju-db snap",
+			ConfigPath: filepath.Join(hostfsPrefix, jujuDBSnapConfig),
+		}
+		settings, err := readMongodConfig(db.ConfigPath)
+		if err != nil && !os.IsNotExist(errors.Cause(err)) {
+			return nil, errors.Trace(err)
+		}
+		db.Port = settings["port"]
+		db.TLSMode = firstNonEmpty(settings["tlsMode"], settings["sslMode"])
+		return db, nil
+	}
+	for _, service := range jujuDBServices {
+		path := filepath.Join(hostfsPrefix, service)
+		args, err := readExecStart(path)
+		if os.IsNotExist(errors.Cause(err)) {
+			continue
+		} else if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return &jujuDB{
+			Packaging:  "system mongod",
+			ConfigPath: path,
+			Port:       args["port"],
+			TLSMode:    firstNonEmpty(args["tlsMode"], args["sslMode"]),
+		}, nil
+	}
+	return nil, errors.NotFoundf("juju-db snap or service under %q", filepath.Join("/", hostfsPrefix))
+}
+
+// readMongodConfig reads the "key = value" settings from the config
+// file the juju-db snap's mongod is started with.
+func readMongodConfig(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	settings := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		settings[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return settings, errors.Annotatef(scanner.Err(), "reading %q", path)
+}
+
+// readExecStart reads the "--name value" options from the ExecStart
+// line of a systemd unit.
+func readExecStart(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	args := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "ExecStart=") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "ExecStart="))
+		for i, field := range fields {
+			if !strings.HasPrefix(field, "--") {
+				continue
+			}
+			name := strings.TrimPrefix(field, "--")
+			if eq := strings.Index(name, "="); eq >= 0 {
+				args[name[:eq]] = strings.Trim(name[eq+1:], `"'`)
+			} else if i+1 < len(fields) && !strings.HasPrefix(fields[i+1], "--") {
+				args[name] = strings.Trim(fields[i+1], `"'`)
+			} else {
+				args[name] = ""
+			}
+		}
+	}
+	return args, errors.Annotatef(scanner.Err(), "reading %q", path)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
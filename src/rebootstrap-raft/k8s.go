@@ -0,0 +1,274 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+)
+
+const k8sDoc = `
+
+Rebootstrap raft in every controller pod of a Kubernetes (CAAS)
+controller, using kubectl exec rather than ssh.
+
+The tool is copied into the api-server container of each pod and run
+there with a dry run first; if every pod generates the same
+configuration it's shown for confirmation. Then jujud is stopped in
+every pod through pebble, which runs it in the api-server container,
+each pod's raft directory on the controller volume is rebuilt in
+turn, and jujud is started again. If a pod fails, jujud is started
+again only in the pods that hadn't been reached; the others are left
+stopped for their stores to be looked at.
+
+The pods are found by label in the controller's namespace
+(controller-<name> for a controller called <name>). Arguments after
+-- are passed to the bootstrap run in every pod.
+
+`
+
+type k8sCommand struct {
+	cmd.CommandBase
+	logFlags
+	kubeconfig string
+	context    string
+	namespace  string
+	container  string
+	selector   string
+	pebble     string
+	service    string
+	dryRun     bool
+	yes        bool
+	extraArgs  []string
+}
+
+// Info is part of cmd.Command.
+func (c *k8sCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "k8s",
+		Args:    "[-- <bootstrap flags>]",
+		Purpose: "Rebootstrap every pod of a Kubernetes controller.",
+		Doc:     strings.TrimSpace(k8sDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *k8sCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	c.logFlags.setFlags(f)
+	f.StringVar(&c.kubeconfig, "kubeconfig", "", "kubeconfig file to use (default: kubectl's own choice)")
+	f.StringVar(&c.context, "context", "", "kubeconfig context to use")
+	f.StringVar(&c.namespace, "namespace", "", "namespace of the controller (required)")
+	f.StringVar(&c.container, "container", "api-server", "container running jujud")
+	f.StringVar(&c.selector, "selector", "app.kubernetes.io/name=controller", "label selector for the controller pods")
+	f.StringVar(&c.pebble, "pebble", "/charm/bin/pebble", "path to pebble in the container")
+	f.StringVar(&c.service, "pebble-service", "jujud", "pebble service running jujud")
+	f.BoolVar(&c.dryRun, "dry-run", false, "show the plan for each pod but don't bootstrap")
+	f.BoolVar(&c.yes, "yes", false, "don't ask for confirmation before writing")
+}
+
+// Init is part of cmd.Command.
+func (c *k8sCommand) Init(args []string) error {
+	if err := c.setupLogging(false); err != nil {
+		return errors.Trace(err)
+	}
+	if c.namespace == "" {
+		return errors.Errorf("--namespace is required")
+	}
+	c.extraArgs = args
+	return nil
+}
+
+// kubectl returns a kubectl command with the connection flags.
+func (c *k8sCommand) kubectl(args ...string) *exec.Cmd {
+	var kubeArgs []string
+	if c.kubeconfig != "" {
+		kubeArgs = append(kubeArgs, "--kubeconfig", c.kubeconfig)
+	}
+	if c.context != "" {
+		kubeArgs = append(kubeArgs, "--context", c.context)
+	}
+	kubeArgs = append(kubeArgs, "--namespace", c.namespace)
+	return exec.Command("kubectl", append(kubeArgs, args...)...)
+}
+
+// Run is part of cmd.Command.
+func (c *k8sCommand) Run(ctx *cmd.Context) error {
+	c.setupOutput(ctx)
+	progress := newProgress(ctx.Stderr, c.quiet)
+
+	pods, err := c.pods()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return errors.Annotate(err, "finding this executable")
+	}
+
+	remotes := make(map[string]remote)
+	paths := make(map[string]string)
+	for _, pod := range pods {
+		r := &kubectlRemote{command: c, pod: pod}
+		done := progress.start("Copying rebootstrap-raft to pod " + pod)
+		path, remove, err := pushFile(r, self, "rebootstrap-raft")
+		done(err)
+		if err != nil {
+			return errors.Annotatef(err, "pod %s", pod)
+		}
+		defer remove()
+		remotes[pod], paths[pod] = r, path
+	}
+
+	var plan []serverResult
+	for _, pod := range pods {
+		done := progress.start("Planning pod " + pod)
+		result, err := c.runBootstrap(remotes[pod], paths[pod], pod, "--dry-run")
+		if err == nil && plan != nil && !reflect.DeepEqual(result.Servers, plan) {
+			err = errors.Errorf("generated a different configuration: %v", result.Servers)
+		}
+		done(err)
+		if err != nil {
+			return errors.Annotatef(err, "pod %s", pod)
+		}
+		plan = result.Servers
+	}
+	fmt.Fprintf(ctx.Stderr, "Every controller pod will be bootstrapped with servers:\n")
+	for _, server := range plan {
+		fmt.Fprintf(ctx.Stderr, "  %-6s %-24s %s\n", server.ID, server.Address, server.Suffrage)
+	}
+	if c.dryRun {
+		return nil
+	}
+	if !c.yes {
+		ok, err := confirm(ctx, "Continue?")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !ok {
+			return errors.New("aborted")
+		}
+	}
+
+	// Stop jujud through pebble rather than killing it: a killed
+	// agent would be restarted with the container straight away,
+	// and a paused one still holds the store's lock.
+	for i, pod := range pods {
+		if _, err := remotes[pod].Run(c.pebble, "stop", c.service); err != nil {
+			c.startAgents(remotes, pods[:i])
+			return errors.Annotatef(err, "stopping jujud in pod %s", pod)
+		}
+	}
+	for i, pod := range pods {
+		done := progress.start("Bootstrapping pod " + pod)
+		result, err := c.runBootstrap(remotes[pod], paths[pod], pod, "--yes", "--force", "--agent-service", noAgentService)
+		done(err)
+		if err != nil {
+			// Starting jujud on a store that's been replaced
+			// while the others haven't would split the
+			// cluster, so only the pods not yet reached are
+			// started.
+			c.startAgents(remotes, pods[i+1:])
+			return errors.Annotatef(err, "pod %s (jujud is left stopped in %s)", pod, strings.Join(pods[:i+1], ", "))
+		}
+		fmt.Fprintf(ctx.Stdout, "Pod %s: wrote %s\n", pod, result.RaftDir)
+	}
+	for _, pod := range pods {
+		if _, err := remotes[pod].Run(c.pebble, "start", c.service); err != nil {
+			return errors.Annotatef(err, "starting jujud in pod %s", pod)
+		}
+	}
+	return nil
+}
+
+// startAgents starts jujud again in pods after a failure, logging
+// rather than returning errors since the caller is already handling
+// one.
+func (c *k8sCommand) startAgents(remotes map[string]remote, pods []string) {
+	for _, pod := range pods {
+		logger.Warningf("Rolling back: starting jujud in pod %s.", pod)
+		if _, err := remotes[pod].Run(c.pebble, "start", c.service); err != nil {
+			logger.Errorf("starting jujud in pod %s: %v", pod, err)
+		}
+	}
+}
+
+// runBootstrap runs the bootstrap subcommand in a pod with the given
+// flags as well as any passed through, returning its result.
+func (c *k8sCommand) runBootstrap(r remote, path, pod string, flags ...string) (*bootstrapResult, error) {
+	machineID, err := podMachineID(pod)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	args := []string{"--machine-id", machineID, "--quiet", "--format", "json"}
+	args = append(args, flags...)
+	return runRemoteBootstrap(r, path, append(args, c.extraArgs...)...)
+}
+
+// pods returns the names of the controller pods.
+func (c *k8sCommand) pods() ([]string, error) {
+	out, err := runRemoteCommand(c.kubectl("get", "pods", "--selector", c.selector,
+		"--output", "jsonpath={.items[*].metadata.name}"))
+	if err != nil {
+		return nil, errors.Annotate(err, "listing controller pods")
+	}
+	pods := strings.Fields(string(out))
+	if len(pods) == 0 {
+		return nil, errors.NotFoundf("controller pods matching %q in %s", c.selector, c.namespace)
+	}
+	sort.Strings(pods)
+	return pods, nil
+}
+
+// podMachineID returns the controller machine id for a pod of the
+// controller stateful set, which is its ordinal: controller-1 is
+// machine 1.
+func podMachineID(pod string) (string, error) {
+	i := strings.LastIndex(pod, "-")
+	if i < 0 || i == len(pod)-1 {
+		return "", errors.Errorf("can't get a machine id from pod name %q", pod)
+	}
+	return pod[i+1:], nil
+}
+
+// kubectlRemote runs commands in a controller pod with kubectl exec.
+// The api-server container already runs as root.
+type kubectlRemote struct {
+	command *k8sCommand
+	pod     string
+}
+
+// Run is part of remote.
+func (r *kubectlRemote) Run(args ...string) ([]byte, error) {
+	execArgs := append([]string{"exec", r.pod, "--container", r.command.container, "--"}, args...)
+	return runRemoteCommand(r.command.kubectl(execArgs...))
+}
+
+// Copy is part of remote.
+func (r *kubectlRemote) Copy(localPath, remotePath string) error {
+	_, err := runRemoteCommand(r.command.kubectl("cp", "--container", r.command.container,
+		localPath, r.pod+":"+remotePath))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, err = r.Run("chmod", "755", remotePath)
+	return errors.Trace(err)
+}
+
+// TempDir is part of remote.
+func (r *kubectlRemote) TempDir() (string, error) {
+	return tempDirPath(r.Run(mktempArgs...))
+}
+
+func (r *kubectlRemote) String() string {
+	return "pod " + r.pod
+}
@@ -0,0 +1,150 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+const leasesDoc = `
+
+Show the leases held in a raft snapshot: which unit leads each
+application (and which machine holds each singular controller lease),
+and how long the lease has left. The snapshot is the newest one found
+at the path, which can be a raft directory, its snapshots directory, a
+single snapshot or a tarball of any of those - the same as
+--snapshot-from accepts. Use this to see what leadership state a
+rebootstrap would keep or lose.
+
+`
+
+type leasesCommand struct {
+	cmd.CommandBase
+	out cmd.Output
+	logFlags
+	path string
+}
+
+// leaseResult describes one lease held in a snapshot.
+type leaseResult struct {
+	Namespace string        `json:"namespace" yaml:"namespace"`
+	Model     string        `json:"model" yaml:"model"`
+	Lease     string        `json:"lease" yaml:"lease"`
+	Holder    string        `json:"holder" yaml:"holder"`
+	Expiry    time.Time     `json:"expiry" yaml:"expiry"`
+	Remaining time.Duration `json:"remaining" yaml:"remaining"`
+	PinnedBy  []string      `json:"pinned-by,omitempty" yaml:"pinned-by,omitempty"`
+}
+
+// Info is part of cmd.Command.
+func (c *leasesCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "leases",
+		Args:    "<snapshot-path>",
+		Purpose: "Show the leases held in a raft snapshot.",
+		Doc:     strings.TrimSpace(leasesDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *leasesCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	c.logFlags.setFlags(f)
+	c.out.AddFlags(f, "text", map[string]cmd.Formatter{
+		"text": formatLeases,
+		"json": cmd.FormatJson,
+		"yaml": cmd.FormatYaml,
+	})
+}
+
+// Init is part of cmd.Command.
+func (c *leasesCommand) Init(args []string) error {
+	if err := c.setupLogging(false); err != nil {
+		return errors.Trace(err)
+	}
+	if len(args) < 1 {
+		return errors.Errorf("snapshot path is required")
+	}
+	c.path = args[0]
+	return c.CommandBase.Init(args[1:])
+}
+
+// Run is part of cmd.Command.
+func (c *leasesCommand) Run(ctx *cmd.Context) error {
+	c.setupOutput(ctx)
+	snapshot, err := readSourceSnapshot(c.path)
+	if err != nil {
+		return errors.Annotate(err, "reading snapshot")
+	}
+	leases, err := rebootstrap.DecodeLeaseSnapshot(snapshot.Data)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return c.out.Write(ctx, makeLeaseResults(leases))
+}
+
+// makeLeaseResults lists the leases in a snapshot, ordered by model,
+// namespace and lease. The time remaining is measured from the
+// snapshot's global time, which is what the lease FSM uses.
+func makeLeaseResults(leases *rebootstrap.LeaseSnapshot) []leaseResult {
+	results := make([]leaseResult, 0, len(leases.Entries))
+	for key, entry := range leases.Entries {
+		expiry := entry.Expiry()
+		results = append(results, leaseResult{
+			Namespace: key.Namespace,
+			Model:     key.ModelUUID,
+			Lease:     key.Lease,
+			Holder:    entry.Holder,
+			Expiry:    expiry,
+			Remaining: expiry.Sub(leases.GlobalTime),
+			PinnedBy:  leases.Pinned[key],
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Model != b.Model {
+			return a.Model < b.Model
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Lease < b.Lease
+	})
+	return results
+}
+
+func formatLeases(writer io.Writer, value interface{}) error {
+	results, ok := value.([]leaseResult)
+	if !ok {
+		return errors.Errorf("expected []leaseResult, got %T", value)
+	}
+	if len(results) == 0 {
+		fmt.Fprintln(writer, "No leases held.")
+		return nil
+	}
+	tw := tabwriter.NewWriter(writer, 0, 1, 2, ' ', 0)
+	fmt.Fprintf(tw, "MODEL\tNAMESPACE\tLEASE\tHOLDER\tEXPIRES\n")
+	for _, result := range results {
+		expires := "expired"
+		if result.Remaining > 0 {
+			expires = "in " + result.Remaining.String()
+		}
+		if len(result.PinnedBy) > 0 {
+			expires += " (pinned)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", result.Model, result.Namespace, result.Lease, result.Holder, expires)
+	}
+	return errors.Trace(tw.Flush())
+}
@@ -0,0 +1,78 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/juju/errors"
+)
+
+// lockFileName is the name of the lock file taken in the juju data
+// directory for the duration of a run.
+const lockFileName = "rebootstrap-raft.lock"
+
+// runLock is an exclusive lock held on a file in the data directory.
+type runLock struct {
+	file *os.File
+}
+
+// acquireLock takes an exclusive lock on the lock file in dataDir,
+// failing immediately if another process holds it. The holder's pid
+// is written into the file so the error can say who has it.
+func acquireLock(dataDir string) (*runLock, error) {
+	path := filepath.Join(dataDir, lockFileName)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Annotatef(err, "opening lock file")
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		holder, _ := ioutil.ReadAll(f)
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errors.Errorf("another rebootstrap-raft (pid %s) is running - lock %q is held",
+				strings.TrimSpace(string(holder)), path)
+		}
+		return nil, errors.Annotatef(err, "locking %q", path)
+	}
+	if err := f.Truncate(0); err == nil {
+		fmt.Fprintf(f, "%d\n", os.Getpid())
+	}
+	return &runLock{file: f}, nil
+}
+
+// Release unlocks and closes the lock file.
+func (l *runLock) Release() {
+	if err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN); err != nil {
+		logger.Warningf("releasing lock: %v", err)
+	}
+	l.file.Close()
+}
+
+// boltFileLocked reports whether another process holds bolt's lock on
+// the file at path. Bolt takes an exclusive flock when it opens a
+// database for writing, so if we can't get a shared one the file is
+// in use.
+func boltFileLocked(path string) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Trace(err)
+	}
+	defer f.Close()
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return true, nil
+	} else if err != nil {
+		return false, errors.Trace(err)
+	}
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return false, nil
+}
@@ -0,0 +1,247 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"github.com/juju/loggo"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+// logFlags holds the flags controlling log output, shared by all the
+// commands.
+type logFlags struct {
+	verbose   bool
+	quiet     bool
+	logFormat string
+	logFile   string
+	syslog    bool
+	syslogTag string
+
+	raftLogLevel  string
+	loggingConfig string
+
+	logFileWriter io.Writer
+}
+
+func (l *logFlags) setFlags(f *gnuflag.FlagSet) {
+	f.BoolVar(&l.verbose, "verbose", false, "show debug logging")
+	f.BoolVar(&l.quiet, "quiet", false, "only log errors, leaving just the result on stdout")
+	f.StringVar(&l.logFormat, "log-format", "text", "format of log output (text or json)")
+	f.StringVar(&l.logFile, "log-file", "", "also append all output, with timestamps, to this file")
+	f.BoolVar(&l.syslog, "syslog", false, "also send log messages to syslog (and so the journal)")
+	f.StringVar(&l.syslogTag, "syslog-tag", "rebootstrap-raft", "tag to use for syslog messages")
+	f.StringVar(&l.raftLogLevel, "raft-log-level", "", "level of hashicorp raft's own logging, independent of the tool's (default: warnings, and everything with --verbose)")
+	f.StringVar(&l.loggingConfig, "logging-config", "", "juju-style logging levels by module, such as \"<root>=INFO;rebootstrap=DEBUG;raft=WARNING\"")
+}
+
+// raftLoggingModule is the --logging-config module that sets the
+// level of raft's own logging, as --raft-log-level does.
+const raftLoggingModule = "raft"
+
+// loggingModules are the short names --logging-config accepts for
+// the tool's own modules. Anything else is taken as a loggo module
+// name.
+var loggingModules = map[string]string{
+	"rebootstrap": "rebootstrap-raft.rebootstrap",
+	"mongo":       "rebootstrap-raft.mongo",
+}
+
+// applyLoggingConfig sets the levels in a juju-style logging config
+// string, "<root>=INFO;module=LEVEL;...".
+func applyLoggingConfig(spec string) error {
+	levels, err := loggo.ParseConfigString(spec)
+	if err != nil {
+		return errors.Annotate(err, "parsing --logging-config")
+	}
+	for module, level := range levels {
+		if module == raftLoggingModule || module == "rebootstrap-raft.rebootstrap.raft" {
+			rebootstrap.SetRaftLogLevel(level)
+			continue
+		}
+		if name, ok := loggingModules[module]; ok {
+			module = name
+		}
+		loggo.GetLogger(module).SetLogLevel(level)
+	}
+	return nil
+}
+
+// setupLogging configures logging as the flags ask, showing debug
+// messages if debug is set even without --verbose (but not with
+// --quiet). It's called first thing in Init so that everything the
+// command logs is affected.
+func (l *logFlags) setupLogging(debug bool) error {
+	switch {
+	case l.verbose && l.quiet:
+		return errors.Errorf("--verbose and --quiet can't be used together")
+	case l.quiet:
+		logger.SetLogLevel(loggo.ERROR)
+	case l.verbose || debug:
+		logger.SetLogLevel(loggo.DEBUG)
+	}
+	if l.raftLogLevel != "" {
+		level, ok := loggo.ParseLevel(l.raftLogLevel)
+		if !ok || level == loggo.UNSPECIFIED {
+			return errors.Errorf("--raft-log-level must be one of trace, debug, info, warning or error, not %q", l.raftLogLevel)
+		}
+		rebootstrap.SetRaftLogLevel(level)
+	}
+	// Levels given by module win over the flags above.
+	if l.loggingConfig != "" {
+		if err := applyLoggingConfig(l.loggingConfig); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	var newWriter func(io.Writer) loggo.Writer
+	switch l.logFormat {
+	case "text":
+		newWriter = newTextWriter
+	case "json":
+		newWriter = newJSONWriter
+	default:
+		return errors.Errorf("--log-format must be text or json, not %q", l.logFormat)
+	}
+	if _, err := loggo.ReplaceDefaultWriter(redactingWriter{newWriter(os.Stderr)}); err != nil {
+		return errors.Trace(err)
+	}
+	if l.logFile != "" {
+		f, err := os.OpenFile(l.logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return errors.Annotate(err, "opening --log-file")
+		}
+		if err := loggo.RegisterWriter("logfile", redactingWriter{newWriter(f)}); err != nil {
+			return errors.Trace(err)
+		}
+		l.logFileWriter = &timestampWriter{w: f}
+	}
+	if l.syslog {
+		w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, l.syslogTag)
+		if err != nil {
+			return errors.Annotate(err, "connecting to syslog")
+		}
+		if err := loggo.RegisterWriter("syslog", redactingWriter{&syslogWriter{w}}); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// syslogWriter is a loggo.Writer that sends entries to syslog at the
+// matching priority. On systemd machines syslog messages end up in
+// the journal under the writer's tag.
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+// Write is part of loggo.Writer.
+func (s *syslogWriter) Write(entry loggo.Entry) {
+	message := fmt.Sprintf("%s %s", entry.Module, entry.Message)
+	switch entry.Level {
+	case loggo.CRITICAL:
+		s.w.Crit(message)
+	case loggo.ERROR:
+		s.w.Err(message)
+	case loggo.WARNING:
+		s.w.Warning(message)
+	case loggo.INFO:
+		s.w.Info(message)
+	default:
+		s.w.Debug(message)
+	}
+}
+
+// setupOutput makes sure nothing the command writes to stdout or
+// stderr (results, prompts and the final error) contains secrets, and
+// copies it all into the log file if there is one.
+func (l *logFlags) setupOutput(ctx *cmd.Context) {
+	if l.logFileWriter != nil {
+		ctx.Stdout = io.MultiWriter(ctx.Stdout, l.logFileWriter)
+		ctx.Stderr = io.MultiWriter(ctx.Stderr, l.logFileWriter)
+	}
+	ctx.Stdout = redactingStream{ctx.Stdout}
+	ctx.Stderr = redactingStream{ctx.Stderr}
+}
+
+// newTextWriter returns a loggo.Writer that writes entries in loggo's
+// default format, which includes a timestamp.
+func newTextWriter(w io.Writer) loggo.Writer {
+	return loggo.NewSimpleWriter(w, loggo.DefaultFormatter)
+}
+
+// timestampWriter prefixes each line written to it with the time.
+type timestampWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	midLine bool
+}
+
+// Write is part of io.Writer.
+func (t *timestampWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var buf bytes.Buffer
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if !t.midLine {
+			buf.WriteString(time.Now().UTC().Format("2006-01-02 15:04:05 "))
+		}
+		buf.Write(line)
+		t.midLine = line[len(line)-1] != '\n'
+	}
+	if _, err := t.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// jsonEntry is how a log entry is written by jsonWriter.
+type jsonEntry struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Module  string `json:"module"`
+	Source  string `json:"source,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+}
+
+// jsonWriter is a loggo.Writer that writes each entry as a line of
+// JSON. Output from raft's hclog loggers comes through loggo too, so
+// it ends up in the same stream.
+type jsonWriter struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func newJSONWriter(w io.Writer) loggo.Writer {
+	return &jsonWriter{encoder: json.NewEncoder(w)}
+}
+
+// Write is part of loggo.Writer.
+func (w *jsonWriter) Write(entry loggo.Entry) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.encoder.Encode(jsonEntry{
+		Time:    entry.Timestamp.UTC().Format(time.RFC3339Nano),
+		Level:   entry.Level.String(),
+		Module:  entry.Module,
+		Source:  entry.Filename,
+		Line:    entry.Line,
+		Message: entry.Message,
+	})
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os/exec"
+	"sort"
+
+	"github.com/juju/errors"
+)
+
+// lxdRemote runs commands in a local LXD container with the lxc
+// client, which talks to the LXD API on our behalf. Commands run as
+// root in the container already.
+type lxdRemote struct {
+	container string
+}
+
+// Run is part of remote.
+func (r *lxdRemote) Run(args ...string) ([]byte, error) {
+	lxcArgs := append([]string{"exec", r.container, "--"}, args...)
+	return runRemoteCommand(exec.Command("lxc", lxcArgs...))
+}
+
+// Copy is part of remote.
+func (r *lxdRemote) Copy(localPath, remotePath string) error {
+	_, err := runRemoteCommand(exec.Command("lxc", "file", "push", localPath, r.container+remotePath))
+	return errors.Trace(err)
+}
+
+// TempDir is part of remote.
+func (r *lxdRemote) TempDir() (string, error) {
+	return tempDirPath(r.Run(mktempArgs...))
+}
+
+func (r *lxdRemote) String() string {
+	return "container " + r.container
+}
+
+// lxdInstanceState is the part of the LXD API's instance state that
+// we need.
+type lxdInstanceState struct {
+	Status  string `json:"status"`
+	Network map[string]struct {
+		Addresses []struct {
+			Family  string `json:"family"`
+			Address string `json:"address"`
+			Scope   string `json:"scope"`
+		} `json:"addresses"`
+	} `json:"network"`
+}
+
+// address asks the LXD API for the container's state and returns its
+// first global IPv4 address (or IPv6 if it has none), taking the
+// interfaces in name order, which MongoDB can be reached on from the
+// host.
+func (r *lxdRemote) address() (string, error) {
+	out, err := runRemoteCommand(exec.Command("lxc", "query", "/1.0/instances/"+r.container+"/state"))
+	if err != nil {
+		return "", errors.Annotatef(err, "getting the state of container %s", r.container)
+	}
+	var state lxdInstanceState
+	if err := json.Unmarshal(out, &state); err != nil {
+		return "", errors.Annotatef(err, "parsing the state of container %s", r.container)
+	}
+	if state.Status != "Running" {
+		return "", errors.Errorf("container %s is %s, not running", r.container, state.Status)
+	}
+	var names []string
+	for name := range state.Network {
+		if name != "lo" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var ipv6 string
+	for _, name := range names {
+		for _, address := range state.Network[name].Addresses {
+			if address.Scope != "global" || net.ParseIP(address.Address) == nil {
+				continue
+			}
+			switch address.Family {
+			case "inet":
+				return address.Address, nil
+			case "inet6":
+				if ipv6 == "" {
+					ipv6 = address.Address
+				}
+			}
+		}
+	}
+	if ipv6 == "" {
+		return "", errors.NotFoundf("global address for container %s", r.container)
+	}
+	return ipv6, nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+// inferMachineTimeout bounds the MongoDB lookup made to infer the
+// machine id.
+const inferMachineTimeout = 30 * time.Second
+
+// agentServiceDirs are where the machine agent's systemd unit can be
+// installed. Juju writes jujud-machine-<id>.service into
+// /lib/systemd/system (in a directory of the same name, in older
+// versions) and links it from /etc/systemd/system.
+var agentServiceDirs = []string{
+	"/etc/systemd/system",
+	"/lib/systemd/system",
+	"/run/systemd/system",
+}
+
+// agentServicePattern matches the machine agent's unit, or the
+// directory holding it, whether installed directly or by a snap, and
+// captures the machine id.
+var agentServicePattern = regexp.MustCompile(`^(?:snap\.[^.]+\.)?jujud-machine-([0-9]+)(?:\.service)?$`)
+
+// installedAgentMachineIDs returns the ids of the machine agents whose
+// systemd units are installed under hostfsPrefix.
+func installedAgentMachineIDs(hostfsPrefix string) []string {
+	seen := make(map[string]bool)
+	var ids []string
+	for _, dir := range agentServiceDirs {
+		entries, err := ioutil.ReadDir(filepath.Join(hostfsPrefix, dir))
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			match := agentServicePattern.FindStringSubmatch(entry.Name())
+			if match != nil && !seen[match[1]] {
+				seen[match[1]] = true
+				ids = append(ids, match[1])
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// inferMachineID works out this machine's id when --machine-id isn't
+// given. If the data directory has exactly one machine agent, it's
+// that one's. Otherwise (there are none, or several from restored or
+// copied directories) it's the one whose systemd unit is installed,
+// if there's just one (among the agents, if there are any). Failing
+// that the local MongoDB is asked which replicaset member it is, and
+// if that member's address is one of this host's, its juju-machine-id
+// tag gives the id.
+func (c *rebootstrapCommand) inferMachineID() error {
+	ids := localMachineIDs(c.dataDir)
+	if len(ids) == 1 {
+		c.machineID = ids[0]
+		logger.Infof("Using machine %s, the only machine agent in %q.", c.machineID, c.dataDir)
+		return nil
+	}
+	logger.Debugf("machine agents in %q: %v", c.dataDir, ids)
+	agents := make(map[string]bool)
+	for _, id := range ids {
+		agents[id] = true
+	}
+	var units []string
+	for _, id := range installedAgentMachineIDs(c.hostfsPrefix) {
+		if len(ids) == 0 || agents[id] {
+			units = append(units, id)
+		}
+	}
+	if len(units) == 1 {
+		c.machineID = units[0]
+		logger.Infof("Using machine %s, whose agent's systemd unit is installed.", c.machineID)
+		return nil
+	}
+	logger.Debugf("machine agent units installed: %v", units)
+	if c.sshTunnel != "" {
+		return errors.Errorf("%d machine agents in %q, and MongoDB through --ssh-tunnel isn't this machine's", len(ids), c.dataDir)
+	}
+	if c.hostname == "localhost" {
+		c.applyJujuDB(c.hostfsPrefix)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), inferMachineTimeout)
+	defer cancel()
+	id, err := c.localMemberMachineID(ctx)
+	if err != nil {
+		return errors.Annotatef(err, "%d machine agents in %q, so asking MongoDB", len(ids), c.dataDir)
+	}
+	c.machineID = id
+	logger.Infof("Using machine %s, whose replicaset member is at one of this host's addresses.", c.machineID)
+	return nil
+}
+
+// localMemberMachineID asks the MongoDB server for its own replicaset
+// member with isMaster, which needs no login, and returns the
+// member's juju-machine-id tag if its address is one of this host's.
+func (m *mongoFlags) localMemberMachineID(ctx context.Context) (string, error) {
+	session, err := m.dial(ctx, "", "", true)
+	if err != nil {
+		return "", errors.Annotate(err, "connecting to MongoDB")
+	}
+	defer session.Close()
+	var result struct {
+		Me   string            `bson:"me"`
+		Tags map[string]string `bson:"tags"`
+	}
+	if err := session.Run("isMaster", &result); err != nil {
+		return "", errors.Annotate(err, "asking MongoDB which member it is")
+	}
+	if result.Me == "" {
+		return "", errors.New("MongoDB isn't running as a replicaset member")
+	}
+	host, _, err := net.SplitHostPort(result.Me)
+	if err != nil {
+		return "", errors.Annotatef(err, "parsing member address %q", result.Me)
+	}
+	local, err := isLocalHost(ctx, host)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if !local {
+		return "", errors.Errorf("the MongoDB member reached is at %s, which isn't one of this host's addresses", result.Me)
+	}
+	id, ok := result.Tags[rebootstrap.MachineIDTag]
+	if !ok {
+		return "", errors.Errorf("the replicaset member at %s has no %s tag", result.Me, rebootstrap.MachineIDTag)
+	}
+	return id, nil
+}
+
+// isLocalHost says whether host, a name or an IP address, is one of
+// the addresses of this host's network interfaces.
+func isLocalHost(ctx context.Context, host string) (bool, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false, errors.Annotate(err, "listing local addresses")
+	}
+	var local []string
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			local = append(local, ipNet.IP.String())
+		}
+	}
+	resolved := []string{host}
+	if net.ParseIP(host) == nil {
+		if resolved, err = net.DefaultResolver.LookupHost(ctx, host); err != nil {
+			return false, errors.Annotatef(err, "resolving %q", host)
+		}
+	}
+	logger.Debugf("member %s resolves to %s; local addresses are %s", host, strings.Join(resolved, ", "), strings.Join(local, ", "))
+	return sharesAddress(resolved, local), nil
+}
@@ -4,25 +4,36 @@
 package main
 
 import (
-	"crypto/tls"
+	"bytes"
+	"context"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/raft"
-	"github.com/hashicorp/raft-boltdb"
 	"github.com/juju/cmd"
 	"github.com/juju/errors"
 	"github.com/juju/gnuflag"
 	"github.com/juju/loggo"
 	"github.com/juju/replicaset"
+	"go.etcd.io/bbolt"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/yaml.v2"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
 )
 
+const superDoc = `
+
+Tools for recovering the raft store of a Juju controller. If no
+subcommand is given the bootstrap subcommand is run.
+
+`
+
 const rebootstrapDoc = `
 
 Recreate an empty raft cluster directory with server configuration
@@ -30,6 +41,10 @@ based on the current replicaset members. This should be run as root on
 a controller machine while the machine agent is stopped. For safety it
 won't run if there's a raft directory already.
 
+If the controller has juju-ha-space configured, each member's raft
+address is taken from its addresses in that space rather than from
+the replicaset.
+
 You can determine the password for Juju's MongoDB by looking in the
 machine agent's configuration file using the following command:
 
@@ -37,30 +52,123 @@ machine agent's configuration file using the following command:
 
 `
 
-// jujuMachineKey is the key for the replset member tag where we
-// store the member's corresponding machine id.
-const jujuMachineKey = "juju-machine-id"
+// jujudSnapshotRetention is the number of snapshots the raft worker
+// in jujud keeps.
+const jujudSnapshotRetention = 2
+
+// defaultStoreTimeout is how long each step of writing the store may
+// take. Writing a new store takes well under a second on a healthy
+// disk.
+const defaultStoreTimeout = 2 * time.Minute
+
+const (
+	boltLogStore = "bolt"
+	walLogStore  = "wal"
+)
 
 var logger = loggo.GetLogger("rebootstrap-raft")
 
 type rebootstrapCommand struct {
 	cmd.CommandBase
-	verbose   bool
+	out cmd.Output
+	logFlags
+	mongoFlags
+	dataDirFlags
 	dryRun    bool
 	raftDir   string
 	apiPort   int
 	machineID string
-	hostname  string
-	mongoPort string
-	ssl       bool
-	password  string
+
+	stage            bool
+	unprivileged     bool
+	interactive      bool
+	restored         bool
+	agentMachineID   string
+	advertise        string
+	advertiseAddrs   map[raft.ServerID]string
+	localAddress     string
+	addressScope     string
+	addressFamily    string
+	selectAddresses  bool
+	minVoters        int
+	expectServers    int
+	allowEvenVoters  bool
+	protocolVersion  int
+	logStoreType     string
+	snapshotRetain   int
+	seedLeases       bool
+	snapshotFrom     string
+	extendLeases     time.Duration
+	expireLeases     bool
+	configFrom       string
+	fromBackup       string
+	idScheme         string
+	recordOp         bool
+	backup           *rebootstrap.Backup
+	startIndex       uint64
+	startTerm        uint64
+	oldRaftDir       string
+	retainOldLogs    bool
+	sourceRaftDir    string
+	sourceCopy       *rebootstrap.StoreCopy
+	retained         []*raft.Log
+	snapshotIndex    uint64
+	snapshotTerm     uint64
+	skipVersionCheck bool
+	force            bool
+	agentService     string
+	stopAgent        bool
+	restartAgent     bool
+	restartAgents    bool
+	verifyAgent      bool
+	verifyTimeout    time.Duration
+	watchLogs        bool
+	yes              bool
+	checkPeers       bool
+	checkPeerStores  bool
+	peerTimeout      time.Duration
+	maxClockSkew     time.Duration
+	dropUnreachable  bool
+	confirmDropped   string
+	dropped          []string
+	origins          map[raft.ServerID]serverOrigin
+	replicasetVotes  bool
+	explain          bool
+	color            string
+	memberCount      int
+	noSync           bool
+	storeTimeout     time.Duration
+	timeout          time.Duration
+	allowNetworkFS   bool
+	ownerSpec        string
+	owner            ownership
+
+	progress      *progress
+	eventsEnabled bool
+	ansible       bool
+	ansibleResult *bootstrapResult
+	resultWritten bool
+	metricsFile   string
+	traceFile     string
+	tracer        *tracer
+	sshFlags
+	allControllers bool
+	scriptsDir     string
+	peersJSON      string
+	events         *eventStream
+	preHook        string
+	postHook       string
+
+	boltNoFreelistSync  bool
+	boltFreelistType    string
+	boltInitialMmapSize int
 }
 
 // Info is part of cmd.Command.
 func (c *rebootstrapCommand) Info() *cmd.Info {
 	return &cmd.Info{
-		Name:    "rebootstrap-raft",
-		Args:    "--machine-id <id> --password <password>",
+		Name:    "bootstrap",
+		Args:    "[--machine-id <id>] [--password <password>]",
 		Purpose: "Recreate a juju raft cluster directory.",
 		Doc:     strings.TrimSpace(rebootstrapDoc),
 	}
@@ -69,219 +177,1457 @@ func (c *rebootstrapCommand) Info() *cmd.Info {
 // SetFlags is part of cmd.Command.
 func (c *rebootstrapCommand) SetFlags(f *gnuflag.FlagSet) {
 	c.CommandBase.SetFlags(f)
-	f.BoolVar(&c.verbose, "verbose", false, "show debug logging")
+	c.logFlags.setFlags(f)
+	c.out.AddFlags(f, "text", outputFormatters)
+	f.BoolVar(&c.eventsEnabled, "events", false, "write a JSON line to stdout for each step, instead of the usual output")
+	f.BoolVar(&c.ansible, "ansible", false, "write the outcome to stdout as an Ansible module's JSON result, without asking for confirmation")
+	f.StringVar(&c.metricsFile, "metrics-file", "", "write the run's outcome to this node-exporter textfile (a .prom file)")
+	f.StringVar(&c.traceFile, "trace-file", "", "write a trace of the run's phases to this file as OTLP/JSON")
+	f.BoolVar(&c.allControllers, "all-controllers", false, "also bootstrap every other controller, over ssh")
+	c.sshFlags.setFlags(f)
+	f.StringVar(&c.scriptsDir, "emit-scripts", "", "write a script to run on each controller machine into this directory, instead of bootstrapping")
+	f.StringVar(&c.peersJSON, "emit-peers-json", "", "write the configuration to this file in hashicorp raft's peers.json recovery format, instead of bootstrapping")
 	f.BoolVar(&c.dryRun, "dry-run", false, "build the configuration but don't bootstrap raft")
-	f.StringVar(&c.raftDir, "raft-dir", "/var/lib/juju/raft", "raft directory location")
-	f.StringVar(&c.machineID, "machine-id", "", "ID of this Juju controller machine")
+	f.BoolVar(&c.explain, "explain", false, "show where each server's id, address and suffrage came from")
+	f.BoolVar(&c.interactive, "interactive", false, "ask about each decision (machine, password, servers and suffrage), suggesting what was detected")
+	f.BoolVar(&c.stage, "stage", false, "write the store to <raft-dir>.staged, for the promote subcommand to move into place later")
+	f.BoolVar(&c.unprivileged, "unprivileged", false, "run without root: write the store to --raft-dir without changing its ownership, leaving the data directory and agent alone")
+	c.dataDirFlags.setFlags(f)
+	f.StringVar(&c.raftDir, "raft-dir", "", "raft directory location (default <data-dir>/raft)")
+	f.StringVar(&c.machineID, "machine-id", "", "ID of this Juju controller machine (default: the only machine agent here, or the local replicaset member's juju-machine-id tag)")
+	f.BoolVar(&c.restored, "restored", false, "the data directory was just restored from a juju backup, possibly taken on another machine")
+	f.StringVar(&c.agentMachineID, "agent-machine-id", "", "with --restored, the machine whose agent directory the backup holds (default: detected)")
 	f.IntVar(&c.apiPort, "api-port", 17070, "the API port of the Juju controller")
-	f.StringVar(&c.hostname, "hostname", "localhost", "the hostname of the Juju MongoDB server")
-	f.StringVar(&c.mongoPort, "mongo-port", "37017", "the port of the Juju MongoDB server")
-	f.BoolVar(&c.ssl, "ssl", true, "use SSL to connect to MongoDB ")
-	f.StringVar(&c.password, "password", "", "password for connecting to MongoDB")
+	f.StringVar(&c.addressFamily, "address-family", rebootstrap.FamilyAny, "give every server an address of this family (ipv4, ipv6 or any), replacing others with the machine's address in that family")
+	f.StringVar(&c.addressScope, "address-scope", "", "take raft addresses from the machines' addresses with this scope (public or internal) instead of from the replicaset")
+	f.BoolVar(&c.selectAddresses, "select-addresses", false, "choose raft addresses from all of each machine's addresses in Juju, as jujud does, instead of from the replicaset")
+	f.BoolVar(&c.replicasetVotes, "replicaset-votes", false, "take each server's suffrage from its replicaset member's vote, instead of from Juju's record of the controller's vote")
+	f.StringVar(&c.advertise, "advertise-address", "", "comma-separated <id>=<address>[:port] pairs giving the address peers must dial for a server, when it differs from the replicaset's (as behind NAT)")
+	f.StringVar(&c.localAddress, "local-address", "", "the address[:port] peers must dial for this machine, when its replicaset address is wrong (as --advertise-address <id>=<address>)")
+	c.mongoFlags.setFlags(f)
+	f.IntVar(&c.minVoters, "min-voters", 1, "fail if the generated configuration has fewer voters than this")
+	f.IntVar(&c.expectServers, "expect-controllers", 0, "fail, listing the servers, unless the generated configuration has exactly this many")
+	f.BoolVar(&c.allowEvenVoters, "allow-even-voters", false, "allow a configuration with an even number of voters")
+	f.StringVar(&c.logStoreType, "log-store", boltLogStore, "log store backend to create (bolt or wal)")
+	f.IntVar(&c.snapshotRetain, "snapshot-retain", jujudSnapshotRetention, "number of snapshots the snapshot store retains")
+	f.BoolVar(&c.seedLeases, "seed-leases", false, "write an initial snapshot holding the lease holders recorded in MongoDB")
+	f.StringVar(&c.snapshotFrom, "snapshot-from", "", "install the newest snapshot from this directory or tarball copied from a healthy controller")
+	f.Uint64Var(&c.startIndex, "start-index", 1, "log index to write the configuration entry at")
+	f.Uint64Var(&c.startTerm, "start-term", 1, "term to write the configuration entry with")
+	f.DurationVar(&c.extendLeases, "extend-leases", 0, "give every seeded lease this long from the snapshot's time, so holders keep leadership while the agents reconnect")
+	f.BoolVar(&c.expireLeases, "expire-leases", false, "expire every seeded lease, so leadership is claimed afresh")
+	f.StringVar(&c.configFrom, "config-from-snapshot", "", "take the configuration, index and term from the newest snapshot in this raft directory instead of from MongoDB")
+	f.StringVar(&c.fromBackup, "from-backup", "", "take the configuration and agent.conf from this juju create-backup archive instead of from MongoDB")
+	f.StringVar(&c.idScheme, "server-id-scheme", "", "how to write server ids: machine-id (\"0\") or tag (\"machine-0\") (default: as a peer's store or the installed jujud has them)")
+	f.StringVar(&c.oldRaftDir, "old-raft-dir", "", "start after the index and term found in this old raft directory")
+	f.BoolVar(&c.retainOldLogs, "retain-old-logs", false, "carry the newest snapshot and the log entries after it over from --old-raft-dir")
+	f.StringVar(&c.sourceRaftDir, "source-raft-dir", "", "copy the newest snapshot, log and term from this copy of a healthy controller's raft directory instead of asking MongoDB")
+	f.StringVar(&c.ownerSpec, "owner", "root:root", "user[:group] to own the new raft directory")
+	f.BoolVar(&c.skipVersionCheck, "skip-version-check", false, "only warn if the store isn't compatible with the installed jujud")
+	f.BoolVar(&c.force, "force", false, "move an existing raft directory to a timestamped backup instead of failing")
+	f.StringVar(&c.agentService, "agent-service", "", "machine agent service name, or none if it isn't run by systemd (default jujud-machine-<id>.service, or the snap's if that's installed)")
+	f.BoolVar(&c.stopAgent, "stop-agent", false, "stop the machine agent if it's running")
+	f.BoolVar(&c.restartAgent, "restart-agent", false, "start the machine agent once the store is written")
+	f.BoolVar(&c.verifyAgent, "verify-agent", false, "after restarting the agent, check its raft workers come up and stay up")
+	f.DurationVar(&c.verifyTimeout, "verify-timeout", 5*time.Minute, "how long to wait for the restarted agent's raft workers, or with --watch-logs for a leader")
+	f.BoolVar(&c.watchLogs, "watch-logs", false, "after restarting the agent, show the raft lines from its log until raft has a leader")
+	f.BoolVar(&c.restartAgents, "restart-agents", false, "start this machine agent and, with --all-controllers, the others' once every store is written")
+	f.BoolVar(&c.yes, "yes", false, "don't ask for confirmation before writing")
+	f.StringVar(&c.color, "color", colorAuto, "colour the server table: auto (on a terminal), always or never")
+	f.StringVar(&c.preHook, "pre-hook", "", "run this script, given the plan as JSON on stdin, before stopping the agent and writing the store; the run stops if it fails")
+	f.StringVar(&c.postHook, "post-hook", "", "run this script, given the result as JSON on stdin, once the store is written and the agents dealt with")
+	f.BoolVar(&c.checkPeers, "check-peers", false, "check that the other servers' raft addresses can be reached")
+	f.BoolVar(&c.checkPeerStores, "check-peer-stores", false, "check over ssh that the other controllers' raft directories have been removed")
+	f.DurationVar(&c.peerTimeout, "peer-timeout", 5*time.Second, "how long to wait when dialling each peer")
+	f.BoolVar(&c.dropUnreachable, "drop-unreachable", false, "leave replicaset members that are down (unhealthy and not answering on their MongoDB port) out of the configuration")
+	f.StringVar(&c.confirmDropped, "confirm-dropped", "", "comma-separated machine ids --drop-unreachable may leave out without asking; --yes doesn't cover dropping machines")
+	f.DurationVar(&c.maxClockSkew, "max-clock-skew", defaultMaxClockSkew, "warn if MongoDB's or another controller's clock is further than this from ours (0 to skip the check)")
+	f.BoolVar(&c.recordOp, "record-operation", false, "once the store is written, record who wrote it and the configuration in the controller's database")
+	f.DurationVar(&c.storeTimeout, "store-timeout", defaultStoreTimeout, "give up if creating the stores, bootstrapping or writing the snapshot takes longer than this (0 to wait forever)")
+	f.DurationVar(&c.timeout, "timeout", 0, "give up on the whole run, abandoning any MongoDB or disk operation in progress, if it takes longer than this (0 to wait forever)")
+	f.BoolVar(&c.allowNetworkFS, "allow-network-fs", false, "write the store even if the raft directory is on NFS or another network filesystem")
+	f.BoolVar(&c.noSync, "no-sync", false, "don't fsync the new store (for testing only)")
+	f.BoolVar(&c.boltNoFreelistSync, "bolt-no-freelist-sync", false, "don't sync the bolt freelist to disk")
+	f.StringVar(&c.boltFreelistType, "bolt-freelist-type", string(bbolt.FreelistArrayType), "bolt freelist type (array or hashmap)")
+	f.IntVar(&c.boltInitialMmapSize, "bolt-initial-mmap-size", 0, "initial bolt mmap size in bytes")
+	f.IntVar(&c.protocolVersion, "raft-protocol-version", int(raft.ProtocolVersionMax), "raft protocol version to write the store with")
 }
 
 // Init is part of cmd.Command.
 func (c *rebootstrapCommand) Init(args []string) error {
-	if c.machineID == "" {
-		return errors.Errorf("machineID is required")
+	if err := c.setupLogging(c.dryRun); err != nil {
+		return errors.Trace(err)
+	}
+	if c.ansible {
+		if c.interactive || c.eventsEnabled {
+			return errors.Errorf("--ansible can't be used with --interactive or --events")
+		}
+		// The playbook is the confirmation.
+		c.yes = true
+	}
+	if c.confirmDropped != "" && !c.dropUnreachable {
+		return errors.Errorf("--confirm-dropped needs --drop-unreachable")
+	}
+	if c.interactive && (c.yes || c.eventsEnabled) {
+		return errors.Errorf("--interactive can't be used with --yes or --events")
+	}
+	if err := c.dataDirFlags.resolve(); err != nil {
+		return errors.Trace(err)
+	}
+	// With --interactive the machine is settled once the operator
+	// has been asked.
+	if !c.interactive {
+		if c.machineID == "" {
+			if err := c.inferMachineID(); err != nil {
+				return errors.Annotate(err, "--machine-id wasn't given and can't be inferred")
+			}
+		}
+		if err := c.resolveMachine(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if c.unprivileged {
+		if c.raftDir == "" {
+			return errors.Errorf("--unprivileged needs --raft-dir")
+		}
+		if c.stopAgent || c.restartAgent || c.restartAgents || c.verifyAgent || c.allControllers || c.stage {
+			return errors.Errorf("--unprivileged can't be used with --stop-agent, --restart-agent, --restart-agents, --verify-agent, --all-controllers or --stage")
+		}
+		if c.ownerSpec != "root:root" {
+			return errors.Errorf("--unprivileged leaves ownership alone, so can't be used with --owner")
+		}
+	}
+	if c.raftDir == "" {
+		c.raftDir = c.getJujuPath("raft")
+	}
+	if c.restartAgents {
+		c.restartAgent = true
+	}
+	if (c.verifyAgent || c.watchLogs) && !c.restartAgent {
+		return errors.Errorf("--verify-agent and --watch-logs need --restart-agent or --restart-agents")
+	}
+	if c.agentService == noAgentService && (c.stopAgent || c.restartAgent) {
+		return errors.Errorf("--stop-agent and --restart-agent need an agent service")
+	}
+	raftDir, err := filepath.Abs(c.raftDir)
+	if err != nil {
+		return errors.Annotate(err, "resolving --raft-dir")
+	}
+	c.raftDir = raftDir
+	if c.stage {
+		if c.restartAgent || c.verifyAgent || c.allControllers || c.scriptsDir != "" {
+			return errors.Errorf("--stage can't be used with --restart-agent, --verify-agent, --all-controllers or --emit-scripts")
+		}
+		// The live store isn't touched, so the agent can be left
+		// running.
+		c.raftDir += stagedSuffix
+	}
+	if c.unprivileged {
+		if strings.HasPrefix(c.raftDir+"/", c.dataDir+"/") {
+			return errors.Errorf("--unprivileged needs a --raft-dir outside the juju data directory %q", c.dataDir)
+		}
+	} else if c.owner, err = parseOwnership(c.ownerSpec); err != nil {
+		return errors.Annotate(err, "parsing --owner")
+	}
+	if c.minVoters < 1 {
+		return errors.Errorf("--min-voters must be at least 1")
+	}
+	if c.expectServers < 0 {
+		return errors.Errorf("--expect-controllers can't be negative")
+	}
+	if c.protocolVersion < int(raft.ProtocolVersionMin) || c.protocolVersion > int(raft.ProtocolVersionMax) {
+		return errors.Errorf("--raft-protocol-version must be between %d and %d",
+			raft.ProtocolVersionMin, raft.ProtocolVersionMax)
+	}
+	if c.logStoreType != boltLogStore && c.logStoreType != walLogStore {
+		return errors.Errorf("--log-store must be %q or %q", boltLogStore, walLogStore)
+	}
+	if c.sourceRaftDir != "" {
+		if c.configFrom != "" || c.fromBackup != "" || c.snapshotFrom != "" || c.oldRaftDir != "" || c.seedLeases ||
+			c.allControllers || c.scriptsDir != "" || c.dropUnreachable || c.addressScope != "" || c.selectAddresses || c.recordOp {
+			return errors.Errorf("--source-raft-dir can't be used with --config-from-snapshot, --from-backup, --snapshot-from, --old-raft-dir, " +
+				"--seed-leases, --all-controllers, --emit-scripts, --drop-unreachable, --address-scope, --select-addresses or --record-operation")
+		}
+		// The source's log is copied as it is, so nothing about
+		// it can be changed.
+		if c.startIndex != 1 || c.startTerm != 1 || c.advertise != "" || c.idScheme != "" {
+			return errors.Errorf("--source-raft-dir can't be used with --start-index, --start-term, --advertise-address or --server-id-scheme")
+		}
+		if c.protocolVersion < 3 {
+			return errors.Errorf("--source-raft-dir needs --raft-protocol-version 3 or later")
+		}
+	}
+	if c.seedLeases && c.snapshotFrom != "" {
+		return errors.Errorf("--seed-leases and --snapshot-from can't be used together")
 	}
-	if c.password == "" {
-		return errors.Errorf("password is required")
+	if c.extendLeases < 0 {
+		return errors.Errorf("--extend-leases can't be negative")
 	}
-	if c.verbose || c.dryRun {
-		logger.SetLogLevel(loggo.DEBUG)
+	if c.extendLeases > 0 && c.expireLeases {
+		return errors.Errorf("--extend-leases and --expire-leases can't be used together")
+	}
+	if (c.extendLeases > 0 || c.expireLeases) && !c.seedLeases && c.snapshotFrom == "" {
+		return errors.Errorf("--extend-leases and --expire-leases need --seed-leases or --snapshot-from")
+	}
+	if c.startIndex < 1 || c.startTerm < 1 {
+		return errors.Errorf("--start-index and --start-term must be at least 1")
+	}
+	if c.oldRaftDir != "" && (c.startIndex != 1 || c.startTerm != 1) {
+		return errors.Errorf("--old-raft-dir can't be used with --start-index or --start-term")
+	}
+	if c.retainOldLogs && (c.oldRaftDir == "" || c.seedLeases || c.snapshotFrom != "") {
+		return errors.Errorf("--retain-old-logs needs --old-raft-dir, and can't be used with --seed-leases or --snapshot-from")
+	}
+	if (c.oldRaftDir != "" || c.startIndex != 1 || c.startTerm != 1) && c.protocolVersion < 3 {
+		return errors.Errorf("a start index or term needs --raft-protocol-version 3 or later")
+	}
+	if c.configFrom != "" {
+		if c.seedLeases || c.oldRaftDir != "" || c.allControllers || c.scriptsDir != "" || c.dropUnreachable || c.addressScope != "" {
+			return errors.Errorf("--config-from-snapshot can't be used with --seed-leases, --old-raft-dir, --all-controllers, --emit-scripts, --drop-unreachable or --address-scope")
+		}
+		if c.protocolVersion < 3 {
+			return errors.Errorf("--config-from-snapshot needs --raft-protocol-version 3 or later")
+		}
+	}
+	if c.recordOp && (c.configFrom != "" || c.fromBackup != "") {
+		return errors.Errorf("--record-operation needs MongoDB, so can't be used with --config-from-snapshot or --from-backup")
+	}
+	if c.fromBackup != "" {
+		if c.configFrom != "" || c.seedLeases || c.allControllers || c.scriptsDir != "" || c.dropUnreachable || c.addressScope != "" {
+			return errors.Errorf("--from-backup can't be used with --config-from-snapshot, --seed-leases, --all-controllers, --emit-scripts, --drop-unreachable or --address-scope")
+		}
+	}
+	if c.allControllers && (c.snapshotFrom != "" || c.oldRaftDir != "") {
+		return errors.Errorf("--all-controllers can't be used with --snapshot-from or --old-raft-dir")
+	}
+	if c.scriptsDir != "" {
+		if c.allControllers || c.snapshotFrom != "" || c.oldRaftDir != "" {
+			return errors.Errorf("--emit-scripts can't be used with --all-controllers, --snapshot-from or --old-raft-dir")
+		}
+		// The scripts do the bootstrapping.
+		c.dryRun = true
+	}
+	if c.peersJSON != "" {
+		if c.allControllers || c.scriptsDir != "" || c.stage {
+			return errors.Errorf("--emit-peers-json can't be used with --all-controllers, --emit-scripts or --stage")
+		}
+		// The existing stores are recovered in place instead.
+		c.dryRun = true
+	}
+	switch c.idScheme {
+	case "", rebootstrap.IDSchemeMachineID, rebootstrap.IDSchemeTag:
+	default:
+		return errors.Errorf("--server-id-scheme must be %q or %q", rebootstrap.IDSchemeMachineID, rebootstrap.IDSchemeTag)
+	}
+	switch c.addressScope {
+	case "", rebootstrap.ScopePublic, rebootstrap.ScopeInternal:
+	default:
+		return errors.Errorf("--address-scope must be %q or %q", rebootstrap.ScopePublic, rebootstrap.ScopeInternal)
+	}
+	switch c.addressFamily {
+	case rebootstrap.FamilyIPv4, rebootstrap.FamilyIPv6, rebootstrap.FamilyAny:
+	default:
+		return errors.Errorf("--address-family must be %q, %q or %q", rebootstrap.FamilyIPv4, rebootstrap.FamilyIPv6, rebootstrap.FamilyAny)
+	}
+	if c.selectAddresses && (c.addressScope != "" || c.configFrom != "" || c.fromBackup != "") {
+		return errors.Errorf("--select-addresses can't be used with --address-scope, --config-from-snapshot or --from-backup")
+	}
+	if c.advertise != "" {
+		if c.advertiseAddrs, err = parseAddressPairs("--advertise-address", c.advertise); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if strings.ContainsAny(c.localAddress, "=,") {
+		return errors.Errorf("--local-address takes a single address, not %q", c.localAddress)
+	}
+	// With --interactive this waits until the machine is settled.
+	if !c.interactive {
+		if err := c.applyLocalAddress(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if c.snapshotRetain < 1 {
+		return errors.Errorf("--snapshot-retain must be at least 1")
+	}
+	if c.snapshotRetain != jujudSnapshotRetention {
+		logger.Warningf("--snapshot-retain %d differs from the %d snapshots jujud retains", c.snapshotRetain, jujudSnapshotRetention)
+	}
+	switch bbolt.FreelistType(c.boltFreelistType) {
+	case bbolt.FreelistArrayType, bbolt.FreelistMapType:
+	default:
+		return errors.Errorf("--bolt-freelist-type must be %q or %q", bbolt.FreelistArrayType, bbolt.FreelistMapType)
+	}
+	if c.storeTimeout < 0 {
+		return errors.Errorf("--store-timeout can't be negative")
+	}
+	if c.timeout < 0 {
+		return errors.Errorf("--timeout can't be negative")
+	}
+	if err := checkColorMode(c.color); err != nil {
+		return errors.Trace(err)
+	}
+	if c.boltInitialMmapSize < 0 {
+		return errors.Errorf("--bolt-initial-mmap-size can't be negative")
+	}
+	if c.preHook != "" {
+		if err := checkHook("--pre-hook", c.preHook); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if c.postHook != "" {
+		if err := checkHook("--post-hook", c.postHook); err != nil {
+			return errors.Trace(err)
+		}
 	}
 	return c.CommandBase.Init(args)
 }
 
+// resolveMachine finishes the parts of Init that depend on the
+// machine id.
+func (c *rebootstrapCommand) resolveMachine() error {
+	if err := c.resolveAgentMachineID(); err != nil {
+		return errors.Trace(err)
+	}
+	// The configuration from a snapshot, backup or another
+	// controller's store means MongoDB isn't needed.
+	if c.configFrom == "" && c.fromBackup == "" && c.sourceRaftDir == "" {
+		if err := c.mongoFlags.validate(c.agentConfFile(c.agentMachineID), c.hostfsPrefix); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if c.agentService == "" {
+		c.agentService = localAgentService(c.machineID)
+	}
+	return nil
+}
+
+// applyLocalAddress adds --local-address to the --advertise-address
+// overrides as this machine's, so the other controllers are given it
+// too with --all-controllers or --emit-scripts.
+func (c *rebootstrapCommand) applyLocalAddress() error {
+	if c.localAddress == "" {
+		return nil
+	}
+	id := raft.ServerID(c.machineID)
+	if _, ok := c.advertiseAddrs[id]; ok {
+		return errors.Errorf("--local-address and --advertise-address both give machine %s's address", c.machineID)
+	}
+	if c.advertiseAddrs == nil {
+		c.advertiseAddrs = make(map[raft.ServerID]string)
+	}
+	c.advertiseAddrs[id] = c.localAddress
+	pair := c.machineID + "=" + c.localAddress
+	if c.advertise != "" {
+		pair = c.advertise + "," + pair
+	}
+	c.advertise = pair
+	return nil
+}
+
 // Run is part of cmd.Command.
 func (c *rebootstrapCommand) Run(ctx *cmd.Context) error {
-	_, err := os.Stat(c.raftDir)
-	if err == nil && !c.dryRun {
-		return errors.Errorf("raft directory %q already exists - remove it first to show your commitment", c.raftDir)
+	c.setupOutput(ctx)
+	if c.eventsEnabled {
+		c.events = newEventStream(ctx.Stdout)
+	}
+	stdCtx, cancel := interruptContext()
+	defer cancel()
+	if c.timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		stdCtx, cancelTimeout = context.WithTimeout(stdCtx, c.timeout)
+		defer cancelTimeout()
+	}
+	if c.traceFile != "" {
+		c.tracer = newTracer("rebootstrap-raft")
+	}
+	start := time.Now()
+	err := c.run(ctx, stdCtx)
+	if err != nil && stdCtx.Err() == context.DeadlineExceeded {
+		// Whatever failed, it was because time ran out.
+		err = &exitCodeError{error: errors.Annotatef(err, "--timeout %v reached", c.timeout), code: exitTimedOut}
+	}
+	if err != nil {
+		c.events.emit(eventError, newErrorResult(err, c.remedyVars()))
+	}
+	if c.metricsFile != "" {
+		metrics := runMetrics{
+			machineID:   c.machineID,
+			start:       start,
+			end:         time.Now(),
+			err:         err,
+			dryRun:      c.dryRun,
+			memberCount: c.memberCount,
+		}
+		if err := writeMetrics(c.metricsFile, metrics); err != nil {
+			logger.Errorf("writing --metrics-file: %v", err)
+		}
+	}
+	if c.tracer != nil {
+		c.tracer.setAttr("machine-id", c.machineID)
+		c.tracer.setAttr("dry-run", fmt.Sprint(c.dryRun))
+		c.tracer.setAttr("member-count", fmt.Sprint(c.memberCount))
+		c.tracer.setAttr("exit-code", fmt.Sprint(exitCode(err)))
+		if err := c.tracer.write(c.traceFile, err); err != nil {
+			logger.Errorf("writing --trace-file: %v", err)
+		}
+	}
+	if c.ansible {
+		if err := writeAnsibleResult(ctx.Stdout, c.ansibleResult, err, c.remedyVars()); err != nil {
+			logger.Errorf("writing the Ansible result: %v", err)
+		}
+	} else if err != nil && !c.resultWritten && c.events == nil && c.out.Name() != "text" {
+		// Failing before there was anything else to say, the
+		// structured output is just the error.
+		result := &bootstrapResult{
+			SchemaVersion: outputSchemaVersion,
+			RaftDir:       c.raftDir,
+			DryRun:        c.dryRun,
+			Error:         newErrorResult(err, c.remedyVars()),
+		}
+		if err := c.out.Write(ctx, result); err != nil {
+			logger.Errorf("writing the result: %v", err)
+		}
+	}
+	return reportExitCodeWith(ctx, err, c.remedyVars())
+}
+
+// remedyVars fills in the commands suggested for failures.
+func (c *rebootstrapCommand) remedyVars() map[string]string {
+	vars := map[string]string{
+		"<id>":       c.machineID,
+		"<raft-dir>": c.raftDir,
+	}
+	if c.agentService != noAgentService {
+		vars["<service>"] = c.agentService
+	}
+	return vars
+}
+
+func (c *rebootstrapCommand) run(ctx *cmd.Context, stdCtx context.Context) error {
+	if c.interactive {
+		if err := c.wizardSetup(ctx); err != nil {
+			return errors.Trace(err)
+		}
+		if err := c.applyLocalAddress(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	c.progress = newProgress(ctx.Stderr, c.quiet)
+	c.progress.trace = c.tracer
+	c.events.emit(eventStarted, map[string]interface{}{
+		"machine-id": c.machineID,
+		"raft-dir":   c.raftDir,
+		"dry-run":    c.dryRun,
+	})
+	if !c.dryRun {
+		lockDir := c.dataDir
+		if c.unprivileged {
+			// The data directory is usually only writable by
+			// root, and the live store isn't touched anyway.
+			lockDir = filepath.Dir(c.raftDir)
+		}
+		lock, err := acquireLock(lockDir)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer lock.Release()
 	}
 
-	members, err := c.getReplicaSetMembers()
+	existing, err := inspectExistingState(c.raftDir)
 	if err != nil {
-		return errors.Annotate(err, "getting replica set members")
+		return errors.Annotate(err, "inspecting existing raft directory")
+	}
+	if existing != nil {
+		if !existing.empty() {
+			logger.Warningf("raft directory %q holds %s", c.raftDir, existing)
+		}
+		if !c.dryRun && !c.force && c.restored {
+			return withExitCode(errors.Errorf("raft directory %q came back with the restored backup - use --force to back it up and replace it", c.raftDir), exitRaftDirExists)
+		}
+		if !c.dryRun && !c.force {
+			return withExitCode(errors.Errorf("raft directory %q already exists - remove it first to show your commitment (or use --force to back it up)", c.raftDir), exitRaftDirExists)
+		}
+	}
+
+	if c.fromBackup != "" {
+		done := c.progress.start("Reading the backup")
+		c.backup, err = rebootstrap.ReadBackup(c.fromBackup)
+		done(err)
+		if err != nil {
+			return errors.Annotate(err, "reading --from-backup")
+		}
 	}
-	logger.Infof("Got replica set members.")
 
-	raftServers, err := makeRaftServers(members, c.apiPort)
+	done := c.progress.start("Checking the machine agent")
+	agentConf, err := c.discoverAgent()
+	if err == nil {
+		err = c.resolveIDScheme()
+	}
+	done(err)
 	if err != nil {
-		return errors.Annotate(err, "constructing raft server configuration")
+		return errors.Trace(err)
 	}
-	logger.Infof("Raft server info:")
-	for _, server := range raftServers.Servers {
-		logger.Infof("%#v", server)
+
+	var session *mgo.Session
+	var raftServers raft.Configuration
+	if c.configFrom != "" {
+		done = c.progress.start("Reading configuration from snapshot")
+		raftServers, err = c.snapshotServers()
+		done(err)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	} else if c.sourceRaftDir != "" {
+		done = c.progress.start("Reading configuration from " + c.sourceRaftDir)
+		raftServers, err = c.sourceServers()
+		done(err)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	} else if c.backup != nil {
+		done = c.progress.start("Reading controllers from the backup")
+		raftServers, err = c.backupServers(stdCtx)
+		done(err)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	} else {
+		done = c.progress.start("Connecting to MongoDB")
+		session, err = c.connect(stdCtx, c.machineID, agentConf)
+		if err == nil && agentConf != nil {
+			err = withExitCode(checkControllerUUID(stdCtx, session, agentConf), exitValidation)
+		}
+		done(err)
+		if session != nil {
+			defer session.Close()
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		done = c.progress.start("Reading controller members")
+		raftServers, err = c.planServers(stdCtx, session, agentConf)
+		done(err)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if c.maxClockSkew > 0 {
+			if skew, uncertainty, err := mongoClockSkew(stdCtx, session); err != nil {
+				logger.Warningf("can't check clock skew: %v", err)
+			} else if warning := skewWarning("MongoDB's", skew, uncertainty, c.maxClockSkew); warning != "" {
+				logger.Warningf("%s", warning)
+			}
+		}
+	}
+	if c.interactive {
+		if raftServers, err = c.wizardServers(ctx, raftServers); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if err := checkServerCount(raftServers, c.expectServers); err != nil {
+		return withExitCode(err, exitValidation)
+	}
+	if err := checkAddressFamily(raftServers, c.addressFamily); err != nil {
+		return withExitCode(err, exitValidation)
+	}
+	for _, warning := range checkServerNames(stdCtx, raftServers, c.origins, c.peerTimeout) {
+		logger.Warningf("%s", warning)
 	}
+	c.memberCount = len(raftServers.Servers)
+	c.events.emit(eventConfigGenerated, c.serverResults(raftServers))
 
+	done = c.progress.start("Preparing initial state")
+	snapshot, err := c.getInitialSnapshot(stdCtx, session)
+	if err == nil && c.oldRaftDir != "" {
+		var index, term uint64
+		index, term, err = readOldStoreState(c.oldRaftDir)
+		err = errors.Annotate(err, "reading old raft state")
+		c.startIndex, c.startTerm = index+1, term+1
+	}
+	if err == nil && c.retainOldLogs {
+		snapshot, err = c.retainOldStore()
+	}
+	done(err)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if c.startIndex != 1 || c.startTerm != 1 {
+		logger.Infof("Writing configuration at index %d, term %d.", c.startIndex, c.startTerm)
+	}
+
+	if c.checkPeers {
+		reportPeers(checkPeers(raftServers, raft.ServerID(c.machineID), c.peerTimeout))
+	}
+	// With --all-controllers the other stores are replaced anyway.
+	if c.checkPeerStores && !c.allControllers {
+		done := c.progress.start("Checking other controllers' raft directories")
+		others, err := c.remoteControllers(raftServers)
+		done(err)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for _, warning := range checkPeerStores(others, c.raftDir) {
+			logger.Warningf("%s", warning)
+		}
+		c.warnRemoteClocks(others)
+	}
+
+	if err := checkFilesystem(c.raftDir, c.allowNetworkFS); err != nil {
+		return withExitCode(err, exitValidation)
+	}
+	snapshotSize := len(snapshot)
+	if c.sourceCopy != nil {
+		snapshotSize = len(c.sourceCopy.Snapshot)
+	}
+	if err := checkDiskSpace(c.raftDir, snapshotSize); err != nil {
+		return errors.Trace(err)
+	}
+
+	result := &bootstrapResult{
+		SchemaVersion: outputSchemaVersion,
+		RaftDir:       c.raftDir,
+		DryRun:        c.dryRun,
+		Servers:       c.serverResults(raftServers),
+		StartIndex:    c.startIndex,
+		StartTerm:     c.startTerm,
+		SnapshotBytes: len(snapshot),
+		Dropped:       c.dropped,
+		localID:       c.machineID,
+		color:         useColor(c.color, os.Stdout),
+	}
+	if c.sourceCopy != nil {
+		// A copied store has no configuration entry of its own;
+		// it carries on from where the source is.
+		result.StartIndex, result.StartTerm = c.sourceCopy.LastIndex(), c.sourceCopy.CurrentTerm
+		result.SnapshotBytes = len(c.sourceCopy.Snapshot)
+	}
+	// writeResult writes the result so far, with runErr if the run
+	// failed, and returns runErr (or the failure to write).
+	writeResult := func(runErr error) error {
+		c.resultWritten = true
+		result.Phases = c.progress.timings()
+		result.Error = newErrorResult(runErr, c.remedyVars())
+		writeDropFollowUp(ctx.Stderr, c.dropped)
+		if c.ansible {
+			c.ansibleResult = result
+			return runErr
+		}
+		if c.events != nil {
+			c.events.emit(eventDone, result)
+			return runErr
+		}
+		return writeRunResult(ctx, &c.out, result, runErr)
+	}
+	var others []remoteController
+	if c.allControllers {
+		done := c.progress.start("Checking other controllers")
+		others, err = c.remoteControllers(raftServers)
+		if err == nil {
+			err = c.checkRemoteAgents(others)
+		}
+		done(err)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		c.warnRemoteClocks(others)
+	}
+	if c.scriptsDir != "" {
+		done := c.progress.start("Writing scripts")
+		result.Scripts, err = c.writeScripts(raftServers)
+		done(err)
+		if err != nil {
+			return errors.Annotate(err, "writing scripts")
+		}
+	}
+	if c.peersJSON != "" {
+		// The ids have to be the ones the stores would record.
+		peers := rebootstrap.ApplyIDScheme(raftServers, c.idScheme)
+		if err := writePeersJSON(c.peersJSON, peers, c.protocolVersion); err != nil {
+			return withExitCode(errors.Annotate(err, "writing --emit-peers-json"), exitWriteFailed)
+		}
+		result.PeersJSON = c.peersJSON
+	}
+	if !c.quiet {
+		c.showPriorConfig(ctx.Stderr, result.Servers)
+	}
 	if c.dryRun {
 		logger.Infof("dry-run specified - stopping")
+		return writeResult(nil)
+	}
+	if !c.yes {
+		if err := confirmPlan(ctx, c.raftDir, result.Servers, c.machineID, useColor(c.color, os.Stderr)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if err := c.checkDropped(ctx); err != nil {
+		return errors.Trace(err)
+	}
+	if c.preHook != "" {
+		if err := runHook(ctx.Stderr, c.preHook, c.hookPlan(preHook, result)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	var undo rollback
+	var stopped bool
+	if !c.stage && !c.unprivileged {
+		stopped, err = ensureAgentStopped(c.agentService, c.stopAgent)
+	}
+	if stopped {
+		undo.add("restarting "+c.agentService, func() error {
+			return startService(c.agentService)
+		})
+	}
+	if err == nil {
+		result.Backup, err = c.bootstrapRaft(stdCtx, raftServers, snapshot, &undo)
+		err = withExitCode(err, exitWriteFailed)
+	}
+	if err != nil {
+		undo.run()
+		return errors.Trace(err)
+	}
+	result.Written = true
+	c.events.emit(eventStoreWritten, map[string]string{
+		"raft-dir": c.raftDir,
+		"backup":   result.Backup,
+	})
+	if c.recordOp {
+		// The store is in place whether or not this works.
+		if err := c.recordOperation(stdCtx, session, raftServers); err != nil {
+			logger.Warningf("%v", err)
+		} else {
+			logger.Infof("Recorded the operation in %s.", rebootstrap.OperationsC)
+		}
+	}
+	if c.allControllers {
+		result.Controllers, err = c.bootstrapRemotes(others, raftServers)
+		if err != nil {
+			return writeResult(withExitCode(err, exitWriteFailed))
+		}
+	}
+	var logs *logWatch
+	if c.restartAgent {
+		if c.watchLogs {
+			logs = newLogWatch(c.machineID, c.agentService)
+		}
+		logger.Infof("Starting %s.", c.agentService)
+		if err := startService(c.agentService); err != nil {
+			return writeResult(errors.Annotate(err, "starting machine agent"))
+		}
+		result.AgentRestarted = true
+	}
+	// The other agents are started before this one is checked,
+	// since it can't elect a leader without them.
+	if c.allControllers && c.restartAgents {
+		done := c.progress.start("Starting other controllers' agents")
+		err := startRemoteAgents(others, result.Controllers)
+		done(err)
+		if err != nil {
+			return writeResult(errors.Trace(err))
+		}
+	}
+	if logs != nil {
+		c.watchAgentLog(stdCtx, ctx.Stderr, logs)
+	}
+	if c.verifyAgent {
+		done := c.progress.start("Verifying the machine agent")
+		err := verifyAgent(c.machineID, c.verifyTimeout)
+		done(err)
+		if err != nil {
+			return writeResult(withExitCode(errors.Annotate(err, "verifying machine agent"), exitAgentUnhealthy))
+		}
+		result.AgentHealthy = true
+	}
+	if c.postHook != "" {
+		if err := runHook(ctx.Stderr, c.postHook, c.hookPlan(postHook, result)); err != nil {
+			return writeResult(errors.Trace(err))
+		}
+	}
+	return writeResult(nil)
+}
+
+// watchAgentLog shows the restarted agent's raft log lines until
+// raft has a leader. Not seeing one is only a warning: --verify-agent
+// is the check that fails the run.
+func (c *rebootstrapCommand) watchAgentLog(ctx context.Context, out io.Writer, logs *logWatch) {
+	healthy, err := logs.watch(ctx, out, useColor(c.color, os.Stderr), c.verifyTimeout)
+	switch {
+	case err != nil:
+		logger.Warningf("watching the agent's log: %v", err)
+	case healthy:
+		logger.Infof("Raft has a leader.")
+	default:
+		logger.Warningf("no raft leader in %s after %s", logs.source(), c.verifyTimeout)
+	}
+}
+
+// hookPlan returns what a hook is told about the run so far.
+func (c *rebootstrapCommand) hookPlan(hook string, result *bootstrapResult) hookPlan {
+	result.Phases = c.progress.timings()
+	return hookPlan{
+		Hook:         hook,
+		MachineID:    c.machineID,
+		AgentService: c.agentService,
+		Result:       result,
+	}
+}
+
+// checkServerCount fails if expected is set and the configuration
+// doesn't have that many servers, listing the ones it does have so a
+// stale replicaset member is easy to spot.
+func checkServerCount(servers raft.Configuration, expected int) error {
+	if expected == 0 || len(servers.Servers) == expected {
 		return nil
 	}
-	return errors.Trace(c.bootstrapRaft(raftServers))
+	var listing bytes.Buffer
+	writeServers(&listing, "  ", servers)
+	return errors.Errorf("--expect-controllers %d, but the configuration has %d servers:\n%s",
+		expected, len(servers.Servers), strings.TrimRight(listing.String(), "\n"))
+}
+
+// checkAddressFamily makes sure every server's host is in family,
+// for configurations that --address-family couldn't convert: those
+// copied from a snapshot, backup or store, and addresses given with
+// --advertise-address or the wizard.
+func checkAddressFamily(servers raft.Configuration, family string) error {
+	var wrong []string
+	for _, server := range servers.Servers {
+		host, _, err := net.SplitHostPort(string(server.Address))
+		if err != nil {
+			return errors.Annotatef(err, "server %s has address %q", server.ID, server.Address)
+		}
+		if !rebootstrap.InFamily(host, family) {
+			wrong = append(wrong, fmt.Sprintf("%s (%s)", server.ID, server.Address))
+		}
+	}
+	if len(wrong) > 0 {
+		return errors.Errorf("--address-family %s, but these servers' addresses aren't: %s", family, strings.Join(wrong, ", "))
+	}
+	return nil
 }
 
-func (c *rebootstrapCommand) getReplicaSetMembers() ([]replicaset.Member, error) {
-	session, err := c.dial()
+// discoverAgent checks the installed machine agent and reads its
+// configuration. A missing or unreadable agent.conf isn't fatal, but
+// the checks that depend on it are skipped, so the result may be nil.
+func (c *rebootstrapCommand) discoverAgent() (*agentConfig, error) {
+	if err := c.checkJujuVersion(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	var agentConf *agentConfig
+	var err error
+	if c.backup != nil && c.agentConf == "" {
+		agentConf, err = c.backupAgentConfig()
+	} else {
+		agentConf, err = readAgentConfig(c.agentConfFile(c.agentMachineID))
+	}
 	if err != nil {
-		return nil, errors.Annotate(err, "connecting to MongoDB")
+		logger.Warningf("can't check MongoDB, controller or addresses against agent.conf: %v", err)
+		return nil, nil
 	}
-	defer session.Close()
-	return replicaset.CurrentMembers(session)
+	return agentConf, nil
 }
 
-func (c *rebootstrapCommand) bootstrapRaft(servers raft.Configuration) error {
-	_, transport := raft.NewInmemTransport(raft.ServerAddress("notused"))
-	defer transport.Close()
+// resolveAgentMachineID works out whose agent directory to read. It's
+// this machine's unless the data directory was restored from a backup
+// taken on another machine.
+func (c *rebootstrapCommand) resolveAgentMachineID() error {
+	if !c.restored {
+		if c.agentMachineID != "" {
+			return errors.Errorf("--agent-machine-id needs --restored")
+		}
+		c.agentMachineID = c.machineID
+		return nil
+	}
+	if c.agentMachineID == "" && c.agentConf != "" {
+		c.agentMachineID = c.machineID
+	} else if c.agentMachineID == "" {
+		id, err := restoredAgentMachineID(c.dataDir, c.machineID)
+		if err != nil {
+			return errors.Annotate(err, "finding the restored agent")
+		}
+		c.agentMachineID = id
+	}
+	if c.agentMachineID != c.machineID {
+		logger.Warningf("restored data directory is from machine %s; using its agent.conf, and logging in to MongoDB as it, for machine %s", c.agentMachineID, c.machineID)
+	}
+	return nil
+}
 
-	logStore, err := NewLogStore(c.raftDir)
+// planServers works out the raft configuration from the replicaset
+// members and checks that it's sensible.
+func (c *rebootstrapCommand) planServers(ctx context.Context, session *mgo.Session, agentConf *agentConfig) (raft.Configuration, error) {
+	span := c.tracer.start("Fetching replicaset members")
+	members, err := rebootstrap.Members(ctx, session)
+	span.finish(err)
 	if err != nil {
-		return errors.Annotate(err, "making log store")
+		return raft.Configuration{}, errors.Trace(err)
+	}
+	span.setAttr("members", fmt.Sprint(len(members)))
+	logger.Infof("Got replica set members.")
+	c.events.emit(eventMembersFetched, makeMemberResults(members))
+	members = rebootstrap.DataMembers(members)
+
+	if err := rebootstrap.CheckControllerMembers(ctx, session, members); err != nil {
+		return raft.Configuration{}, withExitCode(err, exitValidation)
 	}
 
-	snapshotStore, err := NewSnapshotStore(c.raftDir, 2)
+	if c.dropUnreachable {
+		unreachable, err := unreachableMembers(ctx, session, members, c.machineID, c.peerTimeout)
+		if err != nil {
+			return raft.Configuration{}, errors.Trace(err)
+		}
+		for _, member := range unreachable {
+			c.dropped = append(c.dropped, member.Tags[rebootstrap.MachineIDTag])
+		}
+		members = withoutMembers(members, unreachable)
+	}
+
+	var addresses map[string]string
+	source := originHASpace
+	span = c.tracer.start("Selecting addresses")
+	if c.addressScope != "" {
+		addresses, err = rebootstrap.ScopeAddresses(ctx, session, members, c.addressScope)
+		source = c.addressScope + "-scope"
+	} else if c.selectAddresses {
+		addresses, err = rebootstrap.SelectedAddresses(ctx, session, members)
+		source = originSelected
+	} else {
+		addresses, err = rebootstrap.HASpaceAddresses(ctx, session, members)
+	}
+	span.finish(err)
 	if err != nil {
-		return errors.Annotate(err, "making snapshot store")
+		return raft.Configuration{}, errors.Annotate(err, "selecting addresses")
+	}
+	var votes map[string]rebootstrap.ControllerVote
+	if !c.replicasetVotes {
+		span = c.tracer.start("Reading controller votes")
+		votes, err = rebootstrap.ControllerVotes(ctx, session, members)
+		span.finish(err)
+		if err != nil {
+			return raft.Configuration{}, errors.Trace(err)
+		}
+	}
+	converted := make(map[string]bool)
+	if c.addressFamily != rebootstrap.FamilyAny {
+		span = c.tracer.start("Converting address family")
+		familyAddresses, err := rebootstrap.FamilyAddresses(ctx, session, members, addresses, c.addressFamily)
+		span.finish(err)
+		if err != nil {
+			return raft.Configuration{}, errors.Annotate(err, "selecting --address-family addresses")
+		}
+		for id, address := range familyAddresses {
+			if addresses[id] != address {
+				converted[id] = true
+			}
+		}
+		addresses = familyAddresses
+	}
+	c.origins = make(map[raft.ServerID]serverOrigin)
+	for _, member := range members {
+		id := member.Tags[rebootstrap.MachineIDTag]
+		origin := serverOrigin{
+			source: originReplicaset,
+			member: fmt.Sprintf("#%d %s", member.Id, member.Address),
+		}
+		if host, _, err := net.SplitHostPort(member.Address); err == nil {
+			origin.memberHost = host
+		}
+		if converted[id] {
+			origin.source = originFamily
+		} else if _, ok := addresses[id]; ok {
+			origin.source = source
+		}
+		c.origins[raft.ServerID(id)] = origin
+		c.explainMember(member, addresses, origin.source, votes)
 	}
 
-	config, err := makeRaftConfig(c.machineID)
+	span = c.tracer.start("Building raft configuration")
+	raftServers, err := rebootstrap.MakeServers(members, addresses, c.apiPort)
+	span.finish(err)
+	if errors.IsNotFound(err) {
+		err = withExitCode(err, exitMissingTags)
+	}
 	if err != nil {
-		return errors.Annotate(err, "making raft config")
+		return raft.Configuration{}, errors.Annotate(err, "constructing raft server configuration")
+	}
+	rebootstrap.ApplyControllerVotes(&raftServers, votes)
+	if err := setServerAddresses(&raftServers, c.advertiseAddrs); err != nil {
+		return raft.Configuration{}, errors.Annotate(err, "applying --advertise-address")
+	}
+	c.markAdvertised(raftServers)
+	logger.Infof("Raft server info:")
+	logServers(raftServers)
+	if c.restored {
+		// The API addresses in a restored agent.conf are the old
+		// controllers', so there's nothing to check them against.
+		if err := checkRestoredConfig(raftServers, c.machineID, c.agentMachineID); err != nil {
+			return raft.Configuration{}, withExitCode(err, exitValidation)
+		}
+	} else if agentConf != nil {
+		crossCheckAPIAddresses(raftServers, agentConf.APIAddresses)
 	}
+	if err := rebootstrap.ValidateUnique(raftServers); err != nil {
+		return raft.Configuration{}, withExitCode(err, exitValidation)
+	}
+	if err := rebootstrap.ValidateVoters(raftServers, c.minVoters, c.allowEvenVoters); err != nil {
+		return raft.Configuration{}, withExitCode(err, exitValidation)
+	}
+	if err := rebootstrap.ValidateLocal(raftServers, c.machineID); err != nil {
+		return raft.Configuration{}, withExitCode(err, exitValidation)
+	}
+	return raftServers, nil
+}
 
-	err = raft.BootstrapCluster(config, logStore, logStore, snapshotStore, transport, servers)
+// explainMember records how the server for a replicaset member is
+// made, for --explain: its id from the member's tag, its address from
+// the member or from addresses (chosen as source says), and why it
+// is a voter or not, from Juju's votes or else the member.
+func (c *rebootstrapCommand) explainMember(member replicaset.Member, addresses map[string]string, source string, votes map[string]rebootstrap.ControllerVote) {
+	id := member.Tags[rebootstrap.MachineIDTag]
+	serverID := raft.ServerID(id)
+	c.explainServer(serverID, "id from the %s tag of replicaset member #%d (%s)", rebootstrap.MachineIDTag, member.Id, member.Address)
+	if address, ok := addresses[id]; ok {
+		switch source {
+		case originHASpace:
+			c.explainServer(serverID, "host %s is machine %s's address in the controller's juju-ha-space", address, id)
+		case originSelected:
+			c.explainServer(serverID, "host %s chosen from machine %s's addresses as jujud would (--select-addresses)", address, id)
+		case originFamily:
+			c.explainServer(serverID, "host %s is machine %s's %s address, replacing one of another family (--address-family)", address, id, c.addressFamily)
+		default:
+			c.explainServer(serverID, "host %s is machine %s's %s address (--address-scope)", address, id, c.addressScope)
+		}
+	} else {
+		c.explainServer(serverID, "host from the replicaset member's address %s", member.Address)
+	}
+	c.explainServer(serverID, "port %d is the API port", c.apiPort)
+	if vote, ok := votes[id]; ok {
+		suffrage := raft.Nonvoter
+		if vote.Voter() {
+			suffrage = raft.Voter
+		}
+		c.explainServer(serverID, "%s because Juju reports has-vote=%t, wants-vote=%t for machine %s", suffrage, vote.HasVote, vote.WantsVote, id)
+	} else if reason := rebootstrap.NonvoterReason(member); reason != "" {
+		c.explainServer(serverID, "nonvoter because the replicaset member %s", reason)
+	} else {
+		c.explainServer(serverID, "voter because the replicaset member votes and can become primary")
+	}
+}
 
+// snapshotServers takes the configuration from the metadata of the
+// newest snapshot in --config-from-snapshot, for when the log store
+// there is unreadable but its snapshots are intact. Unless a start
+// index or term was given, the new store starts after the snapshot.
+func (c *rebootstrapCommand) snapshotServers() (raft.Configuration, error) {
+	_, meta, err := findNewestSnapshot(c.configFrom)
 	if err != nil {
-		return errors.Annotate(err, "bootstrapping raft cluster")
+		return raft.Configuration{}, errors.Trace(err)
 	}
-	logger.Infof("Raft cluster store bootstrapped in %q.", c.raftDir)
-	return nil
+	if len(meta.Configuration.Servers) == 0 {
+		return raft.Configuration{}, errors.Errorf("snapshot %s records no configuration (written with raft protocol version 2?)", meta.ID)
+	}
+	// Server ids are handled as bare machine ids until the store is
+	// written in the chosen scheme.
+	servers := rebootstrap.ApplyIDScheme(meta.Configuration, rebootstrap.IDSchemeMachineID)
+	if err := setServerAddresses(&servers, c.advertiseAddrs); err != nil {
+		return raft.Configuration{}, errors.Annotate(err, "applying --advertise-address")
+	}
+	c.setOrigins(servers, originSnapshot)
+	logger.Infof("Using configuration from snapshot %s (index %d, term %d):", meta.ID, meta.Index, meta.Term)
+	logServers(servers)
+	if c.startIndex == 1 && c.startTerm == 1 {
+		c.startIndex, c.startTerm = meta.Index+1, meta.Term+1
+	}
+	if err := c.validateStoredServers(servers); err != nil {
+		return raft.Configuration{}, withExitCode(err, exitValidation)
+	}
+	return servers, nil
 }
 
-func makeRaftConfig(machineID string) (*raft.Config, error) {
-	raftConfig := raft.DefaultConfig()
-	raftConfig.LocalID = raft.ServerID(machineID)
-	// Having ShutdownOnRemove true means that the raft node also
-	// stops when it's demoted if it's the leader.
-	raftConfig.ShutdownOnRemove = false
+// sourceServers reads --source-raft-dir, a copy of a healthy
+// controller's raft directory, for this machine's store to be a copy
+// of. The configuration is the source's; it's only read here to check
+// that this machine belongs in it.
+func (c *rebootstrapCommand) sourceServers() (raft.Configuration, error) {
+	config, err := readStoreConfiguration(c.sourceRaftDir)
+	if err != nil {
+		return raft.Configuration{}, errors.Annotate(err, "reading --source-raft-dir")
+	}
+	servers := rebootstrap.ApplyIDScheme(config, rebootstrap.IDSchemeMachineID)
+	c.setOrigins(servers, originSourceStore)
+	if c.sourceCopy, err = readSourceStore(c.sourceRaftDir); err != nil {
+		return raft.Configuration{}, errors.Annotate(err, "reading --source-raft-dir")
+	}
+	logger.Infof("Copying %q (last index %d, term %d) with configuration:", c.sourceRaftDir, c.sourceCopy.LastIndex(), c.sourceCopy.CurrentTerm)
+	logServers(servers)
+	if err := c.validateStoredServers(servers); err != nil {
+		return raft.Configuration{}, withExitCode(err, exitValidation)
+	}
+	return servers, nil
+}
 
-	logWriter := &loggoWriter{logger, loggo.DEBUG}
-	raftConfig.Logger = log.New(logWriter, "", 0)
+// validateStoredServers checks a configuration taken from a store
+// rather than generated from MongoDB, which has had none of the
+// replicaset's checks.
+func (c *rebootstrapCommand) validateStoredServers(servers raft.Configuration) error {
+	if err := rebootstrap.ValidateUnique(servers); err != nil {
+		return errors.Trace(err)
+	}
+	if err := rebootstrap.ValidateVoters(servers, c.minVoters, c.allowEvenVoters); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(rebootstrap.ValidateLocal(servers, c.machineID))
+}
 
-	if err := raft.ValidateConfig(raftConfig); err != nil {
-		return nil, errors.Annotate(err, "validating raft config")
+// backupServers takes the configuration from the controller records
+// in --from-backup, for when MongoDB is gone and has to be restored
+// after the raft store is rebuilt.
+func (c *rebootstrapCommand) backupServers(ctx context.Context) (raft.Configuration, error) {
+	source := rebootstrap.BackupSource{Backup: c.backup, APIPort: c.apiPort}
+	servers, err := source.Servers(ctx)
+	if err != nil {
+		return raft.Configuration{}, errors.Trace(err)
+	}
+	if err := setServerAddresses(&servers, c.advertiseAddrs); err != nil {
+		return raft.Configuration{}, errors.Annotate(err, "applying --advertise-address")
+	}
+	c.setOrigins(servers, originBackup)
+	logger.Infof("Using configuration from %s:", c.fromBackup)
+	logServers(servers)
+	if err := rebootstrap.ValidateUnique(servers); err != nil {
+		return raft.Configuration{}, withExitCode(err, exitValidation)
+	}
+	if err := rebootstrap.ValidateVoters(servers, c.minVoters, c.allowEvenVoters); err != nil {
+		return raft.Configuration{}, withExitCode(err, exitValidation)
+	}
+	if err := rebootstrap.ValidateLocal(servers, c.machineID); err != nil {
+		return raft.Configuration{}, withExitCode(err, exitValidation)
 	}
-	return raftConfig, nil
+	return servers, nil
 }
 
-func makeRaftServers(members []replicaset.Member, apiPort int) (raft.Configuration, error) {
-	var empty raft.Configuration
-	var servers []raft.Server
-	for _, member := range members {
-		id, ok := member.Tags[jujuMachineKey]
-		if !ok {
-			return empty, errors.NotFoundf("juju machine id for replset member %d", member.Id)
+// backupAgentConfig reads the agent.conf for this machine from
+// --from-backup, or the only one there if the backup was taken on
+// another machine.
+func (c *rebootstrapCommand) backupAgentConfig() (*agentConfig, error) {
+	data, ok := c.backup.AgentConfs[c.agentMachineID]
+	if !ok {
+		if len(c.backup.AgentConfs) != 1 {
+			return nil, errors.NotFoundf("agent.conf for machine %s in %q", c.agentMachineID, c.fromBackup)
+		}
+		for id, conf := range c.backup.AgentConfs {
+			logger.Warningf("backup is from machine %s; using its agent.conf for machine %s", id, c.machineID)
+			data = conf
 		}
-		baseAddress, _, err := net.SplitHostPort(member.Address)
+	}
+	return parseAgentConfig(data, c.fromBackup)
+}
+
+// checkJujuVersion makes sure the installed jujud can use the store
+// we're about to write.
+func (c *rebootstrapCommand) checkJujuVersion() error {
+	version, err := detectJujuVersion(c.dataDir, c.agentMachineID, c.agentConfFile(c.agentMachineID))
+	if err != nil {
+		logger.Warningf("can't determine installed juju version: %v", err)
+		return nil
+	}
+	logger.Infof("Installed juju version is %s.", version)
+	err = c.checkVersionCompatibility(version)
+	if err != nil && c.skipVersionCheck {
+		logger.Warningf("%v", err)
+		return nil
+	}
+	return errors.Annotate(err, "checking juju version (use --skip-version-check to override)")
+}
+
+// getInitialSnapshot returns the FSM data to write as the store's
+// first snapshot, or nil if the store should start empty.
+func (c *rebootstrapCommand) getInitialSnapshot(ctx context.Context, session *mgo.Session) ([]byte, error) {
+	switch {
+	case c.seedLeases:
+		leases, err := rebootstrap.ReadLeaseSnapshot(ctx, session)
+		if err != nil {
+			return nil, errors.Annotate(err, "getting leases")
+		}
+		logger.Infof("Got %d lease holders.", len(leases.Entries))
+		c.rewriteLeases(leases)
+		data, err := yaml.Marshal(leases)
+		return data, errors.Annotate(err, "marshalling lease snapshot")
+	case c.snapshotFrom != "":
+		snapshot, err := readSourceSnapshot(c.snapshotFrom)
 		if err != nil {
-			return empty, errors.Annotatef(err, "getting base address for replset member %d", member.Id)
+			return nil, errors.Annotate(err, "reading snapshot")
 		}
-		apiAddress := net.JoinHostPort(baseAddress, strconv.Itoa(apiPort))
-		suffrage := raft.Voter
-		if member.Votes != nil && *member.Votes < 1 {
-			suffrage = raft.Nonvoter
+		leases, err := rebootstrap.DecodeLeaseSnapshot(snapshot.Data)
+		if err != nil {
+			if c.extendLeases > 0 || c.expireLeases {
+				return nil, errors.Annotate(err, "reading leases to rewrite")
+			}
+			logger.Warningf("can't read leases from snapshot: %v", err)
+			return snapshot.Data, nil
 		}
-		server := raft.Server{
-			ID:       raft.ServerID(id),
-			Address:  raft.ServerAddress(apiAddress),
-			Suffrage: suffrage,
+		logger.Infof("Snapshot holds %d leases.", len(leases.Entries))
+		if !c.rewriteLeases(leases) {
+			return snapshot.Data, nil
 		}
-		servers = append(servers, server)
+		data, err := yaml.Marshal(leases)
+		return data, errors.Annotate(err, "marshalling lease snapshot")
 	}
-	return raft.Configuration{Servers: servers}, nil
+	return nil, nil
 }
 
-// NewLogStore opens a boltDB logstore in the specified directory. If
-// the directory doesn't already exist it'll be created.
-func NewLogStore(dir string) (*raftboltdb.BoltStore, error) {
-	if err := os.MkdirAll(dir, 0700); err != nil {
-		return nil, errors.Trace(err)
-	}
-	logs, err := raftboltdb.New(raftboltdb.Options{
-		Path: filepath.Join(dir, "logs"),
-	})
+// retainOldStore reads the snapshot and log tail to carry over from
+// the old raft directory, returning the snapshot data.
+func (c *rebootstrapCommand) retainOldStore() ([]byte, error) {
+	old, entries, err := readOldStoreTail(c.oldRaftDir)
 	if err != nil {
-		return nil, errors.Annotate(err, "failed to create bolt store for raft logs")
+		return nil, errors.Annotate(err, "reading old store to retain")
+	}
+	c.retained = entries
+	if len(entries) > 0 {
+		// The old store's last index may be a snapshot's rather
+		// than a log entry's.
+		c.startIndex = entries[len(entries)-1].Index + 1
+	}
+	logger.Infof("Retaining %d log entries from %q.", len(entries), c.oldRaftDir)
+	if old == nil {
+		return nil, nil
 	}
-	return logs, nil
+	c.snapshotIndex, c.snapshotTerm = old.Meta.Index, old.Meta.Term
+	if len(entries) == 0 {
+		c.snapshotIndex, c.snapshotTerm = 0, 0
+	}
+	return old.Data, nil
 }
 
-// NewSnapshotStore opens a file-based snapshot store in the specified
-// directory. If the directory doesn't exist it'll be created.
-func NewSnapshotStore(
-	dir string,
-	retain int,
-) (raft.SnapshotStore, error) {
-	const logPrefix = "[snapshot] "
-	if err := os.MkdirAll(dir, 0700); err != nil {
-		return nil, errors.Trace(err)
+// rewriteLeases applies --extend-leases or --expire-leases to the
+// leases, reporting whether either was given.
+func (c *rebootstrapCommand) rewriteLeases(leases *rebootstrap.LeaseSnapshot) bool {
+	switch {
+	case c.expireLeases:
+		logger.Infof("Expiring all leases.")
+		leases.ResetExpiries(0)
+	case c.extendLeases > 0:
+		logger.Infof("Giving all leases %v.", c.extendLeases)
+		leases.ResetExpiries(c.extendLeases)
+	default:
+		return false
 	}
-	logWriter := &loggoWriter{logger, loggo.DEBUG}
-	logLogger := log.New(logWriter, logPrefix, 0)
+	return true
+}
 
-	snaps, err := raft.NewFileSnapshotStoreWithLogger(dir, retain, logLogger)
+// bootstrapRaft writes the new store into a staging directory next
+// to the raft directory and only renames it into place once it's
+// complete, so a failure part way through never leaves a half-written
+// raft directory for jujud to pick up. Each change made is recorded
+// in undo.
+func (c *rebootstrapCommand) bootstrapRaft(ctx context.Context, servers raft.Configuration, snapshot []byte, undo *rollback) (string, error) {
+	parent := filepath.Dir(c.raftDir)
+	if _, err := os.Stat(parent); os.IsNotExist(err) {
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return "", errors.Trace(err)
+		}
+		undo.add(fmt.Sprintf("removing %q", parent), func() error {
+			return os.Remove(parent)
+		})
+	}
+	if !c.unprivileged {
+		checkParentOwnership(c.raftDir, c.owner)
+	}
+	if err := c.checkTarget(); err != nil {
+		return "", errors.Trace(err)
+	}
+	// A signal cancels ctx, and the error that causes is rolled
+	// back like any other; Run removes its staging directory.
+	var backupDir string
+	opts := rebootstrap.Options{
+		Members:         rebootstrap.StaticSource(servers),
+		RaftDir:         c.raftDir,
+		MinVoters:       c.minVoters,
+		AllowEvenVoters: c.allowEvenVoters,
+		Snapshot:        snapshot,
+		Copy:            c.sourceCopy,
+		Store:           c.storeOptions(),
+		NoSync:          c.noSync,
+		Prepare: func(stagingDir string) error {
+			return c.prepareStore(stagingDir, servers, snapshot)
+		},
+		// The swap doesn't look at ctx, so a signal arriving part
+		// way through waits until it's done.
+		BeforeMove: func() error {
+			if err := c.checkTarget(); err != nil {
+				return errors.Trace(err)
+			}
+			var err error
+			if backupDir, err = c.backupExisting(); err != nil {
+				return errors.Annotate(err, "backing up existing raft directory")
+			}
+			if backupDir != "" {
+				undo.add(fmt.Sprintf("restoring %q from %q", c.raftDir, backupDir), func() error {
+					return os.Rename(backupDir, c.raftDir)
+				})
+			}
+			return nil
+		},
+	}
+	done := c.progress.start("Writing store")
+	_, err := rebootstrap.Run(ctx, opts)
+	done(err)
 	if err != nil {
-		return nil, errors.Annotate(err, "failed to create file snapshot store")
+		return "", errors.Trace(err)
 	}
-	return snaps, nil
+	undo.add(fmt.Sprintf("removing new raft directory %q", c.raftDir), func() error {
+		return os.RemoveAll(c.raftDir)
+	})
+	return backupDir, nil
 }
 
-// loggoWriter is an io.Writer that will call the embedded
-// logger's Log method for each Write, using the specified
-// log level.
-type loggoWriter struct {
-	logger loggo.Logger
-	level  loggo.Level
+// prepareStore checks the store written to stagingDir, records its
+// manifest and gives it the right ownership before it's moved into
+// place.
+func (c *rebootstrapCommand) prepareStore(stagingDir string, servers raft.Configuration, snapshot []byte) error {
+	var err error
+	if c.sourceCopy != nil {
+		err = c.verifyCopiedStore(stagingDir)
+	} else {
+		withSnapshot := snapshot != nil || (c.startIndex > 1 && len(c.retained) == 0)
+		err = c.verifyStore(stagingDir, servers, withSnapshot)
+	}
+	if err != nil {
+		return errors.Annotate(err, "verifying new store")
+	}
+	if err := writeManifest(stagingDir); err != nil {
+		return errors.Trace(err)
+	}
+	if c.unprivileged {
+		// Whoever installs the store sets its owner.
+		err = applyModes(stagingDir)
+	} else {
+		err = applyOwnership(stagingDir, c.owner)
+	}
+	return errors.Annotate(err, "setting ownership")
 }
 
-// Write is part of the io.Writer interface.
-func (w *loggoWriter) Write(p []byte) (int, error) {
-	w.logger.Logf(w.level, "%s", p[:len(p)-1]) // omit trailing newline
-	return len(p), nil
+// checkTarget makes sure nothing has appeared at the raft directory
+// since the run started, and that nothing has the log store there
+// open. It's called immediately before the store is written and
+// again before it's moved into place, since jujud may have been
+// restarted in the meantime.
+func (c *rebootstrapCommand) checkTarget() error {
+	if _, err := os.Stat(c.raftDir); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+	if !c.force {
+		return withExitCode(errors.Errorf("raft directory %q has appeared since the run started", c.raftDir), exitRaftDirExists)
+	}
+	logsPath := filepath.Join(c.raftDir, "logs")
+	locked, err := boltFileLocked(logsPath)
+	if err != nil {
+		return errors.Annotatef(err, "checking lock on %q", logsPath)
+	}
+	if locked {
+		return errors.Errorf("%q is locked by another process - is the machine agent running?", logsPath)
+	}
+	return nil
 }
 
-func (c *rebootstrapCommand) dial() (*mgo.Session, error) {
-	info := &mgo.DialInfo{
-		Addrs:    []string{net.JoinHostPort(c.hostname, c.mongoPort)},
-		Database: "admin",
-		Username: fmt.Sprintf("machine-%s", c.machineID),
-		Password: c.password,
+// backupExisting moves an existing raft directory aside when --force
+// was given, returning the backup location (or "" if there was
+// nothing to back up).
+func (c *rebootstrapCommand) backupExisting() (string, error) {
+	if !c.force {
+		return "", nil
 	}
-	if c.ssl {
-		info.DialServer = dialSSL
+	if _, err := os.Stat(c.raftDir); os.IsNotExist(err) {
+		return "", nil
 	}
-	session, err := mgo.DialWithInfo(info)
-	if err != nil {
-		return nil, err
+	backupDir := fmt.Sprintf("%s.backup-%s", c.raftDir, time.Now().UTC().Format("20060102-150405"))
+	if err := os.Rename(c.raftDir, backupDir); err != nil {
+		return "", errors.Trace(err)
 	}
-	return session, nil
+	logger.Warningf("Existing raft directory moved to %q.", backupDir)
+	return backupDir, nil
 }
 
-func dialSSL(addr *mgo.ServerAddr) (net.Conn, error) {
-	c, err := net.Dial("tcp", addr.String())
-	if err != nil {
-		return nil, err
+// storeOptions returns the options for writing the store.
+func (c *rebootstrapCommand) storeOptions() rebootstrap.StoreOptions {
+	return rebootstrap.StoreOptions{
+		MachineID:       c.machineID,
+		IDScheme:        c.idScheme,
+		ProtocolVersion: raft.ProtocolVersion(c.protocolVersion),
+		Builder:         c.storeBuilder(),
+		SnapshotRetain:  c.snapshotRetain,
+		StartIndex:      c.startIndex,
+		StartTerm:       c.startTerm,
+		Entries:         c.retained,
+		SnapshotIndex:   c.snapshotIndex,
+		SnapshotTerm:    c.snapshotTerm,
+		StepTimeout:     c.storeTimeout,
 	}
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true,
+}
+
+// storeBuilder returns the builder for the --log-store chosen.
+func (c *rebootstrapCommand) storeBuilder() rebootstrap.StoreBuilder {
+	if c.logStoreType == walLogStore {
+		return rebootstrap.WALStoreBuilder{}
+	}
+	return rebootstrap.BoltStoreBuilder{Options: &bbolt.Options{
+		Timeout:         time.Second,
+		NoSync:          c.noSync,
+		NoFreelistSync:  c.boltNoFreelistSync,
+		FreelistType:    bbolt.FreelistType(c.boltFreelistType),
+		InitialMmapSize: c.boltInitialMmapSize,
+	}}
+}
+
+func newSuperCommand() *cmd.SuperCommand {
+	super := cmd.NewSuperCommand(cmd.SuperCommandParams{
+		Name:    "rebootstrap-raft",
+		Purpose: "Recover a juju controller's raft store.",
+		Doc:     strings.TrimSpace(superDoc),
+	})
+	for _, command := range subcommands() {
+		super.Register(command)
 	}
-	cc := tls.Client(c, tlsConfig)
-	if err := cc.Handshake(); err != nil {
-		return nil, err
+	super.Register(&completionCommand{})
+	return super
+}
+
+// subcommands returns a new instance of each of the recovery
+// subcommands.
+func subcommands() []cmd.Command {
+	return []cmd.Command{
+		&rebootstrapCommand{},
+		&salvageCommand{},
+		&dqliteCommand{},
+		&pluginCommand{},
+		&k8sCommand{},
+		&monitorCommand{},
+		&healCommand{},
+		&removeMemberCommand{},
+		&addMemberCommand{},
+		&setSuffrageCommand{},
+		&leasesCommand{},
+		&workstationCommand{},
+		&collectCommand{},
+		&checkCommand{},
+		&compareCommand{},
+		&promoteCommand{},
+		&truncateLogsCommand{},
+		&pruneSnapshotsCommand{},
+		&resnapshotCommand{},
+		&dumpLogsCommand{},
+		&checkStoreCommand{},
+		&storeStatsCommand{},
+		&benchCommand{},
+		&fixPermissionsCommand{},
+		&bundleCommand{},
+		&batchCommand{},
+		&preflightCommand{},
+		&inspectAgentConfCommand{},
+		&retagCommand{},
 	}
-	return cc, nil
 }
 
 func runCommand(args []string) int {
@@ -290,9 +1636,18 @@ func runCommand(args []string) int {
 		logger.Errorf("creating context: %v", err)
 		return 2
 	}
-	return cmd.Main(&rebootstrapCommand{}, ctx, args)
+	// Running with just flags is how the tool was always used, so
+	// treat that as the bootstrap subcommand.
+	if len(args) > 0 && strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "--help" {
+		args = append([]string{"bootstrap"}, args...)
+	}
+	return cmd.Main(newSuperCommand(), ctx, args)
 }
 
 func main() {
-	os.Exit(runCommand(os.Args[1:]))
+	args := os.Args[1:]
+	if filepath.Base(os.Args[0]) == pluginName {
+		args = pluginArgs(args)
+	}
+	os.Exit(runCommand(args))
 }
@@ -0,0 +1,92 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// manifestFile is the name of the checksum manifest written into a
+// new raft directory.
+const manifestFile = "manifest.sha256"
+
+// writeManifest writes a manifest of every file under dir with its
+// SHA-256 digest. Digest lines use the sha256sum format, so running
+// "sha256sum -c manifest.sha256" in the directory checks them; each
+// is preceded by a comment line giving the file's size.
+func writeManifest(dir string) error {
+	var buf bytes.Buffer
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || info.Name() == manifestFile {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		digest, err := fileDigest(path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&buf, "# %s %d bytes\n", rel, info.Size())
+		fmt.Fprintf(&buf, "%s  %s\n", digest, rel)
+		return nil
+	})
+	if err != nil {
+		return errors.Annotate(err, "building manifest")
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, manifestFile), buf.Bytes(), 0600)
+	return errors.Annotate(err, "writing manifest")
+}
+
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// checkManifest checks every file listed in dir's manifest against
+// its recorded digest.
+func checkManifest(dir string) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return errors.Annotate(err, "reading manifest")
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "  ", 2)
+		if len(parts) != 2 {
+			return errors.Errorf("bad manifest line %q", line)
+		}
+		digest, err := fileDigest(filepath.Join(dir, parts[1]))
+		if err != nil {
+			return errors.Annotatef(err, "checking %s", parts[1])
+		}
+		if digest != parts[0] {
+			return errors.Errorf("%s has changed since the manifest was written", parts[1])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// runMetrics is what's recorded about a run for node-exporter's
+// textfile collector.
+type runMetrics struct {
+	machineID   string
+	start       time.Time
+	end         time.Time
+	err         error
+	dryRun      bool
+	memberCount int
+}
+
+// writeMetrics writes the metrics to path in the Prometheus text
+// format. The file is written alongside and renamed into place, since
+// the collector may read it at any moment.
+func writeMetrics(path string, m runMetrics) error {
+	success, code := 0, 0
+	if m.err == nil {
+		success = 1
+	} else {
+		code = exitCode(m.err)
+	}
+	dryRun := 0
+	if m.dryRun {
+		dryRun = 1
+	}
+	labels := fmt.Sprintf("{machine_id=%q}", m.machineID)
+	var buf bytes.Buffer
+	for _, metric := range []struct {
+		name  string
+		help  string
+		value interface{}
+	}{
+		{"rebootstrap_raft_last_run_timestamp_seconds", "When rebootstrap-raft last finished a run.", m.end.Unix()},
+		{"rebootstrap_raft_last_run_duration_seconds", "How long the last run took.", m.end.Sub(m.start).Seconds()},
+		{"rebootstrap_raft_last_run_success", "Whether the last run succeeded.", success},
+		{"rebootstrap_raft_last_run_exit_code", "The exit code of the last run.", code},
+		{"rebootstrap_raft_last_run_dry_run", "Whether the last run was a dry run.", dryRun},
+		{"rebootstrap_raft_member_count", "Servers in the configuration the last run generated.", m.memberCount},
+	} {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", metric.name, metric.help)
+		fmt.Fprintf(&buf, "# TYPE %s gauge\n", metric.name)
+		fmt.Fprintf(&buf, "%s%s %v\n", metric.name, labels, metric.value)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return errors.Trace(err)
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return errors.Trace(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tmp.Name(), path))
+}
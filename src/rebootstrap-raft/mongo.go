@@ -0,0 +1,549 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"github.com/juju/replicaset"
+	"gopkg.in/mgo.v2"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+// mongoFlags holds the flags used to connect to the controller's
+// MongoDB, shared by the commands that read from it.
+type mongoFlags struct {
+	hostname  string
+	mongoPort string
+	ssl       bool
+	password  string
+
+	// user and authDB are the account to log in as, and the
+	// database it's defined in, instead of the machine's own.
+	user   string
+	authDB string
+
+	// passwordCmd and vaultSecret say where to fetch the password
+	// from instead of taking it on the command line.
+	passwordCmd string
+	vaultSecret string
+
+	// oldPassword is tried if password is rejected. It's only set
+	// when the password came from agent.conf, as is agentUser, the
+	// agent tag the passwords belong to.
+	oldPassword string
+	agentUser   string
+
+	// keyfileFallback says to log in as keyfileUser with the
+	// shared secret if the machine's passwords are refused. The
+	// secret comes from keyfile if that's set, or else agent.conf.
+	keyfileFallback bool
+	keyfile         string
+	sharedSecret    string
+
+	certFingerprint string
+	fingerprint     []byte
+
+	// caCerts, read from agent.conf under --fips without
+	// --mongo-cert-fingerprint, are what the server's certificate
+	// chain is verified against.
+	caCerts *x509.CertPool
+
+	waitForPrimary time.Duration
+	replicaSetName string
+	traceMongo     bool
+
+	// preferIPv4 and preferIPv6 say which address family to try
+	// first when the hostname has both.
+	preferIPv4 bool
+	preferIPv6 bool
+
+	// fips restricts TLS to FIPS approved algorithms.
+	fips bool
+
+	// sshTunnel is the user@host to reach MongoDB through, and
+	// sshTunnelIdentity the key to use. tunnelAddr is the local
+	// end of the tunnel once it's up.
+	sshTunnel         string
+	sshTunnelIdentity string
+	tunnelAddr        string
+
+	// flags is kept so that we can tell which settings were given
+	// explicitly and which can be filled in from the local juju-db.
+	flags *gnuflag.FlagSet
+}
+
+// keyfileUser is the internal user MongoDB replicaset members
+// authenticate to each other as, with the contents of the keyfile
+// (Juju's shared secret) as its password.
+const keyfileUser = "__system"
+
+// primaryPollInterval is how often we try again while waiting for
+// MongoDB to have a primary.
+const primaryPollInterval = 5 * time.Second
+
+func (m *mongoFlags) setFlags(f *gnuflag.FlagSet) {
+	m.flags = f
+	f.StringVar(&m.hostname, "hostname", "localhost", "the hostname of the Juju MongoDB server")
+	f.StringVar(&m.mongoPort, "mongo-port", "37017", "the port of the Juju MongoDB server (default: from the local juju-db)")
+	f.BoolVar(&m.ssl, "ssl", true, "use SSL to connect to MongoDB (default: from the local juju-db)")
+	f.StringVar(&m.password, "password", "", "password for connecting to MongoDB (default: statepassword from agent.conf)")
+	f.StringVar(&m.user, "mongo-user", "", "MongoDB user to log in as, such as an admin or restored database's account (default: machine-<id>)")
+	f.StringVar(&m.authDB, "mongo-auth-db", "", "with --mongo-user, the database the user is defined in (default: admin)")
+	f.StringVar(&m.passwordCmd, "password-cmd", "", "shell command that prints the MongoDB password")
+	f.StringVar(&m.vaultSecret, "vault-secret", "", "read the MongoDB password from this HashiCorp Vault secret, as <path>[#<field>]")
+	f.BoolVar(&m.keyfileFallback, "keyfile-fallback", false, "if MongoDB refuses the machine's password, log in as the internal __system user with the shared secret")
+	f.StringVar(&m.keyfile, "keyfile", "", "with --keyfile-fallback, the MongoDB keyfile holding the shared secret (default: sharedsecret from agent.conf)")
+	f.StringVar(&m.certFingerprint, "mongo-cert-fingerprint", "", "SHA-256 fingerprint the MongoDB server certificate must have")
+	f.BoolVar(&m.fips, "fips", fipsBuild == "true", "only use FIPS approved TLS algorithms for MongoDB, failing if they can't be negotiated")
+	f.StringVar(&m.replicaSetName, "replica-set-name", rebootstrap.ReplicaSetName, "the name MongoDB's replicaset must have, to catch being pointed at the wrong mongod")
+	f.DurationVar(&m.waitForPrimary, "wait-for-primary", 0, "keep trying for this long while MongoDB is starting up or has no primary")
+	f.BoolVar(&m.preferIPv4, "prefer-ipv4", false, "if the MongoDB hostname has IPv4 and IPv6 addresses, try the IPv4 ones first")
+	f.BoolVar(&m.preferIPv6, "prefer-ipv6", false, "if the MongoDB hostname has IPv4 and IPv6 addresses, try the IPv6 ones first")
+	f.BoolVar(&m.traceMongo, "trace-mongo", false, "log every MongoDB connection attempt, server selection decision and operation, with timings")
+	f.StringVar(&m.sshTunnel, "ssh-tunnel", "", "reach MongoDB through an ssh port forward from this user@host (a jump host)")
+	f.StringVar(&m.sshTunnelIdentity, "ssh-tunnel-identity", "", "private key to use for --ssh-tunnel (default: ssh's own choice)")
+}
+
+// validate checks the flags. The password is fetched with
+// --password-cmd or from Vault if asked; if none was given the
+// statepassword from the agent.conf at agentConfPath is used. When
+// MongoDB is on this machine, the port and SSL settings that weren't
+// given are taken from the juju-db found under hostfsPrefix.
+func (m *mongoFlags) validate(agentConfPath, hostfsPrefix string) error {
+	if m.preferIPv4 && m.preferIPv6 {
+		return errors.Errorf("--prefer-ipv4 and --prefer-ipv6 can't both be given")
+	}
+	if m.hostname == "localhost" && m.sshTunnel == "" {
+		m.applyJujuDB(hostfsPrefix)
+	}
+	if err := m.validateFIPS(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := m.fetchPassword(); err != nil {
+		return errors.Trace(err)
+	}
+	if m.authDB != "" && m.user == "" {
+		return errors.Errorf("--mongo-auth-db needs --mongo-user")
+	}
+	if m.user != "" && m.password == "" {
+		// agent.conf only has the machine's own password.
+		return errors.Errorf("--mongo-user needs --password, --password-cmd or --vault-secret")
+	}
+	if m.password == "" {
+		password, oldPassword, err := readMongoPasswords(agentConfPath)
+		if err != nil {
+			return errors.Annotate(err, "password is required and couldn't be read from agent.conf")
+		}
+		// Without a tag the password is taken to be the machine's.
+		tag, err := readAgentTag(agentConfPath)
+		if err != nil && !errors.IsNotFound(err) {
+			return errors.Annotate(err, "finding whose password agent.conf holds")
+		}
+		m.password, m.oldPassword, m.agentUser = password, oldPassword, tag
+	}
+	if m.keyfile != "" && !m.keyfileFallback {
+		return errors.Errorf("--keyfile needs --keyfile-fallback")
+	}
+	if m.keyfileFallback {
+		secret, err := readSharedSecret(agentConfPath, m.keyfile)
+		if err != nil {
+			return errors.Annotate(err, "--keyfile-fallback needs the shared secret")
+		}
+		m.sharedSecret = secret
+	}
+	secrets.add(m.password)
+	secrets.add(m.oldPassword)
+	secrets.add(m.sharedSecret)
+	if m.traceMongo {
+		enableMongoTrace()
+	}
+	if m.sshTunnelIdentity != "" && m.sshTunnel == "" {
+		return errors.Errorf("--ssh-tunnel-identity needs --ssh-tunnel")
+	}
+	if m.certFingerprint != "" {
+		if !m.ssl {
+			return errors.Errorf("--mongo-cert-fingerprint needs --ssl")
+		}
+		fingerprint, err := parseFingerprint(m.certFingerprint)
+		if err != nil {
+			return errors.Annotate(err, "parsing --mongo-cert-fingerprint")
+		}
+		m.fingerprint = fingerprint
+	}
+	if m.fips && m.fingerprint == nil {
+		// FIPS mode mustn't talk to a server it hasn't verified.
+		caCerts, err := readCACert(agentConfPath)
+		if err != nil {
+			return errors.Annotate(err, "--fips verifies MongoDB's certificate against the controller CA in agent.conf, or needs --mongo-cert-fingerprint")
+		}
+		m.caCerts = caCerts
+	}
+	return nil
+}
+
+// applyJujuDB detects how the local MongoDB is packaged and uses its
+// port and TLS settings in place of the defaults, leaving alone any
+// the user gave.
+func (m *mongoFlags) applyJujuDB(hostfsPrefix string) {
+	db, err := detectJujuDB(hostfsPrefix)
+	if errors.IsNotFound(err) {
+		logger.Debugf("%v, using the default MongoDB settings", err)
+		return
+	} else if err != nil {
+		logger.Warningf("can't read the juju-db settings, using the defaults: %v", err)
+		return
+	}
+	given := make(map[string]bool)
+	if m.flags != nil {
+		m.flags.Visit(func(f *gnuflag.Flag) {
+			given[f.Name] = true
+		})
+	}
+	if db.Port != "" && !given["mongo-port"] {
+		m.mongoPort = db.Port
+	}
+	if db.TLSMode != "" && !given["ssl"] {
+		m.ssl = db.usesTLS()
+	}
+	logger.Infof("detected %s (%s): port %s, ssl %v", db.Packaging, db.ConfigPath, m.mongoPort, m.ssl)
+}
+
+// parseFingerprint accepts a SHA-256 fingerprint as plain hex or in
+// the colon-separated form openssl prints.
+func parseFingerprint(s string) ([]byte, error) {
+	fingerprint, err := hex.DecodeString(strings.Replace(s, ":", "", -1))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(fingerprint) != sha256.Size {
+		return nil, errors.Errorf("expected %d bytes, got %d", sha256.Size, len(fingerprint))
+	}
+	return fingerprint, nil
+}
+
+// dial connects to MongoDB as username (a machine tag or keyfileUser)
+// using password. A direct connection talks only to the server named rather
+// than finding the replicaset primary; connections through an ssh
+// tunnel are always direct, since the other members' addresses can't
+// be reached from here. The
+// connection attempt gives up when ctx is done, and a deadline on ctx
+// is used as the dial timeout.
+func (m *mongoFlags) dial(ctx context.Context, username, password string, direct bool) (*mgo.Session, error) {
+	addr := net.JoinHostPort(m.hostname, m.mongoPort)
+	if m.tunnelAddr != "" {
+		addr, direct = m.tunnelAddr, true
+	}
+	info := &mgo.DialInfo{
+		Addrs:    []string{addr},
+		Direct:   direct,
+		Database: "admin",
+		Username: username,
+		Password: password,
+	}
+	if username == keyfileUser {
+		info.Source = "local"
+	} else if username == m.user && m.authDB != "" {
+		info.Source = m.authDB
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		info.Timeout = time.Until(deadline)
+	}
+	if m.ssl {
+		if m.fingerprint == nil && m.caCerts == nil {
+			logger.Debugf("not verifying the MongoDB server certificate")
+		}
+		info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			return m.dialSSL(ctx, addr, m.fingerprint)
+		}
+	} else {
+		info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			return m.dialTCP(ctx, addr.String())
+		}
+	}
+
+	if m.traceMongo {
+		info.DialServer = traceDial(info.DialServer)
+		mongoLogger.Debugf("dialling %v as %s (direct %v, ssl %v, timeout %v)", info.Addrs, info.Username, info.Direct, m.ssl, info.Timeout)
+	}
+
+	type dialResult struct {
+		session *mgo.Session
+		err     error
+	}
+	results := make(chan dialResult, 1)
+	start := time.Now()
+	go func() {
+		session, err := mgo.DialWithInfo(info)
+		results <- dialResult{session, err}
+	}()
+	select {
+	case result := <-results:
+		if m.traceMongo {
+			mongoLogger.Debugf("dial as %s finished after %v: %v", info.Username, time.Since(start).Round(time.Millisecond), result.err)
+		}
+		return result.session, result.err
+	case <-ctx.Done():
+		// Don't leak the session if the dial completes after all.
+		go func() {
+			if result := <-results; result.session != nil {
+				result.session.Close()
+			}
+		}()
+		return nil, errors.Trace(ctx.Err())
+	}
+}
+
+// verifyChain checks the certificates a server presented chain up to
+// one of roots.
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no certificate presented")
+	}
+	intermediates := x509.NewCertPool()
+	var leaf *x509.Certificate
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return errors.Annotate(err, "parsing server certificate")
+		}
+		if i == 0 {
+			leaf = cert
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return errors.Annotate(err, "verifying server certificate against the controller CA")
+}
+
+// connect dials MongoDB as the given controller machine, checking the
+// server version against what agent.conf (if available) expects. If
+// the password is refused and agent.conf has a different oldpassword,
+// that's tried too: an agent part way through changing its password
+// (during an upgrade, say) may not have been given the new one yet.
+// With --ssh-tunnel the tunnel is started first, and lasts until ctx
+// is done.
+func (m *mongoFlags) connect(ctx context.Context, machineID string, agentConf *agentConfig) (*mgo.Session, error) {
+	if agentConf != nil {
+		checkAgentMongoVersion(agentConf)
+	}
+	if m.sshTunnel != "" && m.tunnelAddr == "" {
+		target := net.JoinHostPort(m.hostname, m.mongoPort)
+		addr, err := startTunnel(ctx, m.sshTunnel, m.sshTunnelIdentity, target)
+		if err != nil {
+			return nil, withExitCode(err, exitMongoUnreachable)
+		}
+		m.tunnelAddr = addr
+	}
+	session, err := m.dialWaiting(ctx, machineID)
+	if err != nil && mongoDialExitCode(err) != exitMongoAuth && ctx.Err() == nil {
+		// Without a primary the replicaset config and Juju's
+		// collections can still be read from this member.
+		if direct, directErr := m.dialSecondary(ctx, machineID); directErr == nil {
+			logger.Warningf("can't reach a primary (%v) - reading from %s directly, which may be out of date", err, m.hostname)
+			session, err = direct, nil
+		} else {
+			logger.Debugf("direct connection failed too: %v", directErr)
+		}
+	}
+	if err != nil {
+		err = withExitCode(err, mongoDialExitCode(err))
+		if agentConf != nil {
+			if v, ok := agentMongoVersion(agentConf); ok && mongoIncompatibility(v) != "" {
+				return nil, errors.Annotatef(err, "connecting to MongoDB %s", v)
+			}
+		}
+		return nil, errors.Annotate(err, "connecting to MongoDB")
+	}
+	checkServerMongoVersion(session, agentConf)
+	if err := m.checkReplicaSetName(ctx, session); err != nil {
+		session.Close()
+		return nil, withExitCode(err, exitValidation)
+	}
+	return session, nil
+}
+
+// checkReplicaSetName makes sure the server belongs to the replicaset
+// named with --replica-set-name, so that a mongod that isn't the
+// controller's (a standalone one, or another application's
+// replicaset on the same machine) is refused before anything is read
+// from it.
+func (m *mongoFlags) checkReplicaSetName(ctx context.Context, session *mgo.Session) error {
+	name, err := rebootstrap.CurrentReplicaSetName(ctx, session)
+	if err != nil {
+		return errors.Annotate(err, "checking the replicaset name")
+	}
+	if name != m.replicaSetName {
+		return errors.Errorf("MongoDB at %s is in replicaset %q, not %q - is this the controller's mongod? "+
+			"(use --replica-set-name if the controller's replicaset has a different name)",
+			net.JoinHostPort(m.hostname, m.mongoPort), name, m.replicaSetName)
+	}
+	logger.Debugf("replicaset name is %q", name)
+	return nil
+}
+
+// dialWaiting dials MongoDB, falling back to the oldpassword. With
+// --wait-for-primary it keeps trying until the replicaset has a
+// primary and this member has finished starting up, since the tool is
+// usually run just after mongod has been restarted.
+func (m *mongoFlags) dialWaiting(ctx context.Context, machineID string) (*mgo.Session, error) {
+	deadline := time.Now().Add(m.waitForPrimary)
+	for {
+		session, err := m.dialAgent(ctx, machineID, false)
+		if err == nil && m.waitForPrimary > 0 {
+			if err = checkPrimary(ctx, session); err != nil {
+				session.Close()
+				session = nil
+			}
+		}
+		if err == nil || m.waitForPrimary <= 0 || mongoDialExitCode(err) == exitMongoAuth || !time.Now().Before(deadline) {
+			return session, err
+		}
+		logger.Infof("Waiting for MongoDB: %v", err)
+		select {
+		case <-time.After(primaryPollInterval):
+		case <-ctx.Done():
+			return nil, errors.Trace(ctx.Err())
+		}
+	}
+}
+
+// dialAgent dials with the agent's password, falling back to its
+// oldpassword if that's refused, and then with --keyfile-fallback to
+// the shared secret, which still works when the machine's
+// credentials in MongoDB are out of sync with agent.conf. It logs in
+// as the agent whose agent.conf the password came from, which after a
+// restore from another machine's backup isn't machineID, or with
+// --mongo-user as that user instead.
+func (m *mongoFlags) dialAgent(ctx context.Context, machineID string, direct bool) (*mgo.Session, error) {
+	username := fmt.Sprintf("machine-%s", machineID)
+	switch {
+	case m.user != "":
+		username = m.user
+	case m.agentUser != "":
+		username = m.agentUser
+	}
+	session, err := m.dial(ctx, username, m.password, direct)
+	if err != nil && m.oldPassword != "" && mongoDialExitCode(err) == exitMongoAuth {
+		logger.Warningf("MongoDB rejected statepassword, trying oldpassword")
+		session, err = m.dial(ctx, username, m.oldPassword, direct)
+	}
+	if err != nil && m.keyfileFallback && mongoDialExitCode(err) == exitMongoAuth {
+		logger.Warningf("MongoDB rejected %s's password, logging in as %s with the shared secret", username, keyfileUser)
+		session, err = m.dial(ctx, keyfileUser, m.sharedSecret, direct)
+	}
+	return session, err
+}
+
+// dialSecondary connects directly to the MongoDB server named, which
+// may be a secondary, and allows reading from it.
+func (m *mongoFlags) dialSecondary(ctx context.Context, machineID string) (*mgo.Session, error) {
+	session, err := m.dialAgent(ctx, machineID, true)
+	if err != nil {
+		return nil, err
+	}
+	session.SetMode(mgo.Monotonic, true)
+	return session, nil
+}
+
+// checkPrimary returns an error unless the replicaset has a primary
+// and the member we're connected to is neither starting up nor
+// recovering.
+func checkPrimary(ctx context.Context, session *mgo.Session) error {
+	var status *replicaset.Status
+	err := rebootstrap.WithSession(ctx, session, func(s *mgo.Session) error {
+		var err error
+		status, err = replicaset.CurrentStatus(s)
+		return err
+	})
+	if err != nil {
+		return errors.Annotate(err, "getting replica set status")
+	}
+	primary := false
+	for _, member := range status.Members {
+		if member.Self {
+			switch member.State {
+			case replicaset.StartupState, replicaset.Startup2State, replicaset.RecoveringState:
+				return errors.Errorf("member %s is in state %s", member.Address, member.State)
+			}
+		}
+		if member.State == replicaset.PrimaryState {
+			primary = true
+		}
+	}
+	if !primary {
+		return errors.New("replica set has no primary")
+	}
+	return nil
+}
+
+// dialSSL makes a TLS connection to addr. The controller's
+// certificate is signed by the controller's own CA, which we usually
+// don't have, so the chain isn't verified; if fingerprint is set the
+// leaf certificate must match it instead. Under --fips without a
+// fingerprint the chain is verified against the CA from agent.conf.
+// Juju's certificates name the controller by the addresses it had
+// when they were issued, so the host name isn't checked.
+func (m *mongoFlags) dialSSL(ctx context.Context, addr *mgo.ServerAddr, fingerprint []byte) (net.Conn, error) {
+	c, err := m.dialTCP(ctx, addr.String())
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+	}
+	if m.fips {
+		applyFIPS(tlsConfig)
+	}
+	if m.caCerts != nil {
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(rawCerts, m.caCerts)
+		}
+	}
+	cc := tls.Client(c, tlsConfig)
+	if deadline, ok := ctx.Deadline(); ok {
+		cc.SetDeadline(deadline)
+	}
+	if err := cc.Handshake(); err != nil {
+		cc.Close()
+		return nil, err
+	}
+	cc.SetDeadline(time.Time{})
+	if m.fips {
+		if err := checkFIPSConnection(cc.ConnectionState()); err != nil {
+			cc.Close()
+			return nil, errors.Annotatef(err, "%s", addr)
+		}
+	}
+	if fingerprint != nil {
+		certs := cc.ConnectionState().PeerCertificates
+		if len(certs) == 0 {
+			cc.Close()
+			return nil, errors.Errorf("%s presented no certificate", addr)
+		}
+		actual := sha256.Sum256(certs[0].Raw)
+		if subtle.ConstantTimeCompare(actual[:], fingerprint) != 1 {
+			cc.Close()
+			return nil, errors.Errorf("%s certificate fingerprint is %X, not the expected %X", addr, actual, fingerprint)
+		}
+	}
+	return cc, nil
+}
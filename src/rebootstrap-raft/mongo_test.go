@@ -0,0 +1,65 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// newCert makes a certificate for name, signed by parent (or itself
+// if parent is nil).
+func newCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestVerifyChain(t *testing.T) {
+	ca, caKey := newCert(t, "juju-ca", nil, nil)
+	otherCA, _ := newCert(t, "other-ca", nil, nil)
+	server, _ := newCert(t, "juju-mongodb", ca, caKey)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	others := x509.NewCertPool()
+	others.AddCert(otherCA)
+
+	if err := verifyChain([][]byte{server.Raw}, roots); err != nil {
+		t.Errorf("certificate signed by the CA: %v", err)
+	}
+	if err := verifyChain([][]byte{server.Raw}, others); err == nil {
+		t.Error("certificate signed by another CA verified")
+	}
+	if err := verifyChain(nil, roots); err == nil {
+		t.Error("no certificates verified")
+	}
+}
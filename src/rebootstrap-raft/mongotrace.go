@@ -0,0 +1,52 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/juju/loggo"
+	"gopkg.in/mgo.v2"
+)
+
+// mongoLogger is where --trace-mongo sends mgo's own logging and the
+// timings of each connection attempt.
+var mongoLogger = loggo.GetLogger("rebootstrap-raft.mongo")
+
+// mgoTraceLogger passes mgo's debug output to mongoLogger.
+type mgoTraceLogger struct{}
+
+// Output is called by mgo for each line it logs.
+func (mgoTraceLogger) Output(calldepth int, s string) error {
+	mongoLogger.Debugf("%s", strings.TrimRight(s, "\n"))
+	return nil
+}
+
+// enableMongoTrace turns on mgo's debug logging - dialling, server
+// discovery and selection, and every operation sent - and shows it
+// whatever the log level.
+func enableMongoTrace() {
+	mongoLogger.SetLogLevel(loggo.DEBUG)
+	mgo.SetLogger(mgoTraceLogger{})
+	mgo.SetDebug(true)
+}
+
+// traceDial wraps a server dialler so that each connection attempt is
+// logged with how long it took and how it ended.
+func traceDial(dial func(*mgo.ServerAddr) (net.Conn, error)) func(*mgo.ServerAddr) (net.Conn, error) {
+	return func(addr *mgo.ServerAddr) (net.Conn, error) {
+		start := time.Now()
+		mongoLogger.Debugf("dialling %s (resolved to %s)", addr.String(), addr.TCPAddr())
+		conn, err := dial(addr)
+		elapsed := time.Since(start).Round(time.Millisecond)
+		if err != nil {
+			mongoLogger.Debugf("dialling %s failed after %v: %v", addr.String(), elapsed, err)
+		} else {
+			mongoLogger.Debugf("connected to %s in %v", addr.String(), elapsed)
+		}
+		return conn, err
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+)
+
+// mongoVersion is the major and minor part of a MongoDB version.
+type mongoVersion struct {
+	Major int
+	Minor int
+}
+
+func (v mongoVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+var mongoVersionPattern = regexp.MustCompile(`^(\d+)\.(\d+)`)
+
+// parseMongoVersion accepts the forms MongoDB versions appear in:
+// "4.4.18" from the server, "4.0/wiredTiger" from agent.conf and
+// "4.4/stable" for a juju-db snap channel.
+func parseMongoVersion(s string) (mongoVersion, error) {
+	m := mongoVersionPattern.FindStringSubmatch(s)
+	if m == nil {
+		return mongoVersion{}, errors.NotValidf("mongo version %q", s)
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	return mongoVersion{Major: major, Minor: minor}, nil
+}
+
+// mongoIncompatibility returns why the mgo driver can't talk to the
+// given server version, or "" if it can. MongoDB 5.1 dropped the
+// legacy opcodes mgo sends its commands with, so connections fail
+// during the handshake with errors that don't say why.
+func mongoIncompatibility(v mongoVersion) string {
+	if v.Major > 5 || (v.Major == 5 && v.Minor >= 1) {
+		return fmt.Sprintf("MongoDB %s doesn't support the legacy wire protocol this tool uses", v)
+	}
+	return ""
+}
+
+// agentMongoVersion returns the MongoDB version agent.conf says the
+// controller runs, from mongoversion or failing that the juju-db snap
+// channel.
+func agentMongoVersion(conf *agentConfig) (mongoVersion, bool) {
+	for _, s := range []string{conf.MongoVersion, conf.JujuDBSnapChannel} {
+		if s == "" {
+			continue
+		}
+		if v, err := parseMongoVersion(s); err == nil {
+			return v, true
+		}
+		logger.Debugf("ignoring agent.conf mongo version %q", s)
+	}
+	return mongoVersion{}, false
+}
+
+// checkAgentMongoVersion warns before dialling if agent.conf records a
+// MongoDB version we know we can't talk to.
+func checkAgentMongoVersion(conf *agentConfig) {
+	v, ok := agentMongoVersion(conf)
+	if !ok {
+		return
+	}
+	logger.Debugf("agent.conf mongo version is %s (juju-db channel %q)", v, conf.JujuDBSnapChannel)
+	if reason := mongoIncompatibility(v); reason != "" {
+		logger.Warningf("%s - connecting will probably fail", reason)
+	}
+}
+
+// checkServerMongoVersion compares the server's version with the one
+// recorded in agent.conf, warning about any skew.
+func checkServerMongoVersion(session *mgo.Session, conf *agentConfig) {
+	info, err := session.BuildInfo()
+	if err != nil {
+		logger.Warningf("can't read MongoDB version: %v", err)
+		return
+	}
+	server, err := parseMongoVersion(info.Version)
+	if err != nil {
+		logger.Warningf("%v", err)
+		return
+	}
+	logger.Infof("MongoDB server version is %s.", info.Version)
+	if reason := mongoIncompatibility(server); reason != "" {
+		logger.Warningf("%s", reason)
+	}
+	if conf == nil {
+		return
+	}
+	if expected, ok := agentMongoVersion(conf); ok && expected != server {
+		logger.Warningf("agent.conf expects MongoDB %s but the server is %s - is a juju-db upgrade half done?", expected, server)
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"gopkg.in/yaml.v2"
+)
+
+const monitorDoc = `
+
+Watch a rebootstrapped cluster until raft has a leader that every
+voter follows and has caught up with, or until the timeout.
+
+This is run on a controller machine once every controller has been
+rebootstrapped and its agent restarted. The cluster configuration is
+taken from the local agent's raft worker, and each controller's agent
+is asked for its raft state over its introspection socket - the local
+one directly and the others over ssh (or juju ssh with
+--juju-controller), using curl.
+
+`
+
+// raftReport is the part of the raft worker's engine report that
+// describes its raft state.
+type raftReport struct {
+	State  string `yaml:"state"`
+	Leader string `yaml:"leader"`
+	Index  struct {
+		Applied uint64 `yaml:"applied"`
+		Last    uint64 `yaml:"last"`
+	} `yaml:"index"`
+	ClusterConfig struct {
+		Servers map[string]struct {
+			Address  string `yaml:"address"`
+			Suffrage string `yaml:"suffrage"`
+		} `yaml:"servers"`
+	} `yaml:"cluster-config"`
+}
+
+// parseRaftReport returns the raft worker's report from a /depengine
+// report.
+func parseRaftReport(body []byte) (*raftReport, error) {
+	var report struct {
+		Manifolds struct {
+			Raft struct {
+				Report raftReport `yaml:"report"`
+			} `yaml:"raft"`
+		} `yaml:"manifolds"`
+	}
+	if err := yaml.Unmarshal(body, &report); err != nil {
+		return nil, errors.Annotate(err, "parsing engine report")
+	}
+	return &report.Manifolds.Raft.Report, nil
+}
+
+// nodeStatus is what was seen of one controller in a poll.
+type nodeStatus struct {
+	ID       string
+	Address  string
+	Suffrage string
+	Report   *raftReport
+	Err      error
+}
+
+type monitorCommand struct {
+	cmd.CommandBase
+	logFlags
+	sshFlags
+	machineID string
+	timeout   time.Duration
+	interval  time.Duration
+	maxLag    uint64
+}
+
+// Info is part of cmd.Command.
+func (c *monitorCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "monitor",
+		Purpose: "Wait for the rebootstrapped cluster to elect a leader and catch up.",
+		Doc:     strings.TrimSpace(monitorDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *monitorCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	c.logFlags.setFlags(f)
+	c.sshFlags.setFlags(f)
+	f.StringVar(&c.machineID, "machine-id", "", "ID of this Juju controller machine")
+	f.DurationVar(&c.timeout, "timeout", 10*time.Minute, "how long to wait for the cluster")
+	f.DurationVar(&c.interval, "interval", 5*time.Second, "how often to poll the controllers")
+	f.Uint64Var(&c.maxLag, "max-lag", 100, "how many log entries a voter may be behind the leader and still be in sync")
+}
+
+// Init is part of cmd.Command.
+func (c *monitorCommand) Init(args []string) error {
+	if err := c.setupLogging(false); err != nil {
+		return errors.Trace(err)
+	}
+	if c.machineID == "" {
+		return errors.Errorf("--machine-id is required")
+	}
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *monitorCommand) Run(ctx *cmd.Context) error {
+	c.setupOutput(ctx)
+	return reportExitCode(ctx, c.run(ctx))
+}
+
+func (c *monitorCommand) run(ctx *cmd.Context) error {
+	body, err := fetchDepengine(introspectionSocket(c.machineID))
+	if err != nil {
+		return errors.Annotate(err, "asking the local agent for its raft state")
+	}
+	local, err := parseRaftReport(body)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(local.ClusterConfig.Servers) == 0 {
+		return errors.Errorf("the local raft worker doesn't report a cluster configuration")
+	}
+
+	deadline := time.Now().Add(c.timeout)
+	for {
+		statuses := c.poll(local)
+		problems := clusterProblems(statuses, c.maxLag)
+		if len(problems) == 0 {
+			fmt.Fprintf(ctx.Stdout, "Raft has a leader and every voter is in sync:\n")
+			return errors.Trace(writeNodeStatuses(ctx.Stdout, statuses))
+		}
+		if time.Now().After(deadline) {
+			fmt.Fprintf(ctx.Stdout, "Raft isn't healthy after %s:\n", c.timeout)
+			writeNodeStatuses(ctx.Stdout, statuses)
+			return withExitCode(errors.Errorf("cluster not in sync: %s", strings.Join(problems, "; ")), exitAgentUnhealthy)
+		}
+		if !c.quiet {
+			fmt.Fprintf(ctx.Stderr, "Waiting: %s\n", strings.Join(problems, "; "))
+		}
+		time.Sleep(c.interval)
+	}
+}
+
+// poll asks every controller in the local configuration for its raft
+// state.
+func (c *monitorCommand) poll(local *raftReport) []nodeStatus {
+	var statuses []nodeStatus
+	for id, server := range local.ClusterConfig.Servers {
+		status := nodeStatus{ID: id, Address: server.Address, Suffrage: server.Suffrage}
+		var body []byte
+		if id == c.machineID {
+			body, status.Err = fetchDepengine(introspectionSocket(id))
+		} else if host, _, err := net.SplitHostPort(server.Address); err != nil {
+			status.Err = errors.Annotatef(err, "address of machine %s", id)
+		} else {
+			body, status.Err = c.sshFlags.remote(id, host).Run(
+				"curl", "--silent", "--show-error", "--fail",
+				"--abstract-unix-socket", strings.TrimPrefix(introspectionSocket(id), "@"),
+				"http://localhost/depengine")
+		}
+		if status.Err == nil {
+			status.Report, status.Err = parseRaftReport(body)
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
+
+// clusterProblems returns what stops the cluster from being healthy:
+// there must be a single leader, which every voter follows and is no
+// more than maxLag entries behind.
+func clusterProblems(statuses []nodeStatus, maxLag uint64) []string {
+	var problems []string
+	var leader *nodeStatus
+	for i, status := range statuses {
+		if status.Err != nil {
+			problems = append(problems, fmt.Sprintf("machine %s: %v", status.ID, status.Err))
+			continue
+		}
+		if status.Report.State == "Leader" {
+			if leader != nil {
+				problems = append(problems, fmt.Sprintf("machines %s and %s both think they're leader", leader.ID, status.ID))
+			}
+			leader = &statuses[i]
+		}
+	}
+	if leader == nil {
+		return append(problems, "no leader")
+	}
+	for _, status := range statuses {
+		if status.Err != nil || status.Suffrage != "Voter" || status.ID == leader.ID {
+			continue
+		}
+		if status.Report.Leader != leader.Address {
+			problems = append(problems, fmt.Sprintf("machine %s follows %q, not %s", status.ID, status.Report.Leader, leader.Address))
+		}
+		if status.Report.Index.Applied+maxLag < leader.Report.Index.Last {
+			problems = append(problems, fmt.Sprintf("machine %s is %d entries behind",
+				status.ID, leader.Report.Index.Last-status.Report.Index.Applied))
+		}
+	}
+	return problems
+}
+
+func writeNodeStatuses(w io.Writer, statuses []nodeStatus) error {
+	tw := tabwriter.NewWriter(w, 0, 1, 2, ' ', 0)
+	fmt.Fprintf(tw, "  ID\tADDRESS\tSUFFRAGE\tSTATE\tAPPLIED\n")
+	for _, status := range statuses {
+		if status.Err != nil {
+			fmt.Fprintf(tw, "  %s\t%s\t%s\tunknown\t\n", status.ID, status.Address, status.Suffrage)
+			continue
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%d\n", status.ID, status.Address, status.Suffrage,
+			status.Report.State, status.Report.Index.Applied)
+	}
+	return errors.Trace(tw.Flush())
+}
@@ -0,0 +1,59 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/user"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+// toolVersion is this tool's version, set at build time with
+// -ldflags "-X main.toolVersion=<version>".
+var toolVersion = "dev"
+
+// operatorName returns who is running the tool: the user who ran
+// sudo, if it was run that way.
+func operatorName() string {
+	if name := os.Getenv("SUDO_USER"); name != "" {
+		return name
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "unknown"
+}
+
+// recordOperation writes a record of the store just written into the
+// controller's database, for --record-operation.
+func (c *rebootstrapCommand) recordOperation(ctx context.Context, session *mgo.Session, servers raft.Configuration) error {
+	host, err := os.Hostname()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	op := rebootstrap.Operation{
+		MachineID:   c.machineID,
+		Time:        time.Now().UTC(),
+		User:        operatorName(),
+		Host:        host,
+		ToolVersion: toolVersion,
+		StartIndex:  c.startIndex,
+		StartTerm:   c.startTerm,
+	}
+	for _, server := range rebootstrap.ApplyIDScheme(servers, c.idScheme).Servers {
+		op.Servers = append(op.Servers, rebootstrap.OperationServer{
+			ID:       string(server.ID),
+			Address:  string(server.Address),
+			Suffrage: server.Suffrage.String(),
+		})
+	}
+	return rebootstrap.RecordOperation(ctx, session, op)
+}
@@ -0,0 +1,254 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/errors"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+// remoteController is another controller machine to be bootstrapped
+// with --all-controllers.
+type remoteController struct {
+	machineID string
+	remote    remote
+}
+
+// controllerResult is the outcome of bootstrapping another controller.
+type controllerResult struct {
+	MachineID      string `json:"machine-id" yaml:"machine-id"`
+	Host           string `json:"host" yaml:"host"`
+	Written        bool   `json:"written" yaml:"written"`
+	Backup         string `json:"backup,omitempty" yaml:"backup,omitempty"`
+	AgentRestarted bool   `json:"agent-restarted,omitempty" yaml:"agent-restarted,omitempty"`
+	Error          string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// remoteControllers returns the controllers in servers other than
+// this one, reached at the host part of their raft address.
+func (c *rebootstrapCommand) remoteControllers(servers raft.Configuration) ([]remoteController, error) {
+	return otherControllers(servers, c.machineID, &c.sshFlags)
+}
+
+// otherControllers returns the controllers in servers other than
+// machineID, reached with ssh at the host part of their raft address.
+func otherControllers(servers raft.Configuration, machineID string, ssh *sshFlags) ([]remoteController, error) {
+	var result []remoteController
+	for _, server := range servers.Servers {
+		if string(server.ID) == machineID {
+			continue
+		}
+		host, _, err := net.SplitHostPort(string(server.Address))
+		if err != nil {
+			return nil, errors.Annotatef(err, "address of machine %s", server.ID)
+		}
+		result = append(result, remoteController{
+			machineID: string(server.ID),
+			remote:    ssh.remote(string(server.ID), host),
+		})
+	}
+	return result, nil
+}
+
+// checkRemoteAgents makes sure the machine agent on every other
+// controller is stopped, or will be stopped by the remote run when
+// --stop-agent was given. It checks them all before anything is
+// changed so that a problem with one machine is found up front.
+func (c *rebootstrapCommand) checkRemoteAgents(controllers []remoteController) error {
+	var problems []string
+	for _, controller := range controllers {
+		service := remoteAgentService(controller.remote, controller.machineID)
+		// is-active exits non-zero for a stopped service, so look
+		// at what it printed rather than the error.
+		out, err := controller.remote.Run("systemctl", "is-active", service)
+		state := strings.TrimSpace(string(out))
+		switch state {
+		case "inactive", "failed", "unknown":
+			logger.Infof("%s on %s is not running.", service, controller.remote)
+		case "active", "activating", "deactivating", "reloading":
+			if !c.stopAgent {
+				problems = append(problems, service+" is running on "+controller.remote.String())
+			}
+		default:
+			if err == nil {
+				err = errors.Errorf("unexpected state %q", state)
+			}
+			problems = append(problems, "checking "+service+" on "+controller.remote.String()+": "+err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("other controllers aren't ready (stop their agents or use --stop-agent):\n  %s",
+			strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// checkPeerStores looks for raft directories left on the other
+// controllers, returning a warning for each one that still has one
+// (or couldn't be checked). A peer that keeps its old store will
+// contradict the configuration written here when it starts.
+func checkPeerStores(controllers []remoteController, raftDir string) []string {
+	var warnings []string
+	for _, controller := range controllers {
+		out, err := controller.remote.Run("sh", "-c", `if [ -e "$1" ]; then echo present; fi`, "sh", raftDir)
+		switch {
+		case err != nil:
+			warnings = append(warnings, fmt.Sprintf("can't check %s on machine %s (%s): %v",
+				raftDir, controller.machineID, controller.remote, err))
+		case strings.TrimSpace(string(out)) == "present":
+			warnings = append(warnings, fmt.Sprintf("machine %s (%s) still has %s - move it aside or rebootstrap it too",
+				controller.machineID, controller.remote, raftDir))
+		default:
+			logger.Infof("%s has been removed on machine %s.", raftDir, controller.machineID)
+		}
+	}
+	return warnings
+}
+
+// startRemoteAgents starts the machine agent on each of the other
+// controllers, once all of their stores have been written, recording
+// it in their results. It stops at the first failure.
+func startRemoteAgents(controllers []remoteController, results []controllerResult) error {
+	for i, controller := range controllers {
+		service := remoteAgentService(controller.remote, controller.machineID)
+		logger.Infof("Starting %s on %s.", service, controller.remote)
+		if _, err := controller.remote.Run("systemctl", "start", service); err != nil {
+			return errors.Annotatef(err, "starting %s on %s", service, controller.remote)
+		}
+		results[i].AgentRestarted = true
+	}
+	return nil
+}
+
+// bootstrapRemotes copies this tool to each of the other controllers
+// and runs the bootstrap there, stopping at the first failure. Each
+// run must come up with the same configuration as this one.
+func (c *rebootstrapCommand) bootstrapRemotes(controllers []remoteController, servers raft.Configuration) ([]controllerResult, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, errors.Annotate(err, "finding this executable")
+	}
+	expected := c.serverResults(servers)
+
+	var results []controllerResult
+	for _, controller := range controllers {
+		result := controllerResult{
+			MachineID: controller.machineID,
+			Host:      controller.remote.String(),
+		}
+		done := c.progress.start("Bootstrapping machine " + controller.machineID + " on " + controller.remote.String())
+		remoteResult, err := c.bootstrapRemote(controller, self)
+		if err == nil && !sameServers(remoteResult.Servers, expected) {
+			err = errors.Errorf("generated a different configuration: %v", remoteResult.Servers)
+		}
+		done(err)
+		if err != nil {
+			result.Error = err.Error()
+			results = append(results, result)
+			return results, errors.Annotatef(err, "machine %s on %s", controller.machineID, controller.remote)
+		}
+		result.Written = remoteResult.Written
+		result.Backup = remoteResult.Backup
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (c *rebootstrapCommand) bootstrapRemote(controller remoteController, self string) (*bootstrapResult, error) {
+	path, remove, err := pushFile(controller.remote, self, "rebootstrap-raft")
+	if err != nil {
+		return nil, errors.Annotate(err, "copying rebootstrap-raft")
+	}
+	defer remove()
+	return runRemoteBootstrap(controller.remote, path, c.remoteArgs(controller.machineID)...)
+}
+
+// remoteArgs returns the flags for bootstrapping machineID the same
+// way as this machine from another one. The remote run reads its
+// MongoDB password from its own agent.conf. The machines dropped here
+// have already been agreed to, so the remote run may drop them too.
+func (c *rebootstrapCommand) remoteArgs(machineID string) []string {
+	args := append(c.bootstrapFlags(machineID),
+		"--yes",
+		"--quiet",
+		"--format", "json",
+	)
+	if len(c.dropped) > 0 {
+		args = append(args, "--confirm-dropped", strings.Join(c.dropped, ","))
+	}
+	return args
+}
+
+// bootstrapFlags returns the flags for bootstrapping machineID with
+// the same settings as this run. Any existing raft directory is
+// backed up. The agent isn't restarted: that waits until every
+// controller has been done.
+func (c *rebootstrapCommand) bootstrapFlags(machineID string) []string {
+	args := []string{
+		"--machine-id", machineID,
+		"--force",
+		"--api-port", strconv.Itoa(c.apiPort),
+		"--min-voters", strconv.Itoa(c.minVoters),
+		"--log-store", c.logStoreType,
+		"--snapshot-retain", strconv.Itoa(c.snapshotRetain),
+		"--raft-protocol-version", strconv.Itoa(c.protocolVersion),
+		"--start-index", strconv.FormatUint(c.startIndex, 10),
+		"--start-term", strconv.FormatUint(c.startTerm, 10),
+		"--owner", c.ownerSpec,
+		"--store-timeout", c.storeTimeout.String(),
+	}
+	if c.extendLeases > 0 {
+		args = append(args, "--extend-leases", c.extendLeases.String())
+	}
+	if c.addressScope != "" {
+		args = append(args, "--address-scope", c.addressScope)
+	}
+	if c.addressFamily != rebootstrap.FamilyAny {
+		args = append(args, "--address-family", c.addressFamily)
+	}
+	if c.advertise != "" {
+		args = append(args, "--advertise-address", c.advertise)
+	}
+	if c.idScheme != "" {
+		args = append(args, "--server-id-scheme", c.idScheme)
+	}
+	if c.expectServers != 0 {
+		args = append(args, "--expect-controllers", strconv.Itoa(c.expectServers))
+	}
+	if c.replicaSetName != rebootstrap.ReplicaSetName {
+		args = append(args, "--replica-set-name", c.replicaSetName)
+	}
+	for _, flag := range []struct {
+		name string
+		set  bool
+	}{
+		{"--allow-even-voters", c.allowEvenVoters},
+		{"--seed-leases", c.seedLeases},
+		{"--expire-leases", c.expireLeases},
+		{"--skip-version-check", c.skipVersionCheck},
+		{"--stop-agent", c.stopAgent},
+		{"--drop-unreachable", c.dropUnreachable},
+		{"--no-sync", c.noSync},
+		{"--allow-network-fs", c.allowNetworkFS},
+		{"--keyfile-fallback", c.keyfileFallback},
+		{"--select-addresses", c.selectAddresses},
+		{"--replicaset-votes", c.replicasetVotes},
+		{"--prefer-ipv4", c.preferIPv4},
+		{"--prefer-ipv6", c.preferIPv6},
+		{"--fips", c.fips},
+	} {
+		if flag.set {
+			args = append(args, flag.name)
+		}
+	}
+	return args
+}
@@ -0,0 +1,193 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/replicaset"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+// outputSchemaVersion is the schema-version given in the JSON and
+// YAML output and in events. Within a version fields are only ever
+// added, never renamed, removed or given a different meaning, so
+// scripts should ignore fields they don't know. Anything else bumps
+// the version.
+const outputSchemaVersion = 1
+
+// bootstrapResult is the outcome of a bootstrap run, written to
+// stdout in the format chosen with --format.
+type bootstrapResult struct {
+	SchemaVersion  int            `json:"schema-version" yaml:"schema-version"`
+	RaftDir        string         `json:"raft-dir" yaml:"raft-dir"`
+	DryRun         bool           `json:"dry-run" yaml:"dry-run"`
+	Written        bool           `json:"written" yaml:"written"`
+	Servers        []serverResult `json:"servers" yaml:"servers"`
+	StartIndex     uint64         `json:"start-index" yaml:"start-index"`
+	StartTerm      uint64         `json:"start-term" yaml:"start-term"`
+	SnapshotBytes  int            `json:"snapshot-bytes,omitempty" yaml:"snapshot-bytes,omitempty"`
+	Dropped        []string       `json:"dropped,omitempty" yaml:"dropped,omitempty"`
+	Backup         string         `json:"backup,omitempty" yaml:"backup,omitempty"`
+	AgentRestarted bool           `json:"agent-restarted,omitempty" yaml:"agent-restarted,omitempty"`
+	AgentHealthy   bool           `json:"agent-healthy,omitempty" yaml:"agent-healthy,omitempty"`
+	Phases         []phaseTiming  `json:"phases,omitempty" yaml:"phases,omitempty"`
+
+	// Error says why the run failed, if it did, and what to do
+	// about it.
+	Error *errorResult `json:"error,omitempty" yaml:"error,omitempty"`
+
+	// Controllers holds the results for the other controllers
+	// when --all-controllers is used.
+	Controllers []controllerResult `json:"controllers,omitempty" yaml:"controllers,omitempty"`
+
+	// Scripts holds the paths of the scripts written by
+	// --emit-scripts.
+	Scripts []string `json:"scripts,omitempty" yaml:"scripts,omitempty"`
+
+	// PeersJSON is the file written by --emit-peers-json.
+	PeersJSON string `json:"peers-json,omitempty" yaml:"peers-json,omitempty"`
+
+	// localID and color are only used by the text format, to mark
+	// this machine and colour the table.
+	localID string
+	color   bool
+}
+
+// serverResult describes one server in the generated configuration.
+type serverResult struct {
+	ID       string `json:"id" yaml:"id"`
+	Address  string `json:"address" yaml:"address"`
+	Suffrage string `json:"suffrage" yaml:"suffrage"`
+	Source   string `json:"source,omitempty" yaml:"source,omitempty"`
+	Member   string `json:"member,omitempty" yaml:"member,omitempty"`
+
+	// Explanation says how the server's id, address and suffrage
+	// were arrived at. It's only filled in with --explain.
+	Explanation []string `json:"explanation,omitempty" yaml:"explanation,omitempty"`
+}
+
+// writeRunResult writes result and returns runErr, the run's own
+// error, so a failure part way through still reports what was done.
+// The failure to write is only returned if the run succeeded.
+func writeRunResult(ctx *cmd.Context, out *cmd.Output, result interface{}, runErr error) error {
+	if err := out.Write(ctx, result); err != nil && runErr == nil {
+		return err
+	}
+	return runErr
+}
+
+func makeServerResults(servers raft.Configuration) []serverResult {
+	results := make([]serverResult, len(servers.Servers))
+	for i, server := range servers.Servers {
+		results[i] = serverResult{
+			ID:       string(server.ID),
+			Address:  string(server.Address),
+			Suffrage: server.Suffrage.String(),
+		}
+	}
+	return results
+}
+
+// sameServers reports whether a and b describe the same
+// configuration: the same servers, in the same order, with the same
+// addresses and suffrage. How each was arrived at isn't compared,
+// since that's only explained where --explain was given.
+func sameServers(a, b []serverResult) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].ID != b[i].ID || a[i].Address != b[i].Address || a[i].Suffrage != b[i].Suffrage {
+			return false
+		}
+	}
+	return true
+}
+
+// memberResult describes a replicaset member as read from MongoDB.
+type memberResult struct {
+	ID        int    `json:"id" yaml:"id"`
+	Address   string `json:"address" yaml:"address"`
+	MachineID string `json:"machine-id,omitempty" yaml:"machine-id,omitempty"`
+	Votes     *int   `json:"votes,omitempty" yaml:"votes,omitempty"`
+}
+
+func makeMemberResults(members []replicaset.Member) []memberResult {
+	results := make([]memberResult, len(members))
+	for i, member := range members {
+		results[i] = memberResult{
+			ID:        member.Id,
+			Address:   member.Address,
+			MachineID: member.Tags[rebootstrap.MachineIDTag],
+			Votes:     member.Votes,
+		}
+	}
+	return results
+}
+
+// outputFormatters are the formats available with --format; text is
+// meant for people and the others for scripts.
+var outputFormatters = map[string]cmd.Formatter{
+	"text": formatText,
+	"json": cmd.FormatJson,
+	"yaml": cmd.FormatYaml,
+}
+
+func formatText(writer io.Writer, value interface{}) error {
+	result, ok := value.(*bootstrapResult)
+	if !ok {
+		return errors.Errorf("expected *bootstrapResult, got %T", value)
+	}
+	switch {
+	case result.DryRun:
+		fmt.Fprintf(writer, "Dry run - would write %s with servers:\n", result.RaftDir)
+	case result.Written:
+		fmt.Fprintf(writer, "Wrote %s with servers:\n", result.RaftDir)
+	default:
+		fmt.Fprintf(writer, "Nothing written to %s.\n", result.RaftDir)
+		return nil
+	}
+	if err := writeServerTable(writer, "  ", result.Servers, result.localID, result.color); err != nil {
+		return errors.Trace(err)
+	}
+	for _, server := range result.Servers {
+		if len(server.Explanation) > 0 {
+			fmt.Fprintf(writer, "Where each server came from:\n")
+			writeExplanations(writer, "  ", result.Servers)
+			break
+		}
+	}
+	if result.Backup != "" {
+		fmt.Fprintf(writer, "The previous raft directory is in %s.\n", result.Backup)
+	}
+	if result.AgentHealthy {
+		fmt.Fprintf(writer, "The machine agent's raft workers are running.\n")
+	}
+	for _, controller := range result.Controllers {
+		switch {
+		case controller.Error != "":
+			fmt.Fprintf(writer, "Machine %s on %s failed: %s\n", controller.MachineID, controller.Host, controller.Error)
+		case controller.AgentRestarted:
+			fmt.Fprintf(writer, "Machine %s on %s written and its agent started.\n", controller.MachineID, controller.Host)
+		case controller.Written:
+			fmt.Fprintf(writer, "Machine %s on %s written.\n", controller.MachineID, controller.Host)
+		}
+	}
+	if len(result.Scripts) > 0 {
+		fmt.Fprintf(writer, "Run each script on its controller machine:\n")
+		for _, path := range result.Scripts {
+			fmt.Fprintf(writer, "  %s\n", path)
+		}
+	}
+	if result.PeersJSON != "" {
+		fmt.Fprintf(writer, "Wrote the configuration to %s. jujud doesn't read peers.json itself: apply it with a tool that calls raft's RecoverCluster, or make the same change with remove-member, add-member and set-suffrage.\n", result.PeersJSON)
+	}
+	return nil
+}
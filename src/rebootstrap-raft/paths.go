@@ -0,0 +1,164 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+)
+
+// snapHostfs is where snapd mounts the host's root filesystem inside
+// a strictly confined snap.
+const snapHostfs = "/var/lib/snapd/hostfs"
+
+// dataDirCandidates are the places the juju data directory is found,
+// relative to the host root, in order of preference. On Ubuntu Core
+// the root filesystem is read-only and the writable part of /var/lib
+// only shows up under /writable/system-data when the host filesystem
+// is viewed from inside a snap.
+var dataDirCandidates = []string{
+	"/var/lib/juju",
+	"/writable/system-data/var/lib/juju",
+}
+
+// inSnap reports whether we're running inside a snap.
+func inSnap() bool {
+	return os.Getenv("SNAP") != ""
+}
+
+// detectHostfsPrefix returns the prefix needed to reach the host's
+// filesystem from this process: the snapd hostfs mount when running
+// inside a snap, or "" otherwise. Inside a snap without the hostfs
+// mount there's no way to reach the host's files, so that's an error.
+func detectHostfsPrefix() (string, error) {
+	if !inSnap() {
+		return "", nil
+	}
+	if _, err := os.Stat(snapHostfs); err != nil {
+		return "", errors.Errorf("running in a snap but the host filesystem isn't at %q - use --hostfs-prefix to say where it's mounted", snapHostfs)
+	}
+	return snapHostfs, nil
+}
+
+// checkSnapAccess makes sure the agents directory in dataDir can be
+// read. Confinement denies access to the host's files unless the
+// snap's system-files interface is connected, which otherwise shows
+// up much later as a confusing failure to read agent.conf.
+func checkSnapAccess(dataDir string) error {
+	dir, err := os.Open(filepath.Join(dataDir, "agents"))
+	if err == nil {
+		_, err = dir.Readdirnames(1)
+		dir.Close()
+	}
+	if err == nil || !os.IsPermission(err) {
+		return nil
+	}
+	name := os.Getenv("SNAP_NAME")
+	return errors.Errorf(
+		"can't read %q from inside the %s snap: %v\n"+
+			"The snap's system-files interface probably isn't connected. "+
+			"Check with \"snap connections %s\" and connect it with \"sudo snap connect %s:<plug>\".",
+		dataDir, name, err, name, name,
+	)
+}
+
+// detectDataDir returns the juju data directory, as a path that can be
+// opened from this process, by looking for an agents directory in
+// each candidate location under the hostfs prefix.
+func detectDataDir(hostfsPrefix string) (string, error) {
+	for _, candidate := range dataDirCandidates {
+		dir := filepath.Join(hostfsPrefix, candidate)
+		if _, err := os.Stat(filepath.Join(dir, "agents")); err == nil {
+			return dir, nil
+		}
+	}
+	return "", errors.NotFoundf("juju data directory under %q", filepath.Join("/", hostfsPrefix))
+}
+
+// dataDirFlags holds the flags locating the juju data directory,
+// shared by the commands that work on the local controller.
+type dataDirFlags struct {
+	dataDir      string
+	hostfsPrefix string
+
+	// agentConf is the agent.conf to use instead of the one in the
+	// data directory.
+	agentConf string
+}
+
+func (d *dataDirFlags) setFlags(f *gnuflag.FlagSet) {
+	f.StringVar(&d.dataDir, "data-dir", "", "juju data directory on the host (default: detected)")
+	f.StringVar(&d.hostfsPrefix, "hostfs-prefix", "", "where the host filesystem is mounted (default: detected)")
+	f.StringVar(&d.agentConf, "agent-conf", "", "the machine agent's agent.conf (default: agents/machine-<id>/agent.conf in the data directory)")
+}
+
+// resolve fills in the hostfs prefix and data directory if they
+// weren't given, and makes the data directory reachable from this
+// process.
+func (d *dataDirFlags) resolve() error {
+	if d.hostfsPrefix == "" {
+		prefix, err := detectHostfsPrefix()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		d.hostfsPrefix = prefix
+	} else if _, err := os.Stat(d.hostfsPrefix); err != nil {
+		return errors.Annotate(err, "checking --hostfs-prefix")
+	}
+	if d.dataDir != "" {
+		d.dataDir = filepath.Join(d.hostfsPrefix, d.dataDir)
+	} else if dataDir, err := detectDataDir(d.hostfsPrefix); err == nil {
+		d.dataDir = dataDir
+	} else {
+		d.dataDir = filepath.Join(d.hostfsPrefix, dataDirCandidates[0])
+		logger.Warningf("%v, using %q", err, d.dataDir)
+	}
+	logger.Debugf("using juju data directory %q", d.dataDir)
+	if d.agentConf != "" {
+		if _, err := os.Stat(d.agentConf); err != nil {
+			return errors.Annotate(err, "checking --agent-conf")
+		}
+	}
+	if inSnap() {
+		return errors.Trace(checkSnapAccess(d.dataDir))
+	}
+	return nil
+}
+
+// resolveStore does the setup shared by the commands that work on a
+// machine's existing store: it checks --machine-id was given, resolves
+// the data directory and fills in the raft directory and the agent's
+// service if they weren't given.
+func (d *dataDirFlags) resolveStore(machineID string, raftDir, agentService *string) error {
+	if machineID == "" {
+		return errors.Errorf("--machine-id is required")
+	}
+	if err := d.resolve(); err != nil {
+		return errors.Trace(err)
+	}
+	if *raftDir == "" {
+		*raftDir = d.getJujuPath("raft")
+	}
+	if *agentService == "" {
+		*agentService = localAgentService(machineID)
+	}
+	return nil
+}
+
+// getJujuPath returns the path of elem inside the juju data directory.
+func (d *dataDirFlags) getJujuPath(elem ...string) string {
+	return filepath.Join(append([]string{d.dataDir}, elem...)...)
+}
+
+// agentConfFile returns the path of the agent.conf for machineID: the
+// one given with --agent-conf, or the one in the data directory.
+func (d *dataDirFlags) agentConfFile(machineID string) string {
+	if d.agentConf != "" {
+		return d.agentConf
+	}
+	return agentConfPath(d.dataDir, machineID)
+}
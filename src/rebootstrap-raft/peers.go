@@ -0,0 +1,225 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/replicaset"
+	"gopkg.in/mgo.v2"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+// peerStatus records whether a raft server's address could be dialled.
+type peerStatus struct {
+	Server raft.Server
+	Err    error
+}
+
+// checkPeers dials the address of every server other than localID in
+// parallel and returns the result for each, in configuration order.
+// The local machine is skipped because its agent should be stopped,
+// so nothing will be listening on its API port.
+func checkPeers(servers raft.Configuration, localID raft.ServerID, timeout time.Duration) []peerStatus {
+	var results []peerStatus
+	for _, server := range servers.Servers {
+		if server.ID != localID {
+			results = append(results, peerStatus{Server: server})
+		}
+	}
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(status *peerStatus) {
+			defer wg.Done()
+			conn, err := net.DialTimeout("tcp", string(status.Server.Address), timeout)
+			if err == nil {
+				conn.Close()
+			}
+			status.Err = err
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+// reportPeers logs the result of checking each peer.
+func reportPeers(results []peerStatus) {
+	for _, result := range results {
+		if result.Err != nil {
+			logger.Warningf("machine %s at %s is not reachable: %v", result.Server.ID, result.Server.Address, result.Err)
+		} else {
+			logger.Infof("machine %s at %s is reachable", result.Server.ID, result.Server.Address)
+		}
+	}
+}
+
+// unreachableMembers returns the replicaset members other than the
+// local machine that look permanently gone: the primary reports them
+// unhealthy and their MongoDB port can't be dialled either. The raft
+// API port isn't used because the other controllers' agents will
+// usually be stopped too.
+func unreachableMembers(ctx context.Context, session *mgo.Session, members []replicaset.Member, localID string, timeout time.Duration) ([]replicaset.Member, error) {
+	var status *replicaset.Status
+	err := rebootstrap.WithSession(ctx, session, func(s *mgo.Session) error {
+		var err error
+		status, err = replicaset.CurrentStatus(s)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Annotate(err, "getting replica set status")
+	}
+	healthy := make(map[int]bool)
+	for _, member := range status.Members {
+		healthy[member.Id] = member.Healthy
+	}
+
+	var unreachable []replicaset.Member
+	for _, member := range members {
+		if member.Tags[rebootstrap.MachineIDTag] == localID || healthy[member.Id] {
+			continue
+		}
+		conn, err := net.DialTimeout("tcp", member.Address, timeout)
+		if err == nil {
+			conn.Close()
+			logger.Warningf("member %d (%s) is unhealthy but its MongoDB port answers - keeping it", member.Id, member.Address)
+			continue
+		}
+		logger.Warningf("member %d (%s) is unreachable: %v", member.Id, member.Address, err)
+		unreachable = append(unreachable, member)
+	}
+	return unreachable, nil
+}
+
+// withoutMembers returns members less those in drop.
+func withoutMembers(members, drop []replicaset.Member) []replicaset.Member {
+	dropped := make(map[int]bool)
+	for _, member := range drop {
+		dropped[member.Id] = true
+	}
+	var kept []replicaset.Member
+	for _, member := range members {
+		if !dropped[member.Id] {
+			kept = append(kept, member)
+		}
+	}
+	return kept
+}
+
+// checkDropped makes sure the machines being left out of the cluster
+// were agreed to. Those not named with --confirm-dropped have to be
+// confirmed at the prompt: --yes (and so --ansible) only covers
+// writing the store, so without a prompt they stop the run.
+func (c *rebootstrapCommand) checkDropped(ctx *cmd.Context) error {
+	unconfirmed := unconfirmedDrops(c.dropped, c.confirmDropped)
+	if len(unconfirmed) == 0 {
+		return nil
+	}
+	if c.yes {
+		return withExitCode(errors.Errorf("machines %s would be left out of the cluster; name them with --confirm-dropped to drop them without asking",
+			strings.Join(unconfirmed, ", ")), exitValidation)
+	}
+	ok, err := confirm(ctx, fmt.Sprintf("Really leave machines %s out of the cluster?", strings.Join(unconfirmed, ", ")))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !ok {
+		return errors.New("aborted")
+	}
+	return nil
+}
+
+// unconfirmedDrops returns the machines in dropped that aren't in
+// confirmed, a comma-separated list of machine ids.
+func unconfirmedDrops(dropped []string, confirmed string) []string {
+	named := make(map[string]bool)
+	for _, id := range strings.Split(confirmed, ",") {
+		named[strings.TrimSpace(id)] = true
+	}
+	var unconfirmed []string
+	for _, id := range dropped {
+		if !named[id] {
+			unconfirmed = append(unconfirmed, id)
+		}
+	}
+	return unconfirmed
+}
+
+// writeDropFollowUp tells the operator how to finish removing the
+// controllers left out of the configuration, which are still
+// replicaset members and controller machines as far as Juju knows.
+func writeDropFollowUp(w io.Writer, dropped []string) {
+	if len(dropped) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "Machines %s were left out of the raft configuration. Once the controller is back,\n", strings.Join(dropped, ", "))
+	fmt.Fprintln(w, "remove them properly and restore HA with:")
+	for _, id := range dropped {
+		fmt.Fprintf(w, "  juju remove-machine -m controller %s --force\n", id)
+	}
+	fmt.Fprintln(w, "  juju enable-ha")
+}
+
+// checkServerNames resolves every server address that's a hostname
+// rather than an IP, returning a warning for each that doesn't resolve
+// or that resolves to none of the addresses of the replicaset member
+// it was made from: jujud's raft transport would be unable to dial it
+// later.
+func checkServerNames(ctx context.Context, servers raft.Configuration, origins map[raft.ServerID]serverOrigin, timeout time.Duration) []string {
+	var warnings []string
+	for _, server := range servers.Servers {
+		host, _, err := net.SplitHostPort(string(server.Address))
+		if err != nil || net.ParseIP(host) != nil {
+			continue
+		}
+		resolved, err := lookupHost(ctx, host, timeout)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("machine %s's address %q doesn't resolve (%v) - its peers won't be able to dial it", server.ID, host, err))
+			continue
+		}
+		memberHost := origins[server.ID].memberHost
+		if memberHost == "" || memberHost == host {
+			continue
+		}
+		memberAddresses := []string{memberHost}
+		if net.ParseIP(memberHost) == nil {
+			if memberAddresses, err = lookupHost(ctx, memberHost, timeout); err != nil {
+				continue
+			}
+		}
+		if !sharesAddress(resolved, memberAddresses) {
+			warnings = append(warnings, fmt.Sprintf("machine %s's address %q resolves to %s, but its replicaset member is at %s",
+				server.ID, host, strings.Join(resolved, ", "), strings.Join(memberAddresses, ", ")))
+		}
+	}
+	return warnings
+}
+
+func lookupHost(ctx context.Context, host string, timeout time.Duration) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return net.DefaultResolver.LookupHost(ctx, host)
+}
+
+// sharesAddress says whether any IP appears in both lists.
+func sharesAddress(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if ipX, ipY := net.ParseIP(x), net.ParseIP(y); ipX != nil && ipX.Equal(ipY) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnconfirmedDrops(t *testing.T) {
+	for _, test := range []struct {
+		about     string
+		dropped   []string
+		confirmed string
+		expect    []string
+	}{{
+		about: "nothing dropped",
+	}, {
+		about:   "none confirmed",
+		dropped: []string{"1", "2"},
+		expect:  []string{"1", "2"},
+	}, {
+		about:     "all confirmed",
+		dropped:   []string{"1", "2"},
+		confirmed: "2, 1",
+	}, {
+		about:     "one confirmed",
+		dropped:   []string{"1", "2"},
+		confirmed: "2,3",
+		expect:    []string{"1"},
+	}} {
+		t.Run(test.about, func(t *testing.T) {
+			got := unconfirmedDrops(test.dropped, test.confirmed)
+			if !reflect.DeepEqual(got, test.expect) {
+				t.Errorf("got %v, want %v", got, test.expect)
+			}
+		})
+	}
+}
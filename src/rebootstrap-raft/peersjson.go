@@ -0,0 +1,55 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/errors"
+)
+
+// peersJSONServer is a server as hashicorp raft's peers.json recovery
+// file lists it for protocol version 3 and later, which is what
+// raft.ReadConfigJSON reads.
+type peersJSONServer struct {
+	ID       raft.ServerID      `json:"id"`
+	Address  raft.ServerAddress `json:"address"`
+	NonVoter bool               `json:"non_voter"`
+}
+
+// writePeersJSON writes servers to path in the peers.json format for
+// the given raft protocol version: a list of servers for version 3
+// and later, or a list of addresses (read with raft.ReadPeersJSON)
+// for older ones, where servers have no separate IDs or suffrage.
+func writePeersJSON(path string, servers raft.Configuration, protocolVersion int) error {
+	var peers interface{}
+	if protocolVersion >= 3 {
+		list := make([]peersJSONServer, len(servers.Servers))
+		for i, server := range servers.Servers {
+			list[i] = peersJSONServer{
+				ID:       server.ID,
+				Address:  server.Address,
+				NonVoter: server.Suffrage != raft.Voter,
+			}
+		}
+		peers = list
+	} else {
+		list := make([]raft.ServerAddress, len(servers.Servers))
+		for i, server := range servers.Servers {
+			list[i] = server.Address
+		}
+		peers = list
+	}
+	data, err := json.MarshalIndent(peers, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0600); err != nil {
+		return errors.Trace(err)
+	}
+	logger.Infof("Wrote %s.", path)
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/raft"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+func TestWritePeersJSON(t *testing.T) {
+	servers := rebootstrap.ApplyIDScheme(raft.Configuration{Servers: []raft.Server{
+		{ID: "0", Address: "10.0.0.1:17070", Suffrage: raft.Voter},
+		{ID: "1", Address: "10.0.0.2:17070", Suffrage: raft.Nonvoter},
+	}}, rebootstrap.IDSchemeTag)
+	for _, test := range []struct {
+		protocolVersion int
+		want            string
+	}{{
+		protocolVersion: 3,
+		want: `[
+  {
+    "id": "machine-0",
+    "address": "10.0.0.1:17070",
+    "non_voter": false
+  },
+  {
+    "id": "machine-1",
+    "address": "10.0.0.2:17070",
+    "non_voter": true
+  }
+]
+`,
+	}, {
+		protocolVersion: 2,
+		want: `[
+  "10.0.0.1:17070",
+  "10.0.0.2:17070"
+]
+`,
+	}} {
+		path := filepath.Join(t.TempDir(), "peers.json")
+		if err := writePeersJSON(path, servers, test.protocolVersion); err != nil {
+			t.Fatalf("writePeersJSON: %v", err)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != test.want {
+			t.Errorf("protocol version %d: got\n%s\nwant\n%s", test.protocolVersion, data, test.want)
+		}
+	}
+}
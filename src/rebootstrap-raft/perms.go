@@ -0,0 +1,157 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/juju/errors"
+)
+
+const (
+	// raftDirMode and raftFileMode are the permissions the machine
+	// agent creates its raft directory and files with.
+	raftDirMode  = 0700
+	raftFileMode = 0600
+)
+
+// ownership holds the numeric owner and group for the raft directory.
+type ownership struct {
+	uid int
+	gid int
+}
+
+// parseOwnership parses an owner specification of the form
+// user[:group], where each part is a name or a numeric id. If the
+// group is omitted the user's primary group is used.
+func parseOwnership(spec string) (ownership, error) {
+	userPart, groupPart := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		userPart, groupPart = spec[:i], spec[i+1:]
+	}
+	u, err := lookupUser(userPart)
+	if err != nil {
+		return ownership{}, errors.Annotatef(err, "looking up user %q", userPart)
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return ownership{}, errors.Trace(err)
+	}
+	gidStr := u.Gid
+	if groupPart != "" {
+		g, err := lookupGroup(groupPart)
+		if err != nil {
+			return ownership{}, errors.Annotatef(err, "looking up group %q", groupPart)
+		}
+		gidStr = g.Gid
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return ownership{}, errors.Trace(err)
+	}
+	return ownership{uid: uid, gid: gid}, nil
+}
+
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return user.LookupId(name)
+	}
+	return user.Lookup(name)
+}
+
+func lookupGroup(name string) (*user.Group, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return user.LookupGroupId(name)
+	}
+	return user.LookupGroup(name)
+}
+
+// applyOwnership sets the owner and modes of everything under dir to
+// what the machine agent expects.
+func applyOwnership(dir string, owner ownership) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := os.Lchown(path, owner.uid, owner.gid); err != nil {
+			return errors.Trace(err)
+		}
+		return errors.Trace(os.Chmod(path, raftMode(info)))
+	})
+}
+
+// applyModes sets the modes of everything under dir to what the
+// machine agent expects, leaving the owner alone.
+func applyModes(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return errors.Trace(os.Chmod(path, raftMode(info)))
+	})
+}
+
+func raftMode(info os.FileInfo) os.FileMode {
+	if info.IsDir() {
+		return raftDirMode
+	}
+	return raftFileMode
+}
+
+// ownershipProblem is a path under a raft directory whose owner or
+// mode isn't what the machine agent expects.
+type ownershipProblem struct {
+	path    string
+	problem string
+}
+
+// auditOwnership lists the paths under dir whose owner or mode differ
+// from what applyOwnership would set.
+func auditOwnership(dir string, owner ownership) ([]ownershipProblem, error) {
+	var problems []ownershipProblem
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		var found []string
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && (int(stat.Uid) != owner.uid || int(stat.Gid) != owner.gid) {
+			found = append(found, fmt.Sprintf("owned by %d:%d, expected %d:%d", stat.Uid, stat.Gid, owner.uid, owner.gid))
+		}
+		if mode := raftMode(info); info.Mode()&os.ModeSymlink == 0 && info.Mode().Perm() != mode {
+			found = append(found, fmt.Sprintf("mode %v, expected %v", info.Mode().Perm(), mode))
+		}
+		if len(found) > 0 {
+			problems = append(problems, ownershipProblem{path: path, problem: strings.Join(found, ", ")})
+		}
+		return nil
+	})
+	return problems, errors.Trace(err)
+}
+
+// checkParentOwnership warns if the directory the raft directory
+// lives in isn't owned by the expected owner or can be written by
+// other users, since either usually means the data dir has been set
+// up differently from what the machine agent expects.
+func checkParentOwnership(raftDir string, owner ownership) {
+	parent := filepath.Dir(raftDir)
+	info, err := os.Stat(parent)
+	if err != nil {
+		logger.Warningf("can't check ownership of %q: %v", parent, err)
+		return
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		if int(stat.Uid) != owner.uid || int(stat.Gid) != owner.gid {
+			logger.Warningf("%q is owned by %d:%d, expected %d:%d", parent, stat.Uid, stat.Gid, owner.uid, owner.gid)
+		}
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		logger.Warningf("%q is writable by other users (mode %v)", parent, info.Mode().Perm())
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+)
+
+const pluginDoc = `
+
+Rebootstrap raft on every controller machine from a Juju client,
+using juju ssh and juju scp so no ssh keys for the controllers are
+needed. Installed on the PATH as juju-rebootstrap-raft, this runs as
+"juju rebootstrap-raft".
+
+The tool is copied to each controller machine and run there with a
+dry run first; if every machine generates the same configuration it's
+shown for confirmation and then each machine is bootstrapped in turn.
+Arguments after -- are passed to the bootstrap run on every machine.
+
+`
+
+// pluginName is the name this tool is installed under to be found as
+// a juju plugin.
+const pluginName = "juju-rebootstrap-raft"
+
+// pluginArgs returns the arguments to run with when invoked as a juju
+// plugin. Juju asks plugins for a description with --description, which
+// the super command answers; everything else goes to the plugin
+// subcommand.
+func pluginArgs(args []string) []string {
+	if len(args) == 1 && args[0] == "--description" {
+		return args
+	}
+	return append([]string{"plugin"}, args...)
+}
+
+type pluginCommand struct {
+	cmd.CommandBase
+	logFlags
+	controller   string
+	machines     string
+	dryRun       bool
+	yes          bool
+	stopAgent    bool
+	restartAgent bool
+	extraArgs    []string
+}
+
+// Info is part of cmd.Command.
+func (c *pluginCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "plugin",
+		Args:    "[-- <bootstrap flags>]",
+		Purpose: "Rebootstrap every controller through the juju client.",
+		Doc:     strings.TrimSpace(pluginDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *pluginCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	c.logFlags.setFlags(f)
+	f.StringVar(&c.controller, "c", "", "controller to operate on (default: current controller)")
+	f.StringVar(&c.controller, "controller", "", "")
+	f.StringVar(&c.machines, "machines", "", "comma-separated controller machine ids (default: the controller machines juju show-controller lists)")
+	f.BoolVar(&c.dryRun, "dry-run", false, "show the plan for each machine but don't bootstrap")
+	f.BoolVar(&c.yes, "yes", false, "don't ask for confirmation before writing")
+	f.BoolVar(&c.stopAgent, "stop-agent", false, "stop each machine agent if it's running")
+	f.BoolVar(&c.restartAgent, "restart-agent", false, "start the machine agents once every store is written")
+}
+
+// Init is part of cmd.Command.
+func (c *pluginCommand) Init(args []string) error {
+	if err := c.setupLogging(false); err != nil {
+		return errors.Trace(err)
+	}
+	c.extraArgs = args
+	return nil
+}
+
+// jujuModel returns the -m argument naming the controller model.
+func (c *pluginCommand) jujuModel() string {
+	return controllerModel(c.controller)
+}
+
+// controllerModel returns the juju -m argument for the controller
+// model of the named controller, or of the current one.
+func controllerModel(controller string) string {
+	if controller == "" {
+		return "controller"
+	}
+	return controller + ":controller"
+}
+
+// Run is part of cmd.Command.
+func (c *pluginCommand) Run(ctx *cmd.Context) error {
+	c.setupOutput(ctx)
+	progress := newProgress(ctx.Stderr, c.quiet)
+
+	machineIDs, err := c.machineIDs()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return errors.Annotate(err, "finding this executable")
+	}
+
+	remotes := make(map[string]remote)
+	paths := make(map[string]string)
+	for _, id := range machineIDs {
+		r := &jujuRemote{model: c.jujuModel(), machine: id}
+		done := progress.start("Copying rebootstrap-raft to machine " + id)
+		path, remove, err := pushFile(r, self, "rebootstrap-raft")
+		done(err)
+		if err != nil {
+			return errors.Annotatef(err, "machine %s", id)
+		}
+		defer remove()
+		remotes[id], paths[id] = r, path
+	}
+
+	var plan []serverResult
+	for _, id := range machineIDs {
+		done := progress.start("Planning machine " + id)
+		result, err := c.runBootstrap(remotes[id], paths[id], id, "--dry-run")
+		if err == nil && plan != nil && !reflect.DeepEqual(result.Servers, plan) {
+			err = errors.Errorf("generated a different configuration: %v", result.Servers)
+		}
+		done(err)
+		if err != nil {
+			return errors.Annotatef(err, "machine %s", id)
+		}
+		plan = result.Servers
+	}
+	fmt.Fprintf(ctx.Stderr, "Every controller will be bootstrapped with servers:\n")
+	for _, server := range plan {
+		fmt.Fprintf(ctx.Stderr, "  %-6s %-24s %s\n", server.ID, server.Address, server.Suffrage)
+	}
+	if c.dryRun {
+		return nil
+	}
+	if !c.yes {
+		ok, err := confirm(ctx, "Continue?")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !ok {
+			return errors.New("aborted")
+		}
+	}
+
+	args := []string{"--yes", "--force"}
+	if c.stopAgent {
+		args = append(args, "--stop-agent")
+	}
+	for _, id := range machineIDs {
+		done := progress.start("Bootstrapping machine " + id)
+		result, err := c.runBootstrap(remotes[id], paths[id], id, args...)
+		done(err)
+		if err != nil {
+			return errors.Annotatef(err, "machine %s", id)
+		}
+		fmt.Fprintf(ctx.Stdout, "Machine %s: wrote %s\n", id, result.RaftDir)
+	}
+	if c.restartAgent {
+		for _, id := range machineIDs {
+			if _, err := remotes[id].Run("systemctl", "start", remoteAgentService(remotes[id], id)); err != nil {
+				return errors.Annotatef(err, "starting agent on machine %s", id)
+			}
+		}
+	}
+	return nil
+}
+
+// runBootstrap runs the bootstrap subcommand on a machine with the
+// given flags as well as any passed through, returning its result.
+func (c *pluginCommand) runBootstrap(r remote, path, machineID string, flags ...string) (*bootstrapResult, error) {
+	args := []string{"--machine-id", machineID, "--quiet", "--format", "json"}
+	args = append(args, flags...)
+	return runRemoteBootstrap(r, path, append(args, c.extraArgs...)...)
+}
+
+// machineIDs returns the controller machines to operate on, asking
+// the juju client for them if they weren't given.
+func (c *pluginCommand) machineIDs() ([]string, error) {
+	if c.machines != "" {
+		return strings.Split(c.machines, ","), nil
+	}
+	// The controller model can have machines that aren't
+	// controllers, so ask for the controller machines themselves.
+	args := []string{"show-controller", "--format", "json"}
+	if c.controller != "" {
+		args = append(args, c.controller)
+	}
+	out, err := runRemoteCommand(exec.Command("juju", args...))
+	if err != nil {
+		return nil, errors.Annotate(err, "listing controller machines")
+	}
+	return parseControllerMachines(out)
+}
+
+// parseControllerMachines returns the controller machine ids from
+// juju show-controller's JSON output for one controller.
+func parseControllerMachines(out []byte) ([]string, error) {
+	var controllers map[string]struct {
+		Machines map[string]interface{} `json:"controller-machines"`
+	}
+	if err := json.Unmarshal(out, &controllers); err != nil {
+		return nil, errors.Annotate(err, "parsing juju show-controller output")
+	}
+	if len(controllers) != 1 {
+		return nil, errors.Errorf("juju show-controller described %d controllers, not 1", len(controllers))
+	}
+	var ids []string
+	for _, controller := range controllers {
+		for id := range controller.Machines {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, errors.NotFoundf("controller machines")
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// jujuRemote reaches a machine with juju ssh and juju scp.
+type jujuRemote struct {
+	model   string
+	machine string
+}
+
+// Run is part of remote.
+func (r *jujuRemote) Run(args ...string) ([]byte, error) {
+	return runRemoteCommand(exec.Command("juju", "ssh", "-m", r.model, r.machine, "--", "sudo", shellQuote(args)))
+}
+
+// Copy is part of remote.
+func (r *jujuRemote) Copy(localPath, remotePath string) error {
+	_, err := runRemoteCommand(exec.Command("juju", "scp", "-m", r.model, localPath, r.machine+":"+remotePath))
+	return errors.Trace(err)
+}
+
+// TempDir is part of remote. The directory is made as the user juju
+// ssh logs in as, who Copy writes as, rather than with sudo.
+func (r *jujuRemote) TempDir() (string, error) {
+	return tempDirPath(runRemoteCommand(exec.Command("juju", "ssh", "-m", r.model, r.machine, "--", shellQuote(mktempArgs))))
+}
+
+func (r *jujuRemote) String() string {
+	return "machine " + r.machine
+}
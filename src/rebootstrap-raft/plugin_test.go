@@ -0,0 +1,46 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseControllerMachines(t *testing.T) {
+	for _, test := range []struct {
+		about string
+		out   string
+		ids   []string
+		err   string
+	}{{
+		about: "three controllers",
+		out: `{"prod": {"details": {"uuid": "deadbeef"}, "controller-machines": {
+			"2": {"instance-id": "i-2", "ha-status": "ha-enabled"},
+			"0": {"instance-id": "i-0", "ha-status": "ha-enabled"},
+			"1": {"instance-id": "i-1", "ha-status": "ha-enabled"}}}}`,
+		ids: []string{"0", "1", "2"},
+	}, {
+		about: "no controller machines",
+		out:   `{"prod": {"details": {"uuid": "deadbeef"}}}`,
+		err:   "controller machines not found",
+	}, {
+		about: "several controllers",
+		out:   `{"prod": {}, "staging": {}}`,
+		err:   "juju show-controller described 2 controllers, not 1",
+	}} {
+		t.Run(test.about, func(t *testing.T) {
+			ids, err := parseControllerMachines([]byte(test.out))
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(ids, test.ids) {
+				t.Errorf("got %v, %v, want %v", ids, err, test.ids)
+			}
+		})
+	}
+}
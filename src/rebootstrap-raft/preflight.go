@@ -0,0 +1,313 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"gopkg.in/mgo.v2"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+const preflightDoc = `
+
+Run every check bootstrap would make before writing anything, and a
+few more, without changing anything, then print a go/no-go summary.
+Useful before a maintenance window. The checks are:
+
+  agent          agent.conf can be read and the installed juju uses raft
+  mongo          MongoDB can be reached and logged into
+  controller     the database belongs to this controller
+  tags           every replicaset member has a juju-machine-id tag and
+                 this machine is a voter in the generated configuration
+  disk           the raft directory's filesystem is local, with room
+                 for a new store
+  raft-dir       the raft directory doesn't exist yet
+  agent-stopped  the machine agent isn't running
+  names          server hostnames resolve
+  peers          the other controllers' API ports can be dialled
+
+A check that fails makes it a no-go, and the exit code is non-zero;
+warnings are things bootstrap can be told to deal with (--force,
+--stop-agent) or that it only warns about. Checks that depend on a
+failed one are skipped.
+
+`
+
+// The outcome of a single preflight check.
+const (
+	preflightOK   = "ok"
+	preflightWarn = "warn"
+	preflightFail = "fail"
+	preflightSkip = "skip"
+)
+
+// preflightReport is the outcome of a preflight run.
+type preflightReport struct {
+	SchemaVersion int              `json:"schema-version" yaml:"schema-version"`
+	Go            bool             `json:"go" yaml:"go"`
+	Checks        []preflightCheck `json:"checks" yaml:"checks"`
+}
+
+// preflightCheck is the outcome of one check.
+type preflightCheck struct {
+	Name   string `json:"name" yaml:"name"`
+	Status string `json:"status" yaml:"status"`
+	Detail string `json:"detail,omitempty" yaml:"detail,omitempty"`
+}
+
+func (r *preflightReport) add(name, status, detail string) {
+	r.Checks = append(r.Checks, preflightCheck{Name: name, Status: status, Detail: detail})
+}
+
+// addErr records the check as ok with detail if err is nil, and
+// failed with the error otherwise.
+func (r *preflightReport) addErr(name string, err error, detail string) bool {
+	if err != nil {
+		r.add(name, preflightFail, err.Error())
+		return false
+	}
+	r.add(name, preflightOK, detail)
+	return true
+}
+
+type preflightCommand struct {
+	cmd.CommandBase
+	out cmd.Output
+	logFlags
+	mongoFlags
+	dataDirFlags
+	machineID    string
+	raftDir      string
+	apiPort      int
+	agentService string
+	peerTimeout  time.Duration
+}
+
+// Info is part of cmd.Command.
+func (c *preflightCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "preflight",
+		Args:    "--machine-id <id>",
+		Purpose: "Run every check bootstrap makes, without changing anything.",
+		Doc:     strings.TrimSpace(preflightDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *preflightCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	c.logFlags.setFlags(f)
+	c.dataDirFlags.setFlags(f)
+	c.mongoFlags.setFlags(f)
+	c.out.AddFlags(f, "text", map[string]cmd.Formatter{
+		"text": formatPreflightReport,
+		"json": cmd.FormatJson,
+		"yaml": cmd.FormatYaml,
+	})
+	f.StringVar(&c.machineID, "machine-id", "", "ID of this Juju controller machine")
+	f.StringVar(&c.raftDir, "raft-dir", "", "raft directory location (default <data-dir>/raft)")
+	f.IntVar(&c.apiPort, "api-port", 17070, "the API port of the Juju controller")
+	f.StringVar(&c.agentService, "agent-service", "", "machine agent service name, or none if it isn't run by systemd (default jujud-machine-<id>.service, or the snap's if that's installed)")
+	f.DurationVar(&c.peerTimeout, "peer-timeout", 5*time.Second, "how long to wait when dialling each peer")
+}
+
+// Init is part of cmd.Command.
+func (c *preflightCommand) Init(args []string) error {
+	if err := c.setupLogging(false); err != nil {
+		return errors.Trace(err)
+	}
+	if c.machineID == "" {
+		return errors.Errorf("--machine-id is required")
+	}
+	if err := c.dataDirFlags.resolve(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := c.mongoFlags.validate(c.agentConfFile(c.machineID), c.hostfsPrefix); err != nil {
+		return errors.Trace(err)
+	}
+	if c.raftDir == "" {
+		c.raftDir = c.getJujuPath("raft")
+	}
+	raftDir, err := filepath.Abs(c.raftDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	c.raftDir = raftDir
+	if c.agentService == "" {
+		c.agentService = localAgentService(c.machineID)
+	}
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *preflightCommand) Run(ctx *cmd.Context) error {
+	c.setupOutput(ctx)
+	stdCtx, cancel := interruptContext()
+	defer cancel()
+	report := c.preflight(stdCtx)
+	if err := c.out.Write(ctx, report); err != nil {
+		return reportExitCode(ctx, errors.Trace(err))
+	}
+	if !report.Go {
+		return reportExitCode(ctx, withExitCode(errors.New("preflight checks failed"), exitValidation))
+	}
+	return nil
+}
+
+// preflight runs the checks in turn. None of them write anything.
+func (c *preflightCommand) preflight(ctx context.Context) *preflightReport {
+	report := &preflightReport{SchemaVersion: outputSchemaVersion}
+	agentConf, err := readAgentConfig(c.agentConfFile(c.machineID))
+	if err == nil {
+		var version jujuVersion
+		if version, err = detectJujuVersion(c.dataDir, c.machineID, c.agentConfFile(c.machineID)); err != nil {
+			report.add("agent", preflightWarn, fmt.Sprintf("can't determine installed juju version: %v", err))
+		} else if version.Major >= 3 || version.less(2, 4) {
+			report.add("agent", preflightFail, fmt.Sprintf("juju %s doesn't use a raft store", version))
+		} else {
+			report.add("agent", preflightOK, "juju "+version.String())
+		}
+	} else {
+		report.add("agent", preflightWarn, fmt.Sprintf("can't read agent.conf, so it can't be checked against MongoDB: %v", err))
+		agentConf = nil
+	}
+
+	var servers raft.Configuration
+	session, err := c.connect(ctx, c.machineID, agentConf)
+	if report.addErr("mongo", err, "") {
+		defer session.Close()
+		servers = c.checkDatabase(ctx, report, session, agentConf)
+	} else {
+		report.add("controller", preflightSkip, "")
+		report.add("tags", preflightSkip, "")
+	}
+
+	err = checkFilesystem(c.raftDir, false)
+	if err == nil {
+		err = checkDiskSpace(c.raftDir, 0)
+	}
+	report.addErr("disk", err, "")
+
+	if existing, err := inspectExistingState(c.raftDir); err != nil {
+		report.add("raft-dir", preflightFail, err.Error())
+	} else if existing != nil {
+		report.add("raft-dir", preflightWarn, fmt.Sprintf("%q already exists (remove it, or use --force to back it up)", c.raftDir))
+	} else {
+		report.add("raft-dir", preflightOK, "")
+	}
+
+	if c.agentService == noAgentService {
+		report.add("agent-stopped", preflightSkip, "not run by systemd")
+	} else if active, err := serviceActive(c.agentService); err != nil {
+		report.add("agent-stopped", preflightFail, err.Error())
+	} else if active {
+		report.add("agent-stopped", preflightWarn, c.agentService+" is running (stop it, or use --stop-agent)")
+	} else {
+		report.add("agent-stopped", preflightOK, "")
+	}
+
+	if len(servers.Servers) == 0 {
+		report.add("names", preflightSkip, "")
+		report.add("peers", preflightSkip, "")
+	} else {
+		c.checkNetwork(ctx, report, servers)
+	}
+
+	report.Go = true
+	for _, check := range report.Checks {
+		if check.Status == preflightFail {
+			report.Go = false
+		}
+	}
+	return report
+}
+
+// checkDatabase checks the database and the replicaset's tags,
+// returning the configuration bootstrap would generate if it could
+// be.
+func (c *preflightCommand) checkDatabase(ctx context.Context, report *preflightReport, session *mgo.Session, agentConf *agentConfig) raft.Configuration {
+	if agentConf == nil {
+		report.add("controller", preflightSkip, "no agent.conf")
+	} else {
+		report.addErr("controller", checkControllerUUID(ctx, session, agentConf), "")
+	}
+	members, err := rebootstrap.Members(ctx, session)
+	if err != nil {
+		report.add("tags", preflightFail, err.Error())
+		return raft.Configuration{}
+	}
+	var untagged []string
+	for _, member := range rebootstrap.DataMembers(members) {
+		if _, ok := member.Tags[rebootstrap.MachineIDTag]; !ok {
+			untagged = append(untagged, fmt.Sprintf("%d (%s)", member.Id, member.Address))
+		}
+	}
+	if len(untagged) > 0 {
+		report.add("tags", preflightFail, fmt.Sprintf("members without a %s tag: %s (retag can restore them)", rebootstrap.MachineIDTag, strings.Join(untagged, ", ")))
+		return raft.Configuration{}
+	}
+	servers, err := rebootstrap.PlanServers(ctx, session, c.apiPort, 1, true)
+	if err == nil {
+		err = rebootstrap.ValidateLocal(servers, c.machineID)
+	}
+	if !report.addErr("tags", err, fmt.Sprintf("%d servers", len(servers.Servers))) {
+		return raft.Configuration{}
+	}
+	return servers
+}
+
+// checkNetwork checks that the servers' names resolve and that the
+// other controllers can be dialled.
+func (c *preflightCommand) checkNetwork(ctx context.Context, report *preflightReport, servers raft.Configuration) {
+	if warnings := checkServerNames(ctx, servers, nil, c.peerTimeout); len(warnings) > 0 {
+		report.add("names", preflightWarn, strings.Join(warnings, "; "))
+	} else {
+		report.add("names", preflightOK, "")
+	}
+	var unreachable []string
+	peers := checkPeers(servers, raft.ServerID(c.machineID), c.peerTimeout)
+	for _, peer := range peers {
+		if peer.Err != nil {
+			unreachable = append(unreachable, fmt.Sprintf("machine %s at %s", peer.Server.ID, peer.Server.Address))
+		}
+	}
+	if len(unreachable) > 0 {
+		report.add("peers", preflightWarn, "unreachable: "+strings.Join(unreachable, ", "))
+	} else {
+		report.add("peers", preflightOK, fmt.Sprintf("%d reachable", len(peers)))
+	}
+}
+
+func formatPreflightReport(writer io.Writer, value interface{}) error {
+	report, ok := value.(*preflightReport)
+	if !ok {
+		return errors.Errorf("expected *preflightReport, got %T", value)
+	}
+	tw := tabwriter.NewWriter(writer, 0, 1, 2, ' ', 0)
+	fmt.Fprintf(tw, "CHECK\tSTATUS\tDETAIL\n")
+	for _, check := range report.Checks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", check.Name, check.Status, dashIfEmpty(check.Detail))
+	}
+	if err := tw.Flush(); err != nil {
+		return errors.Trace(err)
+	}
+	if report.Go {
+		fmt.Fprintln(writer, "GO")
+	} else {
+		fmt.Fprintln(writer, "NO-GO")
+	}
+	return nil
+}
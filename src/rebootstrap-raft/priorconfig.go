@@ -0,0 +1,91 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/juju/errors"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+// findPriorStore returns the raft directory holding the configuration
+// the cluster had before: the existing raft directory if there is one
+// (it's about to be backed up), or else the newest backup made of it
+// by an earlier --force run. It returns "" if there's neither.
+func findPriorStore(raftDir string) (string, error) {
+	if _, err := os.Stat(raftDir); err == nil {
+		return raftDir, nil
+	}
+	backups, err := filepath.Glob(raftDir + ".backup-*")
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if len(backups) == 0 {
+		return "", nil
+	}
+	// The timestamps in the names sort in time order.
+	sort.Strings(backups)
+	return backups[len(backups)-1], nil
+}
+
+// showPriorConfig writes how the generated servers differ from the
+// configuration in the prior store, if there is one, so that
+// unexpected membership changes are seen before anything is written.
+// It's only informational, so problems reading the old store are
+// logged rather than failing the run.
+func (c *rebootstrapCommand) showPriorConfig(w io.Writer, servers []serverResult) {
+	dir, err := findPriorStore(c.raftDir)
+	if err != nil || dir == "" {
+		logger.Debugf("no prior raft store to compare with: %v", err)
+		return
+	}
+	config, err := readStoreConfiguration(dir)
+	if err != nil {
+		logger.Warningf("can't read the configuration in %q to compare with: %v", dir, err)
+		return
+	}
+	old := makeServerResults(rebootstrap.ApplyIDScheme(config, rebootstrap.IDSchemeMachineID))
+	fmt.Fprintf(w, "Changes from the configuration in %s:\n", dir)
+	writeConfigDiff(w, "  ", old, servers)
+}
+
+// writeConfigDiff lists every server in old and generated, marked
+// with + if it's been added, - if removed, ~ if its address or
+// suffrage has changed and = if it's the same.
+func writeConfigDiff(w io.Writer, indent string, old, generated []serverResult) {
+	previous := make(map[string]serverResult)
+	for _, server := range old {
+		previous[server.ID] = server
+	}
+	changed := false
+	for _, server := range generated {
+		was, ok := previous[server.ID]
+		delete(previous, server.ID)
+		switch {
+		case !ok:
+			changed = true
+			fmt.Fprintf(w, "%s+ %s %s %s\n", indent, server.ID, server.Address, server.Suffrage)
+		case was.Address != server.Address || was.Suffrage != server.Suffrage:
+			changed = true
+			fmt.Fprintf(w, "%s~ %s %s %s (was %s %s)\n", indent, server.ID, server.Address, server.Suffrage, was.Address, was.Suffrage)
+		default:
+			fmt.Fprintf(w, "%s= %s %s %s\n", indent, server.ID, server.Address, server.Suffrage)
+		}
+	}
+	for _, server := range old {
+		if _, ok := previous[server.ID]; ok {
+			changed = true
+			fmt.Fprintf(w, "%s- %s %s %s\n", indent, server.ID, server.Address, server.Suffrage)
+		}
+	}
+	if !changed {
+		fmt.Fprintf(w, "%s(no changes)\n", indent)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// progressInterval is how often a phase that's still running says so.
+const progressInterval = 10 * time.Second
+
+// phaseTiming records how long a phase of the run took.
+type phaseTiming struct {
+	Name    string  `json:"name" yaml:"name"`
+	Seconds float64 `json:"seconds" yaml:"seconds"`
+	Failed  bool    `json:"failed,omitempty" yaml:"failed,omitempty"`
+}
+
+// progress reports each phase of a run as it finishes, and
+// periodically while a slow one is running, so there's something to
+// look at while bolt spends minutes syncing to a slow disk.
+type progress struct {
+	mu     sync.Mutex
+	out    io.Writer
+	phases []phaseTiming
+
+	// trace, if set, records a span for each phase.
+	trace *tracer
+}
+
+// newProgress returns a progress writing to out, or writing nothing
+// if quiet is set.
+func newProgress(out io.Writer, quiet bool) *progress {
+	if quiet {
+		out = ioutil.Discard
+	}
+	return &progress{out: out}
+}
+
+// start begins a phase. The returned function must be called with the
+// phase's result when it's over.
+func (p *progress) start(name string) func(error) {
+	begin := time.Now()
+	span := p.trace.startPhase(name)
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				p.printf("%s: still running after %s\n", name, now.Sub(begin).Round(time.Second))
+			}
+		}
+	}()
+	return func(err error) {
+		close(stop)
+		span.finish(err)
+		elapsed := time.Since(begin)
+		timing := phaseTiming{Name: name, Seconds: elapsed.Seconds(), Failed: err != nil}
+		if err != nil {
+			p.printf("%s: failed after %s\n", name, elapsed.Round(time.Millisecond))
+		} else {
+			p.printf("%s: done in %s\n", name, elapsed.Round(time.Millisecond))
+		}
+		p.mu.Lock()
+		p.phases = append(p.phases, timing)
+		p.mu.Unlock()
+	}
+}
+
+// timings returns the phases finished so far.
+func (p *progress) timings() []phaseTiming {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]phaseTiming(nil), p.phases...)
+}
+
+func (p *progress) printf(format string, args ...interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintf(p.out, format, args...)
+}
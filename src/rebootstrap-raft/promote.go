@@ -0,0 +1,189 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+// stagedSuffix is added to the raft directory to give where
+// bootstrap --stage writes the new store.
+const stagedSuffix = ".staged"
+
+const promoteDoc = `
+
+Move a store written with bootstrap --stage into place. The staged
+store (<raft-dir>.staged) is checked against its manifest, any existing
+raft directory is moved to a timestamped backup, and the staged one is
+renamed to take its place. The machine agent must be stopped (or use
+--stop-agent).
+
+Staging separates generating the store, which can be done with the
+agent still running and the result inspected or copied elsewhere,
+from activating it.
+
+`
+
+type promoteCommand struct {
+	cmd.CommandBase
+	logFlags
+	dataDirFlags
+	machineID    string
+	raftDir      string
+	agentService string
+	stopAgent    bool
+	restartAgent bool
+	yes          bool
+}
+
+// Info is part of cmd.Command.
+func (c *promoteCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "promote",
+		Args:    "--machine-id <id>",
+		Purpose: "Move a staged raft store into place.",
+		Doc:     strings.TrimSpace(promoteDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *promoteCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	c.logFlags.setFlags(f)
+	c.dataDirFlags.setFlags(f)
+	f.StringVar(&c.machineID, "machine-id", "", "ID of this Juju controller machine")
+	f.StringVar(&c.raftDir, "raft-dir", "", "raft directory location (default <data-dir>/raft)")
+	f.StringVar(&c.agentService, "agent-service", "", "machine agent service name, or none if it isn't run by systemd (default jujud-machine-<id>.service, or the snap's if that's installed)")
+	f.BoolVar(&c.stopAgent, "stop-agent", false, "stop the machine agent if it's running")
+	f.BoolVar(&c.restartAgent, "restart-agent", false, "start the machine agent once the store is in place")
+	f.BoolVar(&c.yes, "yes", false, "don't ask for confirmation")
+}
+
+// Init is part of cmd.Command.
+func (c *promoteCommand) Init(args []string) error {
+	if err := c.setupLogging(false); err != nil {
+		return errors.Trace(err)
+	}
+	if err := c.dataDirFlags.resolveStore(c.machineID, &c.raftDir, &c.agentService); err != nil {
+		return errors.Trace(err)
+	}
+	raftDir, err := filepath.Abs(c.raftDir)
+	if err != nil {
+		return errors.Annotate(err, "resolving --raft-dir")
+	}
+	c.raftDir = raftDir
+	if c.agentService == noAgentService && (c.stopAgent || c.restartAgent) {
+		return errors.Errorf("--stop-agent and --restart-agent need an agent service")
+	}
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *promoteCommand) Run(ctx *cmd.Context) error {
+	c.setupOutput(ctx)
+	return reportExitCode(ctx, c.run(ctx))
+}
+
+func (c *promoteCommand) run(ctx *cmd.Context) error {
+	lock, err := acquireLock(c.dataDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer lock.Release()
+
+	staged := c.raftDir + stagedSuffix
+	if _, err := os.Stat(staged); err != nil {
+		return errors.Annotate(err, "no staged store (run bootstrap --stage first)")
+	}
+	if err := checkManifest(staged); err != nil {
+		return withExitCode(errors.Annotatef(err, "checking %q", staged), exitValidation)
+	}
+	logger.Infof("Staged store %q matches its manifest.", staged)
+
+	if !c.yes {
+		ok, err := confirm(ctx, fmt.Sprintf("Replace %s with %s?", c.raftDir, staged))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !ok {
+			return errors.New("aborted")
+		}
+	}
+	var undo rollback
+	stopped, err := ensureAgentStopped(c.agentService, c.stopAgent)
+	if stopped {
+		undo.add("restarting "+c.agentService, func() error {
+			return startService(c.agentService)
+		})
+	}
+	if err != nil {
+		undo.run()
+		return errors.Trace(err)
+	}
+	backupDir, err := c.swap(staged, &undo)
+	if err != nil {
+		undo.run()
+		return withExitCode(err, exitWriteFailed)
+	}
+	// The new store is in place now, so there's nothing to roll back.
+	if err := rebootstrap.SyncPath(filepath.Dir(c.raftDir)); err != nil {
+		return withExitCode(errors.Annotate(err, "syncing raft directory parent"), exitWriteFailed)
+	}
+	if backupDir != "" {
+		fmt.Fprintf(ctx.Stdout, "Promoted %s; the old store is in %s.\n", staged, backupDir)
+	} else {
+		fmt.Fprintf(ctx.Stdout, "Promoted %s.\n", staged)
+	}
+	if c.restartAgent {
+		logger.Infof("Starting %s.", c.agentService)
+		return errors.Annotate(startService(c.agentService), "starting machine agent")
+	}
+	return nil
+}
+
+// swap moves any existing raft directory aside and the staged store
+// into its place, returning where the old one went. The two renames
+// can't be made as one, so moving the old directory back is recorded
+// in undo: the caller rolls back if the staged store can't be moved.
+func (c *promoteCommand) swap(staged string, undo *rollback) (string, error) {
+	logsPath := filepath.Join(c.raftDir, "logs")
+	locked, err := boltFileLocked(logsPath)
+	if err != nil {
+		return "", errors.Annotatef(err, "checking lock on %q", logsPath)
+	}
+	if locked {
+		return "", errors.Errorf("%q is locked by another process - is the machine agent running?", logsPath)
+	}
+	var backupDir string
+	if _, err := os.Stat(c.raftDir); err == nil {
+		backupDir = fmt.Sprintf("%s.backup-%s", c.raftDir, time.Now().UTC().Format("20060102-150405"))
+		if err := os.Rename(c.raftDir, backupDir); err != nil {
+			return "", errors.Annotate(err, "backing up existing raft directory")
+		}
+		logger.Warningf("Existing raft directory moved to %q.", backupDir)
+		undo.add("moving "+backupDir+" back to "+c.raftDir, func() error {
+			if err := os.Rename(backupDir, c.raftDir); err != nil {
+				return errors.Trace(err)
+			}
+			return errors.Trace(rebootstrap.SyncPath(filepath.Dir(c.raftDir)))
+		})
+	} else if !os.IsNotExist(err) {
+		return "", errors.Trace(err)
+	}
+	if err := os.Rename(staged, c.raftDir); err != nil {
+		return "", errors.Annotate(err, "moving staged store into place")
+	}
+	logger.Infof("Raft cluster store promoted to %q.", c.raftDir)
+	return backupDir, nil
+}
@@ -0,0 +1,214 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+const pruneSnapshotsDoc = `
+
+Remove old and broken snapshots from a raft store's snapshots
+directory. The newest --keep snapshots that pass their CRC check are
+kept; older ones, and any directory that isn't a complete snapshot
+(left behind by a snapshot that was interrupted, or damaged since),
+are removed. Broken snapshot directories can stop jujud starting.
+
+The machine agent must be stopped (or use --stop-agent), since it
+writes snapshots while it runs.
+
+`
+
+type pruneSnapshotsCommand struct {
+	cmd.CommandBase
+	logFlags
+	dataDirFlags
+	machineID    string
+	raftDir      string
+	agentService string
+	stopAgent    bool
+	keep         int
+	dryRun       bool
+	yes          bool
+}
+
+// Info is part of cmd.Command.
+func (c *pruneSnapshotsCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "prune-snapshots",
+		Args:    "--machine-id <id> [--keep <n>]",
+		Purpose: "Remove old and broken snapshots from a raft store.",
+		Doc:     strings.TrimSpace(pruneSnapshotsDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *pruneSnapshotsCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	c.logFlags.setFlags(f)
+	c.dataDirFlags.setFlags(f)
+	f.StringVar(&c.machineID, "machine-id", "", "ID of this Juju controller machine")
+	f.StringVar(&c.raftDir, "raft-dir", "", "raft directory location (default <data-dir>/raft)")
+	f.StringVar(&c.agentService, "agent-service", "", "machine agent service name, or none if it isn't run by systemd (default jujud-machine-<id>.service, or the snap's if that's installed)")
+	f.BoolVar(&c.stopAgent, "stop-agent", false, "stop the machine agent if it's running")
+	f.IntVar(&c.keep, "keep", jujudSnapshotRetention, "number of valid snapshots to keep")
+	f.BoolVar(&c.dryRun, "dry-run", false, "show what would be removed without removing it")
+	f.BoolVar(&c.yes, "yes", false, "don't ask for confirmation")
+}
+
+// Init is part of cmd.Command.
+func (c *pruneSnapshotsCommand) Init(args []string) error {
+	if err := c.setupLogging(c.dryRun); err != nil {
+		return errors.Trace(err)
+	}
+	if c.keep < 1 {
+		return errors.Errorf("--keep must be at least 1")
+	}
+	if err := c.dataDirFlags.resolveStore(c.machineID, &c.raftDir, &c.agentService); err != nil {
+		return errors.Trace(err)
+	}
+	if c.agentService == noAgentService && c.stopAgent {
+		return errors.Errorf("--stop-agent needs an agent service")
+	}
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *pruneSnapshotsCommand) Run(ctx *cmd.Context) error {
+	c.setupOutput(ctx)
+	return reportExitCode(ctx, c.run(ctx))
+}
+
+func (c *pruneSnapshotsCommand) run(ctx *cmd.Context) error {
+	snapshots, err := scanSnapshots(filepath.Join(c.raftDir, "snapshots"))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var remove []snapshotDir
+	kept := 0
+	for _, snapshot := range snapshots {
+		switch {
+		case snapshot.problem != "":
+			fmt.Fprintf(ctx.Stdout, "remove  %s (%s)\n", snapshot.name, snapshot.problem)
+			remove = append(remove, snapshot)
+		case kept < c.keep:
+			fmt.Fprintf(ctx.Stdout, "keep    %s (index %d, term %d)\n", snapshot.name, snapshot.meta.Index, snapshot.meta.Term)
+			kept++
+		default:
+			fmt.Fprintf(ctx.Stdout, "remove  %s (index %d, term %d, older than the newest %d)\n", snapshot.name, snapshot.meta.Index, snapshot.meta.Term, c.keep)
+			remove = append(remove, snapshot)
+		}
+	}
+	if kept == 0 {
+		logger.Warningf("there are no valid snapshots in %q", c.raftDir)
+	}
+	if len(remove) == 0 {
+		fmt.Fprintln(ctx.Stdout, "Nothing to remove.")
+		return nil
+	}
+	if c.dryRun {
+		logger.Infof("dry-run specified - stopping")
+		return nil
+	}
+
+	lock, err := acquireLock(c.dataDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer lock.Release()
+	stopped, err := ensureAgentStopped(c.agentService, c.stopAgent)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if stopped {
+		logger.Infof("%s was stopped; start it again once you're done.", c.agentService)
+	}
+	if !c.yes {
+		ok, err := confirm(ctx, fmt.Sprintf("Remove %d snapshot directories?", len(remove)))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !ok {
+			return errors.New("aborted")
+		}
+	}
+	for _, snapshot := range remove {
+		if err := os.RemoveAll(snapshot.path); err != nil {
+			return withExitCode(errors.Annotatef(err, "removing %q", snapshot.path), exitWriteFailed)
+		}
+	}
+	if err := rebootstrap.SyncPath(filepath.Join(c.raftDir, "snapshots")); err != nil {
+		return errors.Annotate(err, "syncing snapshots directory")
+	}
+	fmt.Fprintf(ctx.Stdout, "Removed %d snapshot directories.\n", len(remove))
+	return nil
+}
+
+// snapshotDir is an entry in a snapshots directory. Either meta is
+// set, for a complete snapshot, or problem says what's wrong with it.
+type snapshotDir struct {
+	name    string
+	path    string
+	meta    *fileSnapshotMeta
+	problem string
+}
+
+// scanSnapshots checks each entry in a snapshots directory, returning
+// the valid snapshots newest first followed by the broken ones.
+func scanSnapshots(dir string) ([]snapshotDir, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var valid, broken []snapshotDir
+	for _, entry := range entries {
+		snapshot := snapshotDir{
+			name: entry.Name(),
+			path: filepath.Join(dir, entry.Name()),
+		}
+		switch {
+		case !entry.IsDir():
+			// Stray files don't bother jujud.
+			continue
+		case strings.HasSuffix(entry.Name(), ".tmp"):
+			// Raft gives a snapshot this suffix until it's
+			// complete.
+			snapshot.problem = "incomplete"
+		default:
+			meta, err := readSnapshotMeta(snapshot.path)
+			if err == nil {
+				_, err = readSnapshotData(snapshot.path, meta)
+			}
+			if err != nil {
+				snapshot.problem = errors.Cause(err).Error()
+			} else {
+				snapshot.meta = meta
+			}
+		}
+		if snapshot.meta != nil {
+			valid = append(valid, snapshot)
+		} else {
+			broken = append(broken, snapshot)
+		}
+	}
+	sort.Slice(valid, func(i, j int) bool {
+		a, b := valid[i].meta, valid[j].meta
+		if a.Term != b.Term {
+			return a.Term > b.Term
+		}
+		return a.Index > b.Index
+	})
+	return append(valid, broken...), nil
+}
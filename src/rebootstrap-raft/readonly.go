@@ -0,0 +1,148 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/raft-boltdb/v2"
+	"github.com/juju/errors"
+	"go.etcd.io/bbolt"
+)
+
+// readOnlyStore is a bolt log store opened only for reading.
+type readOnlyStore struct {
+	*raftboltdb.BoltStore
+
+	// copyDir holds the copy that was opened, if the store was in
+	// use.
+	copyDir string
+}
+
+// Close closes the store and removes any copy of it.
+func (s *readOnlyStore) Close() error {
+	err := s.BoltStore.Close()
+	if s.copyDir != "" {
+		os.RemoveAll(s.copyDir)
+	}
+	return errors.Trace(err)
+}
+
+// openStoreReadOnly opens the bolt log store in the raft directory
+// dir without being able to change it.
+func openStoreReadOnly(dir string) (*readOnlyStore, error) {
+	path, copyDir, err := readableBoltFile(filepath.Join(dir, "logs"))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	store := &readOnlyStore{copyDir: copyDir}
+	store.BoltStore, err = raftboltdb.New(raftboltdb.Options{
+		Path: path,
+		BoltOptions: &bbolt.Options{
+			ReadOnly: true,
+			Timeout:  time.Second,
+		},
+	})
+	if err != nil {
+		if copyDir != "" {
+			os.RemoveAll(copyDir)
+		}
+		return nil, errors.Annotatef(err, "opening %q", path)
+	}
+	return store, nil
+}
+
+// readableBoltFile returns a path the bolt file at path can be opened
+// read-only from. Even a read-only bolt open takes a shared lock,
+// which waits for a running jujud's exclusive one to be released (and
+// would hold jujud up if it restarted), so when the file is in use
+// it's copied into a temporary directory, returned as copyDir for the
+// caller to remove. The copy is as of the last transaction jujud
+// completed before it was taken.
+func readableBoltFile(path string) (readPath, copyDir string, _ error) {
+	if _, err := os.Stat(path); err != nil {
+		return "", "", errors.Trace(err)
+	}
+	locked, err := boltFileLocked(path)
+	if err != nil {
+		return "", "", errors.Annotatef(err, "checking lock on %q", path)
+	}
+	if !locked {
+		return path, "", nil
+	}
+	logger.Warningf("%q is in use - reading a copy of it", path)
+	if copyDir, err = ioutil.TempDir("", "rebootstrap-store"); err != nil {
+		return "", "", errors.Trace(err)
+	}
+	copyPath := filepath.Join(copyDir, filepath.Base(path))
+	if err := copyLiveBoltFile(path, copyPath); err != nil {
+		os.RemoveAll(copyDir)
+		return "", "", errors.Annotatef(err, "copying %q", path)
+	}
+	return copyPath, copyDir, nil
+}
+
+// liveCopyAttempts is how many times copyLiveBoltFile tries before
+// giving up on a store that's committed to during every copy.
+const liveCopyAttempts = 5
+
+// copyLiveBoltFile copies the bolt file at src, which another process
+// may be writing to, to dst. A commit writes its pages where the
+// previous commit's tree doesn't reach and then one of the two meta
+// pages, so if neither meta page changed while the file was copied
+// the copy holds the tree as of the last commit, untorn. Otherwise it
+// tries again.
+func copyLiveBoltFile(src, dst string) error {
+	for attempt := 1; ; attempt++ {
+		before, err := readBoltMeta(src)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := copyFile(src, dst, 0600); err != nil {
+			return errors.Trace(err)
+		}
+		after, err := readBoltMeta(src)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if bytes.Equal(before, after) {
+			return nil
+		}
+		if attempt == liveCopyAttempts {
+			return errors.Errorf("it was written to during each of %d attempts to copy it - stop the machine agent and try again", attempt)
+		}
+		logger.Debugf("%q was written to while it was copied, trying again", src)
+		if err := os.Remove(dst); err != nil {
+			return errors.Trace(err)
+		}
+	}
+}
+
+// readBoltMeta returns the two meta pages at the start of the bolt
+// file at path.
+func readBoltMeta(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	// The largest page size bolt allows, so that boltPageSize
+	// can find the second meta page whatever it is.
+	data := make([]byte, 2*65536)
+	n, err := io.ReadFull(f, data)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, errors.Annotatef(err, "reading meta pages of %q", path)
+	}
+	data = data[:n]
+	pageSize := boltPageSize(data)
+	if len(data) < 2*pageSize {
+		return nil, errors.NotValidf("bolt file %q of %d bytes", path, len(data))
+	}
+	return data[:2*pageSize], nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+func TestCopyLiveBoltFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "logs")
+	db, err := bbolt.Open(src, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	put := func(value string) {
+		err := db.Update(func(tx *bbolt.Tx) error {
+			bucket, err := tx.CreateBucketIfNotExists([]byte("logs"))
+			if err != nil {
+				return err
+			}
+			return bucket.Put([]byte("key"), []byte(value))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("first")
+
+	before, err := readBoltMeta(src)
+	if err != nil {
+		t.Fatalf("readBoltMeta: %v", err)
+	}
+	dst := filepath.Join(dir, "copy")
+	if err := copyLiveBoltFile(src, dst); err != nil {
+		t.Fatalf("copyLiveBoltFile: %v", err)
+	}
+	put("second")
+	after, err := readBoltMeta(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(before, after) {
+		t.Error("meta pages unchanged by a commit")
+	}
+
+	// The copy holds the first commit, not the one after it.
+	copied, err := bbolt.Open(dst, 0600, &bbolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("opening copy: %v", err)
+	}
+	defer copied.Close()
+	err = copied.View(func(tx *bbolt.Tx) error {
+		if value := tx.Bucket([]byte("logs")).Get([]byte("key")); string(value) != "first" {
+			t.Errorf("copy has %q, want %q", value, "first")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
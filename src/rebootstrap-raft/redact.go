@@ -0,0 +1,84 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/juju/loggo"
+)
+
+// redactedText replaces secrets in anything we write.
+const redactedText = "[REDACTED]"
+
+// secrets holds the values that mustn't appear in any output: the
+// MongoDB password and the credentials read from agent.conf. Every log
+// writer and output stream goes through it, so even a debug message
+// that accidentally includes one is safe.
+var secrets redactor
+
+type redactor struct {
+	mu       sync.RWMutex
+	replacer *strings.Replacer
+	values   []string
+}
+
+// add registers a secret. Empty values are ignored.
+func (r *redactor) add(secret string) {
+	if secret == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, value := range r.values {
+		if value == secret {
+			return
+		}
+	}
+	r.values = append(r.values, secret)
+	var pairs []string
+	for _, value := range r.values {
+		pairs = append(pairs, value, redactedText)
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+}
+
+// redact returns s with any registered secrets replaced.
+func (r *redactor) redact(s string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.replacer == nil {
+		return s
+	}
+	return r.replacer.Replace(s)
+}
+
+// redactingWriter is a loggo.Writer that removes secrets from entries
+// before passing them on.
+type redactingWriter struct {
+	writer loggo.Writer
+}
+
+// Write is part of loggo.Writer.
+func (w redactingWriter) Write(entry loggo.Entry) {
+	entry.Message = secrets.redact(entry.Message)
+	w.writer.Write(entry)
+}
+
+// redactingStream is an io.Writer that removes secrets from what's
+// written to it. Each write is redacted on its own, which is enough
+// for output written a line or a value at a time.
+type redactingStream struct {
+	w io.Writer
+}
+
+// Write is part of io.Writer.
+func (s redactingStream) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(s.w, secrets.redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
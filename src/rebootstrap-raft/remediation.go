@@ -0,0 +1,153 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// These are the remediation codes given with failures, for runbooks
+// and automation to match on. Most follow from the exit code; others
+// are finer grained than it.
+const (
+	remedyRaftDirExists    = "raft-dir-exists"
+	remedyMongoUnreachable = "mongo-unreachable"
+	remedyMongoAuth        = "mongo-auth"
+	remedyMissingTags      = "missing-tags"
+	remedyValidation       = "validation"
+	remedyWriteFailed      = "write-failed"
+	remedyAgentUnhealthy   = "agent-unhealthy"
+	remedyTimedOut         = "timed-out"
+	remedyAgentRunning     = "agent-running"
+)
+
+// remediation says what to do about a failure: a code that doesn't
+// change between releases, a hint for people and a command to run
+// next. The command may hold the placeholders <id>, <raft-dir> and
+// <service>, filled in where the failing command knows them.
+type remediation struct {
+	Code    string `json:"code" yaml:"code"`
+	Hint    string `json:"hint" yaml:"hint"`
+	Command string `json:"command,omitempty" yaml:"command,omitempty"`
+}
+
+var remediations = map[string]remediation{
+	remedyRaftDirExists: {
+		Hint:    "move the existing raft directory aside, or rerun with --force to have it backed up",
+		Command: "sudo mv <raft-dir> <raft-dir>.old",
+	},
+	remedyMongoUnreachable: {
+		Hint:    "check juju-db is running and reachable from here; preflight shows what can't be reached",
+		Command: "sudo rebootstrap-raft preflight --machine-id <id>",
+	},
+	remedyMongoAuth: {
+		Hint:    "MongoDB refused the password; give the right one with --password or --password-cmd, log in as another account with --mongo-user, or try --keyfile-fallback",
+		Command: "sudo rebootstrap-raft --machine-id <id> --keyfile-fallback --dry-run",
+	},
+	remedyMissingTags: {
+		Hint:    "a replicaset member has no juju-machine-id tag; retag can put it back",
+		Command: "sudo rebootstrap-raft retag --machine-id <id> --dry-run",
+	},
+	remedyValidation: {
+		Hint:    "the configuration failed a safety check; look at where each server came from before overriding anything",
+		Command: "sudo rebootstrap-raft --machine-id <id> --dry-run --explain",
+	},
+	remedyWriteFailed: {
+		Hint:    "the store couldn't be written; check the disk's free space and speed, then rerun with --force",
+		Command: "sudo rebootstrap-raft bench",
+	},
+	remedyAgentUnhealthy: {
+		Hint:    "the store was written but the restarted agent's raft workers aren't healthy; check the agent's log",
+		Command: "sudo journalctl --unit <service> --lines 200",
+	},
+	remedyTimedOut: {
+		Hint:    "the run took longer than --timeout; find the slow phase with a trace, then allow longer",
+		Command: "sudo rebootstrap-raft --machine-id <id> --dry-run --trace-file rebootstrap-raft-trace.json",
+	},
+	remedyAgentRunning: {
+		Hint:    "the machine agent must be stopped first; stop it, or rerun with --stop-agent",
+		Command: "sudo systemctl stop <service>",
+	},
+}
+
+// exitCodeRemedies gives the remediation for each exit code that
+// doesn't come with a more specific one.
+var exitCodeRemedies = map[int]string{
+	exitRaftDirExists:    remedyRaftDirExists,
+	exitMongoUnreachable: remedyMongoUnreachable,
+	exitMongoAuth:        remedyMongoAuth,
+	exitMissingTags:      remedyMissingTags,
+	exitValidation:       remedyValidation,
+	exitWriteFailed:      remedyWriteFailed,
+	exitAgentUnhealthy:   remedyAgentUnhealthy,
+	exitTimedOut:         remedyTimedOut,
+}
+
+// withRemedy marks err, if it's not nil, with a remediation code,
+// keeping its exit code.
+func withRemedy(err error, remedy string) error {
+	if err == nil {
+		return nil
+	}
+	return &exitCodeError{error: err, code: exitCode(err), remedy: remedy}
+}
+
+// remediationFor returns what to do about err, or nil if there's
+// nothing better to say than the error itself. vars fills in the
+// placeholders in the command; any it doesn't have are left for the
+// reader.
+func remediationFor(err error, vars map[string]string) *remediation {
+	e, ok := errors.Cause(err).(*exitCodeError)
+	if !ok {
+		return nil
+	}
+	code := e.remedy
+	if code == "" {
+		code = exitCodeRemedies[e.code]
+	}
+	r, ok := remediations[code]
+	if !ok {
+		return nil
+	}
+	r.Code = code
+	var replacements []string
+	for placeholder, value := range vars {
+		if value != "" {
+			replacements = append(replacements, placeholder, value)
+		}
+	}
+	r.Command = strings.NewReplacer(replacements...).Replace(r.Command)
+	return &r
+}
+
+// writeRemediation writes the remediation for people to read.
+func writeRemediation(w io.Writer, r *remediation) {
+	fmt.Fprintf(w, "To fix (%s): %s\n", r.Code, r.Hint)
+	if r.Command != "" {
+		fmt.Fprintf(w, "  %s\n", r.Command)
+	}
+}
+
+// errorResult describes a failed run in structured output.
+type errorResult struct {
+	Message     string       `json:"message" yaml:"message"`
+	ExitCode    int          `json:"exit-code" yaml:"exit-code"`
+	Remediation *remediation `json:"remediation,omitempty" yaml:"remediation,omitempty"`
+}
+
+// newErrorResult returns the errorResult for err, or nil if err is.
+func newErrorResult(err error, vars map[string]string) *errorResult {
+	if err == nil {
+		return nil
+	}
+	return &errorResult{
+		Message:     err.Error(),
+		ExitCode:    exitCode(err),
+		Remediation: remediationFor(err, vars),
+	}
+}
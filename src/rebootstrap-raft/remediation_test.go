@@ -0,0 +1,57 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/juju/errors"
+)
+
+func TestRemediationFor(t *testing.T) {
+	vars := map[string]string{"<id>": "2", "<raft-dir>": "/var/lib/juju/raft", "<service>": ""}
+	for _, test := range []struct {
+		about   string
+		err     error
+		code    string
+		command string
+	}{{
+		about: "plain error",
+		err:   errors.New("boom"),
+	}, {
+		about: "exit code without a remediation",
+		err:   withExitCode(errors.New("boom"), exitTimedOut+100),
+	}, {
+		about:   "from the exit code",
+		err:     withExitCode(errors.New("exists"), exitRaftDirExists),
+		code:    remedyRaftDirExists,
+		command: "sudo mv /var/lib/juju/raft /var/lib/juju/raft.old",
+	}, {
+		about:   "traced",
+		err:     errors.Annotate(withExitCode(errors.New("refused"), exitMongoAuth), "connecting"),
+		code:    remedyMongoAuth,
+		command: "sudo rebootstrap-raft --machine-id 2 --keyfile-fallback --dry-run",
+	}, {
+		about:   "finer than the exit code",
+		err:     withRemedy(withExitCode(errors.New("running"), exitValidation), remedyAgentRunning),
+		code:    remedyAgentRunning,
+		command: "sudo systemctl stop <service>",
+	}} {
+		t.Run(test.about, func(t *testing.T) {
+			r := remediationFor(test.err, vars)
+			if test.code == "" {
+				if r != nil {
+					t.Errorf("got %+v, want none", r)
+				}
+				return
+			}
+			if r == nil {
+				t.Fatalf("got no remediation, want %s", test.code)
+			}
+			if r.Code != test.code || r.Command != test.command {
+				t.Errorf("got %s %q, want %s %q", r.Code, r.Command, test.code, test.command)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+)
+
+// remote runs commands on another controller machine.
+type remote interface {
+	// Run runs the command given by args (as root) and returns its
+	// standard output.
+	Run(args ...string) ([]byte, error)
+
+	// Copy copies a local file to path on the machine.
+	Copy(localPath, remotePath string) error
+
+	// TempDir makes a new directory on the machine that only the
+	// user Copy writes as can get into, and returns its path.
+	TempDir() (string, error)
+
+	// String describes the machine for messages.
+	String() string
+}
+
+// sshFlags holds the flags used to reach other controllers with ssh.
+type sshFlags struct {
+	sshUser        string
+	sshIdentity    string
+	jujuController string
+}
+
+func (s *sshFlags) setFlags(f *gnuflag.FlagSet) {
+	f.StringVar(&s.sshUser, "ssh-user", "ubuntu", "user to ssh to other controllers as")
+	f.StringVar(&s.sshIdentity, "ssh-identity", "", "private key to use for ssh (default: ssh's own choice)")
+	f.StringVar(&s.jujuController, "juju-controller", "", "reach other controllers with juju ssh through this controller, instead of ssh")
+}
+
+// remote returns a remote that reaches the given controller machine,
+// with juju ssh if a controller was named or ssh to host otherwise.
+func (s *sshFlags) remote(machineID, host string) remote {
+	if s.jujuController != "" {
+		return &jujuRemote{model: controllerModel(s.jujuController), machine: machineID}
+	}
+	return &sshRemote{host: host, user: s.sshUser, identity: s.sshIdentity}
+}
+
+// sshRemote runs commands over ssh, using sudo to become root.
+type sshRemote struct {
+	host     string
+	user     string
+	identity string
+}
+
+func (r *sshRemote) options() []string {
+	options := []string{"-o", "BatchMode=yes", "-o", "ConnectTimeout=10"}
+	if r.identity != "" {
+		options = append(options, "-i", r.identity)
+	}
+	return options
+}
+
+func (r *sshRemote) target() string {
+	if r.user == "" {
+		return r.host
+	}
+	return r.user + "@" + r.host
+}
+
+// Run is part of remote.
+func (r *sshRemote) Run(args ...string) ([]byte, error) {
+	return r.RunInput(nil, args...)
+}
+
+// RunInput is like Run but gives the command stdin as its standard
+// input, for secrets that shouldn't be on its command line.
+func (r *sshRemote) RunInput(stdin []byte, args ...string) ([]byte, error) {
+	sshArgs := append(r.options(), r.target(), "sudo", shellQuote(args))
+	command := exec.Command("ssh", sshArgs...)
+	if stdin != nil {
+		command.Stdin = bytes.NewReader(stdin)
+	}
+	return runRemoteCommand(command)
+}
+
+// Copy is part of remote.
+func (r *sshRemote) Copy(localPath, remotePath string) error {
+	scpArgs := append(r.options(), localPath, r.target()+":"+remotePath)
+	_, err := runRemoteCommand(exec.Command("scp", scpArgs...))
+	return errors.Trace(err)
+}
+
+// TempDir is part of remote. The directory is made as the ssh user,
+// who Copy writes as, rather than with sudo.
+func (r *sshRemote) TempDir() (string, error) {
+	sshArgs := append(r.options(), r.target(), shellQuote(mktempArgs))
+	return tempDirPath(runRemoteCommand(exec.Command("ssh", sshArgs...)))
+}
+
+func (r *sshRemote) String() string {
+	return r.host
+}
+
+// runRemoteCommand runs command, returning its standard output. If it
+// fails the error includes what was written to stderr, since that's
+// where ssh and the remote command say what went wrong.
+func runRemoteCommand(command *exec.Cmd) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	command.Stdout = &stdout
+	command.Stderr = &stderr
+	logger.Debugf("running %s", strings.Join(command.Args, " "))
+	err := command.Run()
+	if err != nil {
+		return stdout.Bytes(), errors.Errorf("%s: %v: %s", command.Args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	if stderr.Len() > 0 {
+		logger.Debugf("%s stderr: %s", command.Args[0], strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// shellQuote quotes args for the remote shell ssh runs them with.
+func shellQuote(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// mktempArgs makes a directory for pushFile. mktemp gives it mode
+// 0700.
+var mktempArgs = []string{"mktemp", "-d", "/tmp/rebootstrap-raft.XXXXXXXXXX"}
+
+// tempDirPath returns the directory mktempArgs printed.
+func tempDirPath(out []byte, err error) (string, error) {
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	dir := strings.TrimSpace(string(out))
+	if !path.IsAbs(dir) {
+		return "", errors.Errorf("mktemp gave %q, not an absolute path", dir)
+	}
+	return dir, nil
+}
+
+// pushFile copies the local file at localPath, as name, into a new
+// directory on r that only the user copying it can get into, and
+// returns the copy's path and a function that removes the directory.
+// The copy is then run or read as root, so it mustn't go anywhere
+// another user on the machine could put a file of their own first or
+// swap it afterwards, as they could at a fixed path in /tmp.
+func pushFile(r remote, localPath, name string) (string, func(), error) {
+	dir, err := r.TempDir()
+	if err != nil {
+		return "", nil, errors.Annotate(err, "making a private directory")
+	}
+	remove := func() {
+		if _, err := r.Run("rm", "-rf", dir); err != nil {
+			logger.Warningf("removing %s from %s: %v", dir, r, err)
+		}
+	}
+	remotePath := path.Join(dir, name)
+	if err := r.Copy(localPath, remotePath); err != nil {
+		remove()
+		return "", nil, errors.Trace(err)
+	}
+	return remotePath, remove, nil
+}
+
+// runRemoteBootstrap runs a copy of this tool at path on r with the
+// bootstrap subcommand and the given flags, which must include
+// --format json, and returns the result it printed.
+func runRemoteBootstrap(r remote, path string, flags ...string) (*bootstrapResult, error) {
+	return parseRemoteBootstrap(r.Run(append([]string{path, "bootstrap"}, flags...)...))
+}
+
+// parseRemoteBootstrap parses the result a remote bootstrap printed.
+func parseRemoteBootstrap(out []byte, err error) (*bootstrapResult, error) {
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var result bootstrapResult
+	if err := json.Unmarshal(out, &result); err != nil {
+		return nil, errors.Annotatef(err, "parsing result %q", out)
+	}
+	return &result, nil
+}
+
+// localRemote runs commands on this machine, so that it can be
+// treated the same way as the others.
+type localRemote struct{}
+
+// Run is part of remote.
+func (localRemote) Run(args ...string) ([]byte, error) {
+	return runRemoteCommand(exec.Command(args[0], args[1:]...))
+}
+
+// Copy is part of remote.
+func (localRemote) Copy(localPath, remotePath string) error {
+	return errors.Trace(copyFile(localPath, remotePath, 0755))
+}
+
+// TempDir is part of remote.
+func (localRemote) TempDir() (string, error) {
+	dir, err := ioutil.TempDir("", "rebootstrap-raft.")
+	return dir, errors.Trace(err)
+}
+
+func (localRemote) String() string {
+	return "this machine"
+}
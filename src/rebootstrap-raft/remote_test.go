@@ -0,0 +1,104 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTempDirPath(t *testing.T) {
+	for _, test := range []struct {
+		out  string
+		err  error
+		dir  string
+		fail string
+	}{{
+		out: "/tmp/rebootstrap-raft.abcdefghij\n",
+		dir: "/tmp/rebootstrap-raft.abcdefghij",
+	}, {
+		out:  "\n",
+		fail: `mktemp gave "", not an absolute path`,
+	}, {
+		out:  "rebootstrap-raft.abcdefghij",
+		fail: `mktemp gave "rebootstrap-raft.abcdefghij", not an absolute path`,
+	}, {
+		err:  errors.New("ssh: connection refused"),
+		fail: "ssh: connection refused",
+	}} {
+		dir, err := tempDirPath([]byte(test.out), test.err)
+		if test.fail != "" {
+			if err == nil || err.Error() != test.fail {
+				t.Errorf("tempDirPath(%q, %v): got error %v, want %q", test.out, test.err, err, test.fail)
+			}
+			continue
+		}
+		if err != nil || dir != test.dir {
+			t.Errorf("tempDirPath(%q): got %q, %v, want %q", test.out, dir, err, test.dir)
+		}
+	}
+}
+
+// fakeRemote records what's asked of it.
+type fakeRemote struct {
+	copyErr error
+	copied  []string
+	runs    [][]string
+}
+
+func (r *fakeRemote) Run(args ...string) ([]byte, error) {
+	r.runs = append(r.runs, args)
+	return nil, nil
+}
+
+func (r *fakeRemote) Copy(localPath, remotePath string) error {
+	r.copied = append(r.copied, remotePath)
+	return r.copyErr
+}
+
+func (r *fakeRemote) TempDir() (string, error) {
+	return "/tmp/rebootstrap-raft.private", nil
+}
+
+func (r *fakeRemote) String() string {
+	return "fake"
+}
+
+func TestPushFile(t *testing.T) {
+	for _, test := range []struct {
+		about   string
+		copyErr error
+	}{
+		{about: "copied"},
+		{about: "copy fails", copyErr: errors.New("scp: no space left on device")},
+	} {
+		t.Run(test.about, func(t *testing.T) {
+			r := &fakeRemote{copyErr: test.copyErr}
+			path, remove, err := pushFile(r, "/usr/local/bin/rebootstrap-raft", "rebootstrap-raft")
+			wantPath := "/tmp/rebootstrap-raft.private/rebootstrap-raft"
+			if !reflect.DeepEqual(r.copied, []string{wantPath}) {
+				t.Errorf("copied to %v, want %s", r.copied, wantPath)
+			}
+			if test.copyErr != nil {
+				if err == nil || !strings.Contains(err.Error(), test.copyErr.Error()) {
+					t.Errorf("got error %v, want %v", err, test.copyErr)
+				}
+			} else {
+				if err != nil || path != wantPath {
+					t.Fatalf("got %q, %v, want %q", path, err, wantPath)
+				}
+				if len(r.runs) != 0 {
+					t.Errorf("ran %v before remove", r.runs)
+				}
+				remove()
+			}
+			want := [][]string{{"rm", "-rf", "/tmp/rebootstrap-raft.private"}}
+			if !reflect.DeepEqual(r.runs, want) {
+				t.Errorf("ran %v, want %v", r.runs, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+)
+
+const removeMemberDoc = `
+
+Remove dead controllers from the configuration in an existing raft
+store, so that the controllers that are left can reach quorum again
+without replacing their stores. This is the equivalent of hashicorp
+raft's peers.json recovery for Juju's raft directory.
+
+Run it with the same ids on every remaining controller, with their
+agents stopped:
+
+    rebootstrap-raft remove-member --machine-id 0 2
+
+The local machine can't be removed, and at least one voter must be
+left. The raft directory is backed up next to itself first.
+
+`
+
+type removeMemberCommand struct {
+	storeEditCommand
+	ids []raft.ServerID
+}
+
+// Info is part of cmd.Command.
+func (c *removeMemberCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "remove-member",
+		Args:    "--machine-id <id> <member-id> [<member-id>...]",
+		Purpose: "Remove servers from an existing raft store's configuration.",
+		Doc:     strings.TrimSpace(removeMemberDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *removeMemberCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.storeEditCommand.setFlags(f)
+}
+
+// Init is part of cmd.Command.
+func (c *removeMemberCommand) Init(args []string) error {
+	if err := c.storeEditCommand.init(); err != nil {
+		return errors.Trace(err)
+	}
+	if len(args) == 0 {
+		return errors.Errorf("at least one member id is required")
+	}
+	for _, arg := range args {
+		if arg == c.machineID {
+			return errors.Errorf("can't remove the local machine %s", arg)
+		}
+		c.ids = append(c.ids, raft.ServerID(arg))
+	}
+	return nil
+}
+
+// Run is part of cmd.Command.
+func (c *removeMemberCommand) Run(ctx *cmd.Context) error {
+	return reportExitCode(ctx, c.apply(ctx, c.remove))
+}
+
+// remove drops the servers from config.
+func (c *removeMemberCommand) remove(config *raft.Configuration) error {
+	for _, id := range c.ids {
+		i := serverIndex(*config, id)
+		if i < 0 {
+			return errors.NotFoundf("server %s in the configuration", id)
+		}
+		logger.Infof("removing server %s (%s)", id, config.Servers[i].Address)
+		config.Servers = append(config.Servers[:i], config.Servers[i+1:]...)
+	}
+	return nil
+}
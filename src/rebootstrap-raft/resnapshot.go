@@ -0,0 +1,211 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+const resnapshotDoc = `
+
+Write a fresh snapshot of a raft store by replaying its log through
+the lease FSM, as jujud would. If the log still starts at index 1 it's
+replayed from nothing, so a corrupt snapshot doesn't matter;
+otherwise the newest valid snapshot that covers the entries before the
+log starts is replayed from.
+
+The new snapshot covers the whole log, so it can be followed by
+truncate-logs to compact the store, and it replaces a damaged
+snapshot without throwing away any raft history. The machine agent
+must be stopped (or use --stop-agent).
+
+`
+
+type resnapshotCommand struct {
+	cmd.CommandBase
+	logFlags
+	dataDirFlags
+	machineID    string
+	raftDir      string
+	agentService string
+	stopAgent    bool
+	dryRun       bool
+	yes          bool
+}
+
+// Info is part of cmd.Command.
+func (c *resnapshotCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "resnapshot",
+		Args:    "--machine-id <id>",
+		Purpose: "Write a new snapshot by replaying a raft store's log.",
+		Doc:     strings.TrimSpace(resnapshotDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *resnapshotCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	c.logFlags.setFlags(f)
+	c.dataDirFlags.setFlags(f)
+	f.StringVar(&c.machineID, "machine-id", "", "ID of this Juju controller machine")
+	f.StringVar(&c.raftDir, "raft-dir", "", "raft directory location (default <data-dir>/raft)")
+	f.StringVar(&c.agentService, "agent-service", "", "machine agent service name, or none if it isn't run by systemd (default jujud-machine-<id>.service, or the snap's if that's installed)")
+	f.BoolVar(&c.stopAgent, "stop-agent", false, "stop the machine agent if it's running")
+	f.BoolVar(&c.dryRun, "dry-run", false, "replay the log without writing the snapshot")
+	f.BoolVar(&c.yes, "yes", false, "don't ask for confirmation")
+}
+
+// Init is part of cmd.Command.
+func (c *resnapshotCommand) Init(args []string) error {
+	if err := c.setupLogging(c.dryRun); err != nil {
+		return errors.Trace(err)
+	}
+	if err := c.dataDirFlags.resolveStore(c.machineID, &c.raftDir, &c.agentService); err != nil {
+		return errors.Trace(err)
+	}
+	if c.agentService == noAgentService && c.stopAgent {
+		return errors.Errorf("--stop-agent needs an agent service")
+	}
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *resnapshotCommand) Run(ctx *cmd.Context) error {
+	c.setupOutput(ctx)
+	return reportExitCode(ctx, c.run(ctx))
+}
+
+func (c *resnapshotCommand) run(ctx *cmd.Context) error {
+	if _, err := os.Stat(filepath.Join(c.raftDir, "logs")); err != nil {
+		return errors.Annotate(err, "finding the bolt log store")
+	}
+	if !c.dryRun {
+		lock, err := acquireLock(c.dataDir)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer lock.Release()
+		stopped, err := ensureAgentStopped(c.agentService, c.stopAgent)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if stopped {
+			logger.Infof("%s was stopped; start it again once you're done.", c.agentService)
+		}
+	}
+
+	// Replaying only reads the store.
+	logStore, err := openStoreReadOnly(c.raftDir)
+	if err != nil {
+		return errors.Annotate(err, "opening log store")
+	}
+	defer logStore.Close()
+	first, err := logStore.FirstIndex()
+	if err != nil {
+		return errors.Annotate(err, "reading first index")
+	}
+	last, err := logStore.LastIndex()
+	if err != nil {
+		return errors.Annotate(err, "reading last index")
+	}
+	if last == 0 {
+		return errors.Errorf("the log in %q is empty", c.raftDir)
+	}
+
+	replay, err := c.replayStart(first)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if replay.Index >= last {
+		fmt.Fprintf(ctx.Stdout, "The newest snapshot already covers the log (up to %d).\n", last)
+		return nil
+	}
+	from := replay.Index + 1
+	if err := replay.Replay(logStore, last); err != nil {
+		return withExitCode(errors.Annotate(err, "replaying log"), exitValidation)
+	}
+	fmt.Fprintf(ctx.Stdout, "Replayed entries %d to %d (%d lease commands): %d leases, %d pinned, global time %s.\n",
+		from, last, replay.Commands, len(replay.Leases.Entries), len(replay.Leases.Pinned),
+		replay.Leases.GlobalTime.UTC().Format(time.RFC3339))
+	fmt.Fprintf(ctx.Stdout, "Configuration (from index %d):\n", replay.ConfigurationIndex)
+	writeServers(ctx.Stdout, "  ", replay.Configuration)
+	if c.dryRun {
+		logger.Infof("dry-run specified - stopping")
+		return nil
+	}
+	if !c.yes {
+		ok, err := confirm(ctx, fmt.Sprintf("Write a snapshot at index %d, term %d?", replay.Index, replay.Term))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !ok {
+			return errors.New("aborted")
+		}
+	}
+	store, err := rebootstrap.NewSnapshotStore(c.raftDir, jujudSnapshotRetention)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	id, err := replay.WriteSnapshot(store)
+	if err != nil {
+		return withExitCode(err, exitWriteFailed)
+	}
+	fmt.Fprintf(ctx.Stdout, "Wrote snapshot %s.\n", id)
+	return nil
+}
+
+// replayStart returns the state to replay the log from. A log that
+// starts at index 1 holds everything, so the snapshots aren't needed.
+// Otherwise the newest valid snapshot covering the entries before the
+// log starts is used.
+func (c *resnapshotCommand) replayStart(first uint64) (*rebootstrap.LeaseReplay, error) {
+	if first <= 1 {
+		return &rebootstrap.LeaseReplay{Leases: rebootstrap.EmptyLeaseSnapshot()}, nil
+	}
+	snapshots, err := scanSnapshots(filepath.Join(c.raftDir, "snapshots"))
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, errors.Trace(err)
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.meta == nil || snapshot.meta.Index+1 < first {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(snapshot.path, snapshotStateFile))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		leases, err := rebootstrap.DecodeLeaseSnapshot(data)
+		if err != nil {
+			logger.Warningf("skipping snapshot %s: %v", snapshot.name, err)
+			continue
+		}
+		if leases.Entries == nil {
+			leases.Entries = make(map[rebootstrap.LeaseKey]rebootstrap.LeaseEntry)
+		}
+		if leases.Pinned == nil {
+			leases.Pinned = make(map[rebootstrap.LeaseKey][]string)
+		}
+		logger.Infof("replaying from snapshot %s (index %d, term %d)", snapshot.name, snapshot.meta.Index, snapshot.meta.Term)
+		return &rebootstrap.LeaseReplay{
+			Leases:             leases,
+			Configuration:      snapshot.meta.Configuration,
+			ConfigurationIndex: snapshot.meta.ConfigurationIndex,
+			Index:              snapshot.meta.Index,
+			Term:               snapshot.meta.Term,
+		}, nil
+	}
+	return nil, withExitCode(errors.Errorf("the log starts at %d and no valid snapshot covers the entries before it", first), exitValidation)
+}
@@ -0,0 +1,54 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/errors"
+)
+
+// restoredAgentMachineID returns the machine whose agent directory a
+// data directory restored from a backup holds. That's machineID if
+// it's there; otherwise the backup was taken on another machine, and
+// its one agent directory is used.
+func restoredAgentMachineID(dataDir, machineID string) (string, error) {
+	if _, err := os.Stat(filepath.Dir(agentConfPath(dataDir, machineID))); err == nil {
+		return machineID, nil
+	}
+	matches, err := filepath.Glob(filepath.Join(dataDir, "agents", "machine-*"))
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	switch len(matches) {
+	case 0:
+		return "", errors.NotFoundf("machine agent directory in %q", dataDir)
+	case 1:
+		return strings.TrimPrefix(filepath.Base(matches[0]), "machine-"), nil
+	}
+	return "", errors.Errorf("%q has agent directories for several machines (%s) - use --agent-machine-id",
+		dataDir, strings.Join(matches, ", "))
+}
+
+// checkRestoredConfig makes sure the configuration generated after a
+// restore includes this machine. The replicaset comes from the
+// restored database, so if the backup was taken on another machine
+// (or the replicaset hasn't been reinitiated since) it may describe
+// the old controllers instead.
+func checkRestoredConfig(servers raft.Configuration, machineID, backupMachineID string) error {
+	ids := make(map[string]bool)
+	for _, server := range servers.Servers {
+		ids[string(server.ID)] = true
+	}
+	if !ids[machineID] {
+		return errors.Errorf("machine %s isn't in the replicaset of the restored database - has it been reinitiated on this machine?", machineID)
+	}
+	if backupMachineID != machineID && ids[backupMachineID] {
+		logger.Warningf("machine %s, where the backup was taken, is still a replicaset member", backupMachineID)
+	}
+	return nil
+}
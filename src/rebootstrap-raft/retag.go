@@ -0,0 +1,236 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"github.com/juju/replicaset"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+const retagDoc = `
+
+Put back the juju-machine-id tags on replicaset members that have lost
+them, which bootstrap needs to know which machine each member is. Each
+untagged member is matched to the controller machine in Juju's
+machines collection that has the member's address; give the rest (or
+correct a wrong match) with --map:
+
+    rebootstrap-raft retag --machine-id 0 --map 2=5
+
+where 2 is the replicaset member id (the _id in rs.conf()) and 5 the
+machine. The plan is shown and confirmed before the replicaset is
+reconfigured, which needs a primary. Run bootstrap afterwards.
+
+`
+
+type retagCommand struct {
+	cmd.CommandBase
+	logFlags
+	mongoFlags
+	dataDirFlags
+	machineID string
+	mapping   string
+	dryRun    bool
+	yes       bool
+
+	given map[int]string
+}
+
+// Info is part of cmd.Command.
+func (c *retagCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "retag",
+		Args:    "--machine-id <id> [--map <member>=<machine>[,...]]",
+		Purpose: "Restore missing juju-machine-id tags on replicaset members.",
+		Doc:     strings.TrimSpace(retagDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *retagCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	c.logFlags.setFlags(f)
+	c.dataDirFlags.setFlags(f)
+	c.mongoFlags.setFlags(f)
+	f.StringVar(&c.machineID, "machine-id", "", "ID of this Juju controller machine, whose credentials are used for MongoDB")
+	f.StringVar(&c.mapping, "map", "", "comma-separated <member>=<machine> pairs giving the machine for replicaset members by id")
+	f.BoolVar(&c.dryRun, "dry-run", false, "show the tags that would be set without changing the replicaset")
+	f.BoolVar(&c.yes, "yes", false, "don't ask for confirmation")
+}
+
+// Init is part of cmd.Command.
+func (c *retagCommand) Init(args []string) error {
+	if err := c.setupLogging(c.dryRun); err != nil {
+		return errors.Trace(err)
+	}
+	if c.machineID == "" {
+		return errors.Errorf("--machine-id is required")
+	}
+	if c.mapping != "" {
+		given, err := parseMemberMap(c.mapping)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		c.given = given
+	}
+	if err := c.dataDirFlags.resolve(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := c.mongoFlags.validate(c.agentConfFile(c.machineID), c.hostfsPrefix); err != nil {
+		return errors.Trace(err)
+	}
+	return c.CommandBase.Init(args)
+}
+
+// parseMemberMap parses --map's <member>=<machine> pairs.
+func parseMemberMap(value string) (map[int]string, error) {
+	result := make(map[int]string)
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, errors.Errorf("--map: expected <member>=<machine>, got %q", pair)
+		}
+		memberID, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, errors.Errorf("--map: member %q isn't a replicaset member id", parts[0])
+		}
+		result[memberID] = parts[1]
+	}
+	return result, nil
+}
+
+// retagPlan is a tag to be set on a member, and where it came from.
+type retagPlan struct {
+	member  replicaset.Member
+	machine string
+	source  string
+}
+
+// Run is part of cmd.Command.
+func (c *retagCommand) Run(ctx *cmd.Context) error {
+	c.setupOutput(ctx)
+	return reportExitCode(ctx, c.run(ctx))
+}
+
+func (c *retagCommand) run(ctx *cmd.Context) error {
+	stdCtx, cancel := interruptContext()
+	defer cancel()
+	session, err := c.connect(stdCtx, c.machineID, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer session.Close()
+	members, err := rebootstrap.Members(stdCtx, session)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	members = rebootstrap.DataMembers(members)
+	for memberID := range c.given {
+		if !rebootstrap.HasMember(members, memberID) {
+			return withExitCode(errors.Errorf("--map: there's no replicaset member %d", memberID), exitValidation)
+		}
+	}
+	proposed, err := rebootstrap.ProposeMachineTags(stdCtx, session, members)
+	if err != nil {
+		return errors.Annotate(err, "matching members to machines")
+	}
+
+	var plan []retagPlan
+	var unmatched []string
+	for _, member := range members {
+		current, tagged := member.Tags[rebootstrap.MachineIDTag]
+		if machine, ok := c.given[member.Id]; ok {
+			if machine != current || !tagged {
+				plan = append(plan, retagPlan{member, machine, "--map"})
+			}
+		} else if machine, ok := proposed[member.Id]; ok {
+			plan = append(plan, retagPlan{member, machine, "machines"})
+		} else if !tagged {
+			unmatched = append(unmatched, fmt.Sprintf("%d (%s)", member.Id, member.Address))
+		}
+	}
+	if len(plan) > 0 {
+		if err := writeRetagPlan(ctx.Stdout, plan); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if len(unmatched) > 0 {
+		return withExitCode(errors.Errorf("no machine found for members %s - give them with --map", strings.Join(unmatched, ", ")), exitMissingTags)
+	}
+	if len(plan) == 0 {
+		fmt.Fprintf(ctx.Stdout, "Every replicaset member already has a %s tag.\n", rebootstrap.MachineIDTag)
+		return nil
+	}
+	if err := checkRetagPlan(members, plan); err != nil {
+		return withExitCode(err, exitValidation)
+	}
+	if c.dryRun {
+		logger.Infof("dry-run specified - stopping")
+		return nil
+	}
+	if !c.yes {
+		ok, err := confirm(ctx, "Reconfigure the replicaset with these tags?")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !ok {
+			return errors.New("aborted")
+		}
+	}
+	tags := make(map[int]string)
+	for _, p := range plan {
+		tags[p.member.Id] = p.machine
+	}
+	if err := rebootstrap.SetMachineTags(stdCtx, session, tags); err != nil {
+		return withExitCode(err, exitWriteFailed)
+	}
+	fmt.Fprintf(ctx.Stdout, "Tagged %d members; bootstrap can be run now.\n", len(plan))
+	return nil
+}
+
+// checkRetagPlan makes sure no two members would end up with the same
+// machine id.
+func checkRetagPlan(members []replicaset.Member, plan []retagPlan) error {
+	final := make(map[int]string)
+	for _, member := range members {
+		if id, ok := member.Tags[rebootstrap.MachineIDTag]; ok {
+			final[member.Id] = id
+		}
+	}
+	for _, p := range plan {
+		final[p.member.Id] = p.machine
+	}
+	byMachine := make(map[string][]int)
+	for memberID, machine := range final {
+		byMachine[machine] = append(byMachine[machine], memberID)
+	}
+	for machine, memberIDs := range byMachine {
+		if len(memberIDs) > 1 {
+			sort.Ints(memberIDs)
+			return errors.Errorf("members %v would all be machine %s", memberIDs, machine)
+		}
+	}
+	return nil
+}
+
+func writeRetagPlan(w io.Writer, plan []retagPlan) error {
+	tw := tabwriter.NewWriter(w, 0, 1, 2, ' ', 0)
+	fmt.Fprintln(tw, "MEMBER\tADDRESS\tCURRENT\tMACHINE\tFROM")
+	for _, p := range plan {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", p.member.Id, p.member.Address,
+			dashIfEmpty(p.member.Tags[rebootstrap.MachineIDTag]), p.machine, p.source)
+	}
+	return errors.Trace(tw.Flush())
+}
@@ -0,0 +1,88 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/juju/replicaset"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+func TestParseMemberMap(t *testing.T) {
+	for _, test := range []struct {
+		value  string
+		expect map[int]string
+		err    string
+	}{{
+		value:  "1=0",
+		expect: map[int]string{1: "0"},
+	}, {
+		value:  "1=0, 2=3,4=5",
+		expect: map[int]string{1: "0", 2: "3", 4: "5"},
+	}, {
+		value: "1",
+		err:   `--map: expected <member>=<machine>, got "1"`,
+	}, {
+		value: "1=",
+		err:   `--map: expected <member>=<machine>, got "1="`,
+	}, {
+		value: "one=0",
+		err:   `--map: member "one" isn't a replicaset member id`,
+	}} {
+		t.Run(test.value, func(t *testing.T) {
+			got, err := parseMemberMap(test.value)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, test.expect) {
+				t.Errorf("got %v, %v, want %v", got, err, test.expect)
+			}
+		})
+	}
+}
+
+func TestCheckRetagPlan(t *testing.T) {
+	tagged := func(id int, machine string) replicaset.Member {
+		m := replicaset.Member{Id: id}
+		if machine != "" {
+			m.Tags = map[string]string{rebootstrap.MachineIDTag: machine}
+		}
+		return m
+	}
+	members := []replicaset.Member{tagged(1, "0"), tagged(2, ""), tagged(3, "")}
+	for _, test := range []struct {
+		about string
+		plan  []retagPlan
+		err   string
+	}{{
+		about: "distinct machines",
+		plan:  []retagPlan{{member: members[1], machine: "1"}, {member: members[2], machine: "2"}},
+	}, {
+		about: "retagging a tagged member",
+		plan:  []retagPlan{{member: members[0], machine: "3"}, {member: members[1], machine: "0"}},
+	}, {
+		about: "clashes with an existing tag",
+		plan:  []retagPlan{{member: members[1], machine: "0"}},
+		err:   "members [1 2] would all be machine 0",
+	}, {
+		about: "clashes within the plan",
+		plan:  []retagPlan{{member: members[1], machine: "4"}, {member: members[2], machine: "4"}},
+		err:   "members [2 3] would all be machine 4",
+	}} {
+		t.Run(test.about, func(t *testing.T) {
+			err := checkRetagPlan(members, test.plan)
+			if test.err == "" && err != nil {
+				t.Errorf("unexpected error %v", err)
+			} else if test.err != "" && (err == nil || err.Error() != test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
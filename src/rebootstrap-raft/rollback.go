@@ -0,0 +1,34 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+// rollback records how to undo each change made during a run, so a
+// failure part way through can put the machine back the way it was.
+type rollback struct {
+	steps []rollbackStep
+}
+
+type rollbackStep struct {
+	description string
+	undo        func() error
+}
+
+// add records a step to undo a change that's just been made.
+func (r *rollback) add(description string, undo func() error) {
+	r.steps = append(r.steps, rollbackStep{description, undo})
+}
+
+// run undoes the recorded changes, most recent first. Failures are
+// logged rather than returned since the caller is already handling
+// an error, and a failed step shouldn't stop the others.
+func (r *rollback) run() {
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		step := r.steps[i]
+		logger.Warningf("Rolling back: %s.", step.description)
+		if err := step.undo(); err != nil {
+			logger.Errorf("%s: %v", step.description, err)
+		}
+	}
+	r.steps = nil
+}
@@ -0,0 +1,280 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-msgpack/v2/codec"
+	"github.com/hashicorp/raft"
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+const salvageDoc = `
+
+Recover what can be read from a damaged raft log store. The bolt file
+is scanned page by page rather than by walking the database tree, so
+entries in pages that are still intact are recovered even when the
+tree structure or freelist is corrupt. Recovered log entries and
+stable store keys are written to a new log store in the output
+directory, and any gaps in the recovered indexes are reported.
+
+The output directory must not already contain a log store.
+
+`
+
+// These describe the on-disk layout of a bolt database file; see
+// page.go and bucket.go in go.etcd.io/bbolt.
+const (
+	boltPageHeaderSize = 16
+	boltLeafElemSize   = 16
+	boltBucketHeader   = 16
+	boltLeafPageFlag   = 0x02
+	boltBucketLeafFlag = 0x01
+	boltMagic          = 0xED0CDAED
+	boltDefaultPage    = 4096
+)
+
+// stableKeys are the keys raft keeps in its stable store.
+var stableKeys = []string{"CurrentTerm", "LastVoteTerm", "LastVoteCand"}
+
+type salvageCommand struct {
+	cmd.CommandBase
+	logFlags
+	source string
+	target string
+}
+
+// Info is part of cmd.Command.
+func (c *salvageCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "salvage",
+		Args:    "<logs-file> <output-dir>",
+		Purpose: "Recover log entries from a corrupted raft log store.",
+		Doc:     strings.TrimSpace(salvageDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *salvageCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	c.logFlags.setFlags(f)
+}
+
+// Init is part of cmd.Command.
+func (c *salvageCommand) Init(args []string) error {
+	if err := c.setupLogging(false); err != nil {
+		return errors.Trace(err)
+	}
+	if len(args) < 2 {
+		return errors.Errorf("logs file and output directory are required")
+	}
+	c.source, c.target = args[0], args[1]
+	return c.CommandBase.Init(args[2:])
+}
+
+// Run is part of cmd.Command.
+func (c *salvageCommand) Run(ctx *cmd.Context) error {
+	c.setupOutput(ctx)
+	if _, err := os.Stat(filepath.Join(c.target, "logs")); err == nil {
+		return errors.Errorf("%q already has a log store", c.target)
+	}
+	data, err := ioutil.ReadFile(c.source)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	result := salvageBoltFile(data)
+	fmt.Fprintf(ctx.Stdout, "Scanned %d pages, %d unreadable.\n", result.pages, result.badPages)
+
+	store, err := rebootstrap.NewLogStore(c.target, nil)
+	if err != nil {
+		return errors.Annotate(err, "making log store")
+	}
+	defer store.Close()
+
+	logs := result.sortedLogs()
+	if len(logs) > 0 {
+		if err := store.StoreLogs(logs); err != nil {
+			return errors.Annotate(err, "writing recovered logs")
+		}
+	}
+	for _, key := range stableKeys {
+		value, ok := result.stable[key]
+		if !ok {
+			fmt.Fprintf(ctx.Stdout, "Stable store key %s was lost.\n", key)
+			continue
+		}
+		if err := store.Set([]byte(key), value); err != nil {
+			return errors.Annotatef(err, "writing %s", key)
+		}
+	}
+
+	if len(logs) == 0 {
+		fmt.Fprintln(ctx.Stdout, "No log entries could be recovered.")
+		return nil
+	}
+	fmt.Fprintf(ctx.Stdout, "Recovered %d log entries, indexes %d to %d.\n", len(logs), logs[0].Index, logs[len(logs)-1].Index)
+	for _, gap := range findGaps(logs) {
+		fmt.Fprintf(ctx.Stdout, "Lost log entries %d to %d.\n", gap[0], gap[1])
+	}
+	fmt.Fprintf(ctx.Stdout, "Salvaged store written to %q.\n", c.target)
+	return nil
+}
+
+// salvageResult holds what was recovered from a bolt file.
+type salvageResult struct {
+	pages    int
+	badPages int
+	logs     map[uint64]*raft.Log
+	stable   map[string][]byte
+}
+
+// salvageBoltFile scans every page of a raft-boltdb file and picks out
+// anything that looks like a raft log entry or stable store value.
+// Old copies of pages left behind by bolt's copy-on-write can hold
+// earlier versions of the same entries, so where an index is seen
+// more than once the entry with the highest term wins, and for the
+// term keys the highest value wins.
+func salvageBoltFile(data []byte) *salvageResult {
+	result := &salvageResult{
+		logs:   make(map[uint64]*raft.Log),
+		stable: make(map[string][]byte),
+	}
+	pageSize := boltPageSize(data)
+	for offset := 0; offset+boltPageHeaderSize <= len(data); offset += pageSize {
+		result.pages++
+		flags := binary.LittleEndian.Uint16(data[offset+8:])
+		overflow := int(binary.LittleEndian.Uint32(data[offset+12:]))
+		if flags != boltLeafPageFlag {
+			continue
+		}
+		end := offset + (overflow+1)*pageSize
+		if overflow < 0 || end > len(data) {
+			result.badPages++
+			continue
+		}
+		if !result.scanLeaf(data[offset:end]) {
+			result.badPages++
+		}
+		offset += overflow * pageSize
+	}
+	return result
+}
+
+// boltPageSize reads the page size from the first readable meta page,
+// falling back to the usual default.
+func boltPageSize(data []byte) int {
+	for _, offset := range []int{0, boltDefaultPage} {
+		if offset+boltPageHeaderSize+12 > len(data) {
+			continue
+		}
+		meta := data[offset:]
+		if binary.LittleEndian.Uint32(meta[boltPageHeaderSize:]) != boltMagic {
+			continue
+		}
+		size := int(binary.LittleEndian.Uint32(meta[boltPageHeaderSize+8:]))
+		if size >= 512 && size&(size-1) == 0 {
+			return size
+		}
+	}
+	logger.Warningf("Couldn't read page size from bolt meta pages, assuming %d.", boltDefaultPage)
+	return boltDefaultPage
+}
+
+// scanLeaf records the entries from a leaf page, recursing into inline
+// buckets. It returns false if the page was malformed.
+func (r *salvageResult) scanLeaf(page []byte) bool {
+	count := int(binary.LittleEndian.Uint16(page[10:]))
+	ok := true
+	for i := 0; i < count; i++ {
+		elem := boltPageHeaderSize + i*boltLeafElemSize
+		if elem+boltLeafElemSize > len(page) {
+			return false
+		}
+		flags := binary.LittleEndian.Uint32(page[elem:])
+		pos := int(binary.LittleEndian.Uint32(page[elem+4:]))
+		ksize := int(binary.LittleEndian.Uint32(page[elem+8:]))
+		vsize := int(binary.LittleEndian.Uint32(page[elem+12:]))
+		start := elem + pos
+		if pos < 0 || ksize < 0 || vsize < 0 || start+ksize+vsize > len(page) {
+			ok = false
+			continue
+		}
+		key := page[start : start+ksize]
+		value := page[start+ksize : start+ksize+vsize]
+
+		if flags&boltBucketLeafFlag != 0 {
+			// An inline bucket has a zero root page id and
+			// its page follows the bucket header.
+			if len(value) > boltBucketHeader+boltPageHeaderSize &&
+				binary.LittleEndian.Uint64(value) == 0 {
+				ok = r.scanLeaf(value[boltBucketHeader:]) && ok
+			}
+			continue
+		}
+		r.record(key, value)
+	}
+	return ok
+}
+
+func (r *salvageResult) record(key, value []byte) {
+	for _, stableKey := range stableKeys {
+		if string(key) != stableKey {
+			continue
+		}
+		existing, found := r.stable[stableKey]
+		if !found || (len(value) == 8 && len(existing) == 8 &&
+			binary.BigEndian.Uint64(value) > binary.BigEndian.Uint64(existing)) {
+			r.stable[stableKey] = append([]byte(nil), value...)
+		}
+		return
+	}
+	if len(key) != 8 {
+		return
+	}
+	var entry raft.Log
+	decoder := codec.NewDecoder(bytes.NewReader(value), &codec.MsgpackHandle{})
+	if err := decoder.Decode(&entry); err != nil {
+		return
+	}
+	if entry.Index != binary.BigEndian.Uint64(key) {
+		return
+	}
+	if existing, found := r.logs[entry.Index]; !found || entry.Term > existing.Term {
+		r.logs[entry.Index] = &entry
+	}
+}
+
+func (r *salvageResult) sortedLogs() []*raft.Log {
+	logs := make([]*raft.Log, 0, len(r.logs))
+	for _, entry := range r.logs {
+		logs = append(logs, entry)
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].Index < logs[j].Index
+	})
+	return logs
+}
+
+// findGaps returns the ranges of indexes missing from the sorted logs.
+func findGaps(logs []*raft.Log) [][2]uint64 {
+	var gaps [][2]uint64
+	for i := 1; i < len(logs); i++ {
+		if logs[i].Index > logs[i-1].Index+1 {
+			gaps = append(gaps, [2]uint64{logs[i-1].Index + 1, logs[i].Index - 1})
+		}
+	}
+	return gaps
+}
@@ -0,0 +1,64 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/errors"
+)
+
+// scriptTemplate is the script written for each controller machine
+// by --emit-scripts. The operator runs it as root on that machine.
+const scriptTemplate = `#!/bin/sh
+# Rebootstrap raft on juju controller machine %[1]s (%[2]s).
+# Generated by rebootstrap-raft; run it as root on that machine with
+# rebootstrap-raft on the PATH or named by $REBOOTSTRAP_RAFT.
+set -eu
+
+REBOOTSTRAP_RAFT="${REBOOTSTRAP_RAFT:-rebootstrap-raft}"
+
+# bootstrap logs in to MongoDB with this machine's statepassword,
+# read from its agent.conf, so the password is never on a command line.
+exec "$REBOOTSTRAP_RAFT" bootstrap --data-dir %[3]s %[4]s
+`
+
+// writeScripts writes a script for each server into c.scriptsDir,
+// returning their paths.
+func (c *rebootstrapCommand) writeScripts(servers raft.Configuration) ([]string, error) {
+	if err := os.MkdirAll(c.scriptsDir, 0700); err != nil {
+		return nil, errors.Trace(err)
+	}
+	var paths []string
+	for _, server := range servers.Servers {
+		machineID := string(server.ID)
+		content := fmt.Sprintf(scriptTemplate,
+			machineID,
+			server.Address,
+			shellQuote([]string{c.dataDir}),
+			shellQuote(c.scriptFlags(machineID)),
+		)
+		path := filepath.Join(c.scriptsDir, "rebootstrap-machine-"+machineID+".sh")
+		if err := ioutil.WriteFile(path, []byte(content), 0700); err != nil {
+			return paths, errors.Trace(err)
+		}
+		logger.Infof("Wrote %s.", path)
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// scriptFlags returns the bootstrap flags for machineID's script.
+// Each script is run on its own, so it restarts its agent itself.
+func (c *rebootstrapCommand) scriptFlags(machineID string) []string {
+	flags := c.bootstrapFlags(machineID)
+	if c.restartAgent {
+		flags = append(flags, "--restart-agent")
+	}
+	return flags
+}
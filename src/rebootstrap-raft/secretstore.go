@@ -0,0 +1,195 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+const (
+	// defaultVaultAddr is where Vault is expected if $VAULT_ADDR
+	// isn't set, as with the vault client.
+	defaultVaultAddr = "https://127.0.0.1:8200"
+
+	// defaultVaultField is the field read from a Vault secret when
+	// --vault-secret doesn't name one.
+	defaultVaultField = "password"
+
+	// secretStoreTimeout bounds how long fetching the password from
+	// a command or Vault can take.
+	secretStoreTimeout = 30 * time.Second
+)
+
+// fetchPassword fills in the MongoDB password from --password-cmd or
+// --vault-secret if either was given, so that it never has to be on
+// disk or on the command line.
+func (m *mongoFlags) fetchPassword() error {
+	given := 0
+	for _, value := range []string{m.password, m.passwordCmd, m.vaultSecret} {
+		if value != "" {
+			given++
+		}
+	}
+	if given > 1 {
+		return errors.Errorf("only one of --password, --password-cmd and --vault-secret can be given")
+	}
+	var err error
+	switch {
+	case m.passwordCmd != "":
+		m.password, err = runPasswordCommand(m.passwordCmd)
+		err = errors.Annotate(err, "running --password-cmd")
+	case m.vaultSecret != "":
+		m.password, err = readVaultSecret(m.vaultSecret)
+		err = errors.Annotate(err, "reading --vault-secret")
+	}
+	return err
+}
+
+// runPasswordCommand runs shellCommand with the shell and returns the
+// first line of its output. Its stderr is passed through so that it
+// can prompt or explain a failure.
+func runPasswordCommand(shellCommand string) (string, error) {
+	var stdout bytes.Buffer
+	command := exec.Command("/bin/sh", "-c", shellCommand)
+	command.Stdout = &stdout
+	command.Stderr = os.Stderr
+	command.Stdin = os.Stdin
+	if err := command.Start(); err != nil {
+		return "", errors.Trace(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- command.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+	case <-time.After(secretStoreTimeout):
+		command.Process.Kill()
+		return "", errors.Errorf("timed out after %s", secretStoreTimeout)
+	}
+	password := strings.TrimSpace(firstLine(stdout.String()))
+	if password == "" {
+		return "", errors.New("it printed no password")
+	}
+	return password, nil
+}
+
+// readVaultSecret reads a field from a secret in HashiCorp Vault. spec
+// is the secret's API path with an optional #field, such as
+// secret/data/juju/prod#password. Vault is found and logged into the
+// same way as with the vault client: $VAULT_ADDR, $VAULT_TOKEN (or
+// ~/.vault-token), $VAULT_NAMESPACE and $VAULT_CACERT. Both versions
+// of the KV secrets engine are understood.
+func readVaultSecret(spec string) (string, error) {
+	path, field := spec, defaultVaultField
+	if i := strings.LastIndex(spec, "#"); i >= 0 {
+		path, field = spec[:i], spec[i+1:]
+	}
+	path = strings.Trim(path, "/")
+	if path == "" || field == "" {
+		return "", errors.Errorf("%q should be <path>[#<field>]", spec)
+	}
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		addr = defaultVaultAddr
+	}
+	token, err := vaultToken()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	client, err := vaultClient()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimRight(addr, "/")+"/v1/"+path, nil)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("vault returned %s for %q: %s", resp.Status, path, strings.TrimSpace(string(body)))
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", errors.Annotate(err, "parsing vault response")
+	}
+	data := secret.Data
+	// KV version 2 wraps the secret's fields with its metadata.
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	password, ok := data[field].(string)
+	if !ok || password == "" {
+		return "", errors.NotFoundf("field %q in %q", field, path)
+	}
+	return password, nil
+}
+
+// vaultToken returns the token to log into Vault with.
+func vaultToken() (string, error) {
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		return token, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(os.Getenv("HOME"), ".vault-token"))
+	if os.IsNotExist(err) {
+		return "", errors.New("no vault token: set $VAULT_TOKEN or run vault login")
+	}
+	if err != nil {
+		return "", errors.Annotate(err, "reading vault token")
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// vaultClient returns an HTTP client trusting $VAULT_CACERT, if set.
+func vaultClient() (*http.Client, error) {
+	client := &http.Client{Timeout: secretStoreTimeout}
+	caFile := os.Getenv("VAULT_CACERT")
+	if caFile == "" {
+		return client, nil
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.Annotate(err, "reading $VAULT_CACERT")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no certificates in %q", caFile)
+	}
+	client.Transport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}
+	return client, nil
+}
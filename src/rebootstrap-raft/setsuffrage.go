@@ -0,0 +1,87 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+)
+
+const setSuffrageDoc = `
+
+Make a server in an existing raft store's configuration a voter or a
+nonvoter. Promoting a controller that was demoted, or demoting one
+that's gone, can let the cluster reach quorum again without replacing
+the stores:
+
+    rebootstrap-raft set-suffrage --machine-id 0 2 nonvoter
+
+Run it with the same arguments on every controller, with their agents
+stopped. The raft directory is backed up next to itself first.
+
+`
+
+type setSuffrageCommand struct {
+	storeEditCommand
+	id       raft.ServerID
+	suffrage raft.ServerSuffrage
+}
+
+// Info is part of cmd.Command.
+func (c *setSuffrageCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "set-suffrage",
+		Args:    "--machine-id <id> <member-id> voter|nonvoter",
+		Purpose: "Change a server's suffrage in an existing raft store.",
+		Doc:     strings.TrimSpace(setSuffrageDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *setSuffrageCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.storeEditCommand.setFlags(f)
+}
+
+// Init is part of cmd.Command.
+func (c *setSuffrageCommand) Init(args []string) error {
+	if err := c.storeEditCommand.init(); err != nil {
+		return errors.Trace(err)
+	}
+	if len(args) < 2 {
+		return errors.Errorf("member id and suffrage are required")
+	}
+	c.id = raft.ServerID(args[0])
+	switch args[1] {
+	case "voter":
+		c.suffrage = raft.Voter
+	case "nonvoter":
+		c.suffrage = raft.Nonvoter
+	default:
+		return errors.Errorf("suffrage must be voter or nonvoter, not %q", args[1])
+	}
+	return c.CommandBase.Init(args[2:])
+}
+
+// Run is part of cmd.Command.
+func (c *setSuffrageCommand) Run(ctx *cmd.Context) error {
+	return reportExitCode(ctx, c.apply(ctx, c.setSuffrage))
+}
+
+// setSuffrage changes the server's suffrage in config.
+func (c *setSuffrageCommand) setSuffrage(config *raft.Configuration) error {
+	i := serverIndex(*config, c.id)
+	if i < 0 {
+		return errors.NotFoundf("server %s in the configuration", c.id)
+	}
+	if config.Servers[i].Suffrage == c.suffrage {
+		return errors.Errorf("server %s is already a %s", c.id, c.suffrage)
+	}
+	logger.Infof("server %s: %s -> %s", c.id, config.Servers[i].Suffrage, c.suffrage)
+	config.Servers[i].Suffrage = c.suffrage
+	return nil
+}
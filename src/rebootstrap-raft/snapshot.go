@@ -0,0 +1,231 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"hash/crc64"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/errors"
+)
+
+const (
+	snapshotMetaFile  = "meta.json"
+	snapshotStateFile = "state.bin"
+)
+
+// fileSnapshotMeta is the format of meta.json written by raft's file
+// snapshot store.
+type fileSnapshotMeta struct {
+	raft.SnapshotMeta
+	CRC []byte
+}
+
+// sourceSnapshot is a snapshot read from another controller's raft
+// directory.
+type sourceSnapshot struct {
+	Meta raft.SnapshotMeta
+	Data []byte
+}
+
+// readSourceSnapshot reads the newest snapshot found at path, which
+// can be a single snapshot directory, a directory containing
+// snapshots (such as a raft directory or its snapshots
+// subdirectory), or a tarball of any of those. The snapshot data is
+// checked against the CRC recorded in its metadata.
+func readSourceSnapshot(path string) (*sourceSnapshot, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if !info.IsDir() {
+		tmpDir, err := ioutil.TempDir("", "rebootstrap-snapshot")
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		defer os.RemoveAll(tmpDir)
+		if err := extractTarball(path, tmpDir); err != nil {
+			return nil, errors.Annotatef(err, "extracting %q", path)
+		}
+		path = tmpDir
+	}
+
+	dir, meta, err := findNewestSnapshot(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	data, err := readSnapshotData(dir, meta)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	logger.Infof("using snapshot %s (index %d, term %d) from %q", meta.ID, meta.Index, meta.Term, dir)
+	return &sourceSnapshot{Meta: meta.SnapshotMeta, Data: data}, nil
+}
+
+// foundSnapshot is a snapshot directory found by findSnapshots.
+type foundSnapshot struct {
+	dir  string
+	meta *fileSnapshotMeta
+}
+
+// findSnapshots looks for snapshot directories at path, one level
+// below it and in a snapshots subdirectory, and returns them newest
+// first: by term, then index, then id, as raft orders them, so a
+// snapshot replaced with a new configuration comes after its
+// replacement.
+func findSnapshots(path string) ([]foundSnapshot, error) {
+	candidates := []string{path}
+	for _, pattern := range []string{"*", filepath.Join("snapshots", "*"), filepath.Join("*", "snapshots", "*")} {
+		matches, err := filepath.Glob(filepath.Join(path, pattern))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		candidates = append(candidates, matches...)
+	}
+
+	var found []foundSnapshot
+	for _, dir := range candidates {
+		meta, err := readSnapshotMeta(dir)
+		if os.IsNotExist(errors.Cause(err)) {
+			continue
+		} else if err != nil {
+			logger.Warningf("skipping snapshot %q: %v", dir, err)
+			continue
+		}
+		found = append(found, foundSnapshot{dir: dir, meta: meta})
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		a, b := found[i].meta, found[j].meta
+		if a.Term != b.Term {
+			return a.Term > b.Term
+		}
+		if a.Index != b.Index {
+			return a.Index > b.Index
+		}
+		return a.ID > b.ID
+	})
+	return found, nil
+}
+
+// findNewestSnapshot returns the newest of the snapshots findSnapshots
+// finds at path.
+func findNewestSnapshot(path string) (string, *fileSnapshotMeta, error) {
+	found, err := findSnapshots(path)
+	if err != nil {
+		return "", nil, errors.Trace(err)
+	}
+	if len(found) == 0 {
+		return "", nil, errors.NotFoundf("snapshot in %q", path)
+	}
+	return found[0].dir, found[0].meta, nil
+}
+
+// findNewestValidSnapshot is like findNewestSnapshot, but passes over
+// snapshots whose state fails its size or CRC check. Raft does the
+// same when it restores, so that's the snapshot a restarted agent
+// would use.
+func findNewestValidSnapshot(path string) (string, *fileSnapshotMeta, error) {
+	found, err := findSnapshots(path)
+	if err != nil {
+		return "", nil, errors.Trace(err)
+	}
+	for _, snapshot := range found {
+		if _, err := readSnapshotData(snapshot.dir, snapshot.meta); err != nil {
+			logger.Warningf("passing over snapshot %s: %v", snapshot.meta.ID, err)
+			continue
+		}
+		return snapshot.dir, snapshot.meta, nil
+	}
+	return "", nil, errors.NotFoundf("valid snapshot in %q", path)
+}
+
+// readSnapshotData reads the state of the snapshot in dir, checking
+// it against the size and CRC recorded in its metadata.
+func readSnapshotData(dir string, meta *fileSnapshotMeta) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, snapshotStateFile))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if int64(len(data)) != meta.Size {
+		return nil, errors.Errorf("snapshot %q has %d bytes of state, expected %d", dir, len(data), meta.Size)
+	}
+	hash := crc64.New(crc64.MakeTable(crc64.ECMA))
+	hash.Write(data)
+	if !bytes.Equal(hash.Sum(nil), meta.CRC) {
+		return nil, errors.Errorf("snapshot %q failed CRC check", dir)
+	}
+	return data, nil
+}
+
+func readSnapshotMeta(dir string) (*fileSnapshotMeta, error) {
+	f, err := os.Open(filepath.Join(dir, snapshotMetaFile))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	var meta fileSnapshotMeta
+	if err := json.NewDecoder(f).Decode(&meta); err != nil {
+		return nil, errors.Annotate(err, "decoding snapshot metadata")
+	}
+	return &meta, nil
+}
+
+// extractTarball unpacks a (possibly gzipped) tarball into dir.
+func extractTarball(path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".tgz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Trace(err)
+		}
+		target := filepath.Join(dir, filepath.Clean("/"+header.Name))
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return errors.Trace(err)
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return errors.Trace(err)
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			_, err = io.Copy(out, tr)
+			out.Close()
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+}
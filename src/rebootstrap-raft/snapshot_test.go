@@ -0,0 +1,60 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestFindNewestValidSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	store, err := raft.NewFileSnapshotStore(dir, 3, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, transport := raft.NewInmemTransport("notused")
+	defer transport.Close()
+	ids := make(map[uint64]string)
+	for _, index := range []uint64{10, 20} {
+		sink, err := store.Create(raft.SnapshotVersionMax, index, 1, raft.Configuration{}, 1, transport)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sink.Write([]byte("state")); err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatal(err)
+		}
+		ids[index] = sink.ID()
+	}
+	snapshots := filepath.Join(dir, "snapshots")
+
+	_, newest, err := findNewestValidSnapshot(snapshots)
+	if err != nil || newest.Index != 20 {
+		t.Fatalf("got %+v, %v, want the snapshot at index 20", newest, err)
+	}
+
+	// Corrupting the newest snapshot's state leaves the older one.
+	if err := ioutil.WriteFile(filepath.Join(snapshots, ids[20], snapshotStateFile), []byte("stale"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, newest, err = findNewestSnapshot(snapshots); err != nil || newest.Index != 20 {
+		t.Errorf("findNewestSnapshot: got %+v, %v, want the snapshot at index 20", newest, err)
+	}
+	if _, newest, err = findNewestValidSnapshot(snapshots); err != nil || newest.Index != 10 {
+		t.Errorf("findNewestValidSnapshot: got %+v, %v, want the snapshot at index 10", newest, err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(snapshots, ids[10], snapshotStateFile), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = findNewestValidSnapshot(snapshots); err == nil {
+		t.Error("findNewestValidSnapshot: no error with every snapshot corrupt")
+	}
+}
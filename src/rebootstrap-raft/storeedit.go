@@ -0,0 +1,239 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+// storeEditCommand holds what's common to the commands that change
+// the configuration in an existing raft store rather than replacing
+// the store. The change is made where raft will find the
+// configuration when it starts, after backing up the raft directory:
+// to the newest configuration entry in the log, in place, or to the
+// newest snapshot if that's at or after it.
+type storeEditCommand struct {
+	cmd.CommandBase
+	logFlags
+	dataDirFlags
+	machineID    string
+	raftDir      string
+	agentService string
+	stopAgent    bool
+	dryRun       bool
+	yes          bool
+
+	allowEvenVoters bool
+}
+
+func (c *storeEditCommand) setFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	c.logFlags.setFlags(f)
+	c.dataDirFlags.setFlags(f)
+	f.StringVar(&c.machineID, "machine-id", "", "ID of this Juju controller machine")
+	f.StringVar(&c.raftDir, "raft-dir", "", "raft directory location (default <data-dir>/raft)")
+	f.StringVar(&c.agentService, "agent-service", "", "machine agent service name, or none if it isn't run by systemd (default jujud-machine-<id>.service, or the snap's if that's installed)")
+	f.BoolVar(&c.stopAgent, "stop-agent", false, "stop the machine agent if it's running")
+	f.BoolVar(&c.dryRun, "dry-run", false, "show the change without making it")
+	f.BoolVar(&c.yes, "yes", false, "don't ask for confirmation")
+	f.BoolVar(&c.allowEvenVoters, "allow-even-voters", false, "allow the change to leave an even number of voters")
+}
+
+func (c *storeEditCommand) init() error {
+	if err := c.setupLogging(c.dryRun); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(c.dataDirFlags.resolveStore(c.machineID, &c.raftDir, &c.agentService))
+}
+
+// apply opens the store, passes the newest configuration to edit and
+// writes back the result once the operator has confirmed it. edit
+// changes the configuration it's given.
+func (c *storeEditCommand) apply(ctx *cmd.Context, edit func(*raft.Configuration) error) error {
+	c.setupOutput(ctx)
+	if _, err := os.Stat(filepath.Join(c.raftDir, "logs")); err != nil {
+		return errors.Annotate(err, "finding the bolt log store")
+	}
+	if !c.dryRun {
+		lock, err := acquireLock(c.dataDir)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer lock.Release()
+		stopped, err := ensureAgentStopped(c.agentService, c.stopAgent)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if stopped {
+			logger.Infof("%s was stopped; start it again once you're done.", c.agentService)
+		}
+	}
+
+	// A dry run only reads the store, so it's safe while jujud is
+	// running.
+	var logStore rebootstrap.LogStore
+	var err error
+	if c.dryRun {
+		logStore, err = openStoreReadOnly(c.raftDir)
+	} else {
+		logStore, err = rebootstrap.NewLogStore(c.raftDir, nil)
+	}
+	if err != nil {
+		return errors.Annotate(err, "opening log store")
+	}
+	defer logStore.Close()
+	stored, err := readCurrentConfiguration(c.raftDir, logStore)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	before := stored.Configuration
+	after := raft.Configuration{Servers: append([]raft.Server(nil), before.Servers...)}
+	if err := edit(&after); err != nil {
+		return errors.Trace(err)
+	}
+	if err := rebootstrap.ValidateUnique(after); err != nil {
+		return withExitCode(err, exitValidation)
+	}
+	if serverIndex(after, raft.ServerID(c.machineID)) < 0 {
+		return withExitCode(errors.Errorf("the change would remove machine %s, whose store this is, from its own configuration", c.machineID), exitValidation)
+	}
+	// Only check the voters if they've changed, so that a store
+	// that was already unusual can still have addresses fixed.
+	if !reflect.DeepEqual(voterIDs(before), voterIDs(after)) {
+		if err := rebootstrap.ValidateVoters(after, 1, c.allowEvenVoters); err != nil {
+			return withExitCode(err, exitValidation)
+		}
+	}
+
+	if stored.Entry != nil {
+		fmt.Fprintf(ctx.Stdout, "Configuration at index %d, term %d:\n", stored.Entry.Index, stored.Entry.Term)
+	} else {
+		fmt.Fprintf(ctx.Stdout, "Configuration in snapshot %s (index %d, term %d):\n", stored.Snapshot.ID, stored.Snapshot.Index, stored.Snapshot.Term)
+	}
+	writeServers(ctx.Stdout, "  ", before)
+	fmt.Fprintln(ctx.Stdout, "will become:")
+	writeServers(ctx.Stdout, "  ", after)
+	if c.dryRun {
+		logger.Infof("dry-run specified - stopping")
+		return nil
+	}
+	if !c.yes {
+		ok, err := confirm(ctx, "Continue?")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !ok {
+			return errors.New("aborted")
+		}
+	}
+
+	backupDir := fmt.Sprintf("%s.backup-%s", c.raftDir, time.Now().UTC().Format("20060102-150405"))
+	if err := copyTree(c.raftDir, backupDir); err != nil {
+		return errors.Annotate(err, "backing up raft directory")
+	}
+	logger.Infof("Raft directory backed up to %q.", backupDir)
+	var snapshotStore raft.SnapshotStore
+	if stored.Snapshot != nil {
+		// Retaining one more than jujud does keeps the original
+		// alongside the copy that replaces it.
+		if snapshotStore, err = rebootstrap.NewSnapshotStore(c.raftDir, jujudSnapshotRetention+1); err != nil {
+			return withExitCode(errors.Annotate(err, "opening snapshot store"), exitWriteFailed)
+		}
+	}
+	if err := rebootstrap.ReplaceStoredConfiguration(logStore, snapshotStore, stored, after); err != nil {
+		return withExitCode(err, exitWriteFailed)
+	}
+	fmt.Fprintf(ctx.Stdout, "Configuration updated; the original store is in %s.\n", backupDir)
+	return nil
+}
+
+// readCurrentConfiguration finds the configuration raft would start
+// with from the store in raftDir, whose log store is logs.
+func readCurrentConfiguration(raftDir string, logs raft.LogStore) (*rebootstrap.StoredConfiguration, error) {
+	_, newest, err := findNewestSnapshot(filepath.Join(raftDir, "snapshots"))
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, errors.Annotate(err, "reading snapshots")
+	}
+	var meta *raft.SnapshotMeta
+	if newest != nil {
+		meta = &newest.SnapshotMeta
+	}
+	return rebootstrap.CurrentConfiguration(logs, meta)
+}
+
+// voterIDs returns the ids of the voters in config.
+func voterIDs(config raft.Configuration) []raft.ServerID {
+	var ids []raft.ServerID
+	for _, server := range config.Servers {
+		if server.Suffrage == raft.Voter {
+			ids = append(ids, server.ID)
+		}
+	}
+	return ids
+}
+
+// writeServers lists the servers in config, one per line.
+func writeServers(w io.Writer, indent string, config raft.Configuration) {
+	for _, server := range config.Servers {
+		fmt.Fprintf(w, "%s%-6s %-24s %s\n", indent, server.ID, server.Address, server.Suffrage)
+	}
+}
+
+// copyTree copies the regular files and directories under src to dst,
+// which mustn't exist, keeping their permissions.
+func copyTree(src, dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return errors.AlreadyExistsf("%q", dst)
+	}
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return copyFile(path, target, info.Mode().Perm())
+	})
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return errors.Trace(err)
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return errors.Trace(err)
+	}
+	return errors.Trace(out.Close())
+}
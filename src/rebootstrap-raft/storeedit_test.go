@@ -0,0 +1,76 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/errors"
+)
+
+func TestCopyTree(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "raft")
+	files := map[string]os.FileMode{
+		"logs":                         0600,
+		"snapshots/1-10-123/meta.json": 0640,
+		"snapshots/1-10-123/state.bin": 0600,
+	}
+	for name, perm := range files {
+		path := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(name), perm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("logs", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "backup")
+	if err := copyTree(src, dst); err != nil {
+		t.Fatalf("copyTree: %v", err)
+	}
+	for name, perm := range files {
+		path := filepath.Join(dst, name)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Errorf("reading copy: %v", err)
+			continue
+		}
+		if string(data) != name {
+			t.Errorf("%s has %q", name, data)
+		}
+		if info, err := os.Stat(path); err != nil {
+			t.Error(err)
+		} else if info.Mode().Perm() != perm {
+			t.Errorf("%s has mode %v, want %v", name, info.Mode().Perm(), perm)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "link")); !os.IsNotExist(err) {
+		t.Errorf("symlink copied (%v)", err)
+	}
+
+	if err := copyTree(src, dst); !errors.IsAlreadyExists(err) {
+		t.Errorf("copying over an existing directory gave %v", err)
+	}
+}
+
+func TestVoterIDs(t *testing.T) {
+	config := raft.Configuration{Servers: []raft.Server{
+		{ID: "0", Suffrage: raft.Voter},
+		{ID: "1", Suffrage: raft.Nonvoter},
+		{ID: "2", Suffrage: raft.Voter},
+		{ID: "3", Suffrage: raft.Staging},
+	}}
+	if got, want := voterIDs(config), []raft.ServerID{"0", "2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
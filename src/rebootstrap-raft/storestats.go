@@ -0,0 +1,277 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"go.etcd.io/bbolt"
+)
+
+const storeStatsDoc = `
+
+Report how a raft store's bolt file is using its space: the file and
+page sizes, how many pages are in use and free, and for each bucket
+its entry count and the bytes its pages hold, along with the first and
+last raft log indexes. Bolt never gives freed pages back to the
+filesystem, so a large free count means truncate-logs' compaction
+will help, while a large live log means there's more to gain from
+truncating or rebootstrapping.
+
+The store is only read, so this is safe on a live controller.
+
+`
+
+type storeStatsCommand struct {
+	cmd.CommandBase
+	out cmd.Output
+	logFlags
+	dataDirFlags
+	raftDir string
+}
+
+// storeStats describes the space used in a bolt log store.
+type storeStats struct {
+	SchemaVersion int           `json:"schema-version" yaml:"schema-version"`
+	Path          string        `json:"path" yaml:"path"`
+	FileBytes     int64         `json:"file-bytes" yaml:"file-bytes"`
+	PageSize      int           `json:"page-size" yaml:"page-size"`
+	Pages         int64         `json:"pages" yaml:"pages"`
+	FreePages     int           `json:"free-pages" yaml:"free-pages"`
+	PendingPages  int           `json:"pending-pages" yaml:"pending-pages"`
+	FreelistSize  int           `json:"freelist-bytes" yaml:"freelist-bytes"`
+	Buckets       []bucketStats `json:"buckets" yaml:"buckets"`
+	FirstIndex    uint64        `json:"first-index" yaml:"first-index"`
+	LastIndex     uint64        `json:"last-index" yaml:"last-index"`
+}
+
+// bucketStats describes one bucket in a bolt file.
+type bucketStats struct {
+	Name      string `json:"name" yaml:"name"`
+	Keys      int    `json:"keys" yaml:"keys"`
+	Depth     int    `json:"depth" yaml:"depth"`
+	Pages     int    `json:"pages" yaml:"pages"`
+	PageBytes int    `json:"page-bytes" yaml:"page-bytes"`
+	InUse     int    `json:"in-use-bytes" yaml:"in-use-bytes"`
+}
+
+// Info is part of cmd.Command.
+func (c *storeStatsCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "store-stats",
+		Args:    "[<raft-dir>]",
+		Purpose: "Report the space used in a raft store.",
+		Doc:     strings.TrimSpace(storeStatsDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *storeStatsCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	c.logFlags.setFlags(f)
+	c.dataDirFlags.setFlags(f)
+	c.out.AddFlags(f, "text", map[string]cmd.Formatter{
+		"text": formatStoreStats,
+		"json": cmd.FormatJson,
+		"yaml": cmd.FormatYaml,
+	})
+}
+
+// Init is part of cmd.Command.
+func (c *storeStatsCommand) Init(args []string) error {
+	if err := c.setupLogging(false); err != nil {
+		return errors.Trace(err)
+	}
+	if len(args) > 0 {
+		c.raftDir, args = args[0], args[1:]
+	} else {
+		if err := c.dataDirFlags.resolve(); err != nil {
+			return errors.Trace(err)
+		}
+		c.raftDir = c.getJujuPath("raft")
+	}
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *storeStatsCommand) Run(ctx *cmd.Context) error {
+	c.setupOutput(ctx)
+	logsPath := filepath.Join(c.raftDir, "logs")
+	path, copyDir, err := readableBoltFile(logsPath)
+	if err != nil {
+		return errors.Annotate(err, "finding the bolt log store")
+	}
+	if copyDir != "" {
+		defer os.RemoveAll(copyDir)
+	}
+	stats, err := readStoreStats(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	stats.Path = logsPath
+	return c.out.Write(ctx, stats)
+}
+
+// readStoreStats gathers the statistics for the bolt file at path.
+func readStoreStats(path string) (*storeStats, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// Opening the store for writing, even just to roll back, could
+	// change it and would keep jujud from starting meanwhile.
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Annotatef(err, "opening %q", path)
+	}
+	defer db.Close()
+	stats := &storeStats{
+		SchemaVersion: outputSchemaVersion,
+		FileBytes:     info.Size(),
+		PageSize:      db.Info().PageSize,
+	}
+	// Bolt doesn't load the freelist for a read-only open, so it's
+	// read from the file. Pages are only pending in the process that
+	// freed them, so PendingPages stays 0.
+	stats.FreePages, stats.FreelistSize, err = readBoltFreelist(path, stats.PageSize)
+	if errors.IsNotFound(err) {
+		logger.Warningf("can't count free pages: %v", err)
+	} else if err != nil {
+		return nil, errors.Annotatef(err, "reading %q", path)
+	}
+	err = db.View(func(tx *bbolt.Tx) error {
+		stats.Pages = tx.Size() / int64(stats.PageSize)
+		err := tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+			bs := b.Stats()
+			stats.Buckets = append(stats.Buckets, bucketStats{
+				Name:      string(name),
+				Keys:      bs.KeyN,
+				Depth:     bs.Depth,
+				Pages:     bs.BranchPageN + bs.BranchOverflowN + bs.LeafPageN + bs.LeafOverflowN,
+				PageBytes: bs.BranchAlloc + bs.LeafAlloc,
+				InUse:     bs.BranchInuse + bs.LeafInuse,
+			})
+			return nil
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if logs := tx.Bucket(boltLogsBucket); logs != nil {
+			c := logs.Cursor()
+			if k, _ := c.First(); len(k) == 8 {
+				stats.FirstIndex = binary.BigEndian.Uint64(k)
+			}
+			if k, _ := c.Last(); len(k) == 8 {
+				stats.LastIndex = binary.BigEndian.Uint64(k)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "reading %q", path)
+	}
+	sort.Slice(stats.Buckets, func(i, j int) bool { return stats.Buckets[i].Name < stats.Buckets[j].Name })
+	return stats, nil
+}
+
+// These describe bolt's meta page and freelist; see db.go and
+// freelist.go in go.etcd.io/bbolt.
+const (
+	boltMetaFreelistOffset = 32
+	boltMetaTxIDOffset     = 48
+	boltMetaChecksumOffset = 56
+	boltNoFreelist         = ^uint64(0)
+	boltFreelistCountMax   = 0xFFFF
+)
+
+// readBoltFreelist returns how many free pages the freelist of the
+// bolt file at path lists, and how many bytes the freelist takes,
+// as of its newest valid meta page. A store written without syncing
+// its freelist gives a NotFound error.
+func readBoltFreelist(path string, pageSize int) (int, int, error) {
+	metas, err := readBoltMeta(path)
+	if err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	var freelist, txID uint64
+	found := false
+	for offset := 0; offset < len(metas); offset += pageSize {
+		meta := metas[offset+boltPageHeaderSize:]
+		if binary.LittleEndian.Uint32(meta) != boltMagic {
+			continue
+		}
+		sum := fnv.New64a()
+		sum.Write(meta[:boltMetaChecksumOffset])
+		if sum.Sum64() != binary.LittleEndian.Uint64(meta[boltMetaChecksumOffset:]) {
+			continue
+		}
+		if id := binary.LittleEndian.Uint64(meta[boltMetaTxIDOffset:]); !found || id > txID {
+			found, txID = true, id
+			freelist = binary.LittleEndian.Uint64(meta[boltMetaFreelistOffset:])
+		}
+	}
+	if !found {
+		return 0, 0, errors.NotValidf("bolt file %q with no valid meta page", path)
+	}
+	if freelist == boltNoFreelist {
+		return 0, 0, errors.NotFoundf("freelist in %q (it's rebuilt when the store is opened)", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	defer f.Close()
+	header := make([]byte, boltPageHeaderSize+8)
+	if _, err := f.ReadAt(header, int64(freelist)*int64(pageSize)); err != nil {
+		return 0, 0, errors.Annotatef(err, "reading freelist page %d", freelist)
+	}
+	// A count that doesn't fit in the page header is held in the
+	// first element instead.
+	count := int(binary.LittleEndian.Uint16(header[10:]))
+	size := boltPageHeaderSize + count*8
+	if count == boltFreelistCountMax {
+		count = int(binary.LittleEndian.Uint64(header[boltPageHeaderSize:]))
+		size = boltPageHeaderSize + (count+1)*8
+	}
+	return count, size, nil
+}
+
+func formatStoreStats(writer io.Writer, value interface{}) error {
+	stats, ok := value.(*storeStats)
+	if !ok {
+		return errors.Errorf("expected *storeStats, got %T", value)
+	}
+	free := int64(stats.FreePages) * int64(stats.PageSize)
+	fmt.Fprintf(writer, "File:      %s, %s\n", stats.Path, humanize.IBytes(uint64(stats.FileBytes)))
+	fmt.Fprintf(writer, "Pages:     %d of %d bytes\n", stats.Pages, stats.PageSize)
+	fmt.Fprintf(writer, "Free:      %d pages, %s\n", stats.FreePages, humanize.IBytes(uint64(free)))
+	fmt.Fprintf(writer, "Freelist:  %s\n", humanize.IBytes(uint64(stats.FreelistSize)))
+	if stats.LastIndex > 0 {
+		fmt.Fprintf(writer, "Log:       entries %d to %d (%d)\n", stats.FirstIndex, stats.LastIndex, stats.LastIndex-stats.FirstIndex+1)
+	} else {
+		fmt.Fprintln(writer, "Log:       empty")
+	}
+	fmt.Fprintln(writer)
+	tw := tabwriter.NewWriter(writer, 0, 1, 2, ' ', 0)
+	fmt.Fprintf(tw, "BUCKET\tKEYS\tDEPTH\tPAGES\tALLOCATED\tIN USE\n")
+	for _, b := range stats.Buckets {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\t%s\n", b.Name, b.Keys, b.Depth, b.Pages,
+			humanize.IBytes(uint64(b.PageBytes)), humanize.IBytes(uint64(b.InUse)))
+	}
+	return errors.Trace(tw.Flush())
+}
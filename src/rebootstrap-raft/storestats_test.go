@@ -0,0 +1,83 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+func TestReadBoltFreelist(t *testing.T) {
+	for _, test := range []struct {
+		about   string
+		entries uint64
+		deleted uint64
+	}{
+		{"nothing freed", 10, 0},
+		{"some freed", 1000, 900},
+	} {
+		t.Run(test.about, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "logs")
+			db, err := bbolt.Open(path, 0600, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.Update(func(tx *bbolt.Tx) error {
+				bucket, err := tx.CreateBucket([]byte("logs"))
+				if err != nil {
+					return err
+				}
+				for i := uint64(1); i <= test.entries; i++ {
+					var k [8]byte
+					binary.BigEndian.PutUint64(k[:], i)
+					if err := bucket.Put(k[:], make([]byte, 512)); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err == nil {
+				err = db.Update(func(tx *bbolt.Tx) error {
+					bucket := tx.Bucket([]byte("logs"))
+					for i := uint64(1); i <= test.deleted; i++ {
+						var k [8]byte
+						binary.BigEndian.PutUint64(k[:], i)
+						if err := bucket.Delete(k[:]); err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			pageSize := db.Info().PageSize
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			free, size, err := readBoltFreelist(path, pageSize)
+			if err != nil {
+				t.Fatalf("readBoltFreelist: %v", err)
+			}
+			// A writable open loads the freelist.
+			db, err = bbolt.Open(path, 0600, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			stats := db.Stats()
+			if free != stats.FreePageN {
+				t.Errorf("got %d free pages, bolt has %d", free, stats.FreePageN)
+			}
+			if test.deleted > 0 && size <= boltPageHeaderSize {
+				t.Errorf("freelist of %d bytes", size)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/errors"
+)
+
+// Where a server's raft address came from, as shown in the summary
+// table.
+const (
+	originReplicaset  = "replicaset"
+	originHASpace     = "ha-space"
+	originSelected    = "selected"
+	originFamily      = "address-family"
+	originAdvertise   = "advertise-address"
+	originSnapshot    = "snapshot"
+	originBackup      = "backup"
+	originSourceStore = "source-raft-dir"
+)
+
+// originDescriptions describe the sources a whole configuration can
+// be copied from, for --explain.
+var originDescriptions = map[string]string{
+	originSnapshot:    "the snapshot in --config-from-snapshot",
+	originBackup:      "the controller records in --from-backup",
+	originSourceStore: "the store in --source-raft-dir",
+}
+
+// serverOrigin records where a server in the generated configuration
+// came from: the source of its address and the replicaset member it
+// was made from, if any, with that member's host. explanation says,
+// a line at a time, how its id, address and suffrage were arrived at,
+// for --explain.
+type serverOrigin struct {
+	source      string
+	member      string
+	memberHost  string
+	explanation []string
+}
+
+// The --color settings.
+const (
+	colorAuto   = "auto"
+	colorAlways = "always"
+	colorNever  = "never"
+)
+
+// ANSI colours for the suffrage column. They're all the same length
+// so tabwriter keeps the columns lined up.
+const (
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+	ansiRed    = "\x1b[31m"
+	ansiReset  = "\x1b[0m"
+)
+
+// checkColorMode validates a --color setting.
+func checkColorMode(mode string) error {
+	switch mode {
+	case colorAuto, colorAlways, colorNever:
+		return nil
+	}
+	return errors.Errorf("--color must be %q, %q or %q", colorAuto, colorAlways, colorNever)
+}
+
+// useColor says whether output to f should be coloured under the
+// given --color setting. With auto, it is when f is a terminal and
+// $NO_COLOR isn't set.
+func useColor(mode string, f *os.File) bool {
+	switch mode {
+	case colorAlways:
+		return true
+	case colorNever:
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// addOrigins fills in where each server came from.
+func addOrigins(results []serverResult, origins map[raft.ServerID]serverOrigin) []serverResult {
+	for i, result := range results {
+		origin := origins[raft.ServerID(result.ID)]
+		results[i].Source = origin.source
+		results[i].Member = origin.member
+	}
+	return results
+}
+
+// writeServerTable writes the servers as a table, marking the one
+// whose id is localID. The address source and replicaset member
+// columns are only included if something fills them in.
+func writeServerTable(w io.Writer, indent string, servers []serverResult, localID string, color bool) error {
+	origins := false
+	for _, server := range servers {
+		if server.Source != "" || server.Member != "" {
+			origins = true
+		}
+	}
+	tw := tabwriter.NewWriter(w, 0, 1, 2, ' ', 0)
+	fmt.Fprintf(tw, "%sID\tADDRESS\tSUFFRAGE", indent)
+	if origins {
+		fmt.Fprintf(tw, "\tSOURCE\tMEMBER")
+	}
+	fmt.Fprintln(tw)
+	marked := false
+	for _, server := range servers {
+		id := server.ID
+		if id == localID {
+			id += "*"
+			marked = true
+		}
+		suffrage := server.Suffrage
+		if color {
+			suffrage = suffrageColor(suffrage) + suffrage + ansiReset
+		}
+		fmt.Fprintf(tw, "%s%s\t%s\t%s", indent, id, server.Address, suffrage)
+		if origins {
+			fmt.Fprintf(tw, "\t%s\t%s", dashIfEmpty(server.Source), dashIfEmpty(server.Member))
+		}
+		fmt.Fprintln(tw)
+	}
+	if err := tw.Flush(); err != nil {
+		return errors.Trace(err)
+	}
+	if marked {
+		fmt.Fprintf(w, "%s(* is this machine)\n", indent)
+	}
+	return nil
+}
+
+func suffrageColor(suffrage string) string {
+	switch suffrage {
+	case raft.Voter.String():
+		return ansiGreen
+	case raft.Nonvoter.String():
+		return ansiYellow
+	}
+	return ansiRed
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// logServers logs the servers in config one per line.
+func logServers(config raft.Configuration) {
+	for _, server := range config.Servers {
+		logger.Infof("  %-6s %-24s %s", server.ID, server.Address, server.Suffrage)
+	}
+}
+
+// serverResults describes the servers along with where each came
+// from, and with --explain how each was arrived at.
+func (c *rebootstrapCommand) serverResults(servers raft.Configuration) []serverResult {
+	results := addOrigins(makeServerResults(servers), c.origins)
+	if c.explain {
+		for i, result := range results {
+			results[i].Explanation = c.origins[raft.ServerID(result.ID)].explanation
+		}
+	}
+	return results
+}
+
+// setOrigins records that every server came from source, with no
+// replicaset member behind it, then marks those given addresses with
+// --advertise-address.
+func (c *rebootstrapCommand) setOrigins(servers raft.Configuration, source string) {
+	c.origins = make(map[raft.ServerID]serverOrigin)
+	for _, server := range servers.Servers {
+		c.origins[server.ID] = serverOrigin{source: source}
+		c.explainServer(server.ID, "id, address and %s as in %s", server.Suffrage, originDescriptions[source])
+	}
+	c.markAdvertised(servers)
+}
+
+// markAdvertised records the servers in servers whose addresses were
+// given with --advertise-address. Ids that aren't in the
+// configuration are left out, so the summary only describes servers
+// that exist.
+func (c *rebootstrapCommand) markAdvertised(servers raft.Configuration) {
+	for id, address := range c.advertiseAddrs {
+		if serverIndex(servers, id) < 0 {
+			logger.Warningf("--advertise-address for %s, which isn't in the configuration", id)
+			continue
+		}
+		origin := c.origins[id]
+		origin.source = originAdvertise
+		c.origins[id] = origin
+		c.explainServer(id, "address overridden with --advertise-address %s", address)
+	}
+}
+
+// explainServer adds a line to the explanation of how the server with
+// the given id was arrived at.
+func (c *rebootstrapCommand) explainServer(id raft.ServerID, format string, args ...interface{}) {
+	origin := c.origins[id]
+	origin.explanation = append(origin.explanation, fmt.Sprintf(format, args...))
+	c.origins[id] = origin
+}
+
+// writeExplanations writes the explanation of each server that has
+// one, as given by --explain.
+func writeExplanations(w io.Writer, indent string, servers []serverResult) {
+	for _, server := range servers {
+		if len(server.Explanation) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%sServer %s (%s, %s):\n", indent, server.ID, server.Address, server.Suffrage)
+		for _, line := range server.Explanation {
+			fmt.Fprintf(w, "%s  %s\n", indent, line)
+		}
+	}
+}
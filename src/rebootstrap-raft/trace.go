@@ -0,0 +1,259 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// OTLP span kinds and status codes.
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusOK         = 1
+	otlpStatusError      = 2
+)
+
+// tracer records a span for the whole run and for each phase of it,
+// to be written with --trace-file as OTLP/JSON, which Jaeger, Tempo
+// and the OpenTelemetry collector can all load. Phases are run one at
+// a time, so a span started while a phase is running is its child. A
+// nil tracer records nothing.
+type tracer struct {
+	mu      sync.Mutex
+	traceID string
+	root    *traceSpan
+	phase   *traceSpan
+	spans   []*traceSpan
+}
+
+// traceSpan is a span being, or already, recorded.
+type traceSpan struct {
+	tracer *tracer
+	id     string
+	parent string
+	name   string
+	start  time.Time
+	end    time.Time
+	err    error
+	attrs  map[string]string
+}
+
+// newTracer returns a tracer whose root span, named name, starts now.
+func newTracer(name string) *tracer {
+	t := &tracer{traceID: randomHex(16)}
+	t.root = t.newSpan(name, "")
+	return t
+}
+
+func (t *tracer) newSpan(name, parent string) *traceSpan {
+	span := &traceSpan{
+		tracer: t,
+		id:     randomHex(8),
+		parent: parent,
+		name:   name,
+		start:  time.Now(),
+		attrs:  make(map[string]string),
+	}
+	t.spans = append(t.spans, span)
+	return span
+}
+
+// startPhase starts the span for a phase of the run.
+func (t *tracer) startPhase(name string) *traceSpan {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.phase = t.newSpan(name, t.root.id)
+	return t.phase
+}
+
+// start starts a span within the running phase, or within the run if
+// there isn't one.
+func (t *tracer) start(name string) *traceSpan {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parent := t.root
+	if t.phase != nil {
+		parent = t.phase
+	}
+	return t.newSpan(name, parent.id)
+}
+
+// setAttr records an attribute on the run's span.
+func (t *tracer) setAttr(key, value string) {
+	if t == nil {
+		return
+	}
+	t.root.setAttr(key, value)
+}
+
+// setAttr records an attribute on the span.
+func (s *traceSpan) setAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.attrs[key] = value
+}
+
+// finish ends the span with the outcome of what it covers.
+func (s *traceSpan) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.end = time.Now()
+	s.err = err
+	if s.tracer.phase == s {
+		s.tracer.phase = nil
+	}
+}
+
+// write ends the run's span with err and writes everything recorded
+// to path. Spans that never finished, because the run failed or was
+// interrupted within them, end now and are marked as such.
+func (t *tracer) write(path string, err error) error {
+	t.root.finish(err)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	spans := make([]otlpSpan, len(t.spans))
+	for i, span := range t.spans {
+		out := otlpSpan{
+			TraceID:           t.traceID,
+			SpanID:            span.id,
+			ParentSpanID:      span.parent,
+			Name:              span.name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			Status:            otlpStatus{Code: otlpStatusOK},
+		}
+		end := span.end
+		switch {
+		case end.IsZero():
+			end = now
+			out.Status = otlpStatus{Code: otlpStatusError, Message: "unfinished"}
+		case span.err != nil:
+			out.Status = otlpStatus{Code: otlpStatusError, Message: span.err.Error()}
+		}
+		out.EndTimeUnixNano = strconv.FormatInt(end.UnixNano(), 10)
+		keys := make([]string, 0, len(span.attrs))
+		for key := range span.attrs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			out.Attributes = append(out.Attributes, otlpStringAttribute(key, span.attrs[key]))
+		}
+		spans[i] = out
+	}
+	request := otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			otlpStringAttribute("service.name", "rebootstrap-raft"),
+			otlpStringAttribute("service.version", toolVersion),
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "rebootstrap-raft", Version: toolVersion},
+			Spans: spans,
+		}},
+	}}}
+	data, err := json.MarshalIndent(request, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// Written alongside and renamed, so that an earlier trace isn't
+	// lost to a partial write.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return errors.Trace(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tmp.Name(), path))
+}
+
+// The OTLP/JSON encoding of an ExportTraceServiceRequest, with only
+// the fields we use.
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+func otlpStringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: map[string]string{"stringValue": value}}
+}
+
+// randomHex returns n random bytes, hex encoded, as trace and span
+// ids are in OTLP/JSON.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	// The ids only need to be unique within the file, so a failure
+	// here (which doesn't happen on Linux) isn't worth stopping for.
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
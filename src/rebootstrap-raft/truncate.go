@@ -0,0 +1,282 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"go.etcd.io/bbolt"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+const truncateLogsDoc = `
+
+Remove the log entries below an index from an existing raft store,
+once a snapshot in the store has been checked to cover them. By
+default everything the newest snapshot covers is removed. The log
+store is then compacted, since bolt never gives freed space back to
+the filesystem, and a controller whose log has grown to gigabytes can
+take minutes to start.
+
+Only snapshots whose state passes its CRC check count. The raft
+directory is backed up first, and the machine agent must be stopped
+(or use --stop-agent, which starts it again once the store has been
+truncated). Only bolt log stores can be truncated.
+
+`
+
+type truncateLogsCommand struct {
+	cmd.CommandBase
+	logFlags
+	dataDirFlags
+	machineID    string
+	raftDir      string
+	agentService string
+	stopAgent    bool
+	below        uint64
+	noCompact    bool
+	dryRun       bool
+	yes          bool
+}
+
+// Info is part of cmd.Command.
+func (c *truncateLogsCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "truncate-logs",
+		Args:    "--machine-id <id> [--below <index>]",
+		Purpose: "Remove log entries a snapshot covers from a raft store.",
+		Doc:     strings.TrimSpace(truncateLogsDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *truncateLogsCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	c.logFlags.setFlags(f)
+	c.dataDirFlags.setFlags(f)
+	f.StringVar(&c.machineID, "machine-id", "", "ID of this Juju controller machine")
+	f.StringVar(&c.raftDir, "raft-dir", "", "raft directory location (default <data-dir>/raft)")
+	f.StringVar(&c.agentService, "agent-service", "", "machine agent service name, or none if it isn't run by systemd (default jujud-machine-<id>.service, or the snap's if that's installed)")
+	f.BoolVar(&c.stopAgent, "stop-agent", false, "stop the machine agent if it's running")
+	f.Uint64Var(&c.below, "below", 0, "remove the entries before this index (default: all those the newest snapshot covers)")
+	f.BoolVar(&c.noCompact, "no-compact", false, "don't compact the log store afterwards")
+	f.BoolVar(&c.dryRun, "dry-run", false, "show what would be removed without removing it")
+	f.BoolVar(&c.yes, "yes", false, "don't ask for confirmation")
+}
+
+// Init is part of cmd.Command.
+func (c *truncateLogsCommand) Init(args []string) error {
+	if err := c.setupLogging(c.dryRun); err != nil {
+		return errors.Trace(err)
+	}
+	if err := c.dataDirFlags.resolveStore(c.machineID, &c.raftDir, &c.agentService); err != nil {
+		return errors.Trace(err)
+	}
+	if c.agentService == noAgentService && c.stopAgent {
+		return errors.Errorf("--stop-agent needs an agent service")
+	}
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *truncateLogsCommand) Run(ctx *cmd.Context) error {
+	c.setupOutput(ctx)
+	return reportExitCode(ctx, c.run(ctx))
+}
+
+func (c *truncateLogsCommand) run(ctx *cmd.Context) (err error) {
+	logsPath := filepath.Join(c.raftDir, "logs")
+	if _, err := os.Stat(logsPath); err != nil {
+		return errors.Annotate(err, "finding the bolt log store")
+	}
+	// A snapshot that fails its CRC check can't be restored, so
+	// the entries it covers are only safe to remove if an older,
+	// valid snapshot covers them too.
+	_, snapshot, err := findNewestValidSnapshot(filepath.Join(c.raftDir, "snapshots"))
+	if errors.IsNotFound(err) {
+		return withExitCode(errors.Annotate(err, "no snapshot covers the log, so nothing can be removed"), exitValidation)
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+	restart := false
+	if !c.dryRun {
+		lock, err := acquireLock(c.dataDir)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer lock.Release()
+		stopped, err := ensureAgentStopped(c.agentService, c.stopAgent)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		restart = stopped
+	}
+	if restart {
+		// It's only started again if everything worked; otherwise
+		// the store may need looking at first.
+		defer func() {
+			if err != nil {
+				logger.Infof("%s was stopped; start it again once you're done.", c.agentService)
+				return
+			}
+			logger.Infof("Starting %s.", c.agentService)
+			if startErr := startService(c.agentService); startErr != nil {
+				err = withExitCode(errors.Annotate(startErr, "starting machine agent"), exitWriteFailed)
+			}
+		}()
+	}
+
+	var logStore rebootstrap.LogStore
+	if c.dryRun {
+		logStore, err = openStoreReadOnly(c.raftDir)
+	} else {
+		logStore, err = rebootstrap.NewLogStore(c.raftDir, nil)
+	}
+	if err != nil {
+		return errors.Annotate(err, "opening log store")
+	}
+	defer func() {
+		if logStore != nil {
+			logStore.Close()
+		}
+	}()
+	first, err := logStore.FirstIndex()
+	if err != nil {
+		return errors.Annotate(err, "reading first index")
+	}
+	last, err := logStore.LastIndex()
+	if err != nil {
+		return errors.Annotate(err, "reading last index")
+	}
+
+	below := c.below
+	if below == 0 {
+		below = snapshot.Index + 1
+	} else if below > snapshot.Index+1 {
+		return withExitCode(errors.Errorf("the newest snapshot (%s) only covers entries up to %d", snapshot.ID, snapshot.Index), exitValidation)
+	}
+	// Keep the newest entry, so the log still records where it ends.
+	if below > last {
+		below = last
+	}
+	if below <= first {
+		fmt.Fprintf(ctx.Stdout, "Nothing to remove: the log starts at %d and the newest snapshot covers up to %d.\n", first, snapshot.Index)
+		return nil
+	}
+	fmt.Fprintf(ctx.Stdout, "Log holds entries %d to %d; the newest snapshot (%s) covers up to %d.\n", first, last, snapshot.ID, snapshot.Index)
+	fmt.Fprintf(ctx.Stdout, "Entries %d to %d (%d) will be removed.\n", first, below-1, below-first)
+	if c.dryRun {
+		logger.Infof("dry-run specified - stopping")
+		return nil
+	}
+	if !c.yes {
+		ok, err := confirm(ctx, "Continue?")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !ok {
+			return errors.New("aborted")
+		}
+	}
+
+	backupDir := fmt.Sprintf("%s.backup-%s", c.raftDir, time.Now().UTC().Format("20060102-150405"))
+	if err := copyTree(c.raftDir, backupDir); err != nil {
+		return errors.Annotate(err, "backing up raft directory")
+	}
+	logger.Infof("Raft directory backed up to %q.", backupDir)
+	removed, err := rebootstrap.TruncateLog(logStore, below)
+	if err != nil {
+		return withExitCode(err, exitWriteFailed)
+	}
+	err = logStore.Close()
+	logStore = nil
+	if err != nil {
+		return withExitCode(errors.Annotate(err, "closing log store"), exitWriteFailed)
+	}
+	fmt.Fprintf(ctx.Stdout, "Removed %d entries; the original store is in %s.\n", removed, backupDir)
+	if c.noCompact {
+		return nil
+	}
+	before, after, err := compactBoltFile(logsPath)
+	if err != nil {
+		return withExitCode(errors.Annotate(err, "compacting log store"), exitWriteFailed)
+	}
+	fmt.Fprintf(ctx.Stdout, "Compacted the log store from %s to %s.\n", humanize.IBytes(uint64(before)), humanize.IBytes(uint64(after)))
+	return nil
+}
+
+// compactBoltFile rewrites the bolt database at path into a new file
+// holding only its live data, and renames that over the original.
+// It returns the file's size before and after.
+func compactBoltFile(path string) (int64, int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	tmpPath := path + ".compact"
+	if err := copyBoltFile(path, tmpPath, info.Mode().Perm()); err != nil {
+		os.Remove(tmpPath)
+		return 0, 0, errors.Trace(err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return 0, 0, errors.Trace(err)
+	}
+	if err := rebootstrap.SyncPath(filepath.Dir(path)); err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	compacted, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	return info.Size(), compacted.Size(), nil
+}
+
+// copyBoltFile copies every top level bucket of the bolt database at
+// src into a new database at dst. The raft bolt store doesn't nest
+// buckets.
+func copyBoltFile(src, dst string, perm os.FileMode) error {
+	from, err := bbolt.Open(src, 0600, &bbolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return errors.Annotatef(err, "opening %q", src)
+	}
+	defer from.Close()
+	to, err := bbolt.Open(dst, perm, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return errors.Annotatef(err, "creating %q", dst)
+	}
+	err = from.View(func(fromTx *bbolt.Tx) error {
+		return fromTx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+			return to.Update(func(toTx *bbolt.Tx) error {
+				bucket, err := toTx.CreateBucket(name)
+				if err != nil {
+					return errors.Trace(err)
+				}
+				// Raft's keys are written in order, so fill
+				// pages completely.
+				bucket.FillPercent = 1
+				return b.ForEach(func(k, v []byte) error {
+					if v == nil {
+						return errors.Errorf("nested bucket %q in %q", k, name)
+					}
+					return bucket.Put(k, v)
+				})
+			})
+		})
+	})
+	if err != nil {
+		to.Close()
+		return errors.Annotatef(err, "copying %q", src)
+	}
+	return errors.Trace(to.Close())
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+func TestCompactBoltFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs")
+	db, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := func(i uint64) []byte {
+		var k [8]byte
+		binary.BigEndian.PutUint64(k[:], i)
+		return k[:]
+	}
+	value := bytes.Repeat([]byte("x"), 1024)
+	err = db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucket([]byte("logs"))
+		if err != nil {
+			return err
+		}
+		for i := uint64(1); i <= 2000; i++ {
+			if err := bucket.Put(key(i), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Truncating leaves the freed pages in the file.
+	err = db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte("logs"))
+		for i := uint64(1); i <= 1990; i++ {
+			if err := bucket.Delete(key(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	before, after, err := compactBoltFile(path)
+	if err != nil {
+		t.Fatalf("compactBoltFile: %v", err)
+	}
+	if after >= before {
+		t.Errorf("file went from %d to %d bytes", before, after)
+	}
+	db, err = bbolt.Open(path, 0600, &bbolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.View(func(tx *bbolt.Tx) error {
+		if n := tx.Bucket([]byte("logs")).Stats().KeyN; n != 10 {
+			t.Errorf("compacted file has %d entries, want 10", n)
+		}
+		if v := tx.Bucket([]byte("logs")).Get(key(2000)); !bytes.Equal(v, value) {
+			t.Errorf("entry 2000 lost")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
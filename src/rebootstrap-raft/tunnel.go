@@ -0,0 +1,86 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// tunnelStartTimeout is how long ssh has to set up the port forward.
+const tunnelStartTimeout = 30 * time.Second
+
+// startTunnel forwards a local port to target (host:port, as seen from
+// the jump host) with ssh -L through jumpHost (user@host), and returns
+// the local address to dial. ssh is killed when ctx is done.
+func startTunnel(ctx context.Context, jumpHost, identity, target string) (string, error) {
+	port, err := freeLocalPort()
+	if err != nil {
+		return "", errors.Annotate(err, "finding a local port for the tunnel")
+	}
+	local := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	args := []string{
+		"-N",
+		"-o", "BatchMode=yes",
+		"-o", "ConnectTimeout=10",
+		"-o", "ExitOnForwardFailure=yes",
+		"-L", local + ":" + target,
+	}
+	if identity != "" {
+		args = append(args, "-i", identity)
+	}
+	args = append(args, jumpHost)
+	command := exec.CommandContext(ctx, "ssh", args...)
+	var stderr bytes.Buffer
+	command.Stderr = &stderr
+	logger.Debugf("running %s", strings.Join(command.Args, " "))
+	if err := command.Start(); err != nil {
+		return "", errors.Annotate(err, "starting ssh")
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- command.Wait()
+	}()
+
+	deadline := time.Now().Add(tunnelStartTimeout)
+	for {
+		select {
+		case err := <-exited:
+			return "", errors.Errorf("ssh tunnel through %s: %v: %s", jumpHost, err, strings.TrimSpace(stderr.String()))
+		case <-time.After(200 * time.Millisecond):
+		}
+		if conn, err := net.DialTimeout("tcp", local, time.Second); err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			command.Process.Kill()
+			return "", errors.Errorf("ssh tunnel through %s not ready after %v", jumpHost, tunnelStartTimeout)
+		}
+	}
+	logger.Infof("Tunnelling to MongoDB at %s through %s", target, jumpHost)
+	go func() {
+		if err := <-exited; err != nil && ctx.Err() == nil {
+			logger.Warningf("ssh tunnel through %s exited: %v: %s", jumpHost, err, strings.TrimSpace(stderr.String()))
+		}
+	}()
+	return local, nil
+}
+
+// freeLocalPort returns a loopback port that nothing is listening on.
+func freeLocalPort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/errors"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+// verifyStore reopens the store written in dir and checks that it
+// holds the configuration we meant to write, so a bad write is found
+// now rather than when jujud fails to start.
+func (c *rebootstrapCommand) verifyStore(dir string, servers raft.Configuration, withSnapshot bool) error {
+	logStore, err := c.storeBuilder().OpenLogStore(dir)
+	if err != nil {
+		return errors.Annotate(err, "reopening log store")
+	}
+	defer logStore.Close()
+
+	first, err := logStore.FirstIndex()
+	if err != nil {
+		return errors.Annotate(err, "reading first index")
+	}
+	last, err := logStore.LastIndex()
+	if err != nil {
+		return errors.Annotate(err, "reading last index")
+	}
+	expectedFirst := c.startIndex
+	if len(c.retained) > 0 {
+		expectedFirst = c.retained[0].Index
+	}
+	if first != expectedFirst || last != c.startIndex {
+		return errors.Errorf("expected log entries at indexes %d to %d, found %d to %d",
+			expectedFirst, c.startIndex, first, last)
+	}
+	term, err := logStore.GetUint64(rebootstrap.KeyCurrentTerm)
+	if err != nil {
+		return errors.Annotate(err, "reading current term")
+	}
+	if term != c.startTerm {
+		return errors.Errorf("expected current term %d, found %d", c.startTerm, term)
+	}
+
+	var entry raft.Log
+	if err := logStore.GetLog(c.startIndex, &entry); err != nil {
+		return errors.Annotate(err, "reading configuration entry")
+	}
+	if entry.Term != c.startTerm {
+		return errors.Errorf("expected configuration entry term %d, found %d", c.startTerm, entry.Term)
+	}
+	if c.protocolVersion < 3 {
+		// The configuration is stored as a peer address list
+		// that we can't decode without raft internals.
+		if entry.Type != raft.LogRemovePeerDeprecated {
+			return errors.Errorf("unexpected configuration entry type %v", entry.Type)
+		}
+	} else {
+		if entry.Type != raft.LogConfiguration {
+			return errors.Errorf("unexpected configuration entry type %v", entry.Type)
+		}
+		stored := raft.DecodeConfiguration(entry.Data)
+		logger.Infof("Stored configuration:")
+		logServers(stored)
+		if !reflect.DeepEqual(stored, rebootstrap.ApplyIDScheme(servers, c.idScheme)) {
+			return errors.Errorf("stored configuration doesn't match the generated one")
+		}
+	}
+
+	if !withSnapshot {
+		return nil
+	}
+	expectedIndex, expectedTerm := c.startIndex, c.startTerm
+	if c.snapshotIndex != 0 {
+		expectedIndex, expectedTerm = c.snapshotIndex, c.snapshotTerm
+	}
+	return errors.Trace(c.verifySnapshot(dir, expectedIndex, expectedTerm, servers))
+}
+
+// verifySnapshot checks that the store in dir has a single snapshot,
+// at index and term with the configuration servers, and that its
+// state matches its CRC.
+func (c *rebootstrapCommand) verifySnapshot(dir string, index, term uint64, servers raft.Configuration) error {
+	snapshotStore, err := rebootstrap.NewSnapshotStore(dir, c.snapshotRetain)
+	if err != nil {
+		return errors.Annotate(err, "reopening snapshot store")
+	}
+	snapshots, err := snapshotStore.List()
+	if err != nil {
+		return errors.Annotate(err, "listing snapshots")
+	}
+	if len(snapshots) != 1 {
+		return errors.Errorf("expected 1 snapshot, found %d", len(snapshots))
+	}
+	meta := snapshots[0]
+	if meta.Index != index || meta.Term != term {
+		return errors.Errorf("snapshot is at index %d, term %d, expected index %d, term %d",
+			meta.Index, meta.Term, index, term)
+	}
+	if !reflect.DeepEqual(meta.Configuration, servers) {
+		return errors.Errorf("snapshot configuration doesn't match the generated one")
+	}
+	// Opening the snapshot and reading it to the end checks its CRC.
+	_, reader, err := snapshotStore.Open(meta.ID)
+	if err != nil {
+		return errors.Annotate(err, "opening snapshot")
+	}
+	_, err = ioutil.ReadAll(reader)
+	closeErr := reader.Close()
+	if err != nil {
+		return errors.Annotate(err, "reading snapshot")
+	}
+	return errors.Annotate(closeErr, "checking snapshot")
+}
+
+// verifyCopiedStore reopens the store copied from --source-raft-dir
+// into dir and checks it holds the source's log, term and snapshot.
+func (c *rebootstrapCommand) verifyCopiedStore(dir string) error {
+	src := c.sourceCopy
+	logStore, err := c.storeBuilder().OpenLogStore(dir)
+	if err != nil {
+		return errors.Annotate(err, "reopening log store")
+	}
+	defer logStore.Close()
+
+	first, err := logStore.FirstIndex()
+	if err != nil {
+		return errors.Annotate(err, "reading first index")
+	}
+	last, err := logStore.LastIndex()
+	if err != nil {
+		return errors.Annotate(err, "reading last index")
+	}
+	var expectedFirst, expectedLast uint64
+	if len(src.Entries) > 0 {
+		expectedFirst, expectedLast = src.Entries[0].Index, src.Entries[len(src.Entries)-1].Index
+	}
+	if first != expectedFirst || last != expectedLast {
+		return errors.Errorf("expected log entries at indexes %d to %d, found %d to %d",
+			expectedFirst, expectedLast, first, last)
+	}
+	for _, expected := range src.Entries {
+		var entry raft.Log
+		if err := logStore.GetLog(expected.Index, &entry); err != nil {
+			return errors.Annotatef(err, "reading entry %d", expected.Index)
+		}
+		if entry.Term != expected.Term || entry.Type != expected.Type || !bytes.Equal(entry.Data, expected.Data) {
+			return errors.Errorf("entry %d doesn't match the source's", expected.Index)
+		}
+	}
+	term, err := logStore.GetUint64(rebootstrap.KeyCurrentTerm)
+	if err != nil {
+		return errors.Annotate(err, "reading current term")
+	}
+	if term != src.CurrentTerm {
+		return errors.Errorf("expected current term %d, found %d", src.CurrentTerm, term)
+	}
+	if src.SnapshotMeta == nil {
+		return nil
+	}
+	meta := src.SnapshotMeta
+	return errors.Trace(c.verifySnapshot(dir, meta.Index, meta.Term, meta.Configuration))
+}
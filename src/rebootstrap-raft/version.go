@@ -0,0 +1,115 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/juju/errors"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+// jujuVersion is the major and minor part of a Juju version, which is
+// all we need to decide what kind of store the agent expects.
+type jujuVersion struct {
+	Major int
+	Minor int
+	Full  string
+}
+
+func (v jujuVersion) String() string {
+	return v.Full
+}
+
+// less reports whether v is older than major.minor.
+func (v jujuVersion) less(major, minor int) bool {
+	return v.Major < major || (v.Major == major && v.Minor < minor)
+}
+
+var versionPattern = regexp.MustCompile(`^(\d+)\.(\d+)[.\-]?[0-9a-z.]*`)
+
+func parseJujuVersion(s string) (jujuVersion, error) {
+	m := versionPattern.FindStringSubmatch(s)
+	if m == nil {
+		return jujuVersion{}, errors.NotValidf("juju version %q", s)
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	return jujuVersion{Major: major, Minor: minor, Full: m[0]}, nil
+}
+
+// detectJujuVersion works out the version of the machine agent
+// installed for machineID. The tools symlink for the machine is the
+// most reliable source since it points at the binaries that will
+// actually run; upgradedToVersion from the agent.conf at confPath is
+// the fallback.
+func detectJujuVersion(dataDir, machineID, confPath string) (jujuVersion, error) {
+	link := filepath.Join(dataDir, "tools", fmt.Sprintf("machine-%s", machineID))
+	if target, err := os.Readlink(link); err == nil {
+		if v, err := parseJujuVersion(filepath.Base(target)); err == nil {
+			return v, nil
+		}
+	}
+	config, err := readAgentConfig(confPath)
+	if err != nil {
+		return jujuVersion{}, errors.Trace(err)
+	}
+	if config.UpgradedToVersion == "" {
+		return jujuVersion{}, errors.NotFoundf("upgradedToVersion in agent.conf")
+	}
+	return parseJujuVersion(config.UpgradedToVersion)
+}
+
+// versionSettings describes the raft store a version of jujud expects.
+type versionSettings struct {
+	// leasesInRaft is whether the lease FSM runs on raft. Before 2.5
+	// leases were still kept in MongoDB, so the FSM snapshot is never
+	// read and seeding one is pointless.
+	leasesInRaft bool
+
+	// protocolVersion is the raft protocol version jujud runs with.
+	protocolVersion int
+
+	// serverIDScheme is how jujud names raft servers. Every release
+	// so far uses bare machine ids; a store from a peer overrides
+	// this, so clusters set up by hand with tags are kept as they
+	// are.
+	serverIDScheme string
+}
+
+// settingsForVersion returns the store settings for a version of
+// jujud that uses raft.
+func settingsForVersion(v jujuVersion) versionSettings {
+	return versionSettings{
+		leasesInRaft:    !v.less(2, 5),
+		protocolVersion: 3,
+		serverIDScheme:  rebootstrap.IDSchemeMachineID,
+	}
+}
+
+// checkVersionCompatibility returns an error if the store this run
+// would write can't be used by the given version of jujud.
+func (c *rebootstrapCommand) checkVersionCompatibility(v jujuVersion) error {
+	switch {
+	case v.Major >= 3:
+		return errors.Errorf("juju %s controllers don't use raft - use the dqlite subcommand instead", v)
+	case v.less(2, 4):
+		return errors.Errorf("juju %s predates raft support", v)
+	case c.logStoreType != boltLogStore:
+		return errors.Errorf("juju %s only opens bolt log stores", v)
+	}
+	settings := settingsForVersion(v)
+	if !settings.leasesInRaft && (c.seedLeases || c.snapshotFrom != "") {
+		return errors.Errorf("juju %s keeps leases in MongoDB, so there's no lease snapshot to seed", v)
+	}
+	if c.protocolVersion != settings.protocolVersion {
+		return errors.Errorf("juju %s runs raft protocol version %d, not %d", v, settings.protocolVersion, c.protocolVersion)
+	}
+	return nil
+}
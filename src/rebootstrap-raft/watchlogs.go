@@ -0,0 +1,235 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// logPollInterval is how often the agent's log file is checked for
+// new lines.
+const logPollInterval = 500 * time.Millisecond
+
+// agentLogFile returns the machine agent's log file.
+func agentLogFile(machineID string) string {
+	return "/var/log/juju/machine-" + machineID + ".log"
+}
+
+// The kinds of agent log line --watch-logs shows.
+const (
+	logLineStart     = "start"
+	logLineBootstrap = "bootstrap"
+	logLineLeader    = "leadership"
+	logLineProblem   = "problem"
+)
+
+// raftLogPatterns pick out the agent log lines that show how raft is
+// coming up, with the first match deciding the kind. They cover the
+// dependency engine's messages about the raft manifolds and what
+// hashicorp raft logs, in both its old and hclog formats.
+var raftLogPatterns = []struct {
+	kind    string
+	pattern *regexp.Regexp
+}{
+	{logLineProblem, regexp.MustCompile(`(?i)"(raft|raft-[a-z-]+|lease-manager)" manifold worker (stopped|returned unexpected error)|raft.*(ERROR|\[ERR\]|failed to)`)},
+	{logLineStart, regexp.MustCompile(`"(raft|raft-[a-z-]+|lease-manager)" manifold worker started`)},
+	{logLineBootstrap, regexp.MustCompile(`(?i)raft.*(initial configuration|bootstrap)`)},
+	{logLineLeader, regexp.MustCompile(`(?i)entering (leader|follower|candidate) state|election won|heartbeat timeout reached`)},
+}
+
+// healthyLogPatterns are the lines that show raft has a leader: this
+// machine taking over, or following one that it knows.
+var healthyLogPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)entering leader state`),
+	regexp.MustCompile(`(?i)election won`),
+	regexp.MustCompile(`(?i)entering follower state.*leader(-address)?=[^\s]`),
+}
+
+// classifyLogLine returns the kind of a raft log line, or "" if it's
+// not one.
+func classifyLogLine(line string) string {
+	for _, p := range raftLogPatterns {
+		if p.pattern.MatchString(line) {
+			return p.kind
+		}
+	}
+	return ""
+}
+
+// healthyLogLine reports whether line shows raft has a leader.
+func healthyLogLine(line string) bool {
+	for _, pattern := range healthyLogPatterns {
+		if pattern.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// logWatch follows the machine agent's log from the moment it was
+// created: its log file if there is one, or otherwise the agent
+// service's journal.
+type logWatch struct {
+	path    string
+	offset  int64
+	service string
+	since   time.Time
+}
+
+// newLogWatch notes where the agent's log currently ends, so that
+// only what the restarted agent logs is followed.
+func newLogWatch(machineID, service string) *logWatch {
+	w := &logWatch{path: agentLogFile(machineID), service: service, since: time.Now()}
+	if info, err := os.Stat(w.path); err == nil {
+		w.offset = info.Size()
+	} else {
+		logger.Debugf("no agent log file (%v), following the journal for %s", err, service)
+		w.path = ""
+	}
+	return w
+}
+
+// source describes where the lines come from.
+func (w *logWatch) source() string {
+	if w.path != "" {
+		return w.path
+	}
+	return "the journal for " + w.service
+}
+
+// watch writes the raft lines the agent logs to out, highlighted if
+// color is set, until one shows raft has a leader, ctx is done or
+// timeout passes. It reports whether raft was seen to be healthy.
+func (w *logWatch) watch(ctx context.Context, out io.Writer, color bool, timeout time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	lines := make(chan string)
+	errs := make(chan error, 1)
+	go func() {
+		if w.path != "" {
+			errs <- w.tailFile(ctx, lines)
+		} else {
+			errs <- w.followJournal(ctx, lines)
+		}
+	}()
+	fmt.Fprintf(out, "Watching %s for raft to come up:\n", w.source())
+	for {
+		select {
+		case line := <-lines:
+			kind := classifyLogLine(line)
+			if kind == "" {
+				continue
+			}
+			writeLogLine(out, kind, line, color)
+			if healthyLogLine(line) {
+				return true, nil
+			}
+		case err := <-errs:
+			if ctx.Err() != nil {
+				return false, nil
+			}
+			return false, errors.Annotatef(err, "following %s", w.source())
+		case <-ctx.Done():
+			return false, nil
+		}
+	}
+}
+
+// writeLogLine writes a raft log line, marked with its kind.
+func writeLogLine(out io.Writer, kind, line string, color bool) {
+	label := fmt.Sprintf("%-10s", kind)
+	if color {
+		switch kind {
+		case logLineLeader:
+			label = ansiGreen + label + ansiReset
+		case logLineProblem:
+			label = ansiRed + label + ansiReset
+		default:
+			label = ansiYellow + label + ansiReset
+		}
+	}
+	fmt.Fprintf(out, "  %s %s\n", label, strings.TrimSpace(line))
+}
+
+// tailFile sends the lines appended to the log file after offset,
+// starting again from the top if the file is rotated or truncated.
+func (w *logWatch) tailFile(ctx context.Context, lines chan<- string) error {
+	ticker := time.NewTicker(logPollInterval)
+	defer ticker.Stop()
+	var partial string
+	for {
+		f, err := os.Open(w.path)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		info, err := f.Stat()
+		if err == nil && info.Size() < w.offset {
+			w.offset, partial = 0, ""
+		}
+		if err == nil {
+			_, err = f.Seek(w.offset, io.SeekStart)
+		}
+		if err == nil {
+			reader := bufio.NewReader(f)
+			for {
+				chunk, readErr := reader.ReadString('\n')
+				w.offset += int64(len(chunk))
+				if readErr != nil {
+					// A line still being written.
+					partial += chunk
+					break
+				}
+				select {
+				case lines <- partial + chunk:
+				case <-ctx.Done():
+					f.Close()
+					return ctx.Err()
+				}
+				partial = ""
+			}
+		}
+		f.Close()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// followJournal sends the lines the agent service logs to journald.
+func (w *logWatch) followJournal(ctx context.Context, lines chan<- string) error {
+	journal := exec.CommandContext(ctx, "journalctl",
+		"--unit", w.service, "--follow", "--output", "cat",
+		"--since", "@"+strconv.FormatInt(w.since.Unix(), 10))
+	stdout, err := journal.StdoutPipe()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := journal.Start(); err != nil {
+		return errors.Trace(err)
+	}
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		select {
+		case lines <- scanner.Text():
+		case <-ctx.Done():
+		}
+	}
+	return errors.Trace(journal.Wait())
+}
@@ -0,0 +1,225 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+// wizard asks the operator the questions --interactive walks through.
+// Questions go to stderr, like confirm's, and every one has a default
+// that's taken on an empty answer.
+type wizard struct {
+	ctx *cmd.Context
+}
+
+// ask asks a question, returning def for an empty answer.
+func (w wizard) ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(w.ctx.Stderr, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(w.ctx.Stderr, "%s: ", question)
+	}
+	answer, err := readLine(w.ctx.Stdin)
+	if err == io.EOF && answer == "" {
+		fmt.Fprintln(w.ctx.Stderr)
+		return "", errors.New("no answer on stdin")
+	} else if err != nil && err != io.EOF {
+		return "", errors.Trace(err)
+	}
+	if answer = strings.TrimSpace(answer); answer == "" {
+		return def, nil
+	}
+	return answer, nil
+}
+
+// askYesNo asks a yes/no question, returning def for an empty answer.
+func (w wizard) askYesNo(question string, def bool) (bool, error) {
+	hint := "y/N"
+	if def {
+		hint = "Y/n"
+	}
+	for {
+		answer, err := w.ask(fmt.Sprintf("%s (%s)", question, hint), "")
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		switch strings.ToLower(answer) {
+		case "":
+			return def, nil
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+		fmt.Fprintln(w.ctx.Stderr, "Please answer y or n.")
+	}
+}
+
+// askSecret asks for a secret, without echoing it if stdin is a
+// terminal.
+func (w wizard) askSecret(question string) (string, error) {
+	if f, ok := w.ctx.Stdin.(*os.File); ok {
+		if restore, err := disableEcho(f); err == nil {
+			defer func() {
+				restore()
+				fmt.Fprintln(w.ctx.Stderr)
+			}()
+		}
+	}
+	return w.ask(question, "")
+}
+
+// disableEcho turns off echoing on the terminal f, returning a
+// function that turns it back on. It fails if f isn't a terminal.
+func disableEcho(f *os.File) (func(), error) {
+	var termios syscall.Termios
+	fd := f.Fd()
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCGETS, uintptr(unsafe.Pointer(&termios))); errno != 0 {
+		return nil, errno
+	}
+	saved := termios
+	termios.Lflag &^= syscall.ECHO
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&termios))); errno != 0 {
+		return nil, errno
+	}
+	return func() {
+		syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&saved)))
+	}, nil
+}
+
+// localMachineIDs returns the ids of the machine agents in the data
+// directory.
+func localMachineIDs(dataDir string) []string {
+	entries, err := ioutil.ReadDir(filepath.Join(dataDir, "agents"))
+	if err != nil {
+		return nil
+	}
+	var ids []string
+	for _, entry := range entries {
+		if name := entry.Name(); entry.IsDir() && strings.HasPrefix(name, "machine-") {
+			ids = append(ids, strings.TrimPrefix(name, "machine-"))
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// wizardSetup asks for the machine id and where the MongoDB password
+// comes from, offering what was detected, then finishes the setup
+// Init left for it.
+func (c *rebootstrapCommand) wizardSetup(ctx *cmd.Context) error {
+	w := wizard{ctx}
+	fmt.Fprintln(ctx.Stderr, "Answer each question, or press enter to accept the suggestion in brackets.")
+	fmt.Fprintf(ctx.Stderr, "Juju data directory: %s\n", c.dataDir)
+
+	def := c.machineID
+	if ids := localMachineIDs(c.dataDir); def == "" && len(ids) > 0 {
+		fmt.Fprintf(ctx.Stderr, "Machine agents found here: %s\n", strings.Join(ids, ", "))
+		def = ids[0]
+	}
+	for {
+		id, err := w.ask("Which controller machine is this?", def)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if id != "" {
+			c.machineID = id
+			break
+		}
+	}
+
+	needMongo := c.configFrom == "" && c.fromBackup == "" && c.sourceRaftDir == ""
+	if needMongo && c.password == "" {
+		path := c.agentConfFile(c.machineID)
+		fromConf := false
+		if _, err := os.Stat(path); err == nil {
+			ok, err := w.askYesNo(fmt.Sprintf("Read the MongoDB password from %s?", path), true)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			fromConf = ok
+		} else {
+			fmt.Fprintf(ctx.Stderr, "There's no agent.conf at %s.\n", path)
+		}
+		if !fromConf {
+			password, err := w.askSecret("MongoDB password (statepassword in agent.conf)")
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if password == "" {
+				return errors.New("a MongoDB password is needed")
+			}
+			c.password = password
+		}
+	}
+	return errors.Trace(c.resolveMachine())
+}
+
+// wizardServers shows each server in the planned configuration and
+// asks whether to include it and with what suffrage. Servers left out
+// are reported like those dropped with --drop-unreachable.
+func (c *rebootstrapCommand) wizardServers(ctx *cmd.Context, servers raft.Configuration) (raft.Configuration, error) {
+	w := wizard{ctx}
+	fmt.Fprintln(ctx.Stderr, "Planned servers:")
+	writeServers(ctx.Stderr, "  ", servers)
+	ok, err := w.askYesNo("Use these servers as they are?", true)
+	if err != nil || ok {
+		return servers, errors.Trace(err)
+	}
+	var result raft.Configuration
+	for _, server := range servers.Servers {
+		if string(server.ID) != c.machineID {
+			include, err := w.askYesNo(fmt.Sprintf("Include machine %s (%s)?", server.ID, server.Address), true)
+			if err != nil {
+				return raft.Configuration{}, errors.Trace(err)
+			}
+			if !include {
+				c.dropped = append(c.dropped, string(server.ID))
+				continue
+			}
+		}
+		detected := server.Suffrage
+		for {
+			answer, err := w.ask(fmt.Sprintf("Suffrage for machine %s (voter or nonvoter)?", server.ID), server.Suffrage.String())
+			if err != nil {
+				return raft.Configuration{}, errors.Trace(err)
+			}
+			if strings.EqualFold(answer, raft.Voter.String()) {
+				server.Suffrage = raft.Voter
+			} else if strings.EqualFold(answer, raft.Nonvoter.String()) {
+				server.Suffrage = raft.Nonvoter
+			} else {
+				fmt.Fprintln(ctx.Stderr, "Please answer voter or nonvoter.")
+				continue
+			}
+			break
+		}
+		if server.Suffrage != detected {
+			c.explainServer(server.ID, "made a %s with --interactive", server.Suffrage)
+		}
+		result.Servers = append(result.Servers, server)
+	}
+	if err := rebootstrap.ValidateVoters(result, c.minVoters, c.allowEvenVoters); err != nil {
+		return raft.Configuration{}, withExitCode(err, exitValidation)
+	}
+	if err := rebootstrap.ValidateLocal(result, c.machineID); err != nil {
+		return raft.Configuration{}, withExitCode(err, exitValidation)
+	}
+	return result, nil
+}
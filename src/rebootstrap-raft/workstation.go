@@ -0,0 +1,426 @@
+// Copyright 2019 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"go.etcd.io/bbolt"
+
+	"github.com/juju/rebootstrap-raft/pkg/rebootstrap"
+)
+
+const workstationDoc = `
+
+Rebootstrap a controller machine from an operator workstation without
+installing anything on the controller. Over ssh the tool reads the
+machine agent's agent.conf, reaches MongoDB through an ssh tunnel,
+builds the raft directory locally and then copies it into place on the
+controller as a tarball, unpacked and chowned there with sudo.
+
+As with bootstrap, the machine agent must be stopped (or use
+--stop-agent) and the raft directory on the controller mustn't exist.
+The installed jujud version isn't checked.
+
+With --container instead of --host, the controller is a local LXD
+container: commands are run and files copied with the lxc client, and
+MongoDB is reached directly on the container's address as reported by
+the LXD API.
+
+`
+
+type workstationCommand struct {
+	cmd.CommandBase
+	out cmd.Output
+	logFlags
+	mongoFlags
+	host         string
+	container    string
+	sshUser      string
+	sshIdentity  string
+	machineID    string
+	dataDir      string
+	raftDir      string
+	apiPort      int
+	minVoters    int
+	allowEven    bool
+	logStoreType string
+	seedLeases   bool
+	ownerSpec    string
+	stopAgent    bool
+	restartAgent bool
+	dryRun       bool
+	yes          bool
+	color        string
+}
+
+// Info is part of cmd.Command.
+func (c *workstationCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "remote",
+		Args:    "--host <controller> --machine-id <id>",
+		Purpose: "Rebootstrap a controller from a workstation over ssh.",
+		Doc:     strings.TrimSpace(workstationDoc),
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *workstationCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	c.logFlags.setFlags(f)
+	c.out.AddFlags(f, "text", outputFormatters)
+	f.StringVar(&c.host, "host", "", "address of the controller machine")
+	f.StringVar(&c.container, "container", "", "name of a local LXD container running the controller, instead of --host")
+	f.StringVar(&c.sshUser, "ssh-user", "ubuntu", "user to ssh to the controller as")
+	f.StringVar(&c.sshIdentity, "ssh-identity", "", "private key to use for ssh (default: ssh's own choice)")
+	f.StringVar(&c.machineID, "machine-id", "", "ID of the Juju controller machine")
+	f.StringVar(&c.dataDir, "data-dir", "/var/lib/juju", "Juju data directory on the controller")
+	f.StringVar(&c.raftDir, "raft-dir", "", "raft directory location on the controller (default <data-dir>/raft)")
+	f.IntVar(&c.apiPort, "api-port", 17070, "the API port of the Juju controller")
+	c.mongoFlags.setFlags(f)
+	f.IntVar(&c.minVoters, "min-voters", 1, "fail if the generated configuration has fewer voters than this")
+	f.BoolVar(&c.allowEven, "allow-even-voters", false, "allow a configuration with an even number of voters")
+	f.StringVar(&c.logStoreType, "log-store", boltLogStore, "log store backend to create (bolt or wal)")
+	f.BoolVar(&c.seedLeases, "seed-leases", false, "write an initial snapshot holding the lease holders recorded in MongoDB")
+	f.StringVar(&c.ownerSpec, "owner", "root:root", "user[:group] on the controller to own the new raft directory")
+	f.BoolVar(&c.stopAgent, "stop-agent", false, "stop the machine agent if it's running")
+	f.BoolVar(&c.restartAgent, "restart-agent", false, "start the machine agent once the store is in place")
+	f.BoolVar(&c.dryRun, "dry-run", false, "build the configuration but don't write anything")
+	f.BoolVar(&c.yes, "yes", false, "don't ask for confirmation before writing")
+	f.StringVar(&c.color, "color", colorAuto, "colour the server table: auto (on a terminal), always or never")
+}
+
+// Init is part of cmd.Command.
+func (c *workstationCommand) Init(args []string) error {
+	if err := c.setupLogging(c.dryRun); err != nil {
+		return errors.Trace(err)
+	}
+	if (c.host == "") == (c.container == "") {
+		return errors.Errorf("one of --host or --container is required")
+	}
+	if c.machineID == "" {
+		return errors.Errorf("--machine-id is required")
+	}
+	if c.mongoFlags.sshTunnel != "" {
+		return errors.Errorf("--ssh-tunnel can't be used with remote, which reaches MongoDB through --host or --container")
+	}
+	if c.raftDir == "" {
+		c.raftDir = filepath.Join(c.dataDir, "raft")
+	}
+	if c.minVoters < 1 {
+		return errors.Errorf("--min-voters must be at least 1")
+	}
+	if c.logStoreType != boltLogStore && c.logStoreType != walLogStore {
+		return errors.Errorf("--log-store must be %q or %q", boltLogStore, walLogStore)
+	}
+	// The owner is looked up on the controller, not here.
+	if c.ownerSpec == "" || strings.Count(c.ownerSpec, ":") > 1 {
+		return errors.Errorf("--owner must be user or user:group")
+	}
+	if err := checkColorMode(c.color); err != nil {
+		return errors.Trace(err)
+	}
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *workstationCommand) Run(ctx *cmd.Context) error {
+	c.setupOutput(ctx)
+	stdCtx, cancel := interruptContext()
+	defer cancel()
+	return reportExitCode(ctx, c.run(ctx, stdCtx))
+}
+
+func (c *workstationCommand) run(ctx *cmd.Context, stdCtx context.Context) error {
+	progress := newProgress(ctx.Stderr, c.quiet)
+	r, err := c.remote(progress)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	service := remoteAgentService(r, c.machineID)
+
+	workDir, err := ioutil.TempDir("", "rebootstrap-raft")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	done := progress.start("Reading agent.conf from " + r.String())
+	agentConf, err := c.fetchAgentConf(r, workDir)
+	done(err)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if ssh, ok := r.(*sshRemote); ok {
+		c.mongoFlags.sshTunnel = ssh.target()
+		c.mongoFlags.sshTunnelIdentity = c.sshIdentity
+	}
+	done = progress.start("Connecting to MongoDB on " + r.String())
+	session, err := c.connect(stdCtx, c.machineID, agentConf)
+	if err == nil {
+		err = withExitCode(checkControllerUUID(stdCtx, session, agentConf), exitValidation)
+	}
+	done(err)
+	if session != nil {
+		defer session.Close()
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	done = progress.start("Checking the machine agent")
+	err = c.checkRemoteTarget(r, service)
+	done(err)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	localDir := filepath.Join(workDir, "raft")
+	opts := rebootstrap.Options{
+		Session:         session,
+		RaftDir:         localDir,
+		APIPort:         c.apiPort,
+		MinVoters:       c.minVoters,
+		AllowEvenVoters: c.allowEven,
+		SeedLeases:      c.seedLeases,
+		Store: rebootstrap.StoreOptions{
+			MachineID:       c.machineID,
+			ProtocolVersion: raft.ProtocolVersionMax,
+			Builder:         c.storeBuilder(),
+			SnapshotRetain:  jujudSnapshotRetention,
+		},
+	}
+	result := &bootstrapResult{
+		SchemaVersion: outputSchemaVersion,
+		RaftDir:       c.raftDir,
+		DryRun:        c.dryRun,
+		StartIndex:    1,
+		StartTerm:     1,
+		localID:       c.machineID,
+		color:         useColor(c.color, os.Stdout),
+	}
+	if c.dryRun {
+		done = progress.start("Reading controller members")
+		servers, err := rebootstrap.PlanServers(stdCtx, session, c.apiPort, c.minVoters, c.allowEven)
+		done(err)
+		if err != nil {
+			return withExitCode(err, exitValidation)
+		}
+		result.Servers = makeServerResults(servers)
+		logger.Infof("dry-run specified - stopping")
+		return c.out.Write(ctx, result)
+	}
+
+	done = progress.start("Writing store locally")
+	written, err := rebootstrap.Run(stdCtx, opts)
+	done(err)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	result.Servers = makeServerResults(written.Servers)
+	if !c.yes {
+		if err := confirmPlan(ctx, r.String()+":"+c.raftDir, result.Servers, c.machineID, useColor(c.color, os.Stderr)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if c.stopAgent {
+		logger.Infof("Stopping %s on %s.", service, r)
+		if _, err := r.Run("systemctl", "stop", service); err != nil {
+			return errors.Annotatef(err, "stopping %s", service)
+		}
+	}
+	done = progress.start("Copying store to " + r.String())
+	err = c.pushStore(r, localDir, workDir)
+	done(err)
+	if err != nil {
+		return withExitCode(err, exitWriteFailed)
+	}
+	result.Written = true
+	logger.Infof("Raft cluster store bootstrapped in %q on %s.", c.raftDir, r)
+
+	if c.restartAgent {
+		logger.Infof("Starting %s on %s.", service, r)
+		if _, err := r.Run("systemctl", "start", service); err != nil {
+			err = errors.Annotate(err, "starting machine agent")
+			result.Phases = progress.timings()
+			result.Error = newErrorResult(err, map[string]string{"<id>": c.machineID, "<raft-dir>": c.raftDir, "<service>": service})
+			return writeRunResult(ctx, &c.out, result, err)
+		}
+		result.AgentRestarted = true
+	}
+	result.Phases = progress.timings()
+	return c.out.Write(ctx, result)
+}
+
+// remote returns the remote for the controller. For --container the
+// MongoDB connection is pointed straight at the container's address;
+// for --host it goes through an ssh tunnel once agent.conf is read.
+func (c *workstationCommand) remote(progress *progress) (remote, error) {
+	if c.container == "" {
+		return &sshRemote{host: c.host, user: c.sshUser, identity: c.sshIdentity}, nil
+	}
+	r := &lxdRemote{container: c.container}
+	done := progress.start("Finding the address of " + r.String())
+	address, err := r.address()
+	done(err)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if c.mongoFlags.hostname == "localhost" {
+		c.mongoFlags.hostname = address
+	}
+	return r, nil
+}
+
+// fetchAgentConf copies the machine agent's agent.conf from the
+// controller into workDir and reads it, taking the MongoDB password
+// from it unless one was given.
+func (c *workstationCommand) fetchAgentConf(r remote, workDir string) (*agentConfig, error) {
+	data, err := r.Run("cat", agentConfPath(c.dataDir, c.machineID))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	path := filepath.Join(workDir, "agent.conf")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := c.mongoFlags.validate(path, ""); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return readAgentConfig(path)
+}
+
+// checkRemoteTarget makes sure the raft directory doesn't exist on
+// the controller and that the agent is stopped or will be.
+func (c *workstationCommand) checkRemoteTarget(r remote, service string) error {
+	out, err := r.Run("sh", "-c", `if [ -e "$1" ]; then echo present; fi`, "sh", c.raftDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if strings.TrimSpace(string(out)) == "present" {
+		return withExitCode(errors.Errorf("raft directory %q already exists on %s - remove it first", c.raftDir, r), exitRaftDirExists)
+	}
+	// is-active exits non-zero for a stopped service, so look at
+	// what it printed rather than the error.
+	out, err = r.Run("systemctl", "is-active", service)
+	switch state := strings.TrimSpace(string(out)); state {
+	case "inactive", "failed", "unknown":
+		return nil
+	case "active", "activating", "deactivating", "reloading":
+		if c.stopAgent {
+			return nil
+		}
+		return errors.Errorf("%s is running on %s (stop it or use --stop-agent)", service, r)
+	default:
+		if err == nil {
+			err = errors.Errorf("unexpected state %q", state)
+		}
+		return errors.Annotatef(err, "checking %s", service)
+	}
+}
+
+// pushStoreScript unpacks the store tarball into a staging directory
+// beside the raft directory, sets its ownership and moves it into
+// place, so jujud never sees a partial store.
+const pushStoreScript = `set -e
+raft_dir=$1 tarball=$2 owner=$3
+staging="$raft_dir.tmp-$$"
+trap 'rm -rf "$staging" "$tarball"' EXIT
+if [ -e "$raft_dir" ]; then
+	echo "$raft_dir has appeared since the run started" >&2
+	exit 1
+fi
+mkdir -p "$(dirname "$raft_dir")" "$staging"
+tar -xzf "$tarball" -C "$staging"
+chown -R "$owner" "$staging"
+sync
+mv "$staging" "$raft_dir"
+`
+
+// pushStore copies the store in dir to the raft directory on the
+// controller.
+func (c *workstationCommand) pushStore(r remote, dir, workDir string) error {
+	tarball := filepath.Join(workDir, "raft.tar.gz")
+	if err := writeTarball(dir, tarball); err != nil {
+		return errors.Annotate(err, "packing store")
+	}
+	remotePath, remove, err := pushFile(r, tarball, "raft.tar.gz")
+	if err != nil {
+		return errors.Annotate(err, "copying store")
+	}
+	defer remove()
+	_, err = r.Run("sh", "-c", pushStoreScript, "sh", c.raftDir, remotePath, c.ownerSpec)
+	return errors.Annotate(err, "installing store")
+}
+
+// storeBuilder returns the builder for the --log-store chosen.
+func (c *workstationCommand) storeBuilder() rebootstrap.StoreBuilder {
+	if c.logStoreType == walLogStore {
+		return rebootstrap.WALStoreBuilder{}
+	}
+	return rebootstrap.BoltStoreBuilder{Options: &bbolt.Options{Timeout: time.Second}}
+}
+
+// writeTarball writes the files under dir to a gzipped tarball at
+// path, with names relative to dir.
+func writeTarball(dir, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		name, err := filepath.Rel(dir, p)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		header.Name = filepath.ToSlash(name)
+		if err := tw.WriteHeader(header); err != nil {
+			return errors.Trace(err)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		in, err := os.Open(p)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer in.Close()
+		_, err = io.Copy(tw, in)
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := tw.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := gz.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(f.Close())
+}